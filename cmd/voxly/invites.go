@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/registration"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+const invitesUsage = `Usage: voxly invites <command> [arguments]
+
+Commands:
+  create [--uses <n>] [--expires <duration>]
+  list
+  show <code>
+  revoke <code>
+
+Invite codes are only needed when REGISTRATION_MODE is invite. --uses
+defaults to 1, and 0 means the code can be used any number of times;
+without --expires the code never expires.`
+
+// voxly invites <command>: manage the codes people register with when
+// registration is invite only
+func runInvites(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, invitesUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "create":
+		return runInvitesCreate(args[1:])
+	case "list":
+		return runInvitesList(args[1:])
+	case "show":
+		return runInvitesShow(args[1:])
+	case "revoke":
+		return runInvitesRevoke(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "voxly invites: unknown command %q\n\n%s\n", args[0], invitesUsage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+// Print a single invite, along with who registered with it if we know
+func printInvite(w io.Writer, invite *registration.Invite) {
+	fmt.Fprintf(w, "Code:\t%s\n", invite.Code)
+	fmt.Fprintf(w, "Created:\t%s\n", invite.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "Expires:\t%s\n", inviteExpiry(invite))
+	fmt.Fprintf(w, "Uses:\t%s\n", inviteUses(invite))
+	fmt.Fprintf(w, "Usable:\t%t\n", invite.Usable(time.Now()))
+}
+
+func inviteExpiry(invite *registration.Invite) string {
+	if invite.ExpiresAt == nil {
+		return "never"
+	}
+	return invite.ExpiresAt.UTC().Format(time.RFC3339)
+}
+
+func inviteUses(invite *registration.Invite) string {
+	if invite.MaxUses == 0 {
+		return fmt.Sprintf("%d/unlimited", invite.Uses)
+	}
+	return fmt.Sprintf("%d/%d", invite.Uses, invite.MaxUses)
+}
+
+func runInvitesCreate(args []string) error {
+	fs := flag.NewFlagSet("invites create", flag.ExitOnError)
+	uses := fs.Int("uses", 1, "how many times the code can be used, 0 for no limit")
+	expires := fs.Duration("expires", 0, "how long until the code expires, e.g. 72h")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	if *uses < 0 || *expires < 0 {
+		fs.Usage()
+		return fmt.Errorf("--uses and --expires can't be negative")
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	var expiresAt *time.Time
+	if *expires > 0 {
+		at := time.Now().UTC().Add(*expires)
+		expiresAt = &at
+	}
+
+	invite, err := registration.CreateInvite(ctx, "", *uses, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return printResult(*asJSON, invite, func(w io.Writer) {
+		printInvite(w, invite)
+	})
+}
+
+func runInvitesList(args []string) error {
+	fs := flag.NewFlagSet("invites list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	invites, err := registration.ListInvites(ctx)
+	if err != nil {
+		return err
+	}
+
+	return printResult(*asJSON, invites, func(w io.Writer) {
+		now := time.Now()
+		fmt.Fprintln(w, "CODE\tUSES\tEXPIRES\tUSABLE")
+		for i := range invites {
+			invite := &invites[i]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", invite.Code, inviteUses(invite), inviteExpiry(invite), invite.Usable(now))
+		}
+	})
+}
+
+func runInvitesShow(args []string) error {
+	fs := flag.NewFlagSet("invites show", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	positional := parseFlags(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one code")
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	invite, err := registration.GetInvite(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	users, err := user.ListByInviteCode(ctx, invite.Code)
+	if err != nil {
+		return err
+	}
+
+	output := struct {
+		*registration.Invite
+		Users []userOutput `json:"users"`
+	}{invite, make([]userOutput, len(users))}
+	for i := range users {
+		output.Users[i] = newUserOutput(&users[i])
+	}
+
+	return printResult(*asJSON, output, func(w io.Writer) {
+		printInvite(w, invite)
+		for _, u := range output.Users {
+			fmt.Fprintf(w, "Used by:\t%s (%s)\n", u.Username, u.Id)
+		}
+	})
+}
+
+func runInvitesRevoke(args []string) error {
+	fs := flag.NewFlagSet("invites revoke", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	positional := parseFlags(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one code")
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	invite, err := registration.RevokeInvite(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+
+	return printResult(*asJSON, invite, func(w io.Writer) {
+		fmt.Fprintf(w, "Revoked %s.\n", invite.Code)
+	})
+}
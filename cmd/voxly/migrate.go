@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/migrations"
+)
+
+const migrateUsage = `Usage: voxly migrate [status]
+
+With no command, apply every migration that hasn't been applied yet, in order.
+"status" lists every migration and when it was applied.
+
+The server refuses to start while there are migrations waiting to be applied.`
+
+// Migrations go through every document in a collection, so they get a lot
+// longer than the other commands do
+const migrateTimeout = 30 * time.Minute
+
+// voxly migrate [status]: bring the data in Mongo up to date
+func runMigrate(args []string) error {
+	if len(args) > 0 && args[0] == "status" {
+		return runMigrateStatus(args[1:])
+	}
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, migrateUsage) }
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if positional := parseFlags(fs, args); len(positional) > 0 {
+		fmt.Fprintf(os.Stderr, "voxly migrate: unknown command %q\n\n%s\n", positional[0], migrateUsage)
+		os.Exit(2)
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	ran, err := migrations.Run(ctx)
+	// report whatever did get applied even if a later one failed
+	for _, id := range ran {
+		fmt.Fprintf(os.Stderr, "Applied %s\n", id)
+	}
+	if err != nil {
+		return err
+	}
+
+	output := struct {
+		Applied []string `json:"applied"`
+	}{ran}
+
+	return printResult(*asJSON, output, func(w io.Writer) {
+		if len(ran) == 0 {
+			fmt.Fprintln(w, "Nothing to migrate.")
+			return
+		}
+		fmt.Fprintf(w, "Applied %d migration(s).\n", len(ran))
+	})
+}
+
+func runMigrateStatus(args []string) error {
+	fs := flag.NewFlagSet("migrate status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	statuses, err := migrations.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	return printResult(*asJSON, statuses, func(w io.Writer) {
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED\tDESCRIPTION")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Id, applied, s.Description)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/config"
+)
+
+// How long an admin command gets to talk to Mongo/Redis before we give up
+const commandTimeout = 30 * time.Second
+
+// Load the configuration for an admin command, connecting to Redis too if
+// the command needs to touch sessions. Mongo connects lazily the first time
+// a collection is used so there's nothing to do for that here
+func setupCommand(needRedis bool) (*config.Config, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if needRedis {
+		if err := initRedis(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// Get a context for an admin command to run with
+func commandContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), commandTimeout)
+}
+
+// The flag package stops at the first positional argument, which means that
+// `voxly user show alice --json` would ignore --json. Parse the flags wherever
+// they are and return the positional arguments in the order they were given
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// Print the result of a command; as JSON if --json was given so that the
+// output can be piped into something else, otherwise in a human friendly way
+func printResult(asJSON bool, v interface{}, human func(w io.Writer)) error {
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	human(w)
+	return w.Flush()
+}
+
+// Read a password from stdin so that it doesn't have to be passed as a flag,
+// where it would end up in the shell history
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("a password is required")
+	}
+	return password, nil
+}
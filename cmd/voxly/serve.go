@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/account"
+	"github.com/oauthority/voxly-backend/internal/api"
+	"github.com/oauthority/voxly-backend/internal/auth"
+	"github.com/oauthority/voxly-backend/internal/certs"
+	"github.com/oauthority/voxly-backend/internal/config"
+	"github.com/oauthority/voxly-backend/internal/migrations"
+	"github.com/oauthority/voxly-backend/internal/registration"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/storage"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+type App struct {
+	config           *config.Config
+	authManager      *auth.AuthManager
+	registrationMode registration.Mode
+}
+
+func NewApp() (*App, error) {
+	// Intit all common configuration needed to run the app
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out who can register before we connect to anything, so that a
+	// typo in the config is caught straight away
+	registrationMode, err := registration.ParseMode(cfg.Registration.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize our redis configuration
+	if err := initRedis(cfg); err != nil {
+		return nil, err
+	}
+
+	// Initialize the blob store for uploads
+	if err := storage.Initialize(storage.Config{
+		LocalDir: cfg.Storage.MediaDir,
+		BaseURL:  cfg.Storage.MediaBaseURL,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	// Make sure that Mongo has all of the indexes we rely on
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Refuse to run against data that hasn't been migrated yet, the code
+	// only understands the latest shape of every document
+	pending, err := migrations.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("%d migration(s) waiting to be applied (%s), run `voxly migrate` first", len(pending), strings.Join(pending, ", "))
+	}
+
+	if err := user.EnsureIndexes(ctx); err != nil {
+		return nil, err
+	}
+	if err := account.EnsureIndexes(ctx); err != nil {
+		return nil, err
+	}
+	if err := registration.EnsureIndexes(ctx); err != nil {
+		return nil, err
+	}
+	if err := server.EnsureIndexes(ctx); err != nil {
+		return nil, err
+	}
+
+	// Initialize Auth Manager
+	authManager := auth.NewAuthManager(auth.Config{
+		JWTSecret: cfg.Auth.JWTSecret,
+		JWTExpiry: cfg.Auth.JWTExpiry,
+	})
+
+	// Return our application configuration to the main() func so that we can start!
+	return &App{
+		config:           cfg,
+		authManager:      authManager,
+		registrationMode: registrationMode,
+	}, nil
+}
+
+// How often we check whether the certificate files have changed
+const certReloadInterval = 30 * time.Second
+
+// How often the account worker looks for accounts to delete and exports to
+// put together; exports are also started as soon as they're requested
+const accountWorkerInterval = time.Minute
+
+// How often temporary server members who have disconnected are removed
+const serverWorkerInterval = time.Minute
+
+// How long accounts and their data hang around for
+func (a *App) accountPolicy() account.Policy {
+	return account.Policy{
+		DeletionGracePeriod: a.config.Account.DeletionGracePeriod,
+		UsernameHoldPeriod:  a.config.Users.UsernameHoldPeriod,
+		ExportExpiry:        a.config.Account.ExportExpiry,
+	}
+}
+
+// Helper function to start all of our services et al.
+func (a *App) Start() error {
+	tlsConfig := a.config.Server.TLS
+	clientAuth := tls.NoClientCert
+	if tlsConfig.Enabled() {
+		var err error
+		if clientAuth, err = certs.ParseClientAuth(tlsConfig.ClientAuth); err != nil {
+			return err
+		}
+		if clientAuth != tls.NoClientCert && tlsConfig.ClientCAFile == "" {
+			return fmt.Errorf("TLS_CLIENT_CA_FILE is required when TLS_CLIENT_AUTH is %q", tlsConfig.ClientAuth)
+		}
+	}
+
+	// Initialize router with dependencies
+	router := api.NewRouter(api.Dependencies{
+		JWTSecret: a.config.Auth.JWTSecret,
+		JWTExpiry: a.config.Auth.JWTExpiry,
+		UsernamePolicy: user.UsernamePolicy{
+			Cooldown:   a.config.Users.UsernameCooldown,
+			HoldPeriod: a.config.Users.UsernameHoldPeriod,
+		},
+		AccountPolicy:    a.accountPolicy(),
+		RegistrationMode: a.registrationMode,
+		RegistrationChallenge: registration.ChallengePolicy{
+			Difficulty:    a.config.Registration.ChallengeDifficulty,
+			MaxDifficulty: a.config.Registration.ChallengeMaxDifficulty,
+			LoadThreshold: int64(a.config.Registration.ChallengeLoadThreshold),
+			TTL:           a.config.Registration.ChallengeTTL,
+		},
+		// with mutual TLS turned on, the admin routes are only for callers
+		// with a client certificate
+		RequireClientCert: clientAuth != tls.NoClientCert,
+	})
+
+	// deletes accounts once their grace period is up and builds data exports
+	go account.NewWorker(a.accountPolicy(), accountWorkerInterval).Run(context.Background())
+
+	// removes temporary members once they've gone
+	go server.NewWorker(serverWorkerInterval).Run(context.Background())
+
+	serverAddr := fmt.Sprintf(":%s", a.config.Server.Port)
+
+	server := &http.Server{
+		Addr:    serverAddr,
+		Handler: router,
+	}
+
+	if !tlsConfig.Enabled() {
+		fmt.Printf("Starting server on port %s...\n", a.config.Server.Port)
+		return server.ListenAndServe()
+	}
+
+	reloader, err := certs.NewReloader(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.ClientCAFile)
+	if err != nil {
+		return err
+	}
+
+	// pick up renewed certificates automatically, or straight away if we're
+	// sent a SIGHUP
+	go reloader.Watch(context.Background(), certReloadInterval)
+	go reloadOnSighup(reloader)
+
+	if tlsConfig.RedirectPort != "" {
+		go serveRedirect(tlsConfig.RedirectPort, a.config.Server.Port)
+	}
+
+	// HTTP/2 is negotiated automatically over TLS
+	server.TLSConfig = reloader.TLSConfig(clientAuth)
+	fmt.Printf("Starting HTTPS server on port %s...\n", a.config.Server.Port)
+	return server.ListenAndServeTLS("", "")
+}
+
+// Reload the certificate whenever we receive a SIGHUP
+func reloadOnSighup(reloader *certs.Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if err := reloader.Reload(); err != nil {
+			log.Printf("Failed to reload TLS certificate on SIGHUP, still serving the old one: %v", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate on SIGHUP")
+	}
+}
+
+// Listen for plain HTTP and send everyone over to HTTPS instead
+func serveRedirect(redirectPort string, httpsPort string) {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+
+	fmt.Printf("Redirecting HTTP on port %s to HTTPS...\n", redirectPort)
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", redirectPort), redirect); err != nil {
+		log.Printf("HTTP redirect server error: %v", err)
+	}
+}
+
+// voxly serve: start the HTTP server
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: voxly serve")
+		fmt.Fprintln(fs.Output(), "\nStart the HTTP server on the port set by PORT, over HTTPS if TLS_CERT_FILE and TLS_KEY_FILE are set.")
+	}
+	fs.Parse(args)
+
+	app, err := NewApp()
+	if err != nil {
+		return fmt.Errorf("failed to initialize application: %w", err)
+	}
+
+	if err := app.Start(); err != nil {
+		return fmt.Errorf("server error: %w", err)
+	}
+	return nil
+}
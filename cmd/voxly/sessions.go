@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/redis"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+const sessionsUsage = `Usage: voxly sessions <command> [arguments]
+
+Commands:
+  list --user <id|username|email>
+  revoke --user <id|username|email> [--session <id>]
+
+Without --session, revoke logs the user out of every session.`
+
+// voxly sessions <command>: look at and revoke the sessions stored in Redis
+func runSessions(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, sessionsUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "list":
+		return runSessionsList(args[1:])
+	case "revoke":
+		return runSessionsRevoke(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "voxly sessions: unknown command %q\n\n%s\n", args[0], sessionsUsage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+// Look up the user given with --user and get a connection to the session manager
+func sessionsSetup(fs *flag.FlagSet, identifier string) (*user.User, *redis.SessionManager, error) {
+	if identifier == "" {
+		fs.Usage()
+		return nil, nil, fmt.Errorf("--user is required")
+	}
+
+	if _, err := setupCommand(true); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	u, err := user.Lookup(ctx, identifier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessionManager, err := redis.GetConnection()
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, sessionManager, nil
+}
+
+func runSessionsList(args []string) error {
+	fs := flag.NewFlagSet("sessions list", flag.ExitOnError)
+	identifier := fs.String("user", "", "the id, username or email of the user")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	u, sessionManager, err := sessionsSetup(fs, *identifier)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := sessionManager.ListUserSessions(u.Id)
+	if err != nil {
+		return err
+	}
+
+	return printResult(*asJSON, sessions, func(w io.Writer) {
+		if len(sessions) == 0 {
+			fmt.Fprintf(w, "%s has no sessions.\n", u.Username)
+			return
+		}
+		fmt.Fprintln(w, "SESSION\tCREATED\tEXPIRES")
+		for _, session := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s\n",
+				session.Id,
+				session.CreatedAt.UTC().Format(time.RFC3339),
+				session.ExpiresAt.UTC().Format(time.RFC3339),
+			)
+		}
+	})
+}
+
+func runSessionsRevoke(args []string) error {
+	fs := flag.NewFlagSet("sessions revoke", flag.ExitOnError)
+	identifier := fs.String("user", "", "the id, username or email of the user")
+	sessionId := fs.String("session", "", "only revoke this session")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	u, sessionManager, err := sessionsSetup(fs, *identifier)
+	if err != nil {
+		return err
+	}
+
+	revoked := 0
+	if *sessionId != "" {
+		// make sure that the session actually belongs to the user we were
+		// given, so a typo can't log somebody else out
+		session, err := sessionManager.GetSession(*sessionId)
+		if err != nil {
+			return err
+		}
+		if session == nil || session.UserId != u.Id {
+			return fmt.Errorf("session %s not found for %s", *sessionId, u.Username)
+		}
+		if err := sessionManager.DeleteSession(*sessionId); err != nil {
+			return err
+		}
+		revoked = 1
+	} else {
+		if revoked, err = sessionManager.RevokeUserSessions(u.Id); err != nil {
+			return err
+		}
+	}
+
+	output := struct {
+		UserId          string `json:"userId"`
+		RevokedSessions int    `json:"revokedSessions"`
+	}{u.Id, revoked}
+
+	return printResult(*asJSON, output, func(w io.Writer) {
+		fmt.Fprintf(w, "Revoked %d session(s) for %s.\n", revoked, u.Username)
+	})
+}
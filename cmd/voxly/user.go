@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/redis"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+const userUsage = `Usage: voxly user <command> [arguments]
+
+Commands:
+  create --username <name> --email <email> [--password <password>]
+  show <id|username|email>
+  disable <id|username|email> [--enable]
+  admin <id|username|email> [--revoke]
+  set-password <id|username|email> [--password <password>] [--keep-sessions]
+  reindex-search
+
+If --password is not given it is read from stdin.`
+
+// What we print for a user, we never want the password hash ending up in
+// someones terminal (or worse, a log file)
+type userOutput struct {
+	Id           string    `json:"id"`
+	Username     string    `json:"username"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	Bot          bool      `json:"bot"`
+	Disabled     bool      `json:"disabled"`
+	Admin        bool      `json:"admin"`
+	InviteCode   string    `json:"inviteCode,omitempty"`
+}
+
+func newUserOutput(u *user.User) userOutput {
+	return userOutput{
+		Id:           u.Id,
+		Username:     u.Username,
+		Name:         u.Name,
+		Email:        u.Email,
+		RegisteredAt: u.RegisteredAt,
+		Bot:          u.Bot,
+		Disabled:     u.Disabled,
+		Admin:        u.Admin,
+		InviteCode:   u.InviteCode,
+	}
+}
+
+func (o userOutput) print(w io.Writer) {
+	fmt.Fprintf(w, "Id:\t%s\n", o.Id)
+	fmt.Fprintf(w, "Username:\t%s\n", o.Username)
+	fmt.Fprintf(w, "Name:\t%s\n", o.Name)
+	fmt.Fprintf(w, "Email:\t%s\n", o.Email)
+	fmt.Fprintf(w, "Registered:\t%s\n", o.RegisteredAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Bot:\t%t\n", o.Bot)
+	fmt.Fprintf(w, "Disabled:\t%t\n", o.Disabled)
+	fmt.Fprintf(w, "Admin:\t%t\n", o.Admin)
+	if o.InviteCode != "" {
+		fmt.Fprintf(w, "Invite code:\t%s\n", o.InviteCode)
+	}
+}
+
+// voxly user <command>: manage users without having to go and poke at Mongo
+func runUser(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "create":
+		return runUserCreate(args[1:])
+	case "show":
+		return runUserShow(args[1:])
+	case "disable":
+		return runUserDisable(args[1:])
+	case "admin":
+		return runUserAdmin(args[1:])
+	case "set-password":
+		return runUserSetPassword(args[1:])
+	case "reindex-search":
+		return runUserReindexSearch(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "voxly user: unknown command %q\n\n%s\n", args[0], userUsage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+// Get exactly one positional argument identifying a user
+func userArgument(fs *flag.FlagSet, args []string) (string, error) {
+	positional := parseFlags(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return "", fmt.Errorf("expected exactly one user")
+	}
+	return positional[0], nil
+}
+
+func runUserCreate(args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ExitOnError)
+	username := fs.String("username", "", "the username for the new user")
+	email := fs.String("email", "", "the email for the new user")
+	password := fs.String("password", "", "the password for the new user, read from stdin if not given")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	if *username == "" || *email == "" {
+		fs.Usage()
+		return fmt.Errorf("--username and --email are required")
+	}
+
+	if err := user.ValidateUsername(*username); err != nil {
+		return err
+	}
+
+	if *password == "" {
+		var err error
+		if *password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	exists, err := user.Exists(ctx, *username, *email)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("a user already exists with that username or email")
+	}
+
+	newUser, err := user.New(*username, *email, *password)
+	if err != nil {
+		return err
+	}
+	if err := user.Insert(ctx, newUser); err != nil {
+		return err
+	}
+
+	output := newUserOutput(newUser)
+	return printResult(*asJSON, output, output.print)
+}
+
+func runUserShow(args []string) error {
+	fs := flag.NewFlagSet("user show", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	identifier, err := userArgument(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	u, err := user.Lookup(ctx, identifier)
+	if err != nil {
+		return err
+	}
+
+	output := newUserOutput(u)
+	return printResult(*asJSON, output, output.print)
+}
+
+func runUserAdmin(args []string) error {
+	fs := flag.NewFlagSet("user admin", flag.ExitOnError)
+	revoke := fs.Bool("revoke", false, "take admin away from the user instead")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	identifier, err := userArgument(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	u, err := user.Lookup(ctx, identifier)
+	if err != nil {
+		return err
+	}
+
+	if err := user.SetAdmin(ctx, u.Id, !*revoke); err != nil {
+		return err
+	}
+	u.Admin = !*revoke
+
+	output := newUserOutput(u)
+	return printResult(*asJSON, output, output.print)
+}
+
+func runUserDisable(args []string) error {
+	fs := flag.NewFlagSet("user disable", flag.ExitOnError)
+	enable := fs.Bool("enable", false, "re-enable the user instead")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	identifier, err := userArgument(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// we need redis to log a disabled user out of everywhere
+	if _, err := setupCommand(true); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	u, err := user.Lookup(ctx, identifier)
+	if err != nil {
+		return err
+	}
+
+	if err := user.SetDisabled(ctx, u.Id, !*enable); err != nil {
+		return err
+	}
+	u.Disabled = !*enable
+
+	revoked := 0
+	if u.Disabled {
+		if revoked, err = revokeSessions(u.Id); err != nil {
+			return err
+		}
+	}
+
+	output := struct {
+		userOutput
+		RevokedSessions int `json:"revokedSessions"`
+	}{newUserOutput(u), revoked}
+
+	return printResult(*asJSON, output, func(w io.Writer) {
+		output.print(w)
+		fmt.Fprintf(w, "Revoked sessions:\t%d\n", revoked)
+	})
+}
+
+func runUserSetPassword(args []string) error {
+	fs := flag.NewFlagSet("user set-password", flag.ExitOnError)
+	password := fs.String("password", "", "the new password, read from stdin if not given")
+	keepSessions := fs.Bool("keep-sessions", false, "don't log the user out of their existing sessions")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	identifier, err := userArgument(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *password == "" {
+		if *password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := setupCommand(!*keepSessions); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	u, err := user.Lookup(ctx, identifier)
+	if err != nil {
+		return err
+	}
+
+	if err := user.SetPassword(ctx, u.Id, *password); err != nil {
+		return err
+	}
+
+	revoked := 0
+	if !*keepSessions {
+		if revoked, err = revokeSessions(u.Id); err != nil {
+			return err
+		}
+	}
+
+	output := struct {
+		Id              string `json:"id"`
+		RevokedSessions int    `json:"revokedSessions"`
+	}{u.Id, revoked}
+
+	return printResult(*asJSON, output, func(w io.Writer) {
+		fmt.Fprintf(w, "Password changed for %s.\n", u.Username)
+		fmt.Fprintf(w, "Revoked sessions:\t%d\n", revoked)
+	})
+}
+
+// Log a user out of everywhere, which takes them offline too
+func revokeSessions(userId string) (int, error) {
+	sessionManager, err := redis.GetConnection()
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := sessionManager.RevokeUserSessions(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	presenceManager, err := redis.GetPresenceManager()
+	if err != nil {
+		return 0, err
+	}
+	return revoked, presenceManager.DisconnectAll(userId)
+}
+
+// Rebuilding the search fields goes through every user, which takes rather
+// longer than the other commands get
+const reindexTimeout = 30 * time.Minute
+
+func runUserReindexSearch(args []string) error {
+	fs := flag.NewFlagSet("user reindex-search", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reindexTimeout)
+	defer cancel()
+
+	updated, err := user.ReindexSearch(ctx)
+	if err != nil {
+		return err
+	}
+
+	output := struct {
+		Updated int `json:"updated"`
+	}{updated}
+
+	return printResult(*asJSON, output, func(w io.Writer) {
+		fmt.Fprintf(w, "Reindexed %d user(s).\n", updated)
+	})
+}
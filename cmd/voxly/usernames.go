@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+const usernamesUsage = `Usage: voxly usernames <command> [arguments]
+
+Commands:
+  reserve <username> [--reason <reason>]
+  unreserve <username>
+  list
+
+Reserved usernames can't be registered or renamed to; reserving a username
+doesn't take it away from anyone who already has it.`
+
+// voxly usernames <command>: manage the reserved usernames list
+func runUsernames(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usernamesUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "reserve":
+		return runUsernamesReserve(args[1:])
+	case "unreserve":
+		return runUsernamesUnreserve(args[1:])
+	case "list":
+		return runUsernamesList(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "voxly usernames: unknown command %q\n\n%s\n", args[0], usernamesUsage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+func runUsernamesReserve(args []string) error {
+	fs := flag.NewFlagSet("usernames reserve", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the username is reserved")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	positional := parseFlags(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one username")
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	reserved, err := user.ReserveUsername(ctx, positional[0], *reason)
+	if err != nil {
+		return err
+	}
+
+	return printResult(*asJSON, reserved, func(w io.Writer) {
+		fmt.Fprintf(w, "Reserved %s.\n", reserved.Username)
+	})
+}
+
+func runUsernamesUnreserve(args []string) error {
+	fs := flag.NewFlagSet("usernames unreserve", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	positional := parseFlags(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one username")
+	}
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if err := user.UnreserveUsername(ctx, positional[0]); err != nil {
+		if err == user.ErrNotFound {
+			return fmt.Errorf("%s is not reserved (the built in names can't be unreserved)", positional[0])
+		}
+		return err
+	}
+
+	output := struct {
+		Username   string `json:"username"`
+		Unreserved bool   `json:"unreserved"`
+	}{positional[0], true}
+
+	return printResult(*asJSON, output, func(w io.Writer) {
+		fmt.Fprintf(w, "Unreserved %s.\n", positional[0])
+	})
+}
+
+func runUsernamesList(args []string) error {
+	fs := flag.NewFlagSet("usernames list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	parseFlags(fs, args)
+
+	if _, err := setupCommand(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	reserved, err := user.ListReservedUsernames(ctx)
+	if err != nil {
+		return err
+	}
+
+	return printResult(*asJSON, reserved, func(w io.Writer) {
+		fmt.Fprintln(w, "USERNAME\tREASON\tRESERVED")
+		for _, r := range reserved {
+			created := "-"
+			if !r.CreatedAt.IsZero() {
+				created = r.CreatedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Username, r.Reason, created)
+		}
+	})
+}
@@ -2,103 +2,87 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"net/http"
 	"os"
-	"time"
 
-	"github.com/joho/godotenv"
-	"github.com/oauthority/voxly-backend/internal/api"
-	"github.com/oauthority/voxly-backend/internal/auth"
 	"github.com/oauthority/voxly-backend/internal/config"
 	"github.com/oauthority/voxly-backend/internal/redis"
 )
 
-type App struct {
-	config      *config.Config
-	authManager *auth.AuthManager
-}
-
-func NewApp() (*App, error) {
+// The top level usage for the binary, shown for `voxly help` or when we get
+// given a command that we don't know about
+const usage = `Usage: voxly <command> [arguments]
+
+Commands:
+  serve                 start the HTTP server (the default if no command is given)
+  migrate               apply any migrations that haven't been applied yet
+  migrate status        list the migrations and whether they've been applied
+  user create           create a new user
+  user show             show a user
+  user disable          disable (or re-enable) a user
+  user admin            make a user an admin (or stop them being one)
+  user set-password     change the password for a user
+  user reindex-search   rebuild the search fields for every user
+  sessions list         list the sessions for a user
+  sessions revoke       revoke one or all sessions for a user
+  usernames reserve     reserve a username so that nobody can take it
+  usernames unreserve   remove a reserved username
+  usernames list        list the reserved usernames
+  invites create        create an invite code for when registration is invite only
+  invites list          list the invite codes
+  invites show          show an invite code and who registered with it
+  invites revoke        revoke an invite code
+
+Run "voxly <command> -h" for more information about a command.
+Most commands accept --json to print machine readable output.`
+
+// Our main entrypoint for the application. Keep this lightweight and delegate
+// most stuff out to other packages to ensure everything is organised et al.
+// With no arguments we start the HTTP server, exactly as we always have, otherwise
+// run whichever admin command we were asked to
+func main() {
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
 
-	// Try and load the environment variables, if we cannot do this then we cannot
-	// start the application as we depend on the env variables throughout the lifetime, so just
-	// refuse to start
-	if err := godotenv.Load("../../.env"); err != nil {
-		return nil, fmt.Errorf("error loading .env file: %w", err)
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "user":
+		err = runUser(args)
+	case "sessions":
+		err = runSessions(args)
+	case "usernames":
+		err = runUsernames(args)
+	case "invites":
+		err = runInvites(args)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "voxly: unknown command %q\n\n%s\n", command, usage)
+		os.Exit(2)
 	}
 
-	// Intit all common configuration needed to run the app
-	cfg := &config.Config{
-		Server: config.ServerConfig{
-			Port: os.Getenv("PORT"),
-		},
-		Redis: config.RedisConfig{
-			Host:     os.Getenv("REDIS_HOST"),
-			Port:     6379,
-			Password: os.Getenv("REDIS_PASSWORD"),
-			DB:       0,
-		},
-		Auth: config.AuthConfig{
-			JWTSecret: os.Getenv("JWT_SECRET"),
-			JWTExpiry: 24 * time.Hour,
-		},
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "voxly %s: %v\n", command, err)
+		os.Exit(1)
 	}
+}
 
-	// Initialize our redis configuration
+// Connect to Redis using the given configuration; used by the server and by
+// any of the admin commands which need to touch sessions
+func initRedis(cfg *config.Config) error {
 	if err := redis.Initialize(redis.Config{
 		Host:     cfg.Redis.Host,
 		Port:     cfg.Redis.Port,
 		Password: cfg.Redis.Password,
 		DB:       cfg.Redis.DB,
 	}); err != nil {
-		return nil, fmt.Errorf("failed to initialize Redis: %w", err)
-	}
-
-	// Initialize Auth Manager
-	authManager := auth.NewAuthManager(auth.Config{
-		JWTSecret: cfg.Auth.JWTSecret,
-		JWTExpiry: cfg.Auth.JWTExpiry,
-	})
-
-	// Return our application configuration to the main() func so that we can start!
-	return &App{
-		config:      cfg,
-		authManager: authManager,
-	}, nil
-}
-
-// Helper function to start all of our services et al.
-func (a *App) Start() error {
-
-	// Initialize router with dependencies
-	router := api.NewRouter(api.Dependencies{
-		JWTSecret: os.Getenv("JWT_SECRET"),
-		JWTExpiry: 24 * time.Hour,
-	})
-
-	serverAddr := fmt.Sprintf(":%s", a.config.Server.Port)
-	fmt.Printf("Starting server on port %s...\n", a.config.Server.Port)
-
-	server := &http.Server{
-		Addr:    serverAddr,
-		Handler: router,
-	}
-
-	return server.ListenAndServe()
-}
-
-// Our main entrypoint for the application; starts the HTTP server
-// on port 4175. Keep this lightweight and delegate most stuff out to other
-// packages to ensure everything is organised et al. This calls the above newApp function
-// which handles configuring everything needed to set up the application for runtime
-func main() {
-	app, err := NewApp()
-	if err != nil {
-		log.Fatalf("Failed to initialize application: %v", err)
-	}
-
-	if err := app.Start(); err != nil {
-		log.Fatalf("Server error: %v", err)
+		return fmt.Errorf("failed to initialize Redis: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,142 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/redis"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/storage"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+var (
+	// Returned when scheduling the deletion of an account that is already going
+	ErrDeletionScheduled = errors.New("account deletion is already scheduled")
+	// Returned when the user still owns servers, which would be left without
+	// anyone in charge; they have to hand them over or delete them first
+	ErrOwnsServers = errors.New("account still owns servers")
+)
+
+// How long things take to go away
+type Policy struct {
+	DeletionGracePeriod time.Duration // how long a user has to change their mind
+	UsernameHoldPeriod  time.Duration // how long the username of a deleted account is held
+	ExportExpiry        time.Duration // how long a finished export can be downloaded for
+}
+
+// Schedule the account of a user to be deleted once the grace period is over,
+// returning when that will be. Nothing happens to the account until then, the
+// user can carry on using it and cancel whenever they like
+func ScheduleDeletion(ctx context.Context, u *user.User, policy Policy) (time.Time, error) {
+	if u.DeletionScheduledAt != nil {
+		return *u.DeletionScheduledAt, ErrDeletionScheduled
+	}
+	if err := checkNoOwnedServers(ctx, u.Id); err != nil {
+		return time.Time{}, err
+	}
+
+	at := time.Now().UTC().Add(policy.DeletionGracePeriod)
+	if err := user.ScheduleDeletion(ctx, u.Id, at); err != nil {
+		return time.Time{}, err
+	}
+	u.DeletionScheduledAt = &at
+	return at, nil
+}
+
+// Cancel a scheduled deletion
+func CancelDeletion(ctx context.Context, userId string) error {
+	return user.CancelDeletion(ctx, userId)
+}
+
+// Make sure a user doesn't own any servers
+func checkNoOwnedServers(ctx context.Context, userId string) error {
+	owned, err := server.ListOwnedBy(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if len(owned) > 0 {
+		return ErrOwnsServers
+	}
+	return nil
+}
+
+// Delete an account right now: anonymize the user, take them out of every
+// server, throw away their images and exports and log them out of everywhere.
+// Returns ErrOwnsServers without touching anything if they still own a
+// server, e.g. one they made during the grace period
+func Delete(ctx context.Context, u *user.User, policy Policy) error {
+	userId := u.Id
+	if err := checkNoOwnedServers(ctx, userId); err != nil {
+		return err
+	}
+	if err := user.Anonymize(ctx, u, policy.UsernameHoldPeriod); err != nil {
+		return err
+	}
+
+	// from here on the account is gone as far as anyone can tell, so keep
+	// going if any of the cleanup fails and report it at the end
+	var errs []error
+
+	if err := server.RemoveFromAll(ctx, userId); err != nil {
+		errs = append(errs, err)
+	}
+
+	if store, err := storage.Get(); err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, kind := range []user.ImageKind{user.AvatarImage, user.BannerImage} {
+			if err := store.DeletePrefix(ctx, user.ImagePrefix(kind, userId)); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete %s: %w", kind, err))
+			}
+		}
+	}
+
+	if err := deleteExports(ctx, userId); err != nil {
+		errs = append(errs, err)
+	}
+
+	if sessionManager, err := redis.GetConnection(); err != nil {
+		errs = append(errs, err)
+	} else if _, err := sessionManager.RevokeUserSessions(userId); err != nil {
+		errs = append(errs, fmt.Errorf("failed to revoke sessions: %w", err))
+	}
+
+	if presenceManager, err := redis.GetPresenceManager(); err != nil {
+		errs = append(errs, err)
+	} else {
+		if err := presenceManager.DisconnectAll(userId); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clear presence: %w", err))
+		}
+		if err := presenceManager.ClearCustomStatus(userId); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clear custom status: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Delete every account whose grace period has run out, returning how many
+// were deleted
+func DeleteDue(ctx context.Context, policy Policy) (int, error) {
+	users, err := user.DueForDeletion(ctx, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, u := range users {
+		userId := u.Id
+		if err := Delete(ctx, u, policy); err != nil {
+			// owners stay scheduled, and get picked up again once they've
+			// dealt with their servers
+			log.Printf("Error deleting account %s: %v", userId, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
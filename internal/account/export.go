@@ -0,0 +1,500 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/database"
+	"github.com/oauthority/voxly-backend/internal/redis"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/storage"
+	"github.com/oauthority/voxly-backend/internal/user"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that exports are tracked in
+const exportsCollection = "data_exports"
+
+// If an export has been processing for this long then whatever was working on
+// it has probably died, so it's picked up again
+const staleExportAfter = 15 * time.Minute
+
+// Where an export is up to
+type ExportStatus string
+
+const (
+	ExportPending    ExportStatus = "pending"    // waiting for the worker to pick it up
+	ExportProcessing ExportStatus = "processing" // being put together
+	ExportReady      ExportStatus = "ready"      // can be downloaded
+	ExportFailed     ExportStatus = "failed"     // something went wrong, request another
+	ExportExpired    ExportStatus = "expired"    // the archive has been deleted
+)
+
+var (
+	ErrExportNotFound   = errors.New("export not found")
+	ErrExportInProgress = errors.New("an export is already in progress")
+	ErrExportNotReady   = errors.New("export is not ready to download")
+)
+
+// A request from a user for a copy of their data; the archive itself lives in
+// the blob store, never under a public prefix
+type Export struct {
+	Id          string       `bson:"id" json:"id"`
+	UserId      string       `bson:"userId" json:"-"`
+	Status      ExportStatus `bson:"status" json:"status"`
+	RequestedAt time.Time    `bson:"requestedAt" json:"requestedAt"`
+	StartedAt   *time.Time   `bson:"startedAt,omitempty" json:"-"`
+	CompletedAt *time.Time   `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+	ExpiresAt   *time.Time   `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	Size        int64        `bson:"size,omitempty" json:"size,omitempty"`
+	Key         string       `bson:"key,omitempty" json:"-"`
+	Error       string       `bson:"error,omitempty" json:"-"` // for us, not the user
+}
+
+// Poked whenever an export is requested so that the worker doesn't sit on it
+// until its next run
+var wake = make(chan struct{}, 1)
+
+func wakeWorker() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// The prefix every export for a user is stored under
+func exportPrefix(userId string) string {
+	return fmt.Sprintf("exports/%s/", userId)
+}
+
+// Request an export of everything we hold about a user; it's put together in
+// the background, poll it with GetExport until it's ready
+func RequestExport(ctx context.Context, userId string) (*Export, error) {
+	collection := database.GetCollection(exportsCollection)
+
+	err := collection.FindOne(ctx, map[string]interface{}{
+		"userId": userId,
+		"status": map[string]interface{}{"$in": []ExportStatus{ExportPending, ExportProcessing}},
+	}).Err()
+	if err == nil {
+		return nil, ErrExportInProgress
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("failed to check exports: %w", err)
+	}
+
+	export := &Export{
+		Id:          uuid.New().String(),
+		UserId:      userId,
+		Status:      ExportPending,
+		RequestedAt: time.Now().UTC(),
+	}
+	if _, err := collection.InsertOne(ctx, export); err != nil {
+		return nil, fmt.Errorf("failed to save export: %w", err)
+	}
+
+	wakeWorker()
+	return export, nil
+}
+
+// List every export a user has requested, newest first
+func ListExports(ctx context.Context, userId string) ([]Export, error) {
+	cursor, err := database.GetCollection(exportsCollection).Find(ctx,
+		map[string]interface{}{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "requestedAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exports: %w", err)
+	}
+
+	exports := []Export{}
+	if err := cursor.All(ctx, &exports); err != nil {
+		return nil, fmt.Errorf("failed to decode exports: %w", err)
+	}
+	return exports, nil
+}
+
+// Get a single export belonging to a user
+func GetExport(ctx context.Context, userId string, id string) (*Export, error) {
+	var export Export
+	err := database.GetCollection(exportsCollection).FindOne(ctx,
+		map[string]interface{}{"id": id, "userId": userId},
+	).Decode(&export)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find export: %w", err)
+	}
+	return &export, nil
+}
+
+// Open the archive for an export so that it can be downloaded
+func OpenExport(ctx context.Context, userId string, id string) (*Export, io.ReadCloser, error) {
+	export, err := GetExport(ctx, userId, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if export.Status != ExportReady || (export.ExpiresAt != nil && export.ExpiresAt.Before(time.Now())) {
+		return nil, nil, ErrExportNotReady
+	}
+
+	store, err := storage.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	archive, err := store.Open(ctx, export.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return export, archive, nil
+}
+
+// Put together every export which is waiting, returning how many were done
+func ProcessPendingExports(ctx context.Context, policy Policy) (int, error) {
+	collection := database.GetCollection(exportsCollection)
+	processed := 0
+
+	for {
+		// claim the oldest export that nobody is working on, so that two
+		// servers never both build the same one
+		now := time.Now().UTC()
+		var export Export
+		err := collection.FindOneAndUpdate(ctx,
+			map[string]interface{}{
+				"$or": []map[string]interface{}{
+					{"status": ExportPending},
+					{"status": ExportProcessing, "startedAt": map[string]interface{}{"$lt": now.Add(-staleExportAfter)}},
+				},
+			},
+			map[string]interface{}{"$set": map[string]interface{}{"status": ExportProcessing, "startedAt": now}},
+			options.FindOneAndUpdate().
+				SetSort(bson.D{{Key: "requestedAt", Value: 1}}).
+				SetReturnDocument(options.After),
+		).Decode(&export)
+		if err == mongo.ErrNoDocuments {
+			return processed, nil
+		}
+		if err != nil {
+			return processed, fmt.Errorf("failed to claim export: %w", err)
+		}
+
+		fields := map[string]interface{}{}
+		key, size, err := buildExport(ctx, &export)
+		completedAt := time.Now().UTC()
+		if err != nil {
+			fields["status"] = ExportFailed
+			fields["error"] = err.Error()
+			fields["completedAt"] = completedAt
+		} else {
+			fields["status"] = ExportReady
+			fields["key"] = key
+			fields["size"] = size
+			fields["completedAt"] = completedAt
+			fields["expiresAt"] = completedAt.Add(policy.ExportExpiry)
+		}
+
+		_, err = collection.UpdateOne(ctx,
+			map[string]interface{}{"id": export.Id},
+			map[string]interface{}{"$set": fields},
+		)
+		if err != nil {
+			return processed, fmt.Errorf("failed to update export: %w", err)
+		}
+		processed++
+	}
+}
+
+// What ends up in profile.json; everything we store about the user except
+// for the password hash and the bits that only exist for search
+type exportProfile struct {
+	Id                  string     `json:"id"`
+	Username            string     `json:"username"`
+	UsernameChangedAt   *time.Time `json:"usernameChangedAt"`
+	Name                string     `json:"name"`
+	Email               string     `json:"email"`
+	RegisteredAt        time.Time  `json:"registeredAt"`
+	Bot                 bool       `json:"bot"`
+	Disabled            bool       `json:"disabled"`
+	InviteCode          string     `json:"inviteCode,omitempty"`
+	Avatar              string     `json:"avatar"`
+	Banner              string     `json:"banner"`
+	DeletionScheduledAt *time.Time `json:"deletionScheduledAt"`
+}
+
+// What ends up in servers.json
+type exportServer struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Owner bool   `json:"owner"`
+}
+
+// What ends up in relationships.json
+type exportRelationship struct {
+	UserId   string                `json:"userId"`
+	Username string                `json:"username,omitempty"`
+	Type     user.RelationshipType `json:"type"`
+	Since    time.Time             `json:"since"`
+}
+
+// The JSON files that go in an export, keyed by their name in the archive
+func exportFiles(u *user.User, relationships []exportRelationship, history []user.UsernameChange, settings *user.Settings, servers []exportServer, sessions []*redis.Session) map[string]interface{} {
+	return map[string]interface{}{
+		"profile.json": exportProfile{
+			Id:                  u.Id,
+			Username:            u.Username,
+			UsernameChangedAt:   u.UsernameChangedAt,
+			Name:                u.Name,
+			Email:               u.Email,
+			RegisteredAt:        u.RegisteredAt,
+			Bot:                 u.Bot,
+			Disabled:            u.Disabled,
+			InviteCode:          u.InviteCode,
+			Avatar:              u.Avatar,
+			Banner:              u.Banner,
+			DeletionScheduledAt: u.DeletionScheduledAt,
+		},
+		"relationships.json":    relationships,
+		"username_history.json": history,
+		"settings.json":         settings,
+		"servers.json":          servers,
+		"sessions.json":         sessions,
+	}
+}
+
+// Write each of the files as indented JSON, in name order so that nothing is
+// left out when a file is added
+func writeJSONFiles(archive *zip.Writer, files map[string]interface{}) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f, err := archive.Create(name)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(files[name]); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Gather up everything we hold about the user, zip it up and put it in the
+// blob store, returning where it ended up and how big it is
+func buildExport(ctx context.Context, export *Export) (string, int64, error) {
+	u, err := user.GetById(ctx, export.UserId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	records, err := user.ListRelationships(ctx, u.Id)
+	if err != nil {
+		return "", 0, err
+	}
+	ids := make([]string, len(records))
+	for i, record := range records {
+		ids[i] = record.TargetId
+	}
+	related, err := user.GetByIds(ctx, ids)
+	if err != nil {
+		return "", 0, err
+	}
+	relationships := make([]exportRelationship, len(records))
+	for i, record := range records {
+		relationships[i] = exportRelationship{UserId: record.TargetId, Type: record.Type, Since: record.Since}
+		if other, ok := related[record.TargetId]; ok {
+			relationships[i].Username = other.Username
+		}
+	}
+
+	history, err := user.UsernameHistory(ctx, u.Id)
+	if err != nil {
+		return "", 0, err
+	}
+
+	settings, err := user.GetSettings(ctx, u.Id)
+	if err != nil {
+		return "", 0, err
+	}
+
+	memberships, err := server.ListForUser(ctx, u.Id)
+	if err != nil {
+		return "", 0, err
+	}
+	servers := make([]exportServer, len(memberships))
+	for i, s := range memberships {
+		servers[i] = exportServer{Id: s.Id, Name: s.Name, Owner: s.OwnerId == u.Id}
+	}
+
+	sessionManager, err := redis.GetConnection()
+	if err != nil {
+		return "", 0, err
+	}
+	sessions, err := sessionManager.ListUserSessions(u.Id)
+	if err != nil {
+		return "", 0, err
+	}
+
+	files := exportFiles(u, relationships, history, settings, servers, sessions)
+
+	store, err := storage.Get()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	if err := writeJSONFiles(archive, files); err != nil {
+		return "", 0, err
+	}
+
+	// the largest size of each image, which is as close to the original as
+	// we still have
+	images := []struct {
+		kind  user.ImageKind
+		image string
+		name  string
+	}{
+		{user.AvatarImage, u.Avatar, "avatar"},
+		{user.BannerImage, u.Banner, "banner"},
+	}
+	for _, image := range images {
+		if image.image == "" {
+			continue
+		}
+		sizes := image.kind.Sizes()
+		if err := copyBlob(ctx, store, archive,
+			user.ImageKey(image.kind, u.Id, image.image, sizes[len(sizes)-1]),
+			"images/"+image.name+path.Ext(image.image),
+		); err != nil {
+			return "", 0, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return "", 0, fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	size := int64(buf.Len())
+	key := exportPrefix(u.Id) + export.Id + ".zip"
+	if err := store.Put(ctx, key, &buf, "application/zip"); err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// Copy something from the blob store into the archive
+func copyBlob(ctx context.Context, store storage.BlobStore, archive *zip.Writer, key string, name string) error {
+	blob, err := store.Open(ctx, key)
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	f, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if _, err := io.Copy(f, blob); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// Delete the archives of exports that have expired, returning how many
+func ExpireExports(ctx context.Context) (int, error) {
+	collection := database.GetCollection(exportsCollection)
+	cursor, err := collection.Find(ctx, map[string]interface{}{
+		"status":    ExportReady,
+		"expiresAt": map[string]interface{}{"$lte": time.Now().UTC()},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired exports: %w", err)
+	}
+
+	var exports []Export
+	if err := cursor.All(ctx, &exports); err != nil {
+		return 0, fmt.Errorf("failed to decode exports: %w", err)
+	}
+
+	store, err := storage.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, export := range exports {
+		if err := store.Delete(ctx, export.Key); err != nil {
+			return expired, err
+		}
+		_, err := collection.UpdateOne(ctx,
+			map[string]interface{}{"id": export.Id},
+			map[string]interface{}{
+				"$set":   map[string]interface{}{"status": ExportExpired},
+				"$unset": map[string]interface{}{"key": ""},
+			},
+		)
+		if err != nil {
+			return expired, fmt.Errorf("failed to update export: %w", err)
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// Delete every export a user has, archives and all
+func deleteExports(ctx context.Context, userId string) error {
+	store, err := storage.Get()
+	if err != nil {
+		return err
+	}
+	if err := store.DeletePrefix(ctx, exportPrefix(userId)); err != nil {
+		return fmt.Errorf("failed to delete exports: %w", err)
+	}
+
+	_, err = database.GetCollection(exportsCollection).DeleteMany(ctx, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return fmt.Errorf("failed to delete exports: %w", err)
+	}
+	return nil
+}
+
+// Make sure the indexes exports rely on exist
+func EnsureIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(exportsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "requestedAt", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "requestedAt", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create export indexes: %w", err)
+	}
+	return nil
+}
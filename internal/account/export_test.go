@@ -0,0 +1,58 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+func TestExportArchiveHasEveryFile(t *testing.T) {
+	u := &user.User{Id: "user", Username: "someone"}
+	servers := []exportServer{{Id: "server", Name: "Somewhere", Owner: true}}
+	files := exportFiles(u, nil, nil, &user.Settings{}, servers, nil)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	if err := writeJSONFiles(archive, files); err != nil {
+		t.Fatalf("writeJSONFiles: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("closing archive: %v", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("opening archive: %v", err)
+	}
+	got := []string{}
+	for _, f := range reader.File {
+		got = append(got, f.Name)
+	}
+
+	want := []string{"profile.json", "relationships.json", "servers.json", "sessions.json", "settings.json", "username_history.json"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("archive has %v, want %v", got, want)
+	}
+
+	for _, f := range reader.File {
+		if f.Name != "servers.json" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening servers.json: %v", err)
+		}
+		var decoded []exportServer
+		if err := json.NewDecoder(r).Decode(&decoded); err != nil {
+			t.Fatalf("decoding servers.json: %v", err)
+		}
+		r.Close()
+		if len(decoded) != 1 || decoded[0] != servers[0] {
+			t.Errorf("servers.json has %+v, want %+v", decoded, servers)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package account
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Runs everything to do with accounts that happens in the background:
+// deleting accounts whose grace period is up and putting exports together
+type Worker struct {
+	policy   Policy
+	interval time.Duration
+}
+
+func NewWorker(policy Policy, interval time.Duration) *Worker {
+	return &Worker{policy: policy, interval: interval}
+}
+
+// Run until the context is cancelled, every interval or whenever an export
+// is requested, whichever comes first
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.runOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// Go through everything once; one thing failing shouldn't stop the others
+func (w *Worker) runOnce(ctx context.Context) {
+	if deleted, err := DeleteDue(ctx, w.policy); err != nil {
+		log.Printf("Error deleting accounts: %v", err)
+	} else if deleted > 0 {
+		log.Printf("Deleted %d account(s)", deleted)
+	}
+
+	if _, err := ProcessPendingExports(ctx, w.policy); err != nil {
+		log.Printf("Error processing data exports: %v", err)
+	}
+
+	if _, err := ExpireExports(ctx); err != nil {
+		log.Printf("Error expiring data exports: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+)
+
+// The OpenAPI document describing every route in NewRouter; keep this up to
+// date when adding routes, openapi_test.go will fail if a route is missing!
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// The version of Redoc the docs page loads, pinned so that a new release
+// can't change (or break) the page under us. When bumping it, update
+// redocIntegrity to the SRI hash of the new bundle:
+//
+//	curl -sL <redocScript> | openssl dgst -sha384 -binary | openssl base64 -A
+const (
+	redocVersion   = "v2.1.5"
+	redocScript    = "https://cdn.redoc.ly/redoc/" + redocVersion + "/bundles/redoc.standalone.js"
+	redocIntegrity = ""
+)
+
+// A tiny page which renders the spec with Redoc so the frontend team can
+// browse the API without having to read through the handlers. The browser
+// refuses to run the script if it doesn't match redocIntegrity
+var docsPage = fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+	<title>Voxly API</title>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+	<redoc spec-url="/openapi.json"></redoc>
+	<script src="%s" integrity="sha384-%s" crossorigin="anonymous"></script>
+</body>
+</html>
+`, redocScript, redocIntegrity)
+
+// Serve the raw OpenAPI document
+func serveOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+// Serve the HTML documentation page
+func serveDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(docsPage))
+}
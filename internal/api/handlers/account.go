@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/account"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// Handlers for deleting an account and exporting its data
+type AccountHandler struct {
+	policy account.Policy
+}
+
+func NewAccountHandler(policy account.Policy) *AccountHandler {
+	return &AccountHandler{policy: policy}
+}
+
+// Deleting an account needs the password again, a stolen token on its own
+// shouldn't be enough
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteAccountResponse struct {
+	DeletionScheduledAt time.Time `json:"deletionScheduledAt"`
+}
+
+// Schedule the current user's account to be deleted once the grace period is up
+func (h *AccountHandler) ScheduleDeletion(w http.ResponseWriter, r *http.Request) {
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.Password == "" {
+		sendValidationError(w, r, []FieldError{{Field: "password", Code: "required", Message: "Password is required"}})
+		return
+	}
+
+	u := currentUser(w, r)
+	if u == nil {
+		return
+	}
+
+	matches, err := u.CheckPassword(req.Password)
+	if err != nil {
+		log.Printf("Error comparing password hash: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+	if !matches {
+		sendError(w, r, http.StatusForbidden, ErrInvalidCredentials, "The password provided is incorrect")
+		return
+	}
+
+	at, err := account.ScheduleDeletion(r.Context(), u, h.policy)
+	if err == account.ErrDeletionScheduled {
+		sendError(w, r, http.StatusConflict, ErrDeletionScheduled, "Your account is already scheduled to be deleted")
+		return
+	}
+	if err == account.ErrOwnsServers {
+		sendError(w, r, http.StatusConflict, ErrOwnsServers, "You must transfer or delete the servers you own before deleting your account")
+		return
+	}
+	if err != nil {
+		log.Printf("Error scheduling account deletion: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	sendJSON(w, http.StatusAccepted, DeleteAccountResponse{DeletionScheduledAt: at})
+}
+
+// Cancel a scheduled deletion of the current user's account
+func (h *AccountHandler) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	err := account.CancelDeletion(r.Context(), middleware.GetUserId(r.Context()))
+	if err == user.ErrNoDeletionScheduled {
+		sendError(w, r, http.StatusNotFound, ErrDeletionNotScheduled, "Your account is not scheduled to be deleted")
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling account deletion: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Send the error for one of the export errors from the account package
+func sendExportError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case account.ErrExportNotFound:
+		sendError(w, r, http.StatusNotFound, ErrNotFound, "No export exists with that id")
+	case account.ErrExportInProgress:
+		sendError(w, r, http.StatusConflict, ErrExportInProgress, "An export of your data is already being put together")
+	case account.ErrExportNotReady:
+		sendError(w, r, http.StatusConflict, ErrExportNotReady, "That export is not available to download")
+	default:
+		log.Printf("Error with data export: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+	}
+}
+
+// Ask for an export of everything we hold about the current user; it's put
+// together in the background
+func (h *AccountHandler) RequestExport(w http.ResponseWriter, r *http.Request) {
+	export, err := account.RequestExport(r.Context(), middleware.GetUserId(r.Context()))
+	if err != nil {
+		sendExportError(w, r, err)
+		return
+	}
+
+	sendJSON(w, http.StatusAccepted, export)
+}
+
+// List the exports the current user has asked for
+func (h *AccountHandler) ListExports(w http.ResponseWriter, r *http.Request) {
+	exports, err := account.ListExports(r.Context(), middleware.GetUserId(r.Context()))
+	if err != nil {
+		sendExportError(w, r, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, exports)
+}
+
+// Get a single export, to see whether it's ready yet
+func (h *AccountHandler) GetExport(w http.ResponseWriter, r *http.Request) {
+	export, err := account.GetExport(r.Context(), middleware.GetUserId(r.Context()), mux.Vars(r)["id"])
+	if err != nil {
+		sendExportError(w, r, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, export)
+}
+
+// Download the archive for an export that is ready
+func (h *AccountHandler) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	export, archive, err := account.OpenExport(r.Context(), middleware.GetUserId(r.Context()), mux.Vars(r)["id"])
+	if err != nil {
+		sendExportError(w, r, err)
+		return
+	}
+	defer archive.Close()
+
+	filename := fmt.Sprintf("voxly-export-%s.zip", export.RequestedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if export.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(export.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, archive); err != nil {
+		log.Printf("Error sending data export: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/registration"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// Only let admins through; this has to run after RequireAuth. Admins are made
+// with `voxly user admin`, there's deliberately no way to do it over the API
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := currentUser(w, r)
+		if u == nil {
+			return
+		}
+		if !u.Admin || u.Disabled {
+			sendError(w, r, http.StatusForbidden, ErrForbidden, "You do not have permission to access this resource")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Only let through requests made over a connection with a client certificate
+// that we verified, for the routes that are meant for internal callers only.
+// Whether one was asked for at all is up to TLS_CLIENT_AUTH
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			sendError(w, r, http.StatusForbidden, ErrForbidden, "A verified client certificate is required to access this resource")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The body of a request to create an invite code
+type CreateInviteRequest struct {
+	// how many times the code can be used, 1 for a single use code or 0 for
+	// no limit; defaults to 1
+	MaxUses *int `json:"maxUses"`
+	// when the code stops working, or null for never
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// Somebody who registered with an invite code
+type InviteUser struct {
+	Id           string    `json:"id"`
+	Username     string    `json:"username"`
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+// An invite code along with everyone who has registered with it
+type InviteResponse struct {
+	registration.Invite
+	Users []InviteUser `json:"users"`
+}
+
+// Send the error for one of the invite errors from the registration package
+func sendInviteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case registration.ErrInviteNotFound:
+		sendError(w, r, http.StatusNotFound, ErrNotFound, "No invite exists with that code")
+	default:
+		log.Printf("Error with invite: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+	}
+}
+
+// List every invite code, including the ones that can't be used any more
+func ListInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := registration.ListInvites(r.Context())
+	if err != nil {
+		sendInviteError(w, r, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, invites)
+}
+
+// Create a new invite code
+func CreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+
+	var fields []FieldError
+	if maxUses < 0 {
+		fields = append(fields, FieldError{Field: "maxUses", Code: "invalid", Message: "Max uses can't be negative"})
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		fields = append(fields, FieldError{Field: "expiresAt", Code: "invalid", Message: "Expiry must be in the future"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		at := req.ExpiresAt.UTC()
+		expiresAt = &at
+	}
+
+	u := currentUser(w, r)
+	if u == nil {
+		return
+	}
+
+	invite, err := registration.CreateInvite(r.Context(), u.Id, maxUses, expiresAt)
+	if err != nil {
+		sendInviteError(w, r, err)
+		return
+	}
+
+	sendJSON(w, http.StatusCreated, InviteResponse{Invite: *invite, Users: []InviteUser{}})
+}
+
+// Get a single invite code, along with who has registered with it
+func GetInvite(w http.ResponseWriter, r *http.Request) {
+	invite, err := registration.GetInvite(r.Context(), mux.Vars(r)["code"])
+	if err != nil {
+		sendInviteError(w, r, err)
+		return
+	}
+
+	users, err := user.ListByInviteCode(r.Context(), invite.Code)
+	if err != nil {
+		sendInviteError(w, r, err)
+		return
+	}
+
+	response := InviteResponse{Invite: *invite, Users: make([]InviteUser, len(users))}
+	for i, u := range users {
+		response.Users[i] = InviteUser{Id: u.Id, Username: u.Username, RegisteredAt: u.RegisteredAt}
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Revoke an invite code so that nobody else can register with it
+func RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	if _, err := registration.RevokeInvite(r.Context(), mux.Vars(r)["code"]); err != nil {
+		sendInviteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireClientCert(t *testing.T) {
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  int
+	}{
+		{"plain HTTP", nil, http.StatusForbidden},
+		{"no client certificate", &tls.ConnectionState{}, http.StatusForbidden},
+		{"unverified client certificate", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}, http.StatusForbidden},
+		{"verified client certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, http.StatusNoContent},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = test.state
+		RequireClientCert(next).ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// The header clients can put the reason for any administrative action in;
+// it's URL encoded so that it can hold more than ASCII
+const auditReasonHeader = "X-Audit-Log-Reason"
+
+// A page of the audit log of a server
+type AuditLogResponse struct {
+	Entries []server.AuditEntry `json:"entries"`
+	// everyone who did something on this page, plus any users who had
+	// something done to them
+	Users      []user.PublicUser `json:"users"`
+	Total      int               `json:"total"`
+	NextOffset *int              `json:"nextOffset"`
+}
+
+// Get the reason for the current request from the audit log reason header,
+// cut down to the length a reason can be
+func auditReason(r *http.Request) string {
+	reason := r.Header.Get(auditReasonHeader)
+	if unescaped, err := url.PathUnescape(reason); err == nil {
+		reason = unescaped
+	}
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > server.MaxReasonLength {
+		reason = string([]rune(reason)[:server.MaxReasonLength])
+	}
+	return reason
+}
+
+// Add an entry to the audit log of a server for something the current user
+// has just done. The action has already happened by now, so if this fails
+// it's logged rather than failing the request
+func recordAudit(r *http.Request, serverId string, entry server.AuditEntry) {
+	entry.ServerId = serverId
+	entry.ActorId = middleware.GetUserId(r.Context())
+	if entry.Reason == "" {
+		entry.Reason = auditReason(r)
+	}
+	if err := server.RecordAudit(r.Context(), entry); err != nil {
+		log.Printf("Error recording %s in the audit log: %v", entry.Action, err)
+	}
+}
+
+// Parse an optional time from the query string
+func queryTime(r *http.Request, name string) (*time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, false
+	}
+	return &t, true
+}
+
+// List the audit log of a server, newest first, optionally only for some
+// actions, for one actor or between two times; this needs the view audit
+// log permission
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	var filter server.AuditFilter
+	var fields []FieldError
+	for _, value := range r.URL.Query()["action"] {
+		for _, action := range strings.Split(value, ",") {
+			if action := server.AuditAction(strings.TrimSpace(action)); action.Valid() {
+				filter.Actions = append(filter.Actions, action)
+			} else {
+				fields = append(fields, FieldError{Field: "action", Code: "invalid", Message: "Unknown action " + string(action)})
+			}
+		}
+	}
+	filter.ActorId = r.URL.Query().Get("actorId")
+	if filter.After, ok = queryTime(r, "after"); !ok {
+		fields = append(fields, FieldError{Field: "after", Code: "invalid", Message: "After must be an RFC 3339 time"})
+	}
+	if filter.Before, ok = queryTime(r, "before"); !ok {
+		fields = append(fields, FieldError{Field: "before", Code: "invalid", Message: "Before must be an RFC 3339 time"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, _ := permittedServer(w, r, server.PermViewAuditLog)
+	if s == nil {
+		return
+	}
+
+	page, err := server.ListAuditLog(r.Context(), s.Id, filter, limit, offset)
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, entry := range page.Entries {
+		related := []string{entry.ActorId}
+		if entry.TargetType == server.AuditTargetUser {
+			related = append(related, entry.TargetId)
+		}
+		for _, id := range related {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	users, err := publicUsers(r, ids)
+	if err != nil {
+		log.Printf("Error looking up audit log users: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	response := AuditLogResponse{Entries: page.Entries, Users: []user.PublicUser{}, Total: page.Total}
+	for _, id := range ids {
+		if u, ok := users[id]; ok {
+			response.Users = append(response.Users, *u)
+		}
+	}
+	if next := offset + limit; next < page.Total {
+		response.NextOffset = &next
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Record an action in the audit log with the changes between two snapshots
+// of its target, either of which can be nil for something being created or
+// deleted. Nothing is recorded if nothing changed
+func recordChanges(r *http.Request, serverId string, entry server.AuditEntry, before map[string]interface{}, after map[string]interface{}) {
+	entry.Changes = server.Diff(before, after)
+	if len(entry.Changes) == 0 {
+		return
+	}
+	recordAudit(r, serverId, entry)
+}
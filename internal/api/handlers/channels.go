@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/server"
+)
+
+// The body of a request to create a channel
+type CreateChannelRequest struct {
+	Type     server.ChannelType `json:"type"`
+	Name     string             `json:"name"`
+	Topic    string             `json:"topic"`
+	ParentId string             `json:"parentId"`
+	NSFW     bool               `json:"nsfw"`
+}
+
+// The body of a request to update a channel, fields which are left out are
+// left as they are
+type UpdateChannelRequest struct {
+	Name     *string `json:"name"`
+	Topic    *string `json:"topic"`
+	NSFW     *bool   `json:"nsfw"`
+	ParentId *string `json:"parentId"` // "" takes the channel out of its category
+}
+
+// One entry in a bulk reorder
+type ChannelPositionRequest struct {
+	Id       string  `json:"id"`
+	Position int     `json:"position"`
+	ParentId *string `json:"parentId"` // left out keeps the channel where it is, "" moves it to the top level
+}
+
+// Send the error for one of the channel errors from the server package,
+// falling back to sendServerError for everything else
+func sendChannelError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case server.ErrChannelNotFound:
+		sendError(w, r, http.StatusNotFound, ErrChannelNotFound, "No channel exists with that id")
+	case server.ErrTooManyChannels:
+		sendError(w, r, http.StatusBadRequest, ErrTooManyChannels, "The server already has the maximum number of channels")
+	case server.ErrInvalidParent, server.ErrNestedCategory:
+		sendValidationError(w, r, []FieldError{{Field: "parentId", Code: "invalid", Message: err.Error()}})
+	case server.ErrTooManyOverwrites:
+		sendError(w, r, http.StatusBadRequest, ErrTooManyOverwrites, "The channel already has the maximum number of overwrites")
+	case server.ErrOverwriteNotFound:
+		sendError(w, r, http.StatusNotFound, ErrNotFound, "There is no overwrite for that role or member in the channel")
+	case server.ErrCategoryTopic:
+		sendValidationError(w, r, []FieldError{{Field: "type", Code: "invalid", Message: err.Error()}})
+	default:
+		sendServerError(w, r, err)
+	}
+}
+
+// Get the channel in the {channelId} path variable from a server, sending a
+// 404 if there's no such channel in it or the current user can't see it, and
+// a 403 unless they have all of the given permissions in it
+func serverChannel(w http.ResponseWriter, r *http.Request, s *server.Server, access *server.Access, perms server.Permissions) *server.Channel {
+	channel, err := server.GetChannel(r.Context(), s.Id, mux.Vars(r)["channelId"])
+	if err == nil && !access.HasIn(channel, server.PermViewChannel) {
+		err = server.ErrChannelNotFound
+	}
+	if err != nil {
+		sendChannelError(w, r, err)
+		return nil
+	}
+	if !access.HasIn(channel, perms) {
+		sendMissingPermissions(w, r, perms)
+		return nil
+	}
+	return channel
+}
+
+// List every channel in a server that the current user can see, top level
+// first and then each category's channels, each in position order
+func ListChannels(w http.ResponseWriter, r *http.Request) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	channels, err := server.ListChannels(r.Context(), s.Id)
+	if err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+
+	visible := []server.Channel{}
+	for i := range channels {
+		if access.HasIn(&channels[i], server.PermViewChannel) {
+			visible = append(visible, channels[i])
+		}
+	}
+	sendJSON(w, http.StatusOK, visible)
+}
+
+// Get a single channel
+func GetChannel(w http.ResponseWriter, r *http.Request) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	channel := serverChannel(w, r, s, access, server.PermViewChannel)
+	if channel == nil {
+		return
+	}
+	sendJSON(w, http.StatusOK, channel)
+}
+
+// Create a channel or category at the end of its parent
+func CreateChannel(w http.ResponseWriter, r *http.Request) {
+	var req CreateChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	var fields []FieldError
+	if !req.Type.Valid() {
+		fields = append(fields, FieldError{Field: "type", Code: "invalid", Message: server.ErrInvalidChannelType.Error()})
+	}
+	name, err := server.NormalizeChannelName(req.Type, req.Name)
+	if err != nil {
+		fields = append(fields, FieldError{Field: "name", Code: "invalid", Message: err.Error()})
+	}
+	topic, err := server.NormalizeChannelTopic(req.Topic)
+	if err != nil {
+		fields = append(fields, FieldError{Field: "topic", Code: "invalid", Message: err.Error()})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, _ := permittedServer(w, r, server.PermManageChannels)
+	if s == nil {
+		return
+	}
+
+	channel, err := server.CreateChannel(r.Context(), s.Id, server.NewChannel{
+		Type:     req.Type,
+		Name:     name,
+		Topic:    topic,
+		ParentId: req.ParentId,
+		NSFW:     req.NSFW,
+	})
+	if err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditChannelCreate, TargetType: server.AuditTargetChannel, TargetId: channel.Id}, nil, channel.AuditFields())
+	sendJSON(w, http.StatusCreated, channel)
+}
+
+// Update a channel; moving it to another category puts it at the end of that
+// category
+func UpdateChannel(w http.ResponseWriter, r *http.Request) {
+	var req UpdateChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	channel := serverChannel(w, r, s, access, server.PermManageChannels)
+	if channel == nil {
+		return
+	}
+
+	// text channel names depend on the type, so this has to wait until we
+	// know what the channel is
+	changes := server.ChannelUpdate{NSFW: req.NSFW, ParentId: req.ParentId}
+	var fields []FieldError
+	if req.Name != nil {
+		name, err := server.NormalizeChannelName(channel.Type, *req.Name)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "name", Code: "invalid", Message: err.Error()})
+		}
+		changes.Name = &name
+	}
+	if req.Topic != nil {
+		topic, err := server.NormalizeChannelTopic(*req.Topic)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "topic", Code: "invalid", Message: err.Error()})
+		}
+		changes.Topic = &topic
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	before := channel.AuditFields()
+	if err := server.UpdateChannel(r.Context(), channel, changes); err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditChannelUpdate, TargetType: server.AuditTargetChannel, TargetId: channel.Id}, before, channel.AuditFields())
+	sendJSON(w, http.StatusOK, channel)
+}
+
+// Move several channels at once, returning every channel in the server in
+// its new order
+func ReorderChannels(w http.ResponseWriter, r *http.Request) {
+	var req []ChannelPositionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(req) == 0 || len(req) > server.MaxChannels {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Between 1 and 500 channels must be given")
+		return
+	}
+
+	positions := make([]server.ChannelPosition, len(req))
+	seen := map[string]bool{}
+	for i, entry := range req {
+		if seen[entry.Id] {
+			sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Each channel can only be given once")
+			return
+		}
+		if entry.Position < 0 {
+			sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Positions can't be negative")
+			return
+		}
+		seen[entry.Id] = true
+		positions[i] = server.ChannelPosition{Id: entry.Id, Position: entry.Position, ParentId: entry.ParentId}
+	}
+
+	s, _ := permittedServer(w, r, server.PermManageChannels)
+	if s == nil {
+		return
+	}
+
+	before, err := server.ListChannels(r.Context(), s.Id)
+	if err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+	channels, err := server.ReorderChannels(r.Context(), s.Id, positions)
+	if err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+
+	// every channel that moved gets an entry of its own, including the ones
+	// that only moved to make room
+	moved := map[string]map[string]interface{}{}
+	for i := range before {
+		moved[before[i].Id] = before[i].AuditFields()
+	}
+	for i := range channels {
+		recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditChannelUpdate, TargetType: server.AuditTargetChannel, TargetId: channels[i].Id}, moved[channels[i].Id], channels[i].AuditFields())
+	}
+	sendJSON(w, http.StatusOK, channels)
+}
+
+// Delete a channel; deleting a category moves its channels to the top level
+func DeleteChannel(w http.ResponseWriter, r *http.Request) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	channel := serverChannel(w, r, s, access, server.PermManageChannels)
+	if channel == nil {
+		return
+	}
+
+	if err := server.DeleteChannel(r.Context(), channel); err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditChannelDelete, TargetType: server.AuditTargetChannel, TargetId: channel.Id}, channel.AuditFields(), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The body of a request to set an overwrite
+type OverwriteRequest struct {
+	Type  server.OverwriteType `json:"type"`
+	Allow server.Permissions   `json:"allow"`
+	Deny  server.Permissions   `json:"deny"`
+}
+
+// Set what a role or member can do in a channel. This needs the manage roles
+// permission in the channel, nobody can allow or deny permissions they don't
+// have in it themselves and the role or member has to be below them
+func SetOverwrite(w http.ResponseWriter, r *http.Request) {
+	var req OverwriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	var fields []FieldError
+	if req.Type != server.OverwriteRole && req.Type != server.OverwriteMember {
+		fields = append(fields, FieldError{Field: "type", Code: "invalid", Message: "Type must be either role or member"})
+	}
+	if req.Allow&^server.ChannelPermissions != 0 {
+		fields = append(fields, FieldError{Field: "allow", Code: "invalid", Message: "Only channel permissions can be allowed in a channel"})
+	}
+	if req.Deny&^server.ChannelPermissions != 0 {
+		fields = append(fields, FieldError{Field: "deny", Code: "invalid", Message: "Only channel permissions can be denied in a channel"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	channel := serverChannel(w, r, s, access, server.PermManageRoles)
+	if channel == nil {
+		return
+	}
+
+	// the role or member has to actually be in the server
+	id := mux.Vars(r)["id"]
+	role, target, err := overwriteTarget(r, s, req.Type, id)
+	if err == server.ErrRoleNotFound || err == server.ErrNotMember {
+		sendValidationError(w, r, []FieldError{{Field: "type", Code: "invalid", Message: "No " + string(req.Type) + " with that id is in the server"}})
+		return
+	}
+	if err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+	if !checkOverwrite(w, r, access, channel, req.Allow|req.Deny, role, target) {
+		return
+	}
+
+	overwrite := server.Overwrite{Id: id, Type: req.Type, Allow: req.Allow, Deny: req.Deny &^ req.Allow}
+	entry := server.AuditEntry{Action: server.AuditOverwriteCreate, TargetType: server.AuditTargetChannel, TargetId: channel.Id}
+	var before map[string]interface{}
+	if existing := findOverwrite(channel, overwrite.Type, overwrite.Id); existing != nil {
+		entry.Action = server.AuditOverwriteUpdate
+		before = existing.AuditFields()
+	}
+	if err := server.SetOverwrite(r.Context(), channel, overwrite); err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, entry, before, overwrite.AuditFields())
+	sendJSON(w, http.StatusOK, channel)
+}
+
+// Remove the overwrite for a role or member from a channel; the type comes
+// from the query string as both can have the same id
+func DeleteOverwrite(w http.ResponseWriter, r *http.Request) {
+	overwriteType := server.OverwriteType(r.URL.Query().Get("type"))
+	if overwriteType == "" {
+		overwriteType = server.OverwriteRole
+	}
+	if overwriteType != server.OverwriteRole && overwriteType != server.OverwriteMember {
+		sendValidationError(w, r, []FieldError{{Field: "type", Code: "invalid", Message: "Type must be either role or member"}})
+		return
+	}
+
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	channel := serverChannel(w, r, s, access, server.PermManageRoles)
+	if channel == nil {
+		return
+	}
+
+	// taking an overwrite away changes what it applies to just as much as
+	// setting it does. Overwrites for roles that have since been deleted or
+	// members who have left can go whatever
+	var before map[string]interface{}
+	if existing := findOverwrite(channel, overwriteType, mux.Vars(r)["id"]); existing != nil {
+		role, target, err := overwriteTarget(r, s, overwriteType, existing.Id)
+		if err != nil && err != server.ErrRoleNotFound && err != server.ErrNotMember {
+			sendChannelError(w, r, err)
+			return
+		}
+		if !checkOverwrite(w, r, access, channel, existing.Allow|existing.Deny, role, target) {
+			return
+		}
+		before = existing.AuditFields()
+	}
+	if err := server.DeleteOverwrite(r.Context(), channel, overwriteType, mux.Vars(r)["id"]); err != nil {
+		sendChannelError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditOverwriteDelete, TargetType: server.AuditTargetChannel, TargetId: channel.Id}, before, nil)
+	sendJSON(w, http.StatusOK, channel)
+}
+
+// Look up the role or member an overwrite is for; only one of the two is set
+func overwriteTarget(r *http.Request, s *server.Server, overwriteType server.OverwriteType, id string) (*server.Role, *server.Access, error) {
+	if overwriteType == server.OverwriteRole {
+		role, err := server.GetRole(r.Context(), s, id)
+		return role, nil, err
+	}
+	target, err := server.GetAccess(r.Context(), s, id)
+	return nil, target, err
+}
+
+// Check that the current user can set or remove an overwrite with these
+// permissions in a channel, sending a 403 if not. Nobody can allow or deny
+// what they can't do in the channel themselves, and the overwrite has to be
+// for a role they can manage or a member below them. Either role or target
+// can be nil, e.g. for a role that has since been deleted
+func checkOverwrite(w http.ResponseWriter, r *http.Request, access *server.Access, channel *server.Channel, perms server.Permissions, role *server.Role, target *server.Access) bool {
+	if missing := perms &^ access.In(channel); missing != 0 {
+		sendMissingPermissions(w, r, missing)
+		return false
+	}
+	if role != nil && !access.CanManageRole(role) {
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "You can only set overwrites for roles below your highest role")
+		return false
+	}
+	if target != nil && !access.Outranks(target) {
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "You can only set overwrites for members below your highest role")
+		return false
+	}
+	return true
+}
+
+// Find the overwrite for a role or member in a channel, if it has one
+func findOverwrite(channel *server.Channel, overwriteType server.OverwriteType, id string) *server.Overwrite {
+	for i := range channel.Overwrites {
+		if channel.Overwrites[i].Type == overwriteType && channel.Overwrites[i].Id == id {
+			return &channel.Overwrites[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oauthority/voxly-backend/internal/server"
+)
+
+const (
+	testServerId = "server"
+	testOwnerId  = "owner"
+)
+
+var testServer = &server.Server{Id: testServerId, OwnerId: testOwnerId}
+
+// The roles of the test server, lowest first: a plain member role, the
+// moderators and the admins above them
+var (
+	everyoneRole = server.Role{Id: testServerId, ServerId: testServerId, Permissions: server.DefaultPermissions}
+	memberRole   = server.Role{Id: "member", ServerId: testServerId, Position: 1}
+	modRole      = server.Role{Id: "mod", ServerId: testServerId, Position: 2, Permissions: server.PermManageRoles}
+	adminRole    = server.Role{Id: "admin", ServerId: testServerId, Position: 3, Permissions: server.PermManageRoles | server.PermManageChannels}
+	testRoles    = []server.Role{everyoneRole, memberRole, modRole, adminRole}
+)
+
+func testAccess(userId string, roleIds ...string) *server.Access {
+	return server.NewAccess(testServer, userId, roleIds, testRoles)
+}
+
+func TestCheckOverwrite(t *testing.T) {
+	mod := testAccess("mod", "mod")
+
+	// the moderators can't send messages in here
+	muted := &server.Channel{Id: "muted", ServerId: testServerId, Overwrites: []server.Overwrite{
+		{Id: "mod", Type: server.OverwriteRole, Deny: server.PermSendMessages},
+	}}
+	open := &server.Channel{Id: "open", ServerId: testServerId}
+
+	tests := []struct {
+		name    string
+		access  *server.Access
+		channel *server.Channel
+		perms   server.Permissions
+		role    *server.Role
+		target  *server.Access
+		want    bool
+	}{
+		{"allowing what they can do in the channel", mod, open, server.PermSendMessages, nil, testAccess("member", "member"), true},
+		{"allowing themselves what's denied to them in the channel", mod, muted, server.PermSendMessages, nil, mod, false},
+		{"allowing a member what's denied to them in the channel", mod, muted, server.PermSendMessages, nil, testAccess("member", "member"), false},
+		{"allowing what they don't have at all", mod, open, server.PermManageMessages, nil, testAccess("member", "member"), false},
+		{"a role below them", mod, open, server.PermViewChannel, &memberRole, nil, true},
+		{"@everyone", mod, open, server.PermViewChannel, &everyoneRole, nil, true},
+		{"their own role", mod, open, server.PermViewChannel, &modRole, nil, false},
+		{"a role above them", mod, open, server.PermViewChannel, &adminRole, nil, false},
+		{"a member below them", mod, open, server.PermViewChannel, nil, testAccess("member", "member"), true},
+		{"a member level with them", mod, open, server.PermViewChannel, nil, testAccess("other", "mod"), false},
+		{"a member above them", mod, open, server.PermViewChannel, nil, testAccess("admin", "admin"), false},
+		{"the owner", mod, open, server.PermViewChannel, nil, testAccess(testOwnerId), false},
+		{"the owner on a role above everyone", testAccess(testOwnerId), muted, server.PermSendMessages, &adminRole, nil, true},
+		{"a deleted role or departed member", mod, open, server.PermViewChannel, nil, nil, true},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/", nil)
+		got := checkOverwrite(w, r, test.access, test.channel, test.perms, test.role, test.target)
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if !got && w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/server"
+)
+
+// The body of a request to put a server in the directory
+type ListServerRequest struct {
+	Category server.DirectoryCategory `json:"category"`
+	Tags     []string                 `json:"tags"`
+}
+
+// A server as it shows up in the directory
+type DirectoryEntry struct {
+	ServerPreview
+	Category server.DirectoryCategory `json:"category"`
+	Tags     []string                 `json:"tags"`
+	Activity int                      `json:"activity"` // how many people joined in the last week
+	ListedAt time.Time                `json:"listedAt"`
+}
+
+// A page of search results from the directory
+type DirectoryResponse struct {
+	Servers    []DirectoryEntry `json:"servers"`
+	Total      int              `json:"total"`
+	NextOffset *int             `json:"nextOffset"`
+}
+
+// The body of a request to block a server from the directory
+type BlockServerRequest struct {
+	Reason string `json:"reason"`
+}
+
+// A server that has been blocked from the directory, for admins
+type BlockedServer struct {
+	ServerPreview
+	OwnerId string                `json:"ownerId"`
+	Block   server.DirectoryBlock `json:"block"`
+}
+
+// A page of servers blocked from the directory
+type BlockedServersResponse struct {
+	Servers    []BlockedServer `json:"servers"`
+	Total      int             `json:"total"`
+	NextOffset *int            `json:"nextOffset"`
+}
+
+// Send the error for one of the directory errors from the server package,
+// falling back to sendServerError for everything else
+func sendDirectoryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case server.ErrDirectoryBlocked:
+		sendError(w, r, http.StatusForbidden, ErrDirectoryBlocked, "The server has been blocked from the directory")
+	case server.ErrNotListed:
+		// to people outside of it, a server that isn't listed doesn't exist
+		sendError(w, r, http.StatusNotFound, ErrServerNotFound, "No server exists with that id")
+	case server.ErrBanned:
+		sendError(w, r, http.StatusForbidden, ErrBanned, "You are banned from this server")
+	default:
+		sendServerError(w, r, err)
+	}
+}
+
+func previewServer(s *server.Server) ServerPreview {
+	return ServerPreview{
+		Id:          s.Id,
+		Name:        s.Name,
+		Description: s.Description,
+		Icon:        server.IconURLs(s.Id, s.Icon),
+		MemberCount: s.MemberCount,
+	}
+}
+
+// Put a server in the directory, or change its category and tags if it's
+// already there; this needs the manage server permission
+func ListServer(w http.ResponseWriter, r *http.Request) {
+	var req ListServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	var fields []FieldError
+	if !req.Category.Valid() {
+		fields = append(fields, FieldError{Field: "category", Code: "invalid", Message: server.ErrInvalidCategory.Error()})
+	}
+	tags, err := server.NormalizeTags(req.Tags)
+	if err != nil {
+		fields = append(fields, FieldError{Field: "tags", Code: "invalid", Message: err.Error()})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, _ := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return
+	}
+
+	before := s.AuditFields()
+	if err := s.List(r.Context(), req.Category, tags); err != nil {
+		sendDirectoryError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditServerUpdate, TargetType: server.AuditTargetServer, TargetId: s.Id}, before, s.AuditFields())
+	sendJSON(w, http.StatusOK, s.Public())
+}
+
+// Take a server out of the directory; this needs the manage server
+// permission
+func UnlistServer(w http.ResponseWriter, r *http.Request) {
+	s, _ := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return
+	}
+
+	before := s.AuditFields()
+	if err := s.Unlist(r.Context()); err != nil {
+		sendDirectoryError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditServerUpdate, TargetType: server.AuditTargetServer, TargetId: s.Id}, before, s.AuditFields())
+	sendJSON(w, http.StatusOK, s.Public())
+}
+
+// Search the directory, optionally for some text, a category or a tag,
+// sorted by how well they match the text (the default when there is some),
+// activity (the default otherwise), member count or how recently servers
+// were listed
+func SearchDirectory(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	query := server.DirectoryQuery{
+		Text:     r.URL.Query().Get("q"),
+		Category: server.DirectoryCategory(r.URL.Query().Get("category")),
+		Tag:      r.URL.Query().Get("tag"),
+		Sort:     server.DirectorySort(r.URL.Query().Get("sort")),
+	}
+	var fields []FieldError
+	if query.Category != "" && !query.Category.Valid() {
+		fields = append(fields, FieldError{Field: "category", Code: "invalid", Message: server.ErrInvalidCategory.Error()})
+	}
+	if query.Sort != "" && !query.Sort.Valid() {
+		fields = append(fields, FieldError{Field: "sort", Code: "invalid", Message: "Sort must be relevance, activity, members or newest"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	page, err := server.SearchDirectory(r.Context(), query, limit, offset)
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+
+	response := DirectoryResponse{Servers: make([]DirectoryEntry, len(page.Servers)), Total: page.Total}
+	for i, s := range page.Servers {
+		response.Servers[i] = DirectoryEntry{
+			ServerPreview: previewServer(&s),
+			Category:      s.Listing.Category,
+			Tags:          s.Listing.Tags,
+			Activity:      s.Listing.Activity,
+			ListedAt:      s.Listing.ListedAt,
+		}
+	}
+	if next := offset + limit; next < page.Total {
+		response.NextOffset = &next
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Join a server straight from the directory, without an invite
+func JoinListedServer(w http.ResponseWriter, r *http.Request) {
+	s, err := server.GetById(r.Context(), mux.Vars(r)["serverId"])
+	if err != nil {
+		sendDirectoryError(w, r, err)
+		return
+	}
+
+	joined, err := server.JoinListed(r.Context(), s, middleware.GetUserId(r.Context()))
+	if err != nil {
+		sendDirectoryError(w, r, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, JoinResponse{Server: s.Public(), Joined: joined})
+}
+
+// List the servers that have been blocked from the directory, the most
+// recently blocked first
+func ListBlockedServers(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := server.ListBlocked(r.Context(), limit, offset)
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+
+	response := BlockedServersResponse{Servers: make([]BlockedServer, len(page.Servers)), Total: page.Total}
+	for i, s := range page.Servers {
+		response.Servers[i] = BlockedServer{ServerPreview: previewServer(&s), OwnerId: s.OwnerId, Block: *s.DirectoryBlock}
+	}
+	if next := offset + limit; next < page.Total {
+		response.NextOffset = &next
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Take a server out of the directory and stop it from being listed again
+// until it's unblocked. Blocking a server that's already blocked just
+// updates the reason
+func BlockServer(w http.ResponseWriter, r *http.Request) {
+	var req BlockServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	reason, err := server.NormalizeReason(req.Reason)
+	if err != nil {
+		sendValidationError(w, r, []FieldError{{Field: "reason", Code: "invalid", Message: err.Error()}})
+		return
+	}
+
+	s, err := server.GetById(r.Context(), mux.Vars(r)["serverId"])
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+	if err := server.BlockFromDirectory(r.Context(), s, middleware.GetUserId(r.Context()), reason); err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, BlockedServer{ServerPreview: previewServer(s), OwnerId: s.OwnerId, Block: *s.DirectoryBlock})
+}
+
+// Let a server be listed in the directory again. It isn't put back in, its
+// owners have to list it again themselves
+func UnblockServer(w http.ResponseWriter, r *http.Request) {
+	s, err := server.GetById(r.Context(), mux.Vars(r)["serverId"])
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+	if s.DirectoryBlock == nil {
+		sendError(w, r, http.StatusNotFound, ErrNotFound, "The server isn't blocked from the directory")
+		return
+	}
+	if err := server.UnblockFromDirectory(r.Context(), s); err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+)
+
+// ErrorCode is a stable, machine readable identifier for an error so that the
+// frontend can switch on it rather than trying to parse human messages. Once
+// a code has shipped it should never change meaning!
+type ErrorCode string
+
+const (
+	ErrInvalidRequest       ErrorCode = "invalid_request"        // the request body could not be parsed
+	ErrValidationFailed     ErrorCode = "validation_failed"      // one or more fields failed validation, see Fields
+	ErrInvalidCredentials   ErrorCode = "invalid_credentials"    // the password did not match
+	ErrUserNotFound         ErrorCode = "user_not_found"         // no user exists with the given details
+	ErrAccountExists        ErrorCode = "account_exists"         // an account already exists with the given details
+	ErrAccountDisabled      ErrorCode = "account_disabled"       // the account has been disabled by an admin
+	ErrRegistrationClosed   ErrorCode = "registration_closed"    // nobody can register through the API right now
+	ErrInviteInvalid        ErrorCode = "invite_invalid"         // the invite code doesn't exist, has expired or has been used up
+	ErrChallengeFailed      ErrorCode = "challenge_failed"       // the proof of work challenge wasn't solved, had expired or was already used
+	ErrUsernameTaken        ErrorCode = "username_taken"         // somebody else already has that username
+	ErrUsernameReserved     ErrorCode = "username_reserved"      // nobody is allowed that username
+	ErrUsernameCooldown     ErrorCode = "username_cooldown"      // the username was changed too recently
+	ErrDeletionScheduled    ErrorCode = "deletion_scheduled"     // the account is already due to be deleted
+	ErrDeletionNotScheduled ErrorCode = "deletion_not_scheduled" // the account isn't due to be deleted
+	ErrOwnsServers          ErrorCode = "owns_servers"           // the account can't be deleted while it owns servers
+	ErrExportInProgress     ErrorCode = "export_in_progress"     // a data export is already being put together
+	ErrExportNotReady       ErrorCode = "export_not_ready"       // the data export can't be downloaded (yet)
+	ErrSettingsConflict     ErrorCode = "settings_conflict"      // the settings were changed since the client read them
+	ErrImageTooLarge        ErrorCode = "image_too_large"        // the uploaded image is bigger than we allow
+	ErrUnsupportedImage     ErrorCode = "unsupported_image"      // the uploaded file isn't an image type we accept
+	ErrInvalidImage         ErrorCode = "invalid_image"          // the uploaded image is corrupt or the wrong size
+	ErrInvalidRelationship  ErrorCode = "invalid_relationship"   // e.g. trying to befriend yourself
+	ErrRelationshipBlocked  ErrorCode = "relationship_blocked"   // one of the users has blocked the other
+	ErrAlreadyFriends       ErrorCode = "already_friends"        // the users are already friends
+	ErrFriendRequestExists  ErrorCode = "friend_request_exists"  // a friend request has already been sent
+	ErrNoFriendRequest      ErrorCode = "no_friend_request"      // there is no pending friend request
+	ErrNotFriends           ErrorCode = "not_friends"            // the users aren't friends
+	ErrNotBlocked           ErrorCode = "not_blocked"            // the user hasn't been blocked
+	ErrServerNotFound       ErrorCode = "server_not_found"       // no server exists with the given id, or the user isn't in it
+	ErrChannelNotFound      ErrorCode = "channel_not_found"      // no channel exists with the given id in the server
+	ErrTooManyChannels      ErrorCode = "too_many_channels"      // the server already has as many channels as it's allowed
+	ErrTooManyOverwrites    ErrorCode = "too_many_overwrites"    // the channel already has as many overwrites as it's allowed
+	ErrRoleNotFound         ErrorCode = "role_not_found"         // no role exists with the given id in the server
+	ErrTooManyRoles         ErrorCode = "too_many_roles"         // the server already has as many roles as it's allowed
+	ErrMemberNotFound       ErrorCode = "member_not_found"       // the user isn't a member of the server
+	ErrTooManyInvites       ErrorCode = "too_many_invites"       // the server already has as many invites as it's allowed
+	ErrVanityTaken          ErrorCode = "vanity_taken"           // another server already uses the vanity code
+	ErrOwnerCannotLeave     ErrorCode = "owner_cannot_leave"     // the owner has to hand the server over first
+	ErrBanned               ErrorCode = "banned"                 // the user is banned from the server
+	ErrTemplateNotFound     ErrorCode = "template_not_found"     // no template exists with the given code, or the server has none
+	ErrTemplateExists       ErrorCode = "template_exists"        // the server already has a template
+	ErrDirectoryBlocked     ErrorCode = "directory_blocked"      // an admin has blocked the server from the directory
+	ErrBanNotFound          ErrorCode = "ban_not_found"          // the user isn't banned from the server
+	ErrUnauthorized         ErrorCode = "unauthorized"           // no (or an invalid) token was supplied
+	ErrForbidden            ErrorCode = "forbidden"              // the user may not perform this action
+	ErrNotFound             ErrorCode = "not_found"              // the route or resource does not exist
+	ErrMethodNotAllowed     ErrorCode = "method_not_allowed"     // the route exists but not with this method
+	ErrInternal             ErrorCode = "internal_error"         // something went wrong on our side
+)
+
+// A single field that failed validation, Field uses the JSON name of the field
+// in the request body so the frontend can highlight the right input
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The body of an error, which is the same for every error the API returns
+type ErrorBody struct {
+	Code      ErrorCode    `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestId string       `json:"requestId,omitempty"`
+}
+
+// The envelope that every error response from the API is wrapped in
+type ErrorResponse struct {
+	Success bool      `json:"success"`
+	Error   ErrorBody `json:"error"`
+}
+
+// Helper function to send a JSON response from the API
+func sendJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Helper function to send error responses from the API, everything should go
+// through here (or sendValidationError) so that the shape is always the same
+func sendError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	sendJSON(w, status, ErrorResponse{
+		Success: false,
+		Error: ErrorBody{
+			Code:      code,
+			Message:   message,
+			RequestId: middleware.GetRequestId(r.Context()),
+		},
+	})
+}
+
+// Send a validation error back to the client with the fields that failed
+func sendValidationError(w http.ResponseWriter, r *http.Request, fields []FieldError) {
+	sendJSON(w, http.StatusBadRequest, ErrorResponse{
+		Success: false,
+		Error: ErrorBody{
+			Code:      ErrValidationFailed,
+			Message:   "One or more fields are invalid",
+			Fields:    fields,
+			RequestId: middleware.GetRequestId(r.Context()),
+		},
+	})
+}
+
+// Used by the router when no route matches the request
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	sendError(w, r, http.StatusNotFound, ErrNotFound, "The requested resource does not exist")
+}
+
+// Used by the router when a route matches but not with the requested method
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	sendError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "This method is not allowed on this resource")
+}
+
+// Used by middleware to report errors, e.g. when a request isn't authenticated
+func MiddlewareError(w http.ResponseWriter, r *http.Request, status int) {
+	switch status {
+	case http.StatusUnauthorized:
+		sendError(w, r, status, ErrUnauthorized, "A valid token is required to access this resource")
+	case http.StatusForbidden:
+		sendError(w, r, status, ErrForbidden, "You do not have permission to access this resource")
+	default:
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+	}
+}
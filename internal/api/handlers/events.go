@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/redis"
+)
+
+// How often we send something down an otherwise quiet event stream, so that
+// proxies don't decide the connection is dead; we also use it to check that
+// the session hasn't been revoked in the meantime
+const eventKeepaliveInterval = 25 * time.Second
+
+// Stream events for the current user as server-sent events, so that every
+// device they're logged in on hears about changes made on any of the others
+func StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Streaming is not supported")
+		return
+	}
+
+	userId := middleware.GetUserId(r.Context())
+	sessionId := middleware.GetSessionId(r.Context())
+
+	sessionManager, err := redis.GetConnection()
+	if err != nil {
+		log.Printf("Error connecting to Redis: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	sub, err := redis.SubscribeUserEvents(r.Context(), userId)
+	if err != nil {
+		log.Printf("Error subscribing to events: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// stop nginx et al. from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// tell the browser how long to wait before reconnecting if we go away
+	fmt.Fprintf(w, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepalive.C:
+			session, err := sessionManager.GetSession(sessionId)
+			if err == nil && session == nil {
+				// logged out (or revoked) while we were connected
+				return
+			}
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
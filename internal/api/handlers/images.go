@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/imaging"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/storage"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// The limits an upload has to fit within for each kind of image
+var imageLimits = map[user.ImageKind]imaging.Limits{
+	user.AvatarImage: {MaxBytes: 8 << 20, MinWidth: 32, MinHeight: 32, MaxWidth: 4096, MaxHeight: 4096},
+	user.BannerImage: {MaxBytes: 10 << 20, MinWidth: 300, MinHeight: 120, MaxWidth: 8192, MaxHeight: 8192},
+}
+
+// The aspect ratio that each kind of image is cropped to
+var imageAspects = map[user.ImageKind][2]int{
+	user.AvatarImage: {1, 1},
+	user.BannerImage: {5, 2},
+}
+
+// Only these prefixes of the blob store are served publicly, anything else
+// in there is none of the internets business
+var publicMediaPrefixes = []string{
+	string(user.AvatarImage) + "/",
+	string(user.BannerImage) + "/",
+	server.IconPrefixRoot,
+}
+
+// Upload a new avatar for the current user
+func UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	uploadImage(w, r, user.AvatarImage)
+}
+
+// Remove the avatar of the current user
+func DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	deleteImage(w, r, user.AvatarImage)
+}
+
+// Upload a new banner for the current user
+func UploadBanner(w http.ResponseWriter, r *http.Request) {
+	uploadImage(w, r, user.BannerImage)
+}
+
+// Remove the banner of the current user
+func DeleteBanner(w http.ResponseWriter, r *http.Request) {
+	deleteImage(w, r, user.BannerImage)
+}
+
+// Take an image uploaded as the "file" field of a multipart form, resize it
+// into every size we serve and save it against the current user
+func uploadImage(w http.ResponseWriter, r *http.Request, kind user.ImageKind) {
+	img := readUploadedImage(w, r, imageLimits[kind])
+	if img == nil {
+		return
+	}
+
+	u := currentUser(w, r)
+	if u == nil {
+		return
+	}
+
+	store, err := storage.Get()
+	if err != nil {
+		log.Printf("Error getting blob store: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	aspect := imageAspects[kind]
+	name := storeImage(w, r, store, img, aspect, kind.Sizes(), func(name string, size user.ImageSize) string {
+		return user.ImageKey(kind, u.Id, name, size)
+	})
+	if name == "" {
+		return
+	}
+
+	previous := u.Avatar
+	if kind == user.BannerImage {
+		previous = u.Banner
+	}
+
+	if err := user.SetImage(r.Context(), u.Id, kind, name); err != nil {
+		log.Printf("Error updating user image: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	removeImage(r, store, kind, u.Id, previous)
+
+	if kind == user.BannerImage {
+		u.Banner = name
+	} else {
+		u.Avatar = name
+	}
+	sendCurrentUser(w, r, u)
+}
+
+// Read the image uploaded as the "file" field of a multipart form, checking
+// it against the limits; sends an error and returns nil if it isn't one we'll
+// accept
+func readUploadedImage(w http.ResponseWriter, r *http.Request, limits imaging.Limits) image.Image {
+	// leave a bit of room for the rest of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBytes+64<<10)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Expected a multipart/form-data body")
+		return nil
+	}
+
+	// stream through the parts rather than parsing the whole form, so the
+	// upload never has to touch the disk
+	var file io.Reader
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		if part.FormName() == "file" {
+			file = part
+			break
+		}
+	}
+	if file == nil {
+		sendValidationError(w, r, []FieldError{{Field: "file", Code: "required", Message: "An image is required"}})
+		return nil
+	}
+
+	img, err := imaging.Decode(file, limits)
+	if err != nil {
+		switch err {
+		case imaging.ErrTooLarge:
+			sendError(w, r, http.StatusRequestEntityTooLarge, ErrImageTooLarge, "The image is too large")
+		case imaging.ErrUnsupportedFormat:
+			sendError(w, r, http.StatusUnsupportedMediaType, ErrUnsupportedImage, err.Error())
+		case imaging.ErrDimensions, imaging.ErrCorrupt:
+			sendError(w, r, http.StatusBadRequest, ErrInvalidImage, err.Error())
+		default:
+			// most likely the body was bigger than MaxBytesReader allowed
+			sendError(w, r, http.StatusRequestEntityTooLarge, ErrImageTooLarge, "The image is too large")
+		}
+		return nil
+	}
+	return img
+}
+
+// Crop an image to the aspect ratio, then resize it into every size and put
+// each one in the blob store under the key it's given. Returns the name of
+// the new image, or sends an error and returns an empty string
+func storeImage(w http.ResponseWriter, r *http.Request, store storage.BlobStore, img image.Image, aspect [2]int, sizes []user.ImageSize, key func(name string, size user.ImageSize) string) string {
+	cropped := imaging.CropToAspect(img, aspect[0], aspect[1])
+
+	// a new name for every upload, so that caches never serve the old image
+	name := strings.ReplaceAll(uuid.New().String(), "-", "")[:16]
+	for _, size := range sizes {
+		data, ext, err := imaging.Encode(imaging.Resize(cropped, size.Width, size.Height))
+		if err != nil {
+			log.Printf("Error encoding image: %v", err)
+			sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+			return ""
+		}
+
+		// every size is the same format, so the first one decides the name
+		if !strings.Contains(name, ".") {
+			name += "." + ext
+		}
+
+		if err := store.Put(r.Context(), key(name, size), bytes.NewReader(data), mime.TypeByExtension("."+ext)); err != nil {
+			log.Printf("Error storing image: %v", err)
+			sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+			return ""
+		}
+	}
+	return name
+}
+
+// Clear an image of the current user
+func deleteImage(w http.ResponseWriter, r *http.Request, kind user.ImageKind) {
+	u := currentUser(w, r)
+	if u == nil {
+		return
+	}
+
+	previous := u.Avatar
+	if kind == user.BannerImage {
+		previous = u.Banner
+	}
+
+	if err := user.SetImage(r.Context(), u.Id, kind, ""); err != nil {
+		log.Printf("Error updating user image: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	if store, err := storage.Get(); err == nil {
+		removeImage(r, store, kind, u.Id, previous)
+	}
+
+	if kind == user.BannerImage {
+		u.Banner = ""
+	} else {
+		u.Avatar = ""
+	}
+	sendCurrentUser(w, r, u)
+}
+
+// Delete every size of an image that is no longer used; if this fails all
+// we've lost is a bit of disk space, so just log it
+func removeImage(r *http.Request, store storage.BlobStore, kind user.ImageKind, userId string, name string) {
+	if name == "" {
+		return
+	}
+	for _, size := range kind.Sizes() {
+		if err := store.Delete(r.Context(), user.ImageKey(kind, userId, name, size)); err != nil {
+			log.Printf("Error deleting old image: %v", err)
+		}
+	}
+}
+
+// Serve the public parts of the blob store, used when the local store is
+// serving the media itself rather than a CDN
+func ServeMedia(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(path.Clean(r.URL.Path), "/media/")
+
+	public := false
+	for _, prefix := range publicMediaPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			public = true
+			break
+		}
+	}
+	if !public {
+		NotFound(w, r)
+		return
+	}
+
+	store, err := storage.Get()
+	if err != nil {
+		NotFound(w, r)
+		return
+	}
+
+	blob, err := store.Open(r.Context(), key)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("Error opening media: %v", err)
+		}
+		NotFound(w, r)
+		return
+	}
+	defer blob.Close()
+
+	// every upload gets a new name, so whatever is here will never change
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(key)))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, blob)
+}
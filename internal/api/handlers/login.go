@@ -1,18 +1,15 @@
 package handlers
 
 import (
-	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/oauthority/voxly-backend/internal/auth"
-	"github.com/oauthority/voxly-backend/internal/database"
 	"github.com/oauthority/voxly-backend/internal/redis"
 	"github.com/oauthority/voxly-backend/internal/user"
-	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Struct for the request body we will send to the API to log
@@ -54,96 +51,97 @@ func (h *LoginHandler) TryLogin(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		sendLoginError(w, http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
 		return
 	}
 
-	if req.Email == "" || req.Password == "" {
-		sendLoginError(w, http.StatusBadRequest)
+	var fields []FieldError
+	if req.Email == "" {
+		fields = append(fields, FieldError{Field: "email", Code: "required", Message: "Email is required"})
+	}
+	if req.Password == "" {
+		fields = append(fields, FieldError{Field: "password", Code: "required", Message: "Password is required"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
 		return
 	}
 
-	collection := database.GetCollection("users")
-
-	user := user.User{}
-
-	err := collection.FindOne(context.Background(), map[string]interface{}{
-		"$or": []map[string]string{
-			{"email": req.Email},
-		},
-	}).Decode(&user)
-
+	u, err := user.GetByEmail(r.Context(), req.Email)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			sendLoginError(w, http.StatusNotFound)
+		if err == user.ErrNotFound {
+			sendError(w, r, http.StatusNotFound, ErrUserNotFound, "No account was found with that email")
 			return
 		}
 
-		sendLoginError(w, http.StatusInternalServerError)
+		log.Printf("Database error when looking up user: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
 	}
 
 	// compare the hashed password in the database with the one we provided in
-	// the response, will return nil on success and an error on error, obviously
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
-
+	// the response, obviously
+	matches, err := u.CheckPassword(req.Password)
 	if err != nil {
-		if err == bcrypt.ErrMismatchedHashAndPassword {
-			sendLoginError(w, http.StatusForbidden)
-			return
-		}
-
 		// the password might be right, but the erorr we got wasn't
 		// to do with the password, something else went wrong
-		sendLoginError(w, http.StatusInternalServerError)
+		log.Printf("Error comparing password hash: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
 		return
 	}
 
-	// Generate a JWT to send back to the frontend, sending an internal error if something
-	// goes wrong
-	token, tokenExpiry, err := h.authManager.GenerateJWT(user.Id)
+	if !matches {
+		sendError(w, r, http.StatusForbidden, ErrInvalidCredentials, "The password provided is incorrect")
+		return
+	}
 
-	if err != nil {
-		sendLoginError(w, http.StatusInternalServerError)
+	// only tell them the account is disabled once they've proven that it's theirs
+	if u.Disabled {
+		sendError(w, r, http.StatusForbidden, ErrAccountDisabled, "This account has been disabled")
 		return
 	}
 
 	redisManager, err := redis.GetConnection()
 	if err != nil {
-		sendLoginError(w, http.StatusInternalServerError)
+		log.Printf("Error getting Redis connection: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
 	}
 
 	sessionId := uuid.New().String()
 	session, err := redisManager.CreateSession(
 		sessionId,
-		user.Id,
+		u.Id,
 		24*time.Hour,
 	)
 
 	if err != nil {
-		sendLoginError(w, http.StatusInternalServerError)
+		log.Printf("Error creating session: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	// Generate a JWT to send back to the frontend, tied to the session so that
+	// revoking the session revokes the token too, sending an internal error if something
+	// goes wrong
+	token, tokenExpiry, err := h.authManager.GenerateJWT(u.Id, sessionId)
+
+	if err != nil {
+		log.Printf("Error generating JWT: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
 	}
 
 	// send a bogus response for now since we will need to create a session in
 	// redis or something like that for persistence et al.
 	response := LoginResponse{
 		Success:     true,
-		Id:          user.Id,
+		Id:          u.Id,
 		SessionId:   sessionId,
 		Token:       token,
 		ExpiresAt:   session.ExpiresAt.Unix(),
 		TokenExpiry: tokenExpiry.Unix(),
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
-}
-
-// Handler to send a response for an error
-func sendLoginError(w http.ResponseWriter, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(LoginResponse{
-		Success: false,
-	})
+	sendJSON(w, http.StatusOK, response)
 }
@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+const (
+	defaultMembersLimit = 25
+	maxMembersLimit     = 100
+)
+
+// A member of a server along with who they are
+type MemberResponse struct {
+	User      user.PublicUser `json:"user"`
+	Nickname  string          `json:"nickname"`
+	Roles     []string        `json:"roles"`
+	JoinedAt  time.Time       `json:"joinedAt"`
+	Temporary bool            `json:"temporary"`
+}
+
+// A page of the members of a server
+type MemberListResponse struct {
+	Members []MemberResponse `json:"members"`
+	Total   int              `json:"total"`
+	// the offset to ask for to get the next page, null if this is the last
+	// one
+	NextOffset *int `json:"nextOffset"`
+}
+
+// The body of a request to change a member
+type UpdateMemberRequest struct {
+	// an empty nickname goes back to the username
+	Nickname *string `json:"nickname"`
+}
+
+// A ban along with who was banned
+type BanResponse struct {
+	server.Ban
+	User *user.PublicUser `json:"user"` // null if the account has since been deleted
+}
+
+// A page of the bans of a server
+type BanListResponse struct {
+	Bans       []BanResponse `json:"bans"`
+	Total      int           `json:"total"`
+	NextOffset *int          `json:"nextOffset"`
+}
+
+// The body of a request to ban somebody
+type BanRequest struct {
+	Reason string `json:"reason"`
+	// how many seconds back to delete the user's messages from, up to a week
+	DeleteMessageSeconds int `json:"deleteMessageSeconds"`
+}
+
+// Send the error for one of the member and ban errors from the server
+// package, falling back to sendServerError for everything else
+func sendMemberError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case server.ErrNotMember:
+		sendError(w, r, http.StatusNotFound, ErrMemberNotFound, "That user isn't a member of the server")
+	case server.ErrOwnerCannotLeave:
+		sendError(w, r, http.StatusConflict, ErrOwnerCannotLeave, "The owner has to hand the server over before leaving it")
+	case server.ErrBanNotFound:
+		sendError(w, r, http.StatusNotFound, ErrBanNotFound, "That user isn't banned from the server")
+	default:
+		sendServerError(w, r, err)
+	}
+}
+
+// Get the limit and offset query parameters for a page of members or bans,
+// sending a validation error if they're no good
+func pageQuery(w http.ResponseWriter, r *http.Request) (limit int, offset int, ok bool) {
+	var fields []FieldError
+	limit, valid := queryInt(r, "limit", defaultMembersLimit)
+	if !valid || limit < 1 || limit > maxMembersLimit {
+		fields = append(fields, FieldError{Field: "limit", Code: "invalid", Message: "Limit must be between 1 and 100"})
+	}
+	offset, valid = queryInt(r, "offset", 0)
+	if !valid {
+		fields = append(fields, FieldError{Field: "offset", Code: "invalid", Message: "Offset must be a positive number"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
+
+// The user in the {userId} path variable, where @me is the current user
+func pathUserId(r *http.Request) string {
+	id := mux.Vars(r)["userId"]
+	if id == "@me" {
+		return middleware.GetUserId(r.Context())
+	}
+	return id
+}
+
+// Look up the users behind a list of ids, keyed by id; any that have been
+// deleted since are left out
+func publicUsers(r *http.Request, ids []string) (map[string]*user.PublicUser, error) {
+	found, err := user.GetByIds(r.Context(), ids)
+	if err != nil {
+		return nil, err
+	}
+
+	viewerId := middleware.GetUserId(r.Context())
+	publics := map[string]*user.PublicUser{}
+	list := make([]*user.PublicUser, 0, len(found))
+	for id, u := range found {
+		public := u.Public(id == viewerId)
+		publics[id] = &public
+		list = append(list, &public)
+	}
+	attachPresence(r, list...)
+	return publics, nil
+}
+
+// Check that the current user can act on another member of the server, which
+// needs the given permissions and a higher role than theirs. The owner can't
+// be acted on by anyone
+func outranksMember(w http.ResponseWriter, r *http.Request, s *server.Server, access *server.Access, userId string, perms server.Permissions) bool {
+	if !access.Has(perms) {
+		sendMissingPermissions(w, r, perms)
+		return false
+	}
+	target, err := server.GetAccess(r.Context(), s, userId)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return false
+	}
+	if !access.Outranks(target) {
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "You can only do that to members below your highest role")
+		return false
+	}
+	return true
+}
+
+// List the members of a server in the order they joined, a page at a time
+func ListMembers(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	s, _ := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	page, err := server.ListMembers(r.Context(), s.Id, limit, offset)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+
+	ids := make([]string, len(page.Members))
+	for i, member := range page.Members {
+		ids[i] = member.UserId
+	}
+	users, err := publicUsers(r, ids)
+	if err != nil {
+		log.Printf("Error looking up members: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	response := MemberListResponse{Members: []MemberResponse{}, Total: page.Total}
+	for _, member := range page.Members {
+		if u, ok := users[member.UserId]; ok {
+			response.Members = append(response.Members, memberResponse(&member, u))
+		}
+	}
+	if next := offset + limit; next < page.Total {
+		response.NextOffset = &next
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+func memberResponse(member *server.Member, u *user.PublicUser) MemberResponse {
+	return MemberResponse{
+		User:      *u,
+		Nickname:  member.Nickname,
+		Roles:     member.Roles,
+		JoinedAt:  member.JoinedAt,
+		Temporary: member.Temporary,
+	}
+}
+
+// Get a single member of a server
+func GetMember(w http.ResponseWriter, r *http.Request) {
+	s, _ := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	sendMember(w, r, s.Id, pathUserId(r))
+}
+
+func sendMember(w http.ResponseWriter, r *http.Request, serverId string, userId string) {
+	member, err := server.GetMember(r.Context(), serverId, userId)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+	users, err := publicUsers(r, []string{userId})
+	if err != nil {
+		log.Printf("Error looking up member: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+	u, ok := users[userId]
+	if !ok {
+		sendMemberError(w, r, server.ErrNotMember)
+		return
+	}
+	sendJSON(w, http.StatusOK, memberResponse(member, u))
+}
+
+// Change a member's nickname. Changing your own needs the change nickname
+// permission, changing anyone else's needs manage nicknames and a higher
+// role than theirs
+func UpdateMember(w http.ResponseWriter, r *http.Request) {
+	var req UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	var nickname string
+	if req.Nickname != nil {
+		var err error
+		if nickname, err = server.NormalizeNickname(*req.Nickname); err != nil {
+			sendValidationError(w, r, []FieldError{{Field: "nickname", Code: "invalid", Message: err.Error()}})
+			return
+		}
+	}
+
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	userId := pathUserId(r)
+	if userId == access.UserId {
+		if req.Nickname != nil && !access.Has(server.PermChangeNickname) {
+			sendMissingPermissions(w, r, server.PermChangeNickname)
+			return
+		}
+	} else if !outranksMember(w, r, s, access, userId, server.PermManageNicknames) {
+		return
+	}
+
+	member, err := server.GetMember(r.Context(), s.Id, userId)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+	if req.Nickname != nil {
+		before := member.AuditFields()
+		if err := member.SetNickname(r.Context(), nickname); err != nil {
+			sendMemberError(w, r, err)
+			return
+		}
+		recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditMemberUpdate, TargetType: server.AuditTargetUser, TargetId: userId}, before, member.AuditFields())
+	}
+	sendMember(w, r, s.Id, userId)
+}
+
+// Remove a member from a server. Removing yourself (or @me) leaves the
+// server, which anyone but the owner can do; removing somebody else kicks
+// them, which needs the kick members permission and a higher role than theirs
+func RemoveMember(w http.ResponseWriter, r *http.Request) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	userId := pathUserId(r)
+	var err error
+	if userId == access.UserId {
+		err = server.Leave(r.Context(), s, userId)
+	} else {
+		if !outranksMember(w, r, s, access, userId, server.PermKickMembers) {
+			return
+		}
+		if err = server.Kick(r.Context(), s, userId); err == nil {
+			recordAudit(r, s.Id, server.AuditEntry{Action: server.AuditMemberKick, TargetType: server.AuditTargetUser, TargetId: userId})
+		}
+	}
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// List the people banned from a server, newest first; this needs the ban
+// members permission
+func ListBans(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	s, _ := permittedServer(w, r, server.PermBanMembers)
+	if s == nil {
+		return
+	}
+
+	page, err := server.ListBans(r.Context(), s.Id, limit, offset)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+
+	ids := make([]string, len(page.Bans))
+	for i, ban := range page.Bans {
+		ids[i] = ban.UserId
+	}
+	users, err := publicUsers(r, ids)
+	if err != nil {
+		log.Printf("Error looking up banned users: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	response := BanListResponse{Bans: make([]BanResponse, len(page.Bans)), Total: page.Total}
+	for i, ban := range page.Bans {
+		response.Bans[i] = BanResponse{Ban: ban, User: users[ban.UserId]}
+	}
+	if next := offset + limit; next < page.Total {
+		response.NextOffset = &next
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Get the ban of a single user; this needs the ban members permission
+func GetBan(w http.ResponseWriter, r *http.Request) {
+	s, _ := permittedServer(w, r, server.PermBanMembers)
+	if s == nil {
+		return
+	}
+	sendBan(w, r, s.Id, mux.Vars(r)["userId"])
+}
+
+func sendBan(w http.ResponseWriter, r *http.Request, serverId string, userId string) {
+	ban, err := server.GetBan(r.Context(), serverId, userId)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+	users, err := publicUsers(r, []string{userId})
+	if err != nil {
+		log.Printf("Error looking up banned user: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+	sendJSON(w, http.StatusOK, BanResponse{Ban: *ban, User: users[userId]})
+}
+
+// Ban somebody from a server, whether or not they're in it, which kicks them
+// if they are. This needs the ban members permission and, if they're a
+// member, a higher role than theirs
+func BanMember(w http.ResponseWriter, r *http.Request) {
+	var req BanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	// the reason can come from the body or, like anything else that ends up
+	// in the audit log, the reason header
+	if req.Reason == "" {
+		req.Reason = auditReason(r)
+	}
+	var fields []FieldError
+	reason, err := server.NormalizeReason(req.Reason)
+	if err != nil {
+		fields = append(fields, FieldError{Field: "reason", Code: "invalid", Message: err.Error()})
+	}
+	// checked as a number of seconds before it becomes a Duration, big
+	// enough numbers would overflow into something that looks fine
+	if req.DeleteMessageSeconds < 0 || req.DeleteMessageSeconds > int(server.MaxBanMessageDeletion/time.Second) {
+		fields = append(fields, FieldError{Field: "deleteMessageSeconds", Code: "invalid", Message: "Messages can be deleted from at most 7 days back"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+	deleteMessages := time.Duration(req.DeleteMessageSeconds) * time.Second
+
+	s, access := permittedServer(w, r, server.PermBanMembers)
+	if s == nil {
+		return
+	}
+	userId := mux.Vars(r)["userId"]
+	if userId == access.UserId {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "You cannot ban yourself")
+		return
+	}
+
+	target, err := user.GetById(r.Context(), userId)
+	if err == user.ErrNotFound {
+		sendError(w, r, http.StatusNotFound, ErrUserNotFound, "No user exists with that id")
+		return
+	}
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+
+	member, err := server.IsMember(r.Context(), s.Id, target.Id)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+	if member && !outranksMember(w, r, s, access, target.Id, server.PermBanMembers) {
+		return
+	}
+
+	ban, err := server.BanUser(r.Context(), s, target.Id, access.UserId, reason, deleteMessages)
+	if err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+	recordAudit(r, s.Id, server.AuditEntry{Action: server.AuditMemberBan, TargetType: server.AuditTargetUser, TargetId: target.Id, Reason: ban.Reason})
+	sendBan(w, r, s.Id, target.Id)
+}
+
+// Lift a ban; this needs the ban members permission
+func UnbanMember(w http.ResponseWriter, r *http.Request) {
+	s, _ := permittedServer(w, r, server.PermBanMembers)
+	if s == nil {
+		return
+	}
+
+	userId := mux.Vars(r)["userId"]
+	if err := server.Unban(r.Context(), s.Id, userId); err != nil {
+		sendMemberError(w, r, err)
+		return
+	}
+	recordAudit(r, s.Id, server.AuditEntry{Action: server.AuditMemberUnban, TargetType: server.AuditTargetUser, TargetId: userId})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Anything outside of 0 to 7 days is turned away before the server is even
+// looked up, including numbers that would overflow a Duration into a small
+// one (18446744074 seconds is just over 2^64 nanoseconds)
+func TestBanMemberValidatesDeleteMessageSeconds(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"negative", `{"deleteMessageSeconds": -1}`},
+		{"a second over 7 days", `{"deleteMessageSeconds": 604801}`},
+		{"wraps around to under a second", `{"deleteMessageSeconds": 18446744074}`},
+		{"wraps around to negative", `{"deleteMessageSeconds": 9223372037}`},
+		{"the largest int", `{"deleteMessageSeconds": 9223372036854775807}`},
+		{"not a whole number", `{"deleteMessageSeconds": 1.5}`},
+		{"too big for an int", `{"deleteMessageSeconds": 1e30}`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(test.body))
+		BanMember(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
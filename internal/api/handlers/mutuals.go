@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+const (
+	defaultMutualsLimit = 25
+	maxMutualsLimit     = 100
+)
+
+// What the current user has in common with somebody else
+type MutualsResponse struct {
+	Friends      []user.PublicUser `json:"friends"`
+	TotalFriends int               `json:"totalFriends"`
+	// the offset to ask for to get the next page of friends, null if this is
+	// the last one
+	NextOffset *int `json:"nextOffset"`
+	// every server both users are in, ordered by id
+	Servers []server.PublicServer `json:"servers"`
+}
+
+// Get the friends (and servers) that the current user has in common with
+// another user, for showing on their profile
+func GetMutuals(w http.ResponseWriter, r *http.Request) {
+	var fields []FieldError
+	limit, ok := queryInt(r, "limit", defaultMutualsLimit)
+	if !ok || limit < 1 || limit > maxMutualsLimit {
+		fields = append(fields, FieldError{Field: "limit", Code: "invalid", Message: "Limit must be between 1 and 100"})
+	}
+	offset, ok := queryInt(r, "offset", 0)
+	if !ok {
+		fields = append(fields, FieldError{Field: "offset", Code: "invalid", Message: "Offset must be a positive number"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	target := targetUser(w, r)
+	if target == nil {
+		return
+	}
+
+	// you have nothing in common with yourself, and blocks hide everything,
+	// which GetMutualFriends works out for servers too
+	viewerId := middleware.GetUserId(r.Context())
+	mutuals, err := user.GetMutualFriends(r.Context(), viewerId, target.Id, limit, offset)
+	if err != nil {
+		log.Printf("Error finding mutual friends: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	response := MutualsResponse{
+		Friends:      make([]user.PublicUser, len(mutuals.Users)),
+		TotalFriends: mutuals.Total,
+		Servers:      []server.PublicServer{},
+	}
+
+	if !mutuals.Hidden {
+		servers, err := server.GetMutualServers(r.Context(), viewerId, target.Id)
+		if err != nil {
+			log.Printf("Error finding mutual servers: %v", err)
+			sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+			return
+		}
+		for i := range servers {
+			response.Servers = append(response.Servers, servers[i].Public())
+		}
+	}
+
+	publics := make([]*user.PublicUser, len(mutuals.Users))
+	for i, u := range mutuals.Users {
+		// they're the viewer's friends by definition
+		response.Friends[i] = u.Public(false)
+		response.Friends[i].Relationship = user.Friend
+		publics[i] = &response.Friends[i]
+	}
+	attachPresence(r, publics...)
+
+	if next := offset + limit; next < mutuals.Total {
+		response.NextOffset = &next
+	}
+
+	sendJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/redis"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// The longest custom status we'll accept
+const maxCustomStatusLength = 128
+
+// The furthest ahead a custom status can be set to expire; anything longer
+// than this should just not expire at all
+const maxCustomStatusExpiry = 365 * 24 * time.Hour
+
+// The body of a heartbeat, sent by every client every HeartbeatInterval
+type HeartbeatRequest struct {
+	Status redis.PresenceStatus `json:"status"`
+}
+
+// What we send back for a heartbeat, including when the next one is due so
+// that we can change the interval without having to update every client
+type HeartbeatResponse struct {
+	Presence          redis.Presence `json:"presence"`
+	HeartbeatInterval int            `json:"heartbeatInterval"` // in seconds
+}
+
+// The body of a request to set a custom status; give either an absolute
+// expiry or a number of seconds from now, or neither to keep it until cleared
+type CustomStatusRequest struct {
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	ExpiresIn *int       `json:"expiresIn"`
+}
+
+// Fill in the presence of each of the given users, as the current user is
+// allowed to see it. Presence is nice to have, so if Redis is having a bad
+// day everyone just shows as offline rather than the whole request failing
+func attachPresence(r *http.Request, users ...*user.PublicUser) {
+	presenceManager, err := redis.GetPresenceManager()
+	if err != nil {
+		return
+	}
+
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.Id)
+	}
+
+	presences, err := presenceManager.GetPresences(ids)
+	if err != nil {
+		log.Printf("Error getting presences: %v", err)
+		return
+	}
+
+	viewerId := middleware.GetUserId(r.Context())
+	for _, u := range users {
+		if presence, ok := presences[u.Id]; ok {
+			u.SetPresence(*presence, u.Id == viewerId)
+		}
+	}
+}
+
+// Get the presence manager, sending an error if we can't; the caller should
+// bail out if this returns nil
+func presenceManager(w http.ResponseWriter, r *http.Request) *redis.PresenceManager {
+	presenceManager, err := redis.GetPresenceManager()
+	if err != nil {
+		log.Printf("Error getting presence manager: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return nil
+	}
+	return presenceManager
+}
+
+// Record a heartbeat from the current device; every session counts as its
+// own device, so being online on your phone and idle on your desktop works
+func Heartbeat(w http.ResponseWriter, r *http.Request) {
+	var req HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	if req.Status == "" {
+		req.Status = redis.StatusOnline
+	}
+	if !req.Status.Valid() {
+		sendValidationError(w, r, []FieldError{{Field: "status", Code: "invalid", Message: "Status must be one of online, idle, dnd or invisible"}})
+		return
+	}
+
+	pm := presenceManager(w, r)
+	if pm == nil {
+		return
+	}
+
+	presence, err := pm.Heartbeat(middleware.GetUserId(r.Context()), middleware.GetSessionId(r.Context()), req.Status)
+	if err != nil {
+		log.Printf("Error recording heartbeat: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, HeartbeatResponse{
+		Presence:          *presence,
+		HeartbeatInterval: int(redis.HeartbeatInterval.Seconds()),
+	})
+}
+
+// Mark the current device as gone straight away, e.g. when the app is closed
+func Disconnect(w http.ResponseWriter, r *http.Request) {
+	pm := presenceManager(w, r)
+	if pm == nil {
+		return
+	}
+
+	if err := pm.Disconnect(middleware.GetUserId(r.Context()), middleware.GetSessionId(r.Context())); err != nil {
+		log.Printf("Error disconnecting device: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Set the custom status of the current user
+func SetCustomStatus(w http.ResponseWriter, r *http.Request) {
+	var req CustomStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	req.Text = strings.TrimSpace(req.Text)
+
+	var fields []FieldError
+	if req.Text == "" {
+		fields = append(fields, FieldError{Field: "text", Code: "required", Message: "Text is required"})
+	} else if utf8.RuneCountInString(req.Text) > maxCustomStatusLength {
+		fields = append(fields, FieldError{Field: "text", Code: "invalid", Message: "Text must be at most 128 characters"})
+	}
+
+	now := time.Now()
+	expiresAt := req.ExpiresAt
+	switch {
+	case req.ExpiresAt != nil && req.ExpiresIn != nil:
+		fields = append(fields, FieldError{Field: "expiresIn", Code: "invalid", Message: "Only one of expiresAt and expiresIn can be given"})
+	case req.ExpiresIn != nil:
+		// checked as a number of seconds before it becomes a Duration, which
+		// would overflow for anything much over 292 years
+		if *req.ExpiresIn <= 0 || *req.ExpiresIn > int(maxCustomStatusExpiry/time.Second) {
+			fields = append(fields, FieldError{Field: "expiresIn", Code: "invalid", Message: "expiresIn must be between 1 second and 1 year"})
+		} else {
+			expiry := now.Add(time.Duration(*req.ExpiresIn) * time.Second).UTC()
+			expiresAt = &expiry
+		}
+	case req.ExpiresAt != nil:
+		if !req.ExpiresAt.After(now) || req.ExpiresAt.After(now.Add(maxCustomStatusExpiry)) {
+			fields = append(fields, FieldError{Field: "expiresAt", Code: "invalid", Message: "expiresAt must be in the future and at most 1 year away"})
+		}
+	}
+
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	pm := presenceManager(w, r)
+	if pm == nil {
+		return
+	}
+
+	custom, err := pm.SetCustomStatus(middleware.GetUserId(r.Context()), req.Text, expiresAt)
+	if err != nil {
+		log.Printf("Error setting custom status: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, custom)
+}
+
+// Clear the custom status of the current user
+func ClearCustomStatus(w http.ResponseWriter, r *http.Request) {
+	pm := presenceManager(w, r)
+	if pm == nil {
+		return
+	}
+
+	if err := pm.ClearCustomStatus(middleware.GetUserId(r.Context())); err != nil {
+		log.Printf("Error clearing custom status: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
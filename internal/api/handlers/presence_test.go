@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetCustomStatusValidatesExpiry(t *testing.T) {
+	// without Redis a valid request fails with a 500, and logs about it
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	soon := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"no expiry", `{"text": "hi"}`, http.StatusInternalServerError},
+		{"expiresIn", `{"text": "hi", "expiresIn": 3600}`, http.StatusInternalServerError},
+		{"expiresIn of a year", `{"text": "hi", "expiresIn": 31536000}`, http.StatusInternalServerError},
+		{"expiresAt", `{"text": "hi", "expiresAt": "` + soon + `"}`, http.StatusInternalServerError},
+		{"both", `{"text": "hi", "expiresAt": "` + soon + `", "expiresIn": 3600}`, http.StatusBadRequest},
+		{"expiresIn of zero", `{"text": "hi", "expiresIn": 0}`, http.StatusBadRequest},
+		{"negative expiresIn", `{"text": "hi", "expiresIn": -1}`, http.StatusBadRequest},
+		{"expiresIn over a year", `{"text": "hi", "expiresIn": 31536001}`, http.StatusBadRequest},
+		{"expiresIn that would overflow a Duration", `{"text": "hi", "expiresIn": 9223372036854775807}`, http.StatusBadRequest},
+		{"expiresAt in the past", `{"text": "hi", "expiresAt": "2000-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"expiresAt over a year away", `{"text": "hi", "expiresAt": "9999-01-01T00:00:00Z"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(test.body))
+		SetCustomStatus(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
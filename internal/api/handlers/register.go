@@ -3,14 +3,13 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"github.com/google/uuid"
-	"github.com/oauthority/voxly-backend/internal/database"
-	"github.com/oauthority/voxly-backend/internal/user"
-	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
-	"time"
+
+	"github.com/oauthority/voxly-backend/internal/redis"
+	"github.com/oauthority/voxly-backend/internal/registration"
+	"github.com/oauthority/voxly-backend/internal/user"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // The structure of the request we will post to the API to create
@@ -19,6 +18,27 @@ type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Email    string `json:"email"`
+
+	// only needed when registration is invite only
+	InviteCode string `json:"inviteCode"`
+
+	// the solution to a challenge from /register/challenge, unless the
+	// challenge has been turned off
+	Challenge *ChallengeSolution `json:"challenge"`
+}
+
+// A solution to a proof of work challenge
+type ChallengeSolution struct {
+	Id       string `json:"id"`
+	Solution string `json:"solution"`
+}
+
+// A proof of work challenge for the client to solve before registering: find
+// a solution such that sha256(prefix + solution) starts with at least
+// difficulty zero bits
+type ChallengeResponse struct {
+	redis.Challenge
+	Algorithm string `json:"algorithm"`
 }
 
 // The response that we will return based on the
@@ -29,76 +49,172 @@ type RegisterResponse struct {
 	UserId  string `json:"userId,omitempty"`
 }
 
-func TryRegister(w http.ResponseWriter, r *http.Request) {
+// Tells clients whether they need to ask for an invite code, or whether to
+// bother showing a sign up form at all
+type RegistrationInfoResponse struct {
+	Mode              registration.Mode `json:"mode"`
+	ChallengeRequired bool              `json:"challengeRequired"`
+}
+
+// Registration depends on who we're letting in, and how much work we make
+// them do to prove they aren't a script
+type RegisterHandler struct {
+	mode      registration.Mode
+	challenge registration.ChallengePolicy
+}
+
+func NewRegisterHandler(mode registration.Mode, challenge registration.ChallengePolicy) *RegisterHandler {
+	return &RegisterHandler{mode: mode, challenge: challenge}
+}
+
+// Get the registration mode, so that the client knows what to show
+func (h *RegisterHandler) GetRegistrationInfo(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, RegistrationInfoResponse{
+		Mode:              h.mode,
+		ChallengeRequired: h.challenge.Enabled(),
+	})
+}
+
+// Hand out a proof of work challenge to solve before registering
+func (h *RegisterHandler) GetChallenge(w http.ResponseWriter, r *http.Request) {
+	if h.mode == registration.ModeClosed {
+		sendError(w, r, http.StatusForbidden, ErrRegistrationClosed, "Registration is closed")
+		return
+	}
+	if !h.challenge.Enabled() {
+		sendError(w, r, http.StatusNotFound, ErrNotFound, "Registration doesn't need a challenge")
+		return
+	}
+
+	challenge, err := registration.IssueChallenge(h.challenge)
+	if err != nil {
+		log.Printf("Error issuing registration challenge: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	sendJSON(w, http.StatusCreated, ChallengeResponse{Challenge: *challenge, Algorithm: "sha256"})
+}
+
+func (h *RegisterHandler) TryRegister(w http.ResponseWriter, r *http.Request) {
+	// accounts can still be made with the admin commands, just not here
+	if h.mode == registration.ModeClosed {
+		sendError(w, r, http.StatusForbidden, ErrRegistrationClosed, "Registration is closed")
+		return
+	}
+
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
 		return
 	}
 
 	// either the username, password, or email was not provided, we can't do much
 	// so just bail out
-	if req.Username == "" || req.Password == "" || req.Email == "" {
-		sendErrorResponse(w, "Username, password, and email are required", http.StatusBadRequest)
+	var fields []FieldError
+	if req.Username == "" {
+		fields = append(fields, FieldError{Field: "username", Code: "required", Message: "Username is required"})
+	} else if err := user.ValidateUsername(req.Username); err != nil {
+		fields = append(fields, FieldError{Field: "username", Code: "invalid", Message: err.Error()})
+	}
+	if req.Password == "" {
+		fields = append(fields, FieldError{Field: "password", Code: "required", Message: "Password is required"})
+	}
+	if req.Email == "" {
+		fields = append(fields, FieldError{Field: "email", Code: "required", Message: "Email is required"})
+	}
+	if h.mode == registration.ModeInvite && registration.NormalizeCode(req.InviteCode) == "" {
+		fields = append(fields, FieldError{Field: "inviteCode", Code: "required", Message: "An invite code is required"})
+	}
+	if h.challenge.Enabled() && req.Challenge == nil {
+		fields = append(fields, FieldError{Field: "challenge", Code: "required", Message: "A solved challenge is required"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
 		return
 	}
 
-	collection := database.GetCollection("users")
-
-	// check if there is already a user by that username and email
-	existingUser := user.User{}
-	err := collection.FindOne(context.Background(), map[string]interface{}{
-		"$or": []map[string]string{
-			{"username": req.Username},
-			{"email": req.Email},
-		},
-	}).Decode(&existingUser)
-
-	if err != mongo.ErrNoDocuments {
-		// there was no error, which indicates that the user was found
-		// which is a bit oxymoronic
-		if err == nil {
-			sendErrorResponse(w, "An exisiting account was found with the provided details. Cannot register", http.StatusConflict)
+	// check the proof of work before we go anywhere near the database, that's
+	// the whole point of it. The challenge is used up either way, so anything
+	// that fails from here on needs a new one
+	if h.challenge.Enabled() {
+		err := registration.VerifyChallenge(req.Challenge.Id, req.Challenge.Solution)
+		if err == registration.ErrChallengeFailed {
+			sendError(w, r, http.StatusForbidden, ErrChallengeFailed, "The challenge is invalid, has expired or was not solved")
+			return
+		}
+		if err != nil {
+			log.Printf("Error verifying registration challenge: %v", err)
+			sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
 			return
 		}
+	}
 
+	// check if there is already a user by that username and email
+	exists, err := user.Exists(r.Context(), req.Username, req.Email)
+	if err != nil {
 		// some other database error occured during the lookup
 		// return an error
-		// @TODO: log what exactly the error was, obviously
 		log.Printf("Database error when checking for existing user: %v", err)
-		sendErrorResponse(w, "A database error occured, please try again later.", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	if exists {
+		sendError(w, r, http.StatusConflict, ErrAccountExists, "An exisiting account was found with the provided details. Cannot register")
 		return
 	}
 
-	// try and hash the password with bcrypt's default cost before
-	// saving it to the database
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	// reserved names and names that were only just given up are off limits too
+	if err := user.CheckUsernameAvailable(r.Context(), req.Username, ""); err != nil {
+		if err == user.ErrUsernameTaken {
+			sendError(w, r, http.StatusConflict, ErrAccountExists, "An exisiting account was found with the provided details. Cannot register")
+			return
+		}
+		sendUsernameError(w, r, err)
+		return
+	}
+
+	// this hashes the password before we save it to the database
+	newUser, err := user.New(req.Username, req.Email, req.Password)
 	if err != nil {
-		// some database error occured, don't let everyone know that it was when we tried to hash the password
+		// don't let everyone know that it was when we tried to hash the password
 		// for safety reasons, ig.
-		log.Printf("Error hashing password: %v", err)
-		sendErrorResponse(w, "Internal server error. Please try again later", http.StatusInternalServerError)
+		log.Printf("Error creating new user: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
 	}
 
-	// use a British date format for the registration date, because
-	// American dates are dumb
-	registrationDate := time.Now().UTC().Format("02/01/2006 15:04:05")
-
-	newUser := user.User{
-		Id:               uuid.New().String(),
-		Username:         req.Username,
-		Password:         string(hashedPassword),
-		Email:            req.Email,
-		Bot:              false,
-		Online:           false,
-		RegistrationDate: registrationDate,
-		Relationship:     user.Relationship{Type: user.None},
+	// use up the invite as late as we can, so that it isn't wasted on a
+	// registration that was going to fail anyway
+	if h.mode == registration.ModeInvite {
+		invite, err := registration.Redeem(r.Context(), req.InviteCode)
+		if err == registration.ErrInviteInvalid {
+			sendError(w, r, http.StatusForbidden, ErrInviteInvalid, "That invite code is invalid, has expired or has already been used")
+			return
+		}
+		if err != nil {
+			log.Printf("Error redeeming invite: %v", err)
+			sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+			return
+		}
+		newUser.InviteCode = invite.Code
 	}
 
-	_, err = collection.InsertOne(context.Background(), newUser)
-	if err != nil {
+	if err := user.Insert(r.Context(), newUser); err != nil {
+		if newUser.InviteCode != "" {
+			// don't leave it up to a cancelled request to give the use back
+			if err := registration.Release(context.WithoutCancel(r.Context()), newUser.InviteCode); err != nil {
+				log.Printf("Error releasing invite %s: %v", newUser.InviteCode, err)
+			}
+		}
+		// somebody else got the username or email in between our check and now
+		if mongo.IsDuplicateKeyError(err) {
+			sendError(w, r, http.StatusConflict, ErrAccountExists, "An exisiting account was found with the provided details. Cannot register")
+			return
+		}
 		log.Printf("Error inserting new user: %v", err)
-		sendErrorResponse(w, "Internal server error. Please try again later", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
 		return
 	}
 
@@ -114,17 +230,5 @@ func TryRegister(w http.ResponseWriter, r *http.Request) {
 		UserId:  newUser.Id,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
-}
-
-// Helper function to send error responses from the API
-func sendErrorResponse(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(RegisterResponse{
-		Success: false,
-		Message: message,
-	})
+	sendJSON(w, http.StatusCreated, response)
 }
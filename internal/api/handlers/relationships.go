@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// A relationship as it is sent to the client, along with the other user so
+// that the client doesn't have to go and fetch every one of them
+type RelationshipResponse struct {
+	Id    string                `json:"id"`
+	Type  user.RelationshipType `json:"type"`
+	Since time.Time             `json:"since"`
+	User  user.PublicUser       `json:"user"`
+}
+
+// Send the error for one of the relationship errors from the user package
+func sendRelationshipError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case user.ErrSelfRelationship:
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRelationship, "You cannot do that to yourself")
+	case user.ErrBlocked:
+		// don't let on which one of them did the blocking
+		sendError(w, r, http.StatusForbidden, ErrRelationshipBlocked, "You cannot send a friend request to this user")
+	case user.ErrAlreadyFriends:
+		sendError(w, r, http.StatusConflict, ErrAlreadyFriends, "You are already friends with this user")
+	case user.ErrRequestExists:
+		sendError(w, r, http.StatusConflict, ErrFriendRequestExists, "You have already sent this user a friend request")
+	case user.ErrNoFriendRequest:
+		sendError(w, r, http.StatusNotFound, ErrNoFriendRequest, "There is no pending friend request with this user")
+	case user.ErrNotFriends:
+		sendError(w, r, http.StatusNotFound, ErrNotFriends, "You are not friends with this user")
+	case user.ErrNotBlocked:
+		sendError(w, r, http.StatusNotFound, ErrNotBlocked, "You have not blocked this user")
+	default:
+		log.Printf("Error updating relationship: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+	}
+}
+
+// Get the user in the {id} path variable, sending a 404 if they don't exist;
+// the caller should bail out if this returns nil
+func targetUser(w http.ResponseWriter, r *http.Request) *user.User {
+	u, err := user.GetById(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		if err == user.ErrNotFound {
+			sendError(w, r, http.StatusNotFound, ErrUserNotFound, "No user exists with that id")
+			return nil
+		}
+
+		log.Printf("Database error when looking up user: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return nil
+	}
+	return u
+}
+
+// Send back the relationship the current user now has with the target
+func sendRelationship(w http.ResponseWriter, r *http.Request, status int, target *user.User, relationshipType user.RelationshipType) {
+	public := target.Public(false)
+	public.Relationship = relationshipType
+	attachPresence(r, &public)
+
+	sendJSON(w, status, RelationshipResponse{
+		Id:    target.Id,
+		Type:  relationshipType,
+		Since: time.Now().UTC(),
+		User:  public,
+	})
+}
+
+// List every relationship the current user has
+func ListRelationships(w http.ResponseWriter, r *http.Request) {
+	userId := middleware.GetUserId(r.Context())
+
+	records, err := user.ListRelationships(r.Context(), userId)
+	if err != nil {
+		log.Printf("Error listing relationships: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	ids := make([]string, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record.TargetId)
+	}
+
+	users, err := user.GetByIds(r.Context(), ids)
+	if err != nil {
+		log.Printf("Error looking up related users: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	response := []RelationshipResponse{}
+	for _, record := range records {
+		target, ok := users[record.TargetId]
+		if !ok {
+			continue
+		}
+
+		public := target.Public(false)
+		public.Relationship = record.Type
+		response = append(response, RelationshipResponse{
+			Id:    record.TargetId,
+			Type:  record.Type,
+			Since: record.Since,
+			User:  public,
+		})
+	}
+
+	publics := make([]*user.PublicUser, len(response))
+	for i := range response {
+		publics[i] = &response[i].User
+	}
+	attachPresence(r, publics...)
+
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Send a friend request to a user, or accept theirs if they've already sent one
+func SendFriendRequest(w http.ResponseWriter, r *http.Request) {
+	target := targetUser(w, r)
+	if target == nil {
+		return
+	}
+
+	relationshipType, err := user.SendFriendRequest(r.Context(), middleware.GetUserId(r.Context()), target.Id)
+	if err != nil {
+		sendRelationshipError(w, r, err)
+		return
+	}
+
+	sendRelationship(w, r, http.StatusCreated, target, relationshipType)
+}
+
+// Accept a friend request from a user
+func AcceptFriendRequest(w http.ResponseWriter, r *http.Request) {
+	target := targetUser(w, r)
+	if target == nil {
+		return
+	}
+
+	if err := user.AcceptFriendRequest(r.Context(), middleware.GetUserId(r.Context()), target.Id); err != nil {
+		sendRelationshipError(w, r, err)
+		return
+	}
+
+	sendRelationship(w, r, http.StatusOK, target, user.Friend)
+}
+
+// Decline a friend request from a user, or cancel one sent to them
+func RemoveFriendRequest(w http.ResponseWriter, r *http.Request) {
+	if err := user.RemoveFriendRequest(r.Context(), middleware.GetUserId(r.Context()), mux.Vars(r)["id"]); err != nil {
+		sendRelationshipError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stop being friends with a user
+func RemoveFriend(w http.ResponseWriter, r *http.Request) {
+	if err := user.RemoveFriend(r.Context(), middleware.GetUserId(r.Context()), mux.Vars(r)["id"]); err != nil {
+		sendRelationshipError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Block a user
+func BlockUser(w http.ResponseWriter, r *http.Request) {
+	target := targetUser(w, r)
+	if target == nil {
+		return
+	}
+
+	if err := user.Block(r.Context(), middleware.GetUserId(r.Context()), target.Id); err != nil {
+		sendRelationshipError(w, r, err)
+		return
+	}
+
+	sendRelationship(w, r, http.StatusOK, target, user.Blocked)
+}
+
+// Unblock a user
+func UnblockUser(w http.ResponseWriter, r *http.Request) {
+	if err := user.Unblock(r.Context(), middleware.GetUserId(r.Context()), mux.Vars(r)["id"]); err != nil {
+		sendRelationshipError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/server"
+)
+
+// The body of a request to create a role
+type CreateRoleRequest struct {
+	Name        string             `json:"name"`
+	Color       int                `json:"color"`
+	Permissions server.Permissions `json:"permissions"`
+}
+
+// The body of a request to update a role, fields which are left out are left
+// as they are
+type UpdateRoleRequest struct {
+	Name        *string             `json:"name"`
+	Color       *int                `json:"color"`
+	Permissions *server.Permissions `json:"permissions"`
+}
+
+// One entry in a bulk reorder
+type RolePositionRequest struct {
+	Id       string `json:"id"`
+	Position int    `json:"position"`
+}
+
+// What the current user can do in a server
+type PermissionsResponse struct {
+	Permissions server.Permissions `json:"permissions"`
+	// what they can do in each channel they can see, keyed by channel id
+	Channels map[string]server.Permissions `json:"channels"`
+}
+
+// Send the error for one of the role errors from the server package, falling
+// back to sendServerError for everything else
+func sendRoleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case server.ErrRoleNotFound:
+		sendError(w, r, http.StatusNotFound, ErrRoleNotFound, "No role exists with that id")
+	case server.ErrTooManyRoles:
+		sendError(w, r, http.StatusBadRequest, ErrTooManyRoles, "The server already has the maximum number of roles")
+	case server.ErrEveryoneRole:
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "The @everyone role can't be renamed, moved, deleted or handed out")
+	case server.ErrRoleHierarchy:
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "Roles can only be moved below your highest role")
+	case server.ErrNotMember:
+		sendError(w, r, http.StatusNotFound, ErrMemberNotFound, "That user isn't a member of the server")
+	default:
+		sendServerError(w, r, err)
+	}
+}
+
+// Get the role in the {roleId} path variable, sending a 403 unless the
+// current user can manage it
+func manageableRole(w http.ResponseWriter, r *http.Request, s *server.Server, access *server.Access) *server.Role {
+	role, err := server.GetRole(r.Context(), s, mux.Vars(r)["roleId"])
+	if err != nil {
+		sendRoleError(w, r, err)
+		return nil
+	}
+	if !access.Has(server.PermManageRoles) {
+		sendMissingPermissions(w, r, server.PermManageRoles)
+		return nil
+	}
+	if !access.CanManageRole(role) {
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "You can only manage roles below your highest role")
+		return nil
+	}
+	return role
+}
+
+// Check the name, color and permissions of a role
+func validateRole(name *string, color *int, perms *server.Permissions) (string, []FieldError) {
+	var fields []FieldError
+	var normalized string
+	if name != nil {
+		var err error
+		if normalized, err = server.NormalizeRoleName(*name); err != nil {
+			fields = append(fields, FieldError{Field: "name", Code: "invalid", Message: err.Error()})
+		}
+	}
+	if color != nil {
+		if err := server.ValidateColor(*color); err != nil {
+			fields = append(fields, FieldError{Field: "color", Code: "invalid", Message: err.Error()})
+		}
+	}
+	if perms != nil {
+		if err := perms.Validate(); err != nil {
+			fields = append(fields, FieldError{Field: "permissions", Code: "invalid", Message: "Unknown permissions"})
+		}
+	}
+	return normalized, fields
+}
+
+// List every role in a server, highest first
+func ListRoles(w http.ResponseWriter, r *http.Request) {
+	s, _ := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	roles, err := server.ListRoles(r.Context(), s)
+	if err != nil {
+		sendRoleError(w, r, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, roles)
+}
+
+// Create a role, which starts off just above @everyone. Nobody can give a
+// role permissions they don't have themselves
+func CreateRole(w http.ResponseWriter, r *http.Request) {
+	var req CreateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	name, fields := validateRole(&req.Name, &req.Color, &req.Permissions)
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, access := permittedServer(w, r, server.PermManageRoles)
+	if s == nil {
+		return
+	}
+	if !access.CanGrant(req.Permissions) {
+		sendMissingPermissions(w, r, req.Permissions&^access.Base)
+		return
+	}
+
+	role, err := server.CreateRole(r.Context(), s, name, req.Color, req.Permissions)
+	if err != nil {
+		sendRoleError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditRoleCreate, TargetType: server.AuditTargetRole, TargetId: role.Id}, nil, role.AuditFields())
+	sendJSON(w, http.StatusCreated, role)
+}
+
+// Update a role below the current user's highest one. Only the permissions
+// of @everyone can be changed
+func UpdateRole(w http.ResponseWriter, r *http.Request) {
+	var req UpdateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	name, fields := validateRole(req.Name, req.Color, req.Permissions)
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	role := manageableRole(w, r, s, access)
+	if role == nil {
+		return
+	}
+
+	changes := server.RoleUpdate{Color: req.Color, Permissions: req.Permissions}
+	if req.Name != nil {
+		changes.Name = &name
+	}
+	// whatever is being added or taken away has to be something the
+	// current user has
+	if req.Permissions != nil {
+		if changed := *req.Permissions ^ role.Permissions; !access.CanGrant(changed) {
+			sendMissingPermissions(w, r, changed&^access.Base)
+			return
+		}
+	}
+
+	before := role.AuditFields()
+	if err := server.UpdateRole(r.Context(), role, changes); err != nil {
+		sendRoleError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditRoleUpdate, TargetType: server.AuditTargetRole, TargetId: role.Id}, before, role.AuditFields())
+	sendJSON(w, http.StatusOK, role)
+}
+
+// Move several roles at once, returning every role in the server in its new
+// order
+func ReorderRoles(w http.ResponseWriter, r *http.Request) {
+	var req []RolePositionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(req) == 0 || len(req) > server.MaxRoles {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Between 1 and 250 roles must be given")
+		return
+	}
+
+	positions := make([]server.RolePosition, len(req))
+	seen := map[string]bool{}
+	for i, entry := range req {
+		if seen[entry.Id] {
+			sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Each role can only be given once")
+			return
+		}
+		if entry.Position < 1 {
+			sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Positions start at 1, @everyone is always at 0")
+			return
+		}
+		seen[entry.Id] = true
+		positions[i] = server.RolePosition{Id: entry.Id, Position: entry.Position}
+	}
+
+	s, access := permittedServer(w, r, server.PermManageRoles)
+	if s == nil {
+		return
+	}
+
+	before, err := server.ListRoles(r.Context(), s)
+	if err != nil {
+		sendRoleError(w, r, err)
+		return
+	}
+	roles, err := server.ReorderRoles(r.Context(), s, access, positions)
+	if err != nil {
+		sendRoleError(w, r, err)
+		return
+	}
+
+	// like channels, every role that moved gets an entry of its own
+	moved := map[string]map[string]interface{}{}
+	for i := range before {
+		moved[before[i].Id] = before[i].AuditFields()
+	}
+	for i := range roles {
+		recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditRoleUpdate, TargetType: server.AuditTargetRole, TargetId: roles[i].Id}, moved[roles[i].Id], roles[i].AuditFields())
+	}
+	sendJSON(w, http.StatusOK, roles)
+}
+
+// Delete a role below the current user's highest one
+func DeleteRole(w http.ResponseWriter, r *http.Request) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	role := manageableRole(w, r, s, access)
+	if role == nil {
+		return
+	}
+
+	if err := server.DeleteRole(r.Context(), role); err != nil {
+		sendRoleError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditRoleDelete, TargetType: server.AuditTargetRole, TargetId: role.Id}, role.AuditFields(), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Give a member a role below the current user's highest one
+func AddMemberRole(w http.ResponseWriter, r *http.Request) {
+	changeMemberRole(w, r, server.AuditMemberRoleAdd, server.AddMemberRole)
+}
+
+// Take a role below the current user's highest one away from a member
+func RemoveMemberRole(w http.ResponseWriter, r *http.Request) {
+	changeMemberRole(w, r, server.AuditMemberRoleRemove, server.RemoveMemberRole)
+}
+
+func changeMemberRole(w http.ResponseWriter, r *http.Request, action server.AuditAction, change func(ctx context.Context, role *server.Role, userId string) error) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+	role := manageableRole(w, r, s, access)
+	if role == nil {
+		return
+	}
+
+	userId := mux.Vars(r)["userId"]
+	if err := change(r.Context(), role, userId); err != nil {
+		sendRoleError(w, r, err)
+		return
+	}
+
+	given := map[string]interface{}{"roleId": role.Id}
+	entry := server.AuditEntry{Action: action, TargetType: server.AuditTargetUser, TargetId: userId}
+	if action == server.AuditMemberRoleAdd {
+		recordChanges(r, s.Id, entry, nil, given)
+	} else {
+		recordChanges(r, s.Id, entry, given, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Get what the current user can do in a server, and in each channel of it
+// that they can see, so that clients know what to show them
+func GetPermissions(w http.ResponseWriter, r *http.Request) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	channels, err := server.ListChannels(r.Context(), s.Id)
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+
+	response := PermissionsResponse{Permissions: access.Base, Channels: map[string]server.Permissions{}}
+	for i := range channels {
+		if perms := access.In(&channels[i]); perms != 0 {
+			response.Channels[channels[i].Id] = perms
+		}
+	}
+	sendJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+const (
+	defaultSearchLimit = 25
+	maxSearchLimit     = 100
+	maxSearchQuery     = 64
+)
+
+// A page of users matching a search
+type SearchUsersResponse struct {
+	Users []user.PublicUser `json:"users"`
+	Total int               `json:"total"`
+	// the offset to ask for to get the next page, null if this is the last one
+	NextOffset *int `json:"nextOffset"`
+}
+
+// Read a non-negative integer query parameter, falling back to a default if
+// it isn't given
+func queryInt(r *http.Request, name string, fallback int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Search for users by username or display name, to find people to add
+func SearchUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+
+	var fields []FieldError
+	if query == "" {
+		fields = append(fields, FieldError{Field: "q", Code: "required", Message: "A search query is required"})
+	} else if utf8.RuneCountInString(query) > maxSearchQuery {
+		fields = append(fields, FieldError{Field: "q", Code: "invalid", Message: "Search query is too long"})
+	}
+	limit, ok := queryInt(r, "limit", defaultSearchLimit)
+	if !ok || limit < 1 || limit > maxSearchLimit {
+		fields = append(fields, FieldError{Field: "limit", Code: "invalid", Message: "Limit must be between 1 and 100"})
+	}
+	offset, ok := queryInt(r, "offset", 0)
+	if !ok {
+		fields = append(fields, FieldError{Field: "offset", Code: "invalid", Message: "Offset must be a positive number"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	searcherId := middleware.GetUserId(r.Context())
+	results, err := user.Search(r.Context(), searcherId, query, user.SearchOptions{Limit: limit, Offset: offset})
+	if err != nil {
+		log.Printf("Error searching users: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	ids := make([]string, len(results.Users))
+	for i, u := range results.Users {
+		ids[i] = u.Id
+	}
+	relationships, err := user.GetRelationships(r.Context(), searcherId, ids)
+	if err != nil {
+		log.Printf("Error looking up relationships: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	response := SearchUsersResponse{
+		Users: make([]user.PublicUser, len(results.Users)),
+		Total: results.Total,
+	}
+	publics := make([]*user.PublicUser, len(results.Users))
+	for i, u := range results.Users {
+		response.Users[i] = u.Public(false)
+		response.Users[i].Relationship = relationships[u.Id]
+		publics[i] = &response.Users[i]
+	}
+	attachPresence(r, publics...)
+
+	if next := offset + len(results.Users); next < results.Total {
+		response.NextOffset = &next
+	}
+	sendJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/server"
+)
+
+// How long server invites last unless somebody says otherwise
+const defaultInviteMaxAge = 24 * time.Hour
+
+// The body of a request to create an invite to a server
+type CreateServerInviteRequest struct {
+	// the channel to point the invite at, if any
+	ChannelId string `json:"channelId"`
+	// how many seconds the invite lasts for, 0 for ever; defaults to a day
+	MaxAge *int `json:"maxAge"`
+	// how many times the invite can be used, 0 for no limit
+	MaxUses   int  `json:"maxUses"`
+	Temporary bool `json:"temporary"`
+}
+
+// What anyone can see about an invite before accepting it
+type InvitePreview struct {
+	Code      string         `json:"code"`
+	Vanity    bool           `json:"vanity"`
+	ExpiresAt *time.Time     `json:"expiresAt"`
+	Temporary bool           `json:"temporary"`
+	Server    ServerPreview  `json:"server"`
+	Channel   *ChannelSketch `json:"channel"` // the channel the invite points at, if any
+}
+
+// Just enough of a server to decide whether to join it
+type ServerPreview struct {
+	Id          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Icon        map[string]string `json:"icon"`
+	MemberCount int               `json:"memberCount"`
+}
+
+// Just enough of a channel to say where an invite leads
+type ChannelSketch struct {
+	Id   string             `json:"id"`
+	Name string             `json:"name"`
+	Type server.ChannelType `json:"type"`
+}
+
+// The result of accepting an invite
+type JoinResponse struct {
+	Server server.PublicServer `json:"server"`
+	// false if the user was already a member, in which case the invite
+	// wasn't used
+	Joined    bool   `json:"joined"`
+	ChannelId string `json:"channelId,omitempty"`
+}
+
+// Send the error for one of the invite errors from the server package,
+// falling back to sendServerError for everything else
+func sendServerInviteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case server.ErrInviteNotFound:
+		sendError(w, r, http.StatusNotFound, ErrInviteInvalid, "That invite doesn't exist, has expired or has been used up")
+	case server.ErrTooManyInvites:
+		sendError(w, r, http.StatusBadRequest, ErrTooManyInvites, "The server already has the maximum number of invites")
+	case server.ErrBanned:
+		sendError(w, r, http.StatusForbidden, ErrBanned, "You are banned from that server")
+	default:
+		sendChannelError(w, r, err)
+	}
+}
+
+// Look up the invite in the {code} path variable
+func pathInvite(w http.ResponseWriter, r *http.Request) *server.Invite {
+	invite, err := server.GetInvite(r.Context(), mux.Vars(r)["code"])
+	if err != nil {
+		sendServerInviteError(w, r, err)
+		return nil
+	}
+	return invite
+}
+
+// Create an invite to a server, or to one of its channels; this needs the
+// create invite permission, in the channel if there is one
+func CreateServerInvite(w http.ResponseWriter, r *http.Request) {
+	var req CreateServerInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	maxAge := defaultInviteMaxAge
+	var fields []FieldError
+	if req.MaxAge != nil {
+		maxAge = time.Duration(*req.MaxAge) * time.Second
+		if maxAge < 0 || maxAge > server.MaxInviteAge {
+			fields = append(fields, FieldError{Field: "maxAge", Code: "invalid", Message: "Invites can last for at most 7 days, or 0 for ever"})
+		}
+	}
+	if req.MaxUses < 0 || req.MaxUses > server.MaxInviteUses {
+		fields = append(fields, FieldError{Field: "maxUses", Code: "invalid", Message: "Invites can be used at most 100 times, or 0 for no limit"})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	var channel *server.Channel
+	if req.ChannelId != "" {
+		var err error
+		channel, err = server.GetChannel(r.Context(), s.Id, req.ChannelId)
+		if err == nil && !access.HasIn(channel, server.PermViewChannel) {
+			err = server.ErrChannelNotFound
+		}
+		if err != nil {
+			sendServerInviteError(w, r, err)
+			return
+		}
+		if !access.HasIn(channel, server.PermCreateInvite) {
+			sendMissingPermissions(w, r, server.PermCreateInvite)
+			return
+		}
+	} else if !access.Has(server.PermCreateInvite) {
+		sendMissingPermissions(w, r, server.PermCreateInvite)
+		return
+	}
+
+	invite, err := server.CreateInvite(r.Context(), s, channel, access.UserId, maxAge, req.MaxUses, req.Temporary)
+	if err != nil {
+		sendServerInviteError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditInviteCreate, TargetType: server.AuditTargetInvite, TargetId: invite.Code}, nil, invite.AuditFields())
+	sendJSON(w, http.StatusCreated, invite)
+}
+
+// List the invites to a server which can still be used; this needs the manage
+// server permission
+func ListServerInvites(w http.ResponseWriter, r *http.Request) {
+	s, _ := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return
+	}
+
+	invites, err := server.ListInvites(r.Context(), s.Id)
+	if err != nil {
+		sendServerInviteError(w, r, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, invites)
+}
+
+// Show what an invite leads to, to anyone who has the code; this doesn't
+// need you to be logged in so that invite links can show a preview
+func GetServerInvite(w http.ResponseWriter, r *http.Request) {
+	invite := pathInvite(w, r)
+	if invite == nil {
+		return
+	}
+
+	s, err := server.GetById(r.Context(), invite.ServerId)
+	if err != nil {
+		if err == server.ErrNotFound {
+			err = server.ErrInviteNotFound
+		}
+		sendServerInviteError(w, r, err)
+		return
+	}
+
+	preview := InvitePreview{
+		Code:      invite.Code,
+		Vanity:    invite.Vanity,
+		ExpiresAt: invite.ExpiresAt,
+		Temporary: invite.Temporary,
+		Server: ServerPreview{
+			Id:          s.Id,
+			Name:        s.Name,
+			Description: s.Description,
+			Icon:        server.IconURLs(s.Id, s.Icon),
+			MemberCount: s.MemberCount,
+		},
+	}
+	if invite.ChannelId != "" {
+		// the channel might have been deleted since, the invite still works
+		channel, err := server.GetChannel(r.Context(), s.Id, invite.ChannelId)
+		if err != nil && err != server.ErrChannelNotFound {
+			sendServerInviteError(w, r, err)
+			return
+		}
+		if channel != nil {
+			preview.Channel = &ChannelSketch{Id: channel.Id, Name: channel.Name, Type: channel.Type}
+		}
+	}
+	sendJSON(w, http.StatusOK, preview)
+}
+
+// Join the server an invite is for as the current user
+func AcceptServerInvite(w http.ResponseWriter, r *http.Request) {
+	invite := pathInvite(w, r)
+	if invite == nil {
+		return
+	}
+
+	s, joined, err := server.Join(r.Context(), invite, middleware.GetUserId(r.Context()))
+	if err != nil {
+		sendServerInviteError(w, r, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, JoinResponse{Server: s.Public(), Joined: joined, ChannelId: invite.ChannelId})
+}
+
+// Revoke an invite; whoever made it can always do this, anyone else needs
+// the manage server permission. Vanity codes are changed on the server
+// instead
+func DeleteServerInvite(w http.ResponseWriter, r *http.Request) {
+	invite := pathInvite(w, r)
+	if invite == nil {
+		return
+	}
+	if invite.Vanity {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Vanity codes are removed by updating the server")
+		return
+	}
+
+	s, err := server.GetById(r.Context(), invite.ServerId)
+	if err != nil {
+		sendServerInviteError(w, r, err)
+		return
+	}
+	access, err := server.GetAccess(r.Context(), s, middleware.GetUserId(r.Context()))
+	if err == server.ErrNotMember {
+		// nobody outside of the server has any business revoking its invites
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "You can't revoke that invite")
+		return
+	}
+	if err != nil {
+		sendServerInviteError(w, r, err)
+		return
+	}
+	if invite.CreatedBy != access.UserId && !access.Has(server.PermManageServer) {
+		sendMissingPermissions(w, r, server.PermManageServer)
+		return
+	}
+
+	if err := server.DeleteInvite(r.Context(), invite); err != nil {
+		sendServerInviteError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditInviteDelete, TargetType: server.AuditTargetInvite, TargetId: invite.Code}, invite.AuditFields(), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/imaging"
+	"github.com/oauthority/voxly-backend/internal/server"
+	"github.com/oauthority/voxly-backend/internal/storage"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// Icons have the same limits as avatars
+var iconLimits = imaging.Limits{MaxBytes: 8 << 20, MinWidth: 32, MinHeight: 32, MaxWidth: 4096, MaxHeight: 4096}
+
+// The body of a request to create a server
+type CreateServerRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// The body of a request to update a server, fields which are left out are
+// left as they are
+type UpdateServerRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	OwnerId     *string `json:"ownerId"`
+	VanityCode  *string `json:"vanityCode"` // an empty string takes it away
+}
+
+// Send the error for one of the errors from the server package
+func sendServerError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case server.ErrNotFound, server.ErrNotMember:
+		// as far as anyone outside of a server is concerned, it doesn't exist
+		sendError(w, r, http.StatusNotFound, ErrServerNotFound, "No server exists with that id")
+	default:
+		log.Printf("Error with server: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+	}
+}
+
+// Get the server in the {serverId} path variable along with what the current
+// user can do in it, sending a 404 if it doesn't exist or they aren't a
+// member of it; the caller should bail out if the server is nil
+func serverAccess(w http.ResponseWriter, r *http.Request) (*server.Server, *server.Access) {
+	s, err := server.GetById(r.Context(), mux.Vars(r)["serverId"])
+	if err != nil {
+		sendServerError(w, r, err)
+		return nil, nil
+	}
+
+	access, err := server.GetAccess(r.Context(), s, middleware.GetUserId(r.Context()))
+	if err != nil {
+		sendServerError(w, r, err)
+		return nil, nil
+	}
+	return s, access
+}
+
+// Like serverAccess, but also sends a 403 unless the current user has all of
+// the given permissions server wide
+func permittedServer(w http.ResponseWriter, r *http.Request, perms server.Permissions) (*server.Server, *server.Access) {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return nil, nil
+	}
+	if !access.Has(perms) {
+		sendMissingPermissions(w, r, perms)
+		return nil, nil
+	}
+	return s, access
+}
+
+// Get the server in the {serverId} path variable, but only if the current
+// user owns it
+func ownedServer(w http.ResponseWriter, r *http.Request) *server.Server {
+	s, access := serverAccess(w, r)
+	if s == nil {
+		return nil
+	}
+	if !access.Owner {
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "Only the owner of the server can do that")
+		return nil
+	}
+	return s
+}
+
+// Tell the user which permissions they needed for something
+func sendMissingPermissions(w http.ResponseWriter, r *http.Request, perms server.Permissions) {
+	sendError(w, r, http.StatusForbidden, ErrForbidden, "You need the "+strings.Join(perms.Names(), ", ")+" permission to do that")
+}
+
+// Create a new server, owned by the current user
+func CreateServer(w http.ResponseWriter, r *http.Request) {
+	var req CreateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	var fields []FieldError
+	name, err := server.NormalizeName(req.Name)
+	if err != nil {
+		fields = append(fields, FieldError{Field: "name", Code: "invalid", Message: err.Error()})
+	}
+	description, err := server.NormalizeDescription(req.Description)
+	if err != nil {
+		fields = append(fields, FieldError{Field: "description", Code: "invalid", Message: err.Error()})
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, err := server.Create(r.Context(), middleware.GetUserId(r.Context()), name, description)
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+
+	sendJSON(w, http.StatusCreated, s.Public())
+}
+
+// List the servers the current user is in, in the order they joined them
+func ListServers(w http.ResponseWriter, r *http.Request) {
+	servers, err := server.ListForUser(r.Context(), middleware.GetUserId(r.Context()))
+	if err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+
+	response := make([]server.PublicServer, len(servers))
+	for i := range servers {
+		response[i] = servers[i].Public()
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Get a server the current user is in
+func GetServer(w http.ResponseWriter, r *http.Request) {
+	s, _ := serverAccess(w, r)
+	if s == nil {
+		return
+	}
+
+	sendJSON(w, http.StatusOK, s.Public())
+}
+
+// Update a server; this needs the manage server permission, and only the
+// owner can hand the server over to another member
+func UpdateServer(w http.ResponseWriter, r *http.Request) {
+	var req UpdateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	var changes server.Update
+	var fields []FieldError
+	if req.Name != nil {
+		name, err := server.NormalizeName(*req.Name)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "name", Code: "invalid", Message: err.Error()})
+		}
+		changes.Name = &name
+	}
+	if req.Description != nil {
+		description, err := server.NormalizeDescription(*req.Description)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "description", Code: "invalid", Message: err.Error()})
+		}
+		changes.Description = &description
+	}
+	changes.OwnerId = req.OwnerId
+	if req.VanityCode != nil {
+		vanityCode := ""
+		if *req.VanityCode != "" {
+			var err error
+			if vanityCode, err = server.NormalizeVanityCode(*req.VanityCode); err != nil {
+				fields = append(fields, FieldError{Field: "vanityCode", Code: "invalid", Message: err.Error()})
+			}
+		}
+		changes.VanityCode = &vanityCode
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, access := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return
+	}
+	if changes.OwnerId != nil && *changes.OwnerId != s.OwnerId && !access.Owner {
+		sendError(w, r, http.StatusForbidden, ErrForbidden, "Only the owner of the server can hand it over")
+		return
+	}
+
+	before := s.AuditFields()
+	if err := s.Update(r.Context(), changes); err != nil {
+		if err == server.ErrNotMember {
+			sendValidationError(w, r, []FieldError{{Field: "ownerId", Code: "invalid", Message: "The new owner must be a member of the server"}})
+			return
+		}
+		if err == server.ErrVanityTaken {
+			sendError(w, r, http.StatusConflict, ErrVanityTaken, "That vanity code is already in use")
+			return
+		}
+		sendServerError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditServerUpdate, TargetType: server.AuditTargetServer, TargetId: s.Id}, before, s.AuditFields())
+
+	sendJSON(w, http.StatusOK, s.Public())
+}
+
+// Delete a server and everything in it; only the owner can do this
+func DeleteServer(w http.ResponseWriter, r *http.Request) {
+	s := ownedServer(w, r)
+	if s == nil {
+		return
+	}
+
+	if err := s.Delete(r.Context()); err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Upload a new icon for a server
+func UploadServerIcon(w http.ResponseWriter, r *http.Request) {
+	// check that they're allowed to before reading and decoding a body of
+	// up to the upload limit
+	s, _ := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return
+	}
+
+	img := readUploadedImage(w, r, iconLimits)
+	if img == nil {
+		return
+	}
+
+	store, err := storage.Get()
+	if err != nil {
+		log.Printf("Error getting blob store: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	name := storeImage(w, r, store, img, [2]int{1, 1}, server.IconSizes, func(name string, size user.ImageSize) string {
+		return server.IconKey(s.Id, name, size)
+	})
+	if name == "" {
+		return
+	}
+
+	previous := s.Icon
+	before := s.AuditFields()
+	if err := s.SetIcon(r.Context(), name); err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+	removeServerIcon(r, store, s.Id, previous)
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditServerUpdate, TargetType: server.AuditTargetServer, TargetId: s.Id}, before, s.AuditFields())
+
+	sendJSON(w, http.StatusOK, s.Public())
+}
+
+// Remove the icon of a server
+func DeleteServerIcon(w http.ResponseWriter, r *http.Request) {
+	s, _ := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return
+	}
+
+	previous := s.Icon
+	before := s.AuditFields()
+	if err := s.SetIcon(r.Context(), ""); err != nil {
+		sendServerError(w, r, err)
+		return
+	}
+	if store, err := storage.Get(); err == nil {
+		removeServerIcon(r, store, s.Id, previous)
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditServerUpdate, TargetType: server.AuditTargetServer, TargetId: s.Id}, before, s.AuditFields())
+
+	sendJSON(w, http.StatusOK, s.Public())
+}
+
+// Delete every size of an icon that is no longer used; like removeImage, all
+// we lose if this fails is a bit of disk space
+func removeServerIcon(r *http.Request, store storage.BlobStore, serverId string, name string) {
+	if name == "" {
+		return
+	}
+	for _, size := range server.IconSizes {
+		if err := store.Delete(r.Context(), server.IconKey(serverId, name, size)); err != nil {
+			log.Printf("Error deleting old icon: %v", err)
+		}
+	}
+}
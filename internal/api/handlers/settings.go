@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/redis"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// The event sent to the users other devices when their settings change
+const SettingsUpdatedEvent = "settings.updated"
+
+// The body of a request to update settings; anything left out is left as it
+// is. Version is the version the client last saw, if the settings have
+// changed since then the update is refused rather than clobbering whatever
+// another device did
+type UpdateSettingsRequest struct {
+	Version       *int64                      `json:"version"`
+	Theme         *user.Theme                 `json:"theme"`
+	Locale        *string                     `json:"locale"`
+	CompactMode   *bool                       `json:"compactMode"`
+	Notifications *UpdateNotificationsRequest `json:"notifications"`
+}
+
+type UpdateNotificationsRequest struct {
+	Level   *user.NotificationLevel `json:"level"`
+	Desktop *bool                   `json:"desktop"`
+	Sounds  *bool                   `json:"sounds"`
+}
+
+// Get the settings of the current user
+func GetSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := user.GetSettings(r.Context(), middleware.GetUserId(r.Context()))
+	if err != nil {
+		log.Printf("Error getting settings: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, settings)
+}
+
+// Update some of the settings of the current user, and let their other
+// devices know about it
+func UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	var req UpdateSettingsRequest
+	decoder := json.NewDecoder(r.Body)
+	// a typo in a setting name would otherwise be silently ignored, which is
+	// a pain to track down on the client
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	var fields []FieldError
+	if req.Version == nil {
+		fields = append(fields, FieldError{Field: "version", Code: "required", Message: "The version the settings were read at is required"})
+	}
+	if req.Theme != nil && !req.Theme.Valid() {
+		fields = append(fields, FieldError{Field: "theme", Code: "invalid", Message: user.ErrInvalidTheme.Error()})
+	}
+	if req.Locale != nil {
+		locale, err := user.NormalizeLocale(*req.Locale)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "locale", Code: "invalid", Message: err.Error()})
+		}
+		req.Locale = &locale
+	}
+	update := user.SettingsUpdate{
+		Theme:       req.Theme,
+		Locale:      req.Locale,
+		CompactMode: req.CompactMode,
+	}
+	if n := req.Notifications; n != nil {
+		if n.Level != nil && !n.Level.Valid() {
+			fields = append(fields, FieldError{Field: "notifications.level", Code: "invalid", Message: user.ErrInvalidNotificationLevel.Error()})
+		}
+		update.Notifications = &user.NotificationSettingsUpdate{
+			Level:   n.Level,
+			Desktop: n.Desktop,
+			Sounds:  n.Sounds,
+		}
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	userId := middleware.GetUserId(r.Context())
+	settings, err := user.UpdateSettings(r.Context(), userId, *req.Version, update)
+	if err == user.ErrSettingsConflict {
+		sendError(w, r, http.StatusConflict, ErrSettingsConflict, "Your settings have been changed elsewhere, fetch them again and retry")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating settings: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	// the change is saved either way, the other devices will just have to
+	// pick it up the next time they fetch their settings
+	if err := redis.PublishUserEvent(userId, SettingsUpdatedEvent, middleware.GetSessionId(r.Context()), settings); err != nil {
+		log.Printf("Error publishing settings change: %v", err)
+	}
+
+	sendJSON(w, http.StatusOK, settings)
+}
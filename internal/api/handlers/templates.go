@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/server"
+)
+
+// The body of a request to make a template from a server
+type CreateTemplateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// The body of a request to update a template, fields which are left out are
+// left as they are
+type UpdateTemplateRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+// Send the error for one of the template errors from the server package,
+// falling back to sendServerError for everything else
+func sendTemplateError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case server.ErrTemplateNotFound:
+		sendError(w, r, http.StatusNotFound, ErrTemplateNotFound, "No template exists with that code")
+	case server.ErrTemplateExists:
+		sendError(w, r, http.StatusConflict, ErrTemplateExists, "The server already has a template")
+	default:
+		sendServerError(w, r, err)
+	}
+}
+
+// Check the name and description of a template or a new server, which follow
+// the same rules as a server's
+func validateNameAndDescription(name *string, description *string) (string, string, []FieldError) {
+	var fields []FieldError
+	var normalizedName, normalizedDescription string
+	var err error
+	if name != nil {
+		if normalizedName, err = server.NormalizeName(*name); err != nil {
+			fields = append(fields, FieldError{Field: "name", Code: "invalid", Message: err.Error()})
+		}
+	}
+	if description != nil {
+		if normalizedDescription, err = server.NormalizeDescription(*description); err != nil {
+			fields = append(fields, FieldError{Field: "description", Code: "invalid", Message: err.Error()})
+		}
+	}
+	return normalizedName, normalizedDescription, fields
+}
+
+// Get the template of the server in the {serverId} path variable; this needs
+// the manage server permission
+func serverTemplate(w http.ResponseWriter, r *http.Request) (*server.Server, *server.Template) {
+	s, _ := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return nil, nil
+	}
+	template, err := server.GetTemplate(r.Context(), s.Id)
+	if err != nil {
+		sendTemplateError(w, r, err)
+		return nil, nil
+	}
+	return s, template
+}
+
+// Get the template of a server
+func GetServerTemplate(w http.ResponseWriter, r *http.Request) {
+	_, template := serverTemplate(w, r)
+	if template == nil {
+		return
+	}
+	sendJSON(w, http.StatusOK, template)
+}
+
+// Make a template from a server as it is now; this needs the manage server
+// permission
+func CreateServerTemplate(w http.ResponseWriter, r *http.Request) {
+	var req CreateTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	name, description, fields := validateNameAndDescription(&req.Name, &req.Description)
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, access := permittedServer(w, r, server.PermManageServer)
+	if s == nil {
+		return
+	}
+
+	template, err := server.CreateTemplate(r.Context(), s, access.UserId, name, description)
+	if err != nil {
+		sendTemplateError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditTemplateCreate, TargetType: server.AuditTargetTemplate, TargetId: template.Code}, nil, template.AuditFields())
+	sendJSON(w, http.StatusCreated, template)
+}
+
+// Change the name or description of a server's template
+func UpdateServerTemplate(w http.ResponseWriter, r *http.Request) {
+	var req UpdateTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	name, description, fields := validateNameAndDescription(req.Name, req.Description)
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	s, template := serverTemplate(w, r)
+	if template == nil {
+		return
+	}
+
+	var changes server.TemplateUpdate
+	if req.Name != nil {
+		changes.Name = &name
+	}
+	if req.Description != nil {
+		changes.Description = &description
+	}
+	before := template.AuditFields()
+	if err := template.Update(r.Context(), changes); err != nil {
+		sendTemplateError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditTemplateUpdate, TargetType: server.AuditTargetTemplate, TargetId: template.Code}, before, template.AuditFields())
+	sendJSON(w, http.StatusOK, template)
+}
+
+// Take a new snapshot of the server for its template, keeping the same code
+func SyncServerTemplate(w http.ResponseWriter, r *http.Request) {
+	s, template := serverTemplate(w, r)
+	if template == nil {
+		return
+	}
+
+	before := template.AuditFields()
+	if err := template.Sync(r.Context(), s); err != nil {
+		sendTemplateError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditTemplateUpdate, TargetType: server.AuditTargetTemplate, TargetId: template.Code}, before, template.AuditFields())
+	sendJSON(w, http.StatusOK, template)
+}
+
+// Delete a server's template so that its code stops working
+func DeleteServerTemplate(w http.ResponseWriter, r *http.Request) {
+	s, template := serverTemplate(w, r)
+	if template == nil {
+		return
+	}
+
+	if err := template.Delete(r.Context()); err != nil {
+		sendTemplateError(w, r, err)
+		return
+	}
+	recordChanges(r, s.Id, server.AuditEntry{Action: server.AuditTemplateDelete, TargetType: server.AuditTargetTemplate, TargetId: template.Code}, template.AuditFields(), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Get a template by its code, to anyone who has it
+func GetTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := server.GetTemplateByCode(r.Context(), mux.Vars(r)["code"])
+	if err != nil {
+		sendTemplateError(w, r, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, template)
+}
+
+// Create a new server from a template, owned by the current user
+func CreateServerFromTemplate(w http.ResponseWriter, r *http.Request) {
+	var req CreateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+	name, description, fields := validateNameAndDescription(&req.Name, &req.Description)
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	template, err := server.GetTemplateByCode(r.Context(), mux.Vars(r)["code"])
+	if err != nil {
+		sendTemplateError(w, r, err)
+		return
+	}
+
+	s, err := server.CreateFromTemplate(r.Context(), template, middleware.GetUserId(r.Context()), name, description)
+	if err != nil {
+		sendTemplateError(w, r, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, s.Public())
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// The body of a request to update the current user, fields which are left
+// out are left as they are
+type UpdateUserRequest struct {
+	Username *string `json:"username"`
+	Name     *string `json:"name"`
+}
+
+// Handlers for the current user which need to know how username changes are
+// limited
+type UserHandler struct {
+	usernamePolicy user.UsernamePolicy
+}
+
+func NewUserHandler(usernamePolicy user.UsernamePolicy) *UserHandler {
+	return &UserHandler{usernamePolicy: usernamePolicy}
+}
+
+// The usernames a user has had, along with when they can next change it
+type UsernameHistoryResponse struct {
+	History []user.UsernameChange `json:"history"`
+	// when the user can next change their username, null if they can now
+	NextChangeAvailableAt *time.Time `json:"nextChangeAvailableAt"`
+}
+
+// Send the error for one of the username errors from the user package
+func sendUsernameError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case user.ErrUsernameTaken:
+		sendError(w, r, http.StatusConflict, ErrUsernameTaken, "That username is already taken")
+	case user.ErrUsernameHeld:
+		// as far as anyone else is concerned it's still taken
+		sendError(w, r, http.StatusConflict, ErrUsernameTaken, "That username is already taken")
+	case user.ErrUsernameReserved:
+		sendError(w, r, http.StatusConflict, ErrUsernameReserved, "That username is reserved")
+	case user.ErrUsernameCooldown:
+		sendError(w, r, http.StatusTooManyRequests, ErrUsernameCooldown, "You changed your username too recently, please try again later")
+	default:
+		log.Printf("Error changing username: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+	}
+}
+
+// Look up the user making the request, sending an error response if we
+// can't; the caller should bail out if this returns nil
+func currentUser(w http.ResponseWriter, r *http.Request) *user.User {
+	u, err := user.GetById(r.Context(), middleware.GetUserId(r.Context()))
+	if err != nil {
+		if err == user.ErrNotFound {
+			// the session outlived the user somehow
+			sendError(w, r, http.StatusUnauthorized, ErrUnauthorized, "A valid token is required to access this resource")
+			return nil
+		}
+
+		log.Printf("Database error when looking up current user: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return nil
+	}
+	return u
+}
+
+// Send the current user back, with everything that only they get to see
+func sendCurrentUser(w http.ResponseWriter, r *http.Request, u *user.User) {
+	public := u.Public(true)
+	attachPresence(r, &public)
+	sendJSON(w, http.StatusOK, public)
+}
+
+// Get the user making the request, including their email
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(w, r)
+	if u == nil {
+		return
+	}
+
+	sendCurrentUser(w, r, u)
+}
+
+// Update the profile of the user making the request
+func (h *UserHandler) UpdateCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var req UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid request body")
+		return
+	}
+
+	var fields []FieldError
+	if req.Username != nil {
+		if err := user.ValidateUsername(*req.Username); err != nil {
+			fields = append(fields, FieldError{Field: "username", Code: "invalid", Message: err.Error()})
+		}
+	}
+	if req.Name != nil {
+		name, err := user.NormalizeName(*req.Name)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "name", Code: "invalid", Message: err.Error()})
+		}
+		req.Name = &name
+	}
+	if len(fields) > 0 {
+		sendValidationError(w, r, fields)
+		return
+	}
+
+	u := currentUser(w, r)
+	if u == nil {
+		return
+	}
+
+	// the username goes first, it's the part that is most likely to be
+	// refused and we don't want to half apply the update
+	if req.Username != nil {
+		if err := user.ChangeUsername(r.Context(), u, *req.Username, h.usernamePolicy); err != nil {
+			sendUsernameError(w, r, err)
+			return
+		}
+	}
+
+	err := user.UpdateProfile(r.Context(), u.Id, user.ProfileUpdate{
+		Name: req.Name,
+	})
+	if err != nil {
+		log.Printf("Error updating user: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "Internal server error. Please try again later")
+		return
+	}
+
+	if req.Name != nil {
+		u.Name = *req.Name
+	}
+
+	sendCurrentUser(w, r, u)
+}
+
+// Get the usernames the current user has had, newest first
+func (h *UserHandler) GetUsernameHistory(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(w, r)
+	if u == nil {
+		return
+	}
+
+	history, err := user.UsernameHistory(r.Context(), u.Id)
+	if err != nil {
+		log.Printf("Error getting username history: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	response := UsernameHistoryResponse{History: history}
+	if next := u.NextUsernameChange(h.usernamePolicy); !next.IsZero() {
+		response.NextChangeAvailableAt = &next
+	}
+	sendJSON(w, http.StatusOK, response)
+}
+
+// Get the public profile of any user, along with the relationship the
+// current user has with them
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	u := targetUser(w, r)
+	if u == nil {
+		return
+	}
+
+	viewerId := middleware.GetUserId(r.Context())
+	relationship, err := user.GetRelationship(r.Context(), viewerId, u.Id)
+	if err != nil {
+		log.Printf("Error looking up relationship: %v", err)
+		sendError(w, r, http.StatusInternalServerError, ErrInternal, "A database error occured, please try again later.")
+		return
+	}
+
+	public := u.Public(u.Id == viewerId)
+	public.Relationship = relationship
+	attachPresence(r, &public)
+	sendJSON(w, http.StatusOK, public)
+}
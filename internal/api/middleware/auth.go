@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/oauthority/voxly-backend/internal/auth"
+	"github.com/oauthority/voxly-backend/internal/redis"
+)
+
+const (
+	userIdKey    contextKey = "userId"
+	sessionIdKey contextKey = "sessionId"
+)
+
+// Writes an error response with the given status; the middleware doesn't know
+// what the API's errors look like, so whoever sets it up tells it how
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, status int)
+
+// Only let requests through if they carry a valid bearer token for a session
+// which still exists in Redis, otherwise respond with a 401
+func RequireAuth(authManager *auth.AuthManager, onError ErrorHandler) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || tokenString == "" {
+				onError(w, r, http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := authManager.ValidateJWT(tokenString)
+			if err != nil {
+				onError(w, r, http.StatusUnauthorized)
+				return
+			}
+
+			// the token might still be valid, but if the session has been
+			// revoked (or has expired) then so has the token
+			sessionManager, err := redis.GetConnection()
+			if err != nil {
+				log.Printf("Error getting Redis connection: %v", err)
+				onError(w, r, http.StatusInternalServerError)
+				return
+			}
+
+			session, err := sessionManager.GetSession(claims.SessionId)
+			if err != nil {
+				log.Printf("Error getting session: %v", err)
+				onError(w, r, http.StatusInternalServerError)
+				return
+			}
+			if session == nil || session.UserId != claims.UserId {
+				onError(w, r, http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userIdKey, claims.UserId)
+			ctx = context.WithValue(ctx, sessionIdKey, claims.SessionId)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Get the id of the user making the request, or an empty string if the
+// RequireAuth middleware has not run
+func GetUserId(ctx context.Context) string {
+	userId, _ := ctx.Value(userIdKey).(string)
+	return userId
+}
+
+// Get the id of the session the request was made with
+func GetSessionId(ctx context.Context) string {
+	sessionId, _ := ctx.Value(sessionIdKey).(string)
+	return sessionId
+}
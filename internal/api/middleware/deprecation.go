@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Describes a route (or a whole version of the API) which is scheduled
+// for removal
+type Deprecation struct {
+	Since     time.Time // when the route was deprecated
+	Sunset    time.Time // when the route will stop working
+	OldPrefix string    // the prefix the deprecated routes live under, e.g. "" or "/api/v1"
+	NewPrefix string    // the prefix of the routes that replace them, e.g. "/api/v2"
+}
+
+// Let clients know that they are calling something that is going away by
+// setting the Deprecation (RFC 9745) and Sunset (RFC 8594) headers, along
+// with a link to the same route under the version replacing it
+func Deprecated(d Deprecation) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+			if !d.Sunset.IsZero() {
+				w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+			}
+			if d.NewPrefix != "" {
+				successor := d.NewPrefix + strings.TrimPrefix(r.URL.Path, d.OldPrefix)
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// The header we read an incoming request id from (if a proxy in front of us
+// has already assigned one) and echo back on every response
+const RequestIdHeader = "X-Request-Id"
+
+type contextKey string
+
+const requestIdKey contextKey = "requestId"
+
+// Make sure that every request has an id attached to it so that we can
+// include it in error responses and logs; makes tracking down what went
+// wrong for a particular user a lot less painful
+func RequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if requestId == "" || len(requestId) > 128 {
+			requestId = uuid.New().String()
+		}
+
+		w.Header().Set(RequestIdHeader, requestId)
+		ctx := context.WithValue(r.Context(), requestIdKey, requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Get the request id for the current request, or an empty string if
+// the RequestId middleware has not run
+func GetRequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey).(string)
+	return requestId
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func loadSpec(t *testing.T) openAPIDocument {
+	t.Helper()
+
+	var doc openAPIDocument
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	return doc
+}
+
+// Collect every path + method registered on the router, e.g. "POST /api/v1/login".
+// Routes registered with a path prefix rather than a full path end in a "*"
+func registeredRoutes(t *testing.T) map[string]bool {
+	t.Helper()
+
+	router := NewRouter(Dependencies{JWTSecret: "test", JWTExpiry: time.Hour})
+	routes := map[string]bool{}
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		// subrouters (like the one for each version) have no handler, the
+		// routes on them are walked separately
+		if route.GetHandler() == nil {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		// a route that takes any method can't be checked against the
+		// operations in openapi.json, so every route has to say which
+		// methods it's for
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("route %s is registered without .Methods(...), so it can't be checked against openapi.json", path)
+			return nil
+		}
+		// mux only anchors the end of the pattern for full paths
+		if pattern, err := route.GetPathRegexp(); err == nil && !strings.HasSuffix(pattern, "$") {
+			path += "*"
+		}
+		for _, method := range methods {
+			routes[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk router: %v", err)
+	}
+	return routes
+}
+
+// Check whether a route matches a documented path; a prefix route matches
+// anything documented underneath it
+func routeMatches(route string, documented string) bool {
+	if prefix, ok := strings.CutSuffix(route, "*"); ok {
+		return strings.HasPrefix(documented, prefix)
+	}
+	return route == documented
+}
+
+func TestEveryRouteIsDocumented(t *testing.T) {
+	doc := loadSpec(t)
+
+	for route := range registeredRoutes(t) {
+		method, _, _ := strings.Cut(route, " ")
+		documented := false
+		for path, operations := range doc.Paths {
+			if _, ok := operations[strings.ToLower(method)]; ok && routeMatches(route, method+" "+path) {
+				documented = true
+				break
+			}
+		}
+		if !documented {
+			t.Errorf("route %s is registered but has no %s operation in openapi.json", route, strings.ToLower(method))
+		}
+	}
+}
+
+func TestEveryDocumentedRouteExists(t *testing.T) {
+	doc := loadSpec(t)
+	routes := registeredRoutes(t)
+
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			if method == "parameters" {
+				continue
+			}
+			documented := strings.ToUpper(method) + " " + path
+			registered := false
+			for route := range routes {
+				if routeMatches(route, documented) {
+					registered = true
+					break
+				}
+			}
+			if !registered {
+				t.Errorf("openapi.json documents %s but it is not registered on the router", documented)
+			}
+		}
+	}
+}
+
+// The deprecated routes at the root have to say so in the spec too
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Deprecated bool `json:"deprecated"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	for _, path := range []string{"/login", "/register"} {
+		operations, ok := doc.Paths[path]
+		if !ok {
+			t.Errorf("%s is missing from openapi.json", path)
+			continue
+		}
+		for method, operation := range operations {
+			if !operation.Deprecated {
+				t.Errorf("%s %s is not marked as deprecated in openapi.json", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// The docs page has to load a pinned copy of Redoc and have the browser
+// check it, rather than running whatever the CDN is serving today
+func TestDocsPagePinsRedoc(t *testing.T) {
+	if strings.Contains(docsPage, "/latest/") {
+		t.Errorf("the docs page loads the latest Redoc rather than a pinned version")
+	}
+	if !strings.Contains(docsPage, `src="`+redocScript+`"`) {
+		t.Errorf("the docs page doesn't load %s", redocScript)
+	}
+	if !strings.Contains(docsPage, `integrity="sha384-`) || !strings.Contains(docsPage, `crossorigin="anonymous"`) {
+		t.Errorf("the docs page doesn't check the integrity of Redoc")
+	}
+}
@@ -1,10 +1,15 @@
 package api
 
 import (
+	"net/http"
 	"time"
 
+	"github.com/oauthority/voxly-backend/internal/account"
 	"github.com/oauthority/voxly-backend/internal/api/handlers"
+	"github.com/oauthority/voxly-backend/internal/api/middleware"
 	"github.com/oauthority/voxly-backend/internal/auth"
+	"github.com/oauthority/voxly-backend/internal/registration"
+	"github.com/oauthority/voxly-backend/internal/user"
 
 	"github.com/gorilla/mux"
 )
@@ -14,6 +19,64 @@ import (
 type Dependencies struct {
 	JWTSecret string
 	JWTExpiry time.Duration
+
+	// how username changes are limited
+	UsernamePolicy user.UsernamePolicy
+	// how long deleted accounts and data exports stick around for
+	AccountPolicy account.Policy
+	// who can sign up through the API
+	RegistrationMode registration.Mode
+	// the proof of work needed to register
+	RegistrationChallenge registration.ChallengePolicy
+	// whether the admin routes, which are for internal callers, need a
+	// verified client certificate on top of an admin's token
+	RequireClientCert bool
+}
+
+// The prefix of the current version of the API, which is what openapi.json
+// describes
+const CurrentVersionPrefix = "/api/v1"
+
+// All of the handlers the routes are registered against; built once in
+// NewRouter and shared between every version of the API so that an older
+// version only needs to override what actually changed
+type routeHandlers struct {
+	login       *handlers.LoginHandler
+	register    *handlers.RegisterHandler
+	users       *handlers.UserHandler
+	account     *handlers.AccountHandler
+	requireAuth mux.MiddlewareFunc
+
+	requireClientCert bool
+}
+
+// A version of the API mounted under its own prefix. Several versions can
+// be mounted side by side; once a version is scheduled for removal give it a
+// deprecation so that clients are told to move on
+type apiVersion struct {
+	prefix      string
+	deprecation *middleware.Deprecation
+	register    func(r *mux.Router, h *routeHandlers)
+}
+
+// Every version of the API that we currently serve
+var apiVersions = []apiVersion{
+	{
+		prefix:   CurrentVersionPrefix,
+		register: registerV1,
+	},
+	{
+		// the original, unversioned routes at the root; these are kept around
+		// so that we don't break any existing clients, but they're going away
+		prefix: "",
+		deprecation: &middleware.Deprecation{
+			Since:     time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+			Sunset:    time.Date(2027, time.April, 19, 0, 0, 0, 0, time.UTC),
+			OldPrefix: "",
+			NewPrefix: CurrentVersionPrefix,
+		},
+		register: registerLegacy,
+	},
 }
 
 // Return an instance of the router and assign all of our routes
@@ -24,10 +87,162 @@ func NewRouter(deps Dependencies) *mux.Router {
 		JWTExpiry: deps.JWTExpiry,
 	}
 
-	loginHandler := handlers.NewLoginHandler(authConfig)
+	h := &routeHandlers{
+		login:       handlers.NewLoginHandler(authConfig),
+		register:    handlers.NewRegisterHandler(deps.RegistrationMode, deps.RegistrationChallenge),
+		users:       handlers.NewUserHandler(deps.UsernamePolicy),
+		account:     handlers.NewAccountHandler(deps.AccountPolicy),
+		requireAuth: middleware.RequireAuth(auth.NewAuthManager(authConfig), handlers.MiddlewareError),
+
+		requireClientCert: deps.RequireClientCert,
+	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/login", loginHandler.TryLogin).Methods("POST")
-	r.HandleFunc("/register", handlers.TryRegister).Methods("POST")
+	r.Use(middleware.RequestId)
+
+	// mux doesn't run middleware when nothing matches, so wrap these ourselves
+	// to make sure that the request id still ends up in the error response
+	r.NotFoundHandler = middleware.RequestId(http.HandlerFunc(handlers.NotFound))
+	r.MethodNotAllowedHandler = middleware.RequestId(http.HandlerFunc(handlers.MethodNotAllowed))
+
+	// uploaded media lives outside of the API versions, the URLs end up
+	// stored by clients so they must never change
+	r.PathPrefix("/media/").HandlerFunc(handlers.ServeMedia).Methods("GET", "HEAD")
+
+	// the spec describes every version, so it also lives somewhere that
+	// doesn't depend on one
+	r.HandleFunc("/openapi.json", serveOpenAPISpec).Methods("GET")
+
+	for _, version := range apiVersions {
+		var sub *mux.Router
+		if version.prefix == "" {
+			sub = r.NewRoute().Subrouter()
+		} else {
+			sub = r.PathPrefix(version.prefix).Subrouter()
+		}
+
+		if version.deprecation != nil {
+			sub.Use(middleware.Deprecated(*version.deprecation))
+		}
+		version.register(sub, h)
+	}
+
 	return r
 }
+
+// Routes for version 1 of the API, mounted under /api/v1
+func registerV1(r *mux.Router, h *routeHandlers) {
+	r.HandleFunc("/login", h.login.TryLogin).Methods("POST")
+	r.HandleFunc("/register", h.register.TryRegister).Methods("POST")
+	r.HandleFunc("/register/challenge", h.register.GetChallenge).Methods("POST")
+	r.HandleFunc("/registration", h.register.GetRegistrationInfo).Methods("GET")
+	r.HandleFunc("/invites/{code}", handlers.GetServerInvite).Methods("GET")
+
+	r.HandleFunc("/openapi.json", serveOpenAPISpec).Methods("GET")
+	r.HandleFunc("/docs", serveDocs).Methods("GET")
+
+	// everything from here on needs the user to be logged in
+	authed := r.NewRoute().Subrouter()
+	authed.Use(h.requireAuth)
+
+	authed.HandleFunc("/users/@me", handlers.GetCurrentUser).Methods("GET")
+	authed.HandleFunc("/users/@me", h.users.UpdateCurrentUser).Methods("PATCH")
+	authed.HandleFunc("/users/@me/username-history", h.users.GetUsernameHistory).Methods("GET")
+	authed.HandleFunc("/users/@me/settings", handlers.GetSettings).Methods("GET")
+	authed.HandleFunc("/users/@me/settings", handlers.UpdateSettings).Methods("PATCH")
+	authed.HandleFunc("/users/@me/events", handlers.StreamEvents).Methods("GET")
+	authed.HandleFunc("/users/@me/deletion", h.account.ScheduleDeletion).Methods("POST")
+	authed.HandleFunc("/users/@me/deletion", h.account.CancelDeletion).Methods("DELETE")
+	authed.HandleFunc("/users/@me/exports", h.account.RequestExport).Methods("POST")
+	authed.HandleFunc("/users/@me/exports", h.account.ListExports).Methods("GET")
+	authed.HandleFunc("/users/@me/exports/{id}", h.account.GetExport).Methods("GET")
+	authed.HandleFunc("/users/@me/exports/{id}/download", h.account.DownloadExport).Methods("GET")
+	authed.HandleFunc("/users/@me/avatar", handlers.UploadAvatar).Methods("PUT")
+	authed.HandleFunc("/users/@me/avatar", handlers.DeleteAvatar).Methods("DELETE")
+	authed.HandleFunc("/users/@me/banner", handlers.UploadBanner).Methods("PUT")
+	authed.HandleFunc("/users/@me/banner", handlers.DeleteBanner).Methods("DELETE")
+	authed.HandleFunc("/users/@me/presence", handlers.Heartbeat).Methods("POST")
+	authed.HandleFunc("/users/@me/presence", handlers.Disconnect).Methods("DELETE")
+	authed.HandleFunc("/users/@me/presence/custom-status", handlers.SetCustomStatus).Methods("PUT")
+	authed.HandleFunc("/users/@me/presence/custom-status", handlers.ClearCustomStatus).Methods("DELETE")
+	authed.HandleFunc("/users/@me/relationships", handlers.ListRelationships).Methods("GET")
+	authed.HandleFunc("/users/@me/friend-requests/{id}", handlers.SendFriendRequest).Methods("POST")
+	authed.HandleFunc("/users/@me/friend-requests/{id}", handlers.AcceptFriendRequest).Methods("PUT")
+	authed.HandleFunc("/users/@me/friend-requests/{id}", handlers.RemoveFriendRequest).Methods("DELETE")
+	authed.HandleFunc("/users/@me/friends/{id}", handlers.RemoveFriend).Methods("DELETE")
+	authed.HandleFunc("/users/@me/blocks/{id}", handlers.BlockUser).Methods("PUT")
+	authed.HandleFunc("/users/@me/blocks/{id}", handlers.UnblockUser).Methods("DELETE")
+	authed.HandleFunc("/users/@me/servers", handlers.ListServers).Methods("GET")
+	authed.HandleFunc("/users/search", handlers.SearchUsers).Methods("GET")
+	authed.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
+	authed.HandleFunc("/users/{id}/mutuals", handlers.GetMutuals).Methods("GET")
+
+	authed.HandleFunc("/servers", handlers.CreateServer).Methods("POST")
+	authed.HandleFunc("/servers/{serverId}", handlers.GetServer).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}", handlers.UpdateServer).Methods("PATCH")
+	authed.HandleFunc("/servers/{serverId}", handlers.DeleteServer).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/icon", handlers.UploadServerIcon).Methods("PUT")
+	authed.HandleFunc("/servers/{serverId}/icon", handlers.DeleteServerIcon).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/channels", handlers.ListChannels).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/channels", handlers.CreateChannel).Methods("POST")
+	authed.HandleFunc("/servers/{serverId}/channels", handlers.ReorderChannels).Methods("PATCH")
+	authed.HandleFunc("/servers/{serverId}/channels/{channelId}", handlers.GetChannel).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/channels/{channelId}", handlers.UpdateChannel).Methods("PATCH")
+	authed.HandleFunc("/servers/{serverId}/channels/{channelId}", handlers.DeleteChannel).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/channels/{channelId}/overwrites/{id}", handlers.SetOverwrite).Methods("PUT")
+	authed.HandleFunc("/servers/{serverId}/channels/{channelId}/overwrites/{id}", handlers.DeleteOverwrite).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/roles", handlers.ListRoles).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/roles", handlers.CreateRole).Methods("POST")
+	authed.HandleFunc("/servers/{serverId}/roles", handlers.ReorderRoles).Methods("PATCH")
+	authed.HandleFunc("/servers/{serverId}/roles/{roleId}", handlers.UpdateRole).Methods("PATCH")
+	authed.HandleFunc("/servers/{serverId}/roles/{roleId}", handlers.DeleteRole).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/members", handlers.ListMembers).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/members/{userId}", handlers.GetMember).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/members/{userId}", handlers.UpdateMember).Methods("PATCH")
+	authed.HandleFunc("/servers/{serverId}/members/{userId}", handlers.RemoveMember).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/members/{userId}/roles/{roleId}", handlers.AddMemberRole).Methods("PUT")
+	authed.HandleFunc("/servers/{serverId}/members/{userId}/roles/{roleId}", handlers.RemoveMemberRole).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/bans", handlers.ListBans).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/bans/{userId}", handlers.GetBan).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/bans/{userId}", handlers.BanMember).Methods("PUT")
+	authed.HandleFunc("/servers/{serverId}/bans/{userId}", handlers.UnbanMember).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/permissions", handlers.GetPermissions).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/audit-log", handlers.GetAuditLog).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/invites", handlers.ListServerInvites).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/invites", handlers.CreateServerInvite).Methods("POST")
+	authed.HandleFunc("/servers/{serverId}/template", handlers.GetServerTemplate).Methods("GET")
+	authed.HandleFunc("/servers/{serverId}/template", handlers.CreateServerTemplate).Methods("POST")
+	authed.HandleFunc("/servers/{serverId}/template", handlers.UpdateServerTemplate).Methods("PATCH")
+	authed.HandleFunc("/servers/{serverId}/template", handlers.DeleteServerTemplate).Methods("DELETE")
+	authed.HandleFunc("/servers/{serverId}/template/sync", handlers.SyncServerTemplate).Methods("POST")
+	authed.HandleFunc("/servers/{serverId}/listing", handlers.ListServer).Methods("PUT")
+	authed.HandleFunc("/servers/{serverId}/listing", handlers.UnlistServer).Methods("DELETE")
+	authed.HandleFunc("/directory", handlers.SearchDirectory).Methods("GET")
+	authed.HandleFunc("/directory/{serverId}/join", handlers.JoinListedServer).Methods("POST")
+	authed.HandleFunc("/templates/{code}", handlers.GetTemplate).Methods("GET")
+	authed.HandleFunc("/templates/{code}", handlers.CreateServerFromTemplate).Methods("POST")
+	authed.HandleFunc("/invites/{code}", handlers.AcceptServerInvite).Methods("POST")
+	authed.HandleFunc("/invites/{code}", handlers.DeleteServerInvite).Methods("DELETE")
+
+	// and everything from here on needs them to be an admin too
+	admin := authed.NewRoute().Subrouter()
+	admin.Use(handlers.RequireAdmin)
+	if h.requireClientCert {
+		admin.Use(handlers.RequireClientCert)
+	}
+
+	admin.HandleFunc("/admin/invites", handlers.ListInvites).Methods("GET")
+	admin.HandleFunc("/admin/invites", handlers.CreateInvite).Methods("POST")
+	admin.HandleFunc("/admin/invites/{code}", handlers.GetInvite).Methods("GET")
+	admin.HandleFunc("/admin/invites/{code}", handlers.RevokeInvite).Methods("DELETE")
+	admin.HandleFunc("/admin/directory/blocked", handlers.ListBlockedServers).Methods("GET")
+	admin.HandleFunc("/admin/directory/{serverId}/block", handlers.BlockServer).Methods("PUT")
+	admin.HandleFunc("/admin/directory/{serverId}/block", handlers.UnblockServer).Methods("DELETE")
+}
+
+// The original routes from before the API was versioned, don't add anything
+// new here!
+func registerLegacy(r *mux.Router, h *routeHandlers) {
+	r.HandleFunc("/login", h.login.TryLogin).Methods("POST")
+	r.HandleFunc("/register", h.register.TryRegister).Methods("POST")
+}
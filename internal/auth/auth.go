@@ -18,9 +18,12 @@ type AuthManager struct {
 	jwtExpiry time.Duration
 }
 
-// Claims stuff — we just include the userId to keep the JWT light
+// Claims stuff — we just include the userId and the session the token
+// belongs to, to keep the JWT light; the session lets us revoke a token
+// before it expires
 type Claims struct {
-	UserId string `json:"userId"`
+	UserId    string `json:"userId"`
+	SessionId string `json:"sessionId"`
 	jwt.RegisteredClaims
 }
 
@@ -34,12 +37,13 @@ func NewAuthManager(config Config) *AuthManager {
 
 // Generate a new JWT for a user so that we can return it to the user on the
 // frontend
-func (am *AuthManager) GenerateJWT(userId string) (string, time.Time, error) {
+func (am *AuthManager) GenerateJWT(userId string, sessionId string) (string, time.Time, error) {
 	now := time.Now()
 	expiry := now.Add(am.jwtExpiry)
 
 	claims := Claims{
 		userId,
+		sessionId,
 		jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expiry),
 			IssuedAt:  jwt.NewNumericDate(now),
@@ -57,19 +61,21 @@ func (am *AuthManager) GenerateJWT(userId string) (string, time.Time, error) {
 	return tokenString, expiry, nil
 }
 
-// Validate the JWT to make sure that it is valid, obviously!
-func (am *AuthManager) ValidateJWT(tokenString string) (string, error) {
+// Validate the JWT to make sure that it is valid, obviously! We only accept
+// the algorithm that we sign with, otherwise someone could hand us a token
+// signed with something else entirely
+func (am *AuthManager) ValidateJWT(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return am.jwtSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims.UserId, nil
+		return claims, nil
 	}
 
-	return "", fmt.Errorf("invalid token")
+	return nil, fmt.Errorf("invalid token")
 }
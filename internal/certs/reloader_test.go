@@ -0,0 +1,187 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseClientAuth(t *testing.T) {
+	tests := []struct {
+		mode string
+		want tls.ClientAuthType
+		ok   bool
+	}{
+		{"", tls.NoClientCert, true},
+		{"none", tls.NoClientCert, true},
+		{"optional", tls.VerifyClientCertIfGiven, true},
+		{"require", tls.RequireAndVerifyClientCert, true},
+		{"Require", tls.NoClientCert, false},
+		{"request", tls.NoClientCert, false},
+		{"yes", tls.NoClientCert, false},
+	}
+	for _, test := range tests {
+		got, err := ParseClientAuth(test.mode)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error %v, want ok %v", test.mode, err, test.ok)
+		}
+		if got != test.want {
+			t.Errorf("%q: got %v, want %v", test.mode, got, test.want)
+		}
+	}
+}
+
+// Write a freshly generated self-signed certificate and its key for
+// commonName to certFile and keyFile
+func writeCert(t *testing.T, certFile string, keyFile string, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+}
+
+// Make a file look modified, without relying on the clock having moved on
+// far enough for the filesystem to notice
+func touch(t *testing.T, file string, at time.Time) {
+	t.Helper()
+	if err := os.Chtimes(file, at, at); err != nil {
+		t.Fatalf("touching %s: %v", file, err)
+	}
+}
+
+// The common name of the certificate the reloader would hand out to the
+// next connection
+func servedName(t *testing.T, r *Reloader) string {
+	t.Helper()
+
+	config, err := r.TLSConfig(tls.NoClientCert).GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient: %v", err)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing served certificate: %v", err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "first")
+
+	r, err := NewReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	if got := servedName(t, r); got != "first" {
+		t.Fatalf("serving %q, want first", got)
+	}
+	if r.changed() {
+		t.Errorf("changed before anything was touched")
+	}
+
+	// a renewed certificate is picked up
+	writeCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	touch(t, certFile, later)
+	touch(t, keyFile, later)
+	if !r.changed() {
+		t.Fatalf("not changed after the certificate was replaced")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := servedName(t, r); got != "second" {
+		t.Errorf("serving %q after reloading, want second", got)
+	}
+	if r.changed() {
+		t.Errorf("still changed after reloading")
+	}
+
+	// a broken one isn't, we keep serving what we had
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+	touch(t, certFile, later.Add(time.Minute))
+	if !r.changed() {
+		t.Fatalf("not changed after the certificate was broken")
+	}
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload of a broken certificate succeeded")
+	}
+	if got := servedName(t, r); got != "second" {
+		t.Errorf("serving %q after a failed reload, want second", got)
+	}
+
+	// and a missing file doesn't count as a change, it's probably halfway
+	// through being replaced
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatalf("removing key: %v", err)
+	}
+	if r.changed() {
+		t.Errorf("changed while the key was missing")
+	}
+}
+
+func TestReloadClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCert(t, certFile, keyFile, "server")
+
+	if err := os.WriteFile(caFile, []byte("no certificates here"), 0o600); err != nil {
+		t.Fatalf("writing CA file: %v", err)
+	}
+	if _, err := NewReloader(certFile, keyFile, caFile); err == nil {
+		t.Fatalf("NewReloader succeeded with a CA file without any certificates")
+	}
+
+	// any certificate will do as a CA for checking that it gets loaded
+	writeCert(t, caFile, filepath.Join(dir, "ca-key.pem"), "ca")
+	r, err := NewReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	config, err := r.TLSConfig(tls.RequireAndVerifyClientCert).GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient: %v", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("got client auth %v with CAs %v, want RequireAndVerifyClientCert with the CA file", config.ClientAuth, config.ClientCAs)
+	}
+}
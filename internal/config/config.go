@@ -1,27 +1,221 @@
 package config
 
 import (
-    "time"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
 )
 
 type Config struct {
-    Server ServerConfig
-    Redis  RedisConfig
-    Auth   AuthConfig
+	Server       ServerConfig
+	Redis        RedisConfig
+	Auth         AuthConfig
+	Storage      StorageConfig
+	Users        UsersConfig
+	Account      AccountConfig
+	Registration RegistrationConfig
 }
 
 type ServerConfig struct {
-    Port string
+	Port string
+	TLS  TLSConfig
+}
+
+// Serving over HTTPS is enabled when both a cert and key file are set,
+// otherwise we serve plain HTTP as before
+type TLSConfig struct {
+	CertFile     string // path to the PEM encoded certificate (chain)
+	KeyFile      string // path to the PEM encoded private key
+	ClientCAFile string // CAs to verify client certificates against, for mutual TLS
+	ClientAuth   string // none, optional or require
+	RedirectPort string // if set, listen for plain HTTP here and redirect to HTTPS
+}
+
+// Are we serving over HTTPS?
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
 }
 
 type RedisConfig struct {
-    Host     string
-    Port     int
-    Password string
-    DB       int
+	Host     string
+	Port     int
+	Password string
+	DB       int
 }
 
 type AuthConfig struct {
-    JWTSecret string
-    JWTExpiry time.Duration
-}
\ No newline at end of file
+	JWTSecret string
+	JWTExpiry time.Duration
+}
+
+// Where uploaded files (avatars, banners et al.) are kept
+type StorageConfig struct {
+	MediaDir     string // the directory the local blob store writes to
+	MediaBaseURL string // the URL media is served from, /media unless there's a CDN in front
+}
+
+// Limits on what users can do to their own accounts
+type UsersConfig struct {
+	UsernameCooldown   time.Duration // how long between username changes
+	UsernameHoldPeriod time.Duration // how long a released username is kept for its old owner
+}
+
+// How long deleted accounts and data exports stick around for
+type AccountConfig struct {
+	DeletionGracePeriod time.Duration // how long a user has to change their mind about deleting their account
+	ExportExpiry        time.Duration // how long a data export can be downloaded for
+}
+
+// Who can sign up through the API
+type RegistrationConfig struct {
+	Mode string // open, invite or closed
+
+	// the proof of work challenge, see registration.ChallengePolicy
+	ChallengeDifficulty    int
+	ChallengeMaxDifficulty int
+	ChallengeLoadThreshold int
+	ChallengeTTL           time.Duration
+}
+
+// The .env file we load by default, relative to cmd/voxly; set ENV_FILE to
+// load one from somewhere else
+const defaultEnvFile = "../../.env"
+
+// Load the configuration from the environment; shared between the server and
+// the admin commands so that they always agree on where everything lives
+func Load() (*Config, error) {
+	envFile := os.Getenv("ENV_FILE")
+	if envFile == "" {
+		envFile = defaultEnvFile
+	}
+
+	// Try and load the environment variables, if we cannot do this then we cannot
+	// start the application as we depend on the env variables throughout the lifetime, so just
+	// refuse to start
+	if err := godotenv.Load(envFile); err != nil {
+		return nil, fmt.Errorf("error loading .env file: %w", err)
+	}
+
+	usernameCooldown, err := getEnvDuration("USERNAME_CHANGE_COOLDOWN", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	usernameHoldPeriod, err := getEnvDuration("USERNAME_HOLD_PERIOD", 14*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	deletionGracePeriod, err := getEnvDuration("ACCOUNT_DELETION_GRACE_PERIOD", 14*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	exportExpiry, err := getEnvDuration("DATA_EXPORT_EXPIRY", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	challengeDifficulty, err := getEnvInt("REGISTRATION_CHALLENGE_DIFFICULTY", 20)
+	if err != nil {
+		return nil, err
+	}
+	challengeMaxDifficulty, err := getEnvInt("REGISTRATION_CHALLENGE_MAX_DIFFICULTY", 26)
+	if err != nil {
+		return nil, err
+	}
+	challengeLoadThreshold, err := getEnvInt("REGISTRATION_CHALLENGE_LOAD_THRESHOLD", 60)
+	if err != nil {
+		return nil, err
+	}
+	challengeTTL, err := getEnvDuration("REGISTRATION_CHALLENGE_TTL", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	// anything over 32 bits would take a real client hours
+	if challengeDifficulty > 32 || challengeMaxDifficulty > 32 {
+		return nil, fmt.Errorf("registration challenge difficulty can't be more than 32")
+	}
+	if challengeMaxDifficulty < challengeDifficulty {
+		challengeMaxDifficulty = challengeDifficulty
+	}
+
+	return &Config{
+		Server: ServerConfig{
+			Port: os.Getenv("PORT"),
+			TLS: TLSConfig{
+				CertFile:     os.Getenv("TLS_CERT_FILE"),
+				KeyFile:      os.Getenv("TLS_KEY_FILE"),
+				ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+				ClientAuth:   os.Getenv("TLS_CLIENT_AUTH"),
+				RedirectPort: os.Getenv("HTTP_REDIRECT_PORT"),
+			},
+		},
+		Redis: RedisConfig{
+			Host:     os.Getenv("REDIS_HOST"),
+			Port:     6379,
+			Password: os.Getenv("REDIS_PASSWORD"),
+			DB:       0,
+		},
+		Auth: AuthConfig{
+			JWTSecret: os.Getenv("JWT_SECRET"),
+			JWTExpiry: 24 * time.Hour,
+		},
+		Storage: StorageConfig{
+			MediaDir:     getEnvDefault("MEDIA_DIR", "media"),
+			MediaBaseURL: getEnvDefault("MEDIA_BASE_URL", "/media"),
+		},
+		Users: UsersConfig{
+			UsernameCooldown:   usernameCooldown,
+			UsernameHoldPeriod: usernameHoldPeriod,
+		},
+		Account: AccountConfig{
+			DeletionGracePeriod: deletionGracePeriod,
+			ExportExpiry:        exportExpiry,
+		},
+		Registration: RegistrationConfig{
+			Mode:                   getEnvDefault("REGISTRATION_MODE", "open"),
+			ChallengeDifficulty:    challengeDifficulty,
+			ChallengeMaxDifficulty: challengeMaxDifficulty,
+			ChallengeLoadThreshold: challengeLoadThreshold,
+			ChallengeTTL:           challengeTTL,
+		},
+	}, nil
+}
+
+// Get an environment variable, falling back to a default if it isn't set
+func getEnvDefault(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Get an environment variable as a duration (e.g. "720h"), falling back to a
+// default if it isn't set
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q for %s", value, key)
+	}
+	return duration, nil
+}
+
+// Get an environment variable as a whole number that can't be negative,
+// falling back to a default if it isn't set
+func getEnvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q for %s", value, key)
+	}
+	return n, nil
+}
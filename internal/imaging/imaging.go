@@ -0,0 +1,165 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+)
+
+// The formats that we accept uploads in, by the MIME type that
+// http.DetectContentType sniffs from the first few bytes of the file
+var decoders = map[string]func(io.Reader) (image.Image, error){
+	"image/png":  png.Decode,
+	"image/jpeg": jpeg.Decode,
+	"image/gif":  gif.Decode, // only the first frame, we don't do animated images (yet)
+}
+
+var configDecoders = map[string]func(io.Reader) (image.Config, error){
+	"image/png":  png.DecodeConfig,
+	"image/jpeg": jpeg.DecodeConfig,
+	"image/gif":  gif.DecodeConfig,
+}
+
+var (
+	ErrTooLarge          = errors.New("image is too large")
+	ErrUnsupportedFormat = errors.New("image must be a PNG, JPEG or GIF")
+	ErrDimensions        = errors.New("image dimensions are out of bounds")
+	ErrCorrupt           = errors.New("image could not be decoded")
+)
+
+// The limits an upload has to fit within
+type Limits struct {
+	MaxBytes  int64 // the largest file we'll accept
+	MinWidth  int
+	MinHeight int
+	MaxWidth  int
+	MaxHeight int
+}
+
+// Read an image from r, working out what it is from its contents rather than
+// trusting whatever the client claims it is. The dimensions are checked from
+// the header before the image is decoded, so we don't go and allocate a huge
+// amount of memory for a tiny file claiming to be 50000x50000
+func Decode(r io.Reader, limits Limits) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limits.MaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, ErrTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	decode, ok := decoders[contentType]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+
+	config, err := configDecoders[contentType](bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	if config.Width < limits.MinWidth || config.Height < limits.MinHeight ||
+		config.Width > limits.MaxWidth || config.Height > limits.MaxHeight {
+		return nil, ErrDimensions
+	}
+
+	img, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return img, nil
+}
+
+// Crop the largest area out of the middle of the image that has the given
+// aspect ratio, e.g. 1:1 for avatars
+func CropToAspect(img image.Image, aspectWidth int, aspectHeight int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	cropWidth, cropHeight := width, width*aspectHeight/aspectWidth
+	if cropHeight > height {
+		cropWidth, cropHeight = height*aspectWidth/aspectHeight, height
+	}
+
+	x := bounds.Min.X + (width-cropWidth)/2
+	y := bounds.Min.Y + (height-cropHeight)/2
+	crop := image.Rect(x, y, x+cropWidth, y+cropHeight)
+
+	dst := image.NewRGBA(image.Rect(0, 0, cropWidth, cropHeight))
+	draw.Draw(dst, dst.Bounds(), img, crop.Min, draw.Src)
+	return dst
+}
+
+// Scale an image to exactly the given size. When shrinking, every pixel is
+// the average of the source pixels it covers, which looks a lot better than
+// nearest neighbour for photos; when growing it falls back to nearest
+// neighbour, which is good enough as we only ever grow tiny images
+func Resize(img image.Image, width int, height int) *image.RGBA {
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max((y+1)*srcHeight/height, y0+1)
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max((x+1)*srcWidth/width, x0+1)
+
+			// RGBA is premultiplied, so averaging the channels directly
+			// doesn't bleed colour out of transparent pixels
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[offset])
+					g += uint64(src.Pix[offset+1])
+					b += uint64(src.Pix[offset+2])
+					a += uint64(src.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+
+	return dst
+}
+
+// Encode an image so that it can be stored. Anything with transparency is
+// stored as a PNG and everything else as a JPEG; as we always encode from
+// scratch none of the metadata from the upload (EXIF, GPS et al.) survives.
+// Returns the encoded image and the extension to store it with
+func Encode(img *image.RGBA) ([]byte, string, error) {
+	var buf bytes.Buffer
+
+	if img.Opaque() {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, "", fmt.Errorf("failed to encode JPEG: %w", err)
+		}
+		return buf.Bytes(), "jpg", nil
+	}
+
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, "", fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), "png", nil
+}
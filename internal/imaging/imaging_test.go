@@ -0,0 +1,200 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// A solid image of the given size
+func solid(width int, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encoded(t *testing.T, format string, width int, height int) []byte {
+	t.Helper()
+
+	img := solid(width, height, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("encoding %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	limits := Limits{MaxBytes: 1 << 20, MinWidth: 16, MinHeight: 16, MaxWidth: 1024, MaxHeight: 1024}
+	pngData := encoded(t, "png", 64, 32)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		limits Limits
+		want   error
+		width  int
+		height int
+	}{
+		{"png", pngData, limits, nil, 64, 32},
+		{"jpeg", encoded(t, "jpeg", 64, 32), limits, nil, 64, 32},
+		{"gif", encoded(t, "gif", 64, 32), limits, nil, 64, 32},
+		{"exactly the smallest", encoded(t, "png", 16, 16), limits, nil, 16, 16},
+		{"exactly the largest", encoded(t, "png", 1024, 1024), limits, nil, 1024, 1024},
+		{"exactly the byte limit", pngData, Limits{MaxBytes: int64(len(pngData)), MaxWidth: 1024, MaxHeight: 1024}, nil, 64, 32},
+		{"a byte over the limit", pngData, Limits{MaxBytes: int64(len(pngData)) - 1, MaxWidth: 1024, MaxHeight: 1024}, ErrTooLarge, 0, 0},
+		{"too narrow", encoded(t, "png", 15, 32), limits, ErrDimensions, 0, 0},
+		{"too short", encoded(t, "png", 32, 15), limits, ErrDimensions, 0, 0},
+		{"too wide", encoded(t, "png", 1025, 32), limits, ErrDimensions, 0, 0},
+		{"too tall", encoded(t, "png", 32, 1025), limits, ErrDimensions, 0, 0},
+		{"text", []byte("definitely not an image"), limits, ErrUnsupportedFormat, 0, 0},
+		{"empty", []byte{}, limits, ErrUnsupportedFormat, 0, 0},
+		{"bmp", append([]byte("BM"), make([]byte, 64)...), limits, ErrUnsupportedFormat, 0, 0},
+		{"webp", append([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), make([]byte, 64)...), limits, ErrUnsupportedFormat, 0, 0},
+		{"truncated png", pngData[:len(pngData)/2], limits, ErrCorrupt, 0, 0},
+		{"png header only", pngData[:16], limits, ErrCorrupt, 0, 0},
+	}
+	for _, test := range tests {
+		img, err := Decode(bytes.NewReader(test.data), test.limits)
+		if err != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := img.Bounds(); got.Dx() != test.width || got.Dy() != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, got.Dx(), got.Dy(), test.width, test.height)
+		}
+	}
+}
+
+// The format is sniffed from the contents, so a PNG is a PNG whatever the
+// upload claims, and a file that claims to be a PNG but isn't is rejected
+func TestDecodeSniffsFormat(t *testing.T) {
+	limits := Limits{MaxBytes: 1 << 20, MaxWidth: 1024, MaxHeight: 1024}
+
+	jpegData := encoded(t, "jpeg", 32, 32)
+	if _, err := Decode(bytes.NewReader(jpegData), limits); err != nil {
+		t.Errorf("jpeg: %v", err)
+	}
+
+	// a JPEG with a PNG signature stuck on the front sniffs as a PNG, and
+	// then doesn't decode as one
+	disguised := append([]byte("\x89PNG\r\n\x1a\n"), jpegData...)
+	if _, err := Decode(bytes.NewReader(disguised), limits); err != ErrCorrupt {
+		t.Errorf("disguised jpeg: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestCropToAspect(t *testing.T) {
+	tests := []struct {
+		name          string
+		bounds        image.Rectangle
+		aspectWidth   int
+		aspectHeight  int
+		width, height int
+	}{
+		{"square to square", image.Rect(0, 0, 100, 100), 1, 1, 100, 100},
+		{"wide to square", image.Rect(0, 0, 200, 100), 1, 1, 100, 100},
+		{"tall to square", image.Rect(0, 0, 100, 300), 1, 1, 100, 100},
+		{"square to a banner", image.Rect(0, 0, 300, 300), 3, 1, 300, 100},
+		{"very wide to a banner", image.Rect(0, 0, 1000, 100), 3, 1, 300, 100},
+		{"odd sizes", image.Rect(0, 0, 101, 57), 16, 9, 101, 56},
+		{"bounds not at the origin", image.Rect(50, 50, 250, 150), 1, 1, 100, 100},
+	}
+	for _, test := range tests {
+		img := image.NewRGBA(test.bounds)
+		got := CropToAspect(img, test.aspectWidth, test.aspectHeight).Bounds()
+		if got.Dx() != test.width || got.Dy() != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, got.Dx(), got.Dy(), test.width, test.height)
+		}
+		if got.Min != (image.Point{}) {
+			t.Errorf("%s: cropped image starts at %v, want the origin", test.name, got.Min)
+		}
+	}
+}
+
+// The crop comes from the middle of the image
+func TestCropToAspectCentres(t *testing.T) {
+	img := solid(300, 100, color.RGBA{A: 255})
+	for y := 0; y < 100; y++ {
+		for x := 100; x < 200; x++ {
+			img.Set(x, y, color.RGBA{R: 255, A: 255})
+		}
+	}
+
+	cropped := CropToAspect(img, 1, 1)
+	for _, p := range []image.Point{{0, 0}, {99, 0}, {0, 99}, {99, 99}, {50, 50}} {
+		if r, _, _, _ := cropped.At(p.X, p.Y).RGBA(); r != 0xffff {
+			t.Errorf("pixel %v of the crop isn't from the middle of the image", p)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name          string
+		srcWidth      int
+		srcHeight     int
+		width, height int
+	}{
+		{"shrink", 512, 512, 128, 128},
+		{"shrink unevenly", 500, 300, 64, 64},
+		{"grow", 16, 16, 64, 64},
+		{"same size", 64, 64, 64, 64},
+		{"to a single pixel", 100, 100, 1, 1},
+		{"banner", 1500, 500, 600, 200},
+	}
+	for _, test := range tests {
+		src := solid(test.srcWidth, test.srcHeight, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+		got := Resize(src, test.width, test.height)
+		if got.Bounds() != image.Rect(0, 0, test.width, test.height) {
+			t.Errorf("%s: got %v, want %dx%d", test.name, got.Bounds(), test.width, test.height)
+			continue
+		}
+		// a solid colour stays exactly that colour whatever the scaling
+		if c := got.RGBAAt(test.width-1, test.height-1); c != (color.RGBA{R: 10, G: 20, B: 30, A: 255}) {
+			t.Errorf("%s: got colour %v, want it unchanged", test.name, c)
+		}
+	}
+}
+
+func TestEncodeFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		img  *image.RGBA
+		want string
+	}{
+		{"opaque", solid(8, 8, color.RGBA{R: 255, A: 255}), "jpg"},
+		{"transparent", solid(8, 8, color.RGBA{}), "png"},
+		{"partly transparent", solid(8, 8, color.RGBA{R: 128, A: 128}), "png"},
+	}
+	for _, test := range tests {
+		_, ext, err := Encode(test.img)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if ext != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, ext, test.want)
+		}
+	}
+}
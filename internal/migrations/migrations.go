@@ -0,0 +1,137 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The collection we keep track of which migrations have been applied in
+const migrationsCollection = "migrations"
+
+// A change to the data that's already in Mongo, applied once and in order.
+// Migrations have to be safe to run again if they fail half way through,
+// since they're only recorded as applied once they finish
+type Migration struct {
+	Id          string // never change this once the migration has shipped
+	Description string
+	Up          func(ctx context.Context) error
+}
+
+// Every migration, oldest first; only ever add to the end of this
+var all = []Migration{
+	userDocumentFields,
+	usernameCaseDuplicates,
+	userSearchFields,
+}
+
+// A migration that has been applied, as recorded in Mongo
+type applied struct {
+	Id        string    `bson:"id"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// Where a migration is up to
+type Status struct {
+	Id          string     `json:"id"`
+	Description string     `json:"description"`
+	AppliedAt   *time.Time `json:"appliedAt"`
+}
+
+// List every migration and whether it has been applied yet
+func List(ctx context.Context) ([]Status, error) {
+	cursor, err := database.GetCollection(migrationsCollection).Find(ctx, map[string]interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	var records []applied
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode migrations: %w", err)
+	}
+	appliedAt := make(map[string]time.Time, len(records))
+	for _, record := range records {
+		appliedAt[record.Id] = record.AppliedAt
+	}
+
+	statuses := make([]Status, len(all))
+	for i, migration := range all {
+		statuses[i] = Status{Id: migration.Id, Description: migration.Description}
+		if at, ok := appliedAt[migration.Id]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// Get the ids of every migration that hasn't been applied yet
+func Pending(ctx context.Context) ([]string, error) {
+	statuses, err := List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []string{}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Id)
+		}
+	}
+	return pending, nil
+}
+
+// Apply every migration that hasn't been applied yet, in order, stopping at
+// the first one that fails. Returns the ids of the ones that were applied
+func Run(ctx context.Context) ([]string, error) {
+	pending, err := Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	isPending := make(map[string]bool, len(pending))
+	for _, id := range pending {
+		isPending[id] = true
+	}
+
+	ran := []string{}
+	for _, migration := range all {
+		if !isPending[migration.Id] {
+			continue
+		}
+
+		if err := migration.Up(ctx); err != nil {
+			return ran, fmt.Errorf("migration %s failed: %w", migration.Id, err)
+		}
+
+		_, err := database.GetCollection(migrationsCollection).UpdateOne(ctx,
+			map[string]interface{}{"id": migration.Id},
+			map[string]interface{}{"$set": applied{Id: migration.Id, AppliedAt: time.Now().UTC()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return ran, fmt.Errorf("failed to record migration %s: %w", migration.Id, err)
+		}
+		ran = append(ran, migration.Id)
+	}
+	return ran, nil
+}
+
+// Drop an index if it exists; migrations that rename fields have to get rid
+// of the indexes on the old names themselves
+func dropIndexIfExists(ctx context.Context, collection string, name string) error {
+	_, err := database.GetCollection(collection).Indexes().DropOne(ctx, name)
+	if err == nil {
+		return nil
+	}
+	// 27 is IndexNotFound, and 26 is NamespaceNotFound for when the
+	// collection doesn't exist at all
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && (commandErr.Code == 27 || commandErr.Code == 26) {
+		return nil
+	}
+	return fmt.Errorf("failed to drop index %s: %w", name, err)
+}
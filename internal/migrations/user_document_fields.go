@@ -0,0 +1,134 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The British format that registration dates used to be stored in
+const legacyRegistrationDateFormat = "02/01/2006 15:04:05"
+
+// Users used to be stored without any bson tags, so every field ended up
+// named after the lowercased Go field, and the registration date was a
+// British formatted string. Rename the fields to match the tags on user.User,
+// turn the registration date into a real date, and drop the zero dates that
+// used to stand in for "never"
+var userDocumentFields = Migration{
+	Id:          "0001_user_document_fields",
+	Description: "rename user fields to camelCase and store registration dates as dates",
+	Up: func(ctx context.Context) error {
+		users := database.GetCollection("users")
+
+		_, err := users.UpdateMany(ctx, bson.D{}, bson.D{{Key: "$rename", Value: bson.D{
+			{Key: "usernamechangedat", Value: "usernameChangedAt"},
+			{Key: "deletionscheduledat", Value: "deletionScheduledAt"},
+			{Key: "usernamelower", Value: "usernameLower"},
+			{Key: "usernamegrams", Value: "usernameGrams"},
+			{Key: "namelower", Value: "nameLower"},
+			{Key: "namegrams", Value: "nameGrams"},
+		}}})
+		if err != nil {
+			return fmt.Errorf("failed to rename user fields: %w", err)
+		}
+
+		for _, field := range []string{"usernameChangedAt", "deletionScheduledAt"} {
+			_, err := users.UpdateMany(ctx,
+				bson.D{{Key: field, Value: time.Time{}}},
+				bson.D{{Key: "$unset", Value: bson.D{{Key: field, Value: ""}}}},
+			)
+			if err != nil {
+				return fmt.Errorf("failed to clear empty %s: %w", field, err)
+			}
+		}
+
+		if err := convertRegistrationDates(ctx, users); err != nil {
+			return err
+		}
+
+		for _, index := range []string{"usernamelower_1", "namelower_1", "usernamegrams_1", "namegrams_1", "deletionscheduledat_1"} {
+			if err := dropIndexIfExists(ctx, "users", index); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// Turn every registrationdate string into a registeredAt date
+func convertRegistrationDates(ctx context.Context, users *mongo.Collection) error {
+	cursor, err := users.Find(ctx, bson.D{{Key: "registrationdate", Value: bson.D{{Key: "$exists", Value: true}}}})
+	if err != nil {
+		return fmt.Errorf("failed to find registration dates: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		if _, err := users.BulkWrite(ctx, models); err != nil {
+			return fmt.Errorf("failed to convert registration dates: %w", err)
+		}
+		models = models[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			Id               string      `bson:"id"`
+			RegistrationDate interface{} `bson:"registrationdate"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("failed to decode user: %w", err)
+		}
+
+		registeredAt, err := parseRegistrationDate(doc.RegistrationDate)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", doc.Id, err)
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "id", Value: doc.Id}}).
+			SetUpdate(bson.D{
+				{Key: "$set", Value: bson.D{{Key: "registeredAt", Value: registeredAt}}},
+				{Key: "$unset", Value: bson.D{{Key: "registrationdate", Value: ""}}},
+			}))
+		if len(models) >= 500 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to find registration dates: %w", err)
+	}
+	return flush()
+}
+
+// Registration dates were always written in the British format in UTC, but
+// be forgiving of anything that somebody might have fixed up by hand
+func parseRegistrationDate(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case string:
+		for _, layout := range []string{legacyRegistrationDateFormat, time.RFC3339} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("can't parse registration date %q", v)
+	case time.Time:
+		return v.UTC(), nil
+	default:
+		// the driver decodes dates into interface{} as primitive.DateTime
+		if dt, ok := v.(interface{ Time() time.Time }); ok {
+			return dt.Time().UTC(), nil
+		}
+		return time.Time{}, fmt.Errorf("unexpected registration date %v", v)
+	}
+}
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRegistrationDate(t *testing.T) {
+	want := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  time.Time
+		ok    bool
+	}{
+		{"legacy format", "04/03/2021 05:06:07", want, true},
+		{"RFC3339 in UTC", "2021-03-04T05:06:07Z", want, true},
+		{"RFC3339 with an offset", "2021-03-04T07:06:07+02:00", want, true},
+		{"time", want.In(time.FixedZone("EST", -5*60*60)), want, true},
+		{"mongo date", primitive.NewDateTimeFromTime(want), want, true},
+		{"American format", "03/04/2021 05:06:07 PM", time.Time{}, false},
+		{"day out of range", "32/01/2021 05:06:07", time.Time{}, false},
+		{"empty string", "", time.Time{}, false},
+		{"number", 1614834367, time.Time{}, false},
+		{"nil", nil, time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseRegistrationDate(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if !got.Equal(test.want) || got.Location() != time.UTC {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
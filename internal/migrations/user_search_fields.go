@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// Users from before search existed have no usernameLower, usernameGrams,
+// nameLower or nameGrams, so they can't be found, and the case-insensitive
+// username checks can't see them either. Fill them in for everyone who
+// hasn't deleted their account; this has to come after the case duplicates
+// are renamed, or the unique index on usernameLower would turn them away
+var userSearchFields = Migration{
+	Id:          "0003_user_search_fields",
+	Description: "fill in the search fields for existing users",
+	Up: func(ctx context.Context) error {
+		_, err := user.ReindexSearch(ctx)
+		return err
+	},
+}
@@ -0,0 +1,138 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The longest a username could be when this migration was written
+const maxDedupedUsernameLength = 32
+
+// Usernames used to be unique only in the exact case they were written in,
+// so "Alice" and "alice" could both exist, and the unique index on
+// usernameLower can't be created until they don't. The account that has had
+// a name the longest keeps it, and everyone else sharing it is renamed to
+// the first free "name_2", "name_3" and so on, with the rename recorded in
+// their username history like any other. Deleted accounts are left out, the
+// index ignores them
+var usernameCaseDuplicates = Migration{
+	Id:          "0002_username_case_duplicates",
+	Description: "rename accounts whose usernames differ only by case",
+	Up: func(ctx context.Context) error {
+		users := database.GetCollection("users")
+
+		cursor, err := users.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.D{{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}}}}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{{Key: "$toLower", Value: "$username"}}},
+				{Key: "accounts", Value: bson.D{{Key: "$push", Value: bson.D{
+					{Key: "id", Value: "$id"},
+					{Key: "username", Value: "$username"},
+					{Key: "registeredAt", Value: "$registeredAt"},
+				}}}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to find duplicate usernames: %w", err)
+		}
+
+		var groups []struct {
+			Accounts []caseDuplicate `bson:"accounts"`
+		}
+		if err := cursor.All(ctx, &groups); err != nil {
+			return fmt.Errorf("failed to decode duplicate usernames: %w", err)
+		}
+
+		for _, group := range groups {
+			sortCaseDuplicates(group.Accounts)
+			for _, account := range group.Accounts[1:] {
+				if err := renameCaseDuplicate(ctx, users, account); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// One of the accounts sharing a username
+type caseDuplicate struct {
+	Id           string    `bson:"id"`
+	Username     string    `bson:"username"`
+	RegisteredAt time.Time `bson:"registeredAt"`
+}
+
+// Put the account that keeps the username first; that's whoever registered
+// first, with the id breaking ties so that re-running picks the same one
+func sortCaseDuplicates(accounts []caseDuplicate) {
+	sort.Slice(accounts, func(i, j int) bool {
+		if !accounts[i].RegisteredAt.Equal(accounts[j].RegisteredAt) {
+			return accounts[i].RegisteredAt.Before(accounts[j].RegisteredAt)
+		}
+		return accounts[i].Id < accounts[j].Id
+	})
+}
+
+// The nth candidate for a new username, cutting the old one short so that
+// the suffix still fits
+func dedupedUsername(username string, n int) string {
+	suffix := "_" + strconv.Itoa(n)
+	base := []rune(username)
+	for len(string(base))+len(suffix) > maxDedupedUsernameLength {
+		base = base[:len(base)-1]
+	}
+	return string(base) + suffix
+}
+
+// Give an account the first free deduplicated version of its username
+func renameCaseDuplicate(ctx context.Context, users *mongo.Collection, account caseDuplicate) error {
+	for n := 2; ; n++ {
+		username := dedupedUsername(account.Username, n)
+
+		// usernameLower can't be trusted to be filled in yet, so compare
+		// the usernames themselves
+		count, err := users.CountDocuments(ctx, bson.D{{Key: "username", Value: bson.D{
+			{Key: "$regex", Value: "^" + regexp.QuoteMeta(username) + "$"},
+			{Key: "$options", Value: "i"},
+		}}})
+		if err != nil {
+			return fmt.Errorf("failed to check username %s: %w", username, err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		_, err = users.UpdateOne(ctx, bson.D{{Key: "id", Value: account.Id}}, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "username", Value: username},
+			{Key: "usernameLower", Value: strings.ToLower(strings.TrimSpace(username))},
+		}}})
+		if err != nil {
+			return fmt.Errorf("failed to rename user %s: %w", account.Id, err)
+		}
+
+		_, err = database.GetCollection("username_history").InsertOne(ctx, bson.D{
+			{Key: "userId", Value: account.Id},
+			{Key: "oldUsername", Value: account.Username},
+			{Key: "newUsername", Value: username},
+			{Key: "changedAt", Value: time.Now().UTC()},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record rename of user %s: %w", account.Id, err)
+		}
+
+		log.Printf("Renamed user %s from %s to %s, another account already has that username", account.Id, account.Username, username)
+		return nil
+	}
+}
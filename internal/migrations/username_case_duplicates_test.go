@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupedUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		n        int
+		want     string
+	}{
+		{"alice", 2, "alice_2"},
+		{"Alice", 10, "Alice_10"},
+		{strings.Repeat("a", 30), 2, strings.Repeat("a", 30) + "_2"},
+		{strings.Repeat("a", 31), 2, strings.Repeat("a", 30) + "_2"},
+		{strings.Repeat("a", 32), 100, strings.Repeat("a", 28) + "_100"},
+		{"é" + strings.Repeat("a", 30), 2, "é" + strings.Repeat("a", 28) + "_2"},
+	}
+	for _, test := range tests {
+		got := dedupedUsername(test.username, test.n)
+		if got != test.want {
+			t.Errorf("%s, %d: got %s, want %s", test.username, test.n, got, test.want)
+		}
+		if len(got) > maxDedupedUsernameLength {
+			t.Errorf("%s, %d: %s is longer than %d", test.username, test.n, got, maxDedupedUsernameLength)
+		}
+	}
+}
+
+func TestSortCaseDuplicates(t *testing.T) {
+	earlier := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+
+	accounts := []caseDuplicate{
+		{Id: "c", Username: "ALICE", RegisteredAt: later},
+		{Id: "b", Username: "Alice", RegisteredAt: earlier},
+		{Id: "a", Username: "alice", RegisteredAt: later},
+	}
+	sortCaseDuplicates(accounts)
+
+	got := []string{}
+	for _, account := range accounts {
+		got = append(got, account.Id)
+	}
+	if want := []string{"b", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,124 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// A proof of work challenge handed out to somebody who wants to register;
+// see internal/registration for what solving one means
+type Challenge struct {
+	Id         string    `json:"id"`
+	Prefix     string    `json:"prefix"`     // random, so that solutions can't be worked out ahead of time
+	Difficulty int       `json:"difficulty"` // how many leading zero bits the hash needs
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// struct for handing out and redeeming challenges through redis
+type ChallengeManager struct {
+	client *redis.Client
+}
+
+// Get the ChallengeManager
+func GetChallengeManager() (*ChallengeManager, error) {
+	if client == nil {
+		return nil, fmt.Errorf("redis connection not initialized")
+	}
+	return &ChallengeManager{client: client}, nil
+}
+
+// Every challenge lives under its own key until it's used or expires, and we
+// count how many are handed out each minute so that the difficulty can go up
+// when somebody is hammering us
+func challengeKey(id string) string {
+	return fmt.Sprintf("pow_challenge:%s", id)
+}
+
+func challengesIssuedKey(minute int64) string {
+	return fmt.Sprintf("pow_issued:%d", minute)
+}
+
+// How many challenges were handed out over the last minute or so; the
+// current minute only counts for whatever part of it has gone by, so we add
+// on the matching share of the one before
+func (cm *ChallengeManager) RecentlyIssued() (int64, error) {
+	ctx := context.Background()
+	now := time.Now()
+	minute := now.Unix() / 60
+
+	counts, err := cm.client.MGet(ctx, challengesIssuedKey(minute), challengesIssuedKey(minute-1)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count challenges: %v", err)
+	}
+
+	var current, previous int64
+	if s, ok := counts[0].(string); ok {
+		fmt.Sscan(s, &current)
+	}
+	if s, ok := counts[1].(string); ok {
+		fmt.Sscan(s, &previous)
+	}
+
+	elapsed := float64(now.Unix()%60) / 60
+	return current + int64(float64(previous)*(1-elapsed)), nil
+}
+
+// Hand out a new challenge at the given difficulty which can be used once
+// before it expires
+func (cm *ChallengeManager) Issue(difficulty int, ttl time.Duration) (*Challenge, error) {
+	prefix := make([]byte, 16)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate challenge: %v", err)
+	}
+
+	challenge := &Challenge{
+		Id:         uuid.New().String(),
+		Prefix:     hex.EncodeToString(prefix),
+		Difficulty: difficulty,
+		ExpiresAt:  time.Now().UTC().Add(ttl),
+	}
+	data, err := json.Marshal(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal challenge: %v", err)
+	}
+
+	ctx := context.Background()
+	issuedKey := challengesIssuedKey(time.Now().Unix() / 60)
+
+	pipe := cm.client.TxPipeline()
+	pipe.Set(ctx, challengeKey(challenge.Id), data, ttl)
+	pipe.Incr(ctx, issuedKey)
+	pipe.Expire(ctx, issuedKey, 2*time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store challenge: %v", err)
+	}
+	return challenge, nil
+}
+
+// Take a challenge so that it can be checked, returning nil if it doesn't
+// exist or has expired. The challenge is deleted in the same step, so each
+// one can only ever be taken once whether or not the solution turns out to
+// be right
+func (cm *ChallengeManager) Take(id string) (*Challenge, error) {
+	ctx := context.Background()
+	data, err := cm.client.GetDel(ctx, challengeKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get challenge: %v", err)
+	}
+
+	var challenge Challenge
+	if err := json.Unmarshal(data, &challenge); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal challenge: %v", err)
+	}
+	return &challenge, nil
+}
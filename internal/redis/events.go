@@ -0,0 +1,106 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Something that happened to a user which every device they're logged in on
+// should hear about, e.g. their settings changing on another device
+type UserEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+	// the session that caused the event, so that the device which made the
+	// change can ignore its own echo
+	SessionId string    `json:"sessionId,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Every user gets a pub/sub channel of their own, so that whichever server a
+// device is connected to hears about changes made through any other
+func userEventsChannel(userId string) string {
+	return fmt.Sprintf("user_events:%s", userId)
+}
+
+// Tell every device a user is connected from about something; nobody
+// listening is perfectly fine, the event is just dropped
+func PublishUserEvent(userId string, eventType string, sessionId string, data interface{}) error {
+	if client == nil {
+		return fmt.Errorf("redis connection not initialized")
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	event, err := json.Marshal(UserEvent{
+		Type:      eventType,
+		Data:      payload,
+		SessionId: sessionId,
+		At:        time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := client.Publish(ctx, userEventsChannel(userId), event).Err(); err != nil {
+		return fmt.Errorf("failed to publish event: %v", err)
+	}
+	return nil
+}
+
+// A subscription to the events for a user, Close it once you're done
+type UserEventSubscription struct {
+	pubsub *redis.PubSub
+	events chan UserEvent
+}
+
+// Subscribe to the events for a user until the context is cancelled or the
+// subscription is closed
+func SubscribeUserEvents(ctx context.Context, userId string) (*UserEventSubscription, error) {
+	if client == nil {
+		return nil, fmt.Errorf("redis connection not initialized")
+	}
+
+	pubsub := client.Subscribe(ctx, userEventsChannel(userId))
+	// wait for the subscription to be confirmed, otherwise anything published
+	// straight after we return could be missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to events: %v", err)
+	}
+
+	sub := &UserEventSubscription{
+		pubsub: pubsub,
+		events: make(chan UserEvent),
+	}
+	go func() {
+		defer close(sub.events)
+		for message := range pubsub.Channel() {
+			var event UserEvent
+			if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// The events as they arrive; closed when the subscription is
+func (s *UserEventSubscription) Events() <-chan UserEvent {
+	return s.events
+}
+
+func (s *UserEventSubscription) Close() error {
+	return s.pubsub.Close()
+}
@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The status a user shows to everyone else
+type PresenceStatus string
+
+const (
+	StatusOnline       PresenceStatus = "online"
+	StatusIdle         PresenceStatus = "idle"
+	StatusDoNotDisturb PresenceStatus = "dnd"
+	StatusInvisible    PresenceStatus = "invisible" // shown as offline to everyone else
+	StatusOffline      PresenceStatus = "offline"   // never sent by clients, it's what you are with no devices
+)
+
+const (
+	// How often clients should send a heartbeat
+	HeartbeatInterval = 30 * time.Second
+	// How long after its last heartbeat a device is considered gone; a few
+	// intervals so that one dropped request doesn't flick someone offline
+	PresenceTimeout = 3 * HeartbeatInterval
+)
+
+// When a user is connected from several devices, the status that wins; an
+// explicit choice (invisible, do not disturb) always beats being online, and
+// being online anywhere beats being idle somewhere else
+var statusPriority = map[PresenceStatus]int{
+	StatusInvisible:    4,
+	StatusDoNotDisturb: 3,
+	StatusOnline:       2,
+	StatusIdle:         1,
+}
+
+// Is this a status that a client may send in a heartbeat?
+func (s PresenceStatus) Valid() bool {
+	_, ok := statusPriority[s]
+	return ok
+}
+
+// A bit of text the user shows alongside their status, optionally expiring
+type CustomStatus struct {
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// The presence of a user, aggregated over every device they're connected from
+type Presence struct {
+	Status       PresenceStatus `json:"status"`
+	CustomStatus *CustomStatus  `json:"customStatus,omitempty"`
+	Devices      int            `json:"devices,omitempty"`
+}
+
+// How the presence looks to anyone other than the user themselves; invisible
+// users look exactly like offline ones, and nobody sees a custom status for
+// someone who isn't around
+func (p Presence) Public() Presence {
+	if p.Status == StatusInvisible || p.Status == StatusOffline {
+		return Presence{Status: StatusOffline}
+	}
+	return Presence{Status: p.Status, CustomStatus: p.CustomStatus}
+}
+
+// Is the user online, in any form, as far as everyone else is concerned?
+func (p Presence) Online() bool {
+	return p.Public().Status != StatusOffline
+}
+
+// struct for tracking presence through redis
+type PresenceManager struct {
+	client *redis.Client
+}
+
+// Get the PresenceManager
+func GetPresenceManager() (*PresenceManager, error) {
+	if client == nil {
+		return nil, fmt.Errorf("redis connection not initialized")
+	}
+	return &PresenceManager{client: client}, nil
+}
+
+// Every device a user has is stored in a sorted set scored by the time of its
+// last heartbeat, with the status each device reported in a hash alongside it.
+// Both expire a timeout after the last heartbeat from any device, so a user
+// that vanishes without saying goodbye drops offline all by themselves
+func presenceDevicesKey(userId string) string {
+	return fmt.Sprintf("presence_devices:%s", userId)
+}
+
+func presenceStatusesKey(userId string) string {
+	return fmt.Sprintf("presence_statuses:%s", userId)
+}
+
+func customStatusKey(userId string) string {
+	return fmt.Sprintf("presence_custom:%s", userId)
+}
+
+// Record a heartbeat from one of a users devices and return their presence
+func (pm *PresenceManager) Heartbeat(userId string, deviceId string, status PresenceStatus) (*Presence, error) {
+	if !status.Valid() {
+		return nil, fmt.Errorf("invalid status %q", status)
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	pipe := pm.client.TxPipeline()
+	pipe.ZAdd(ctx, presenceDevicesKey(userId), redis.Z{Score: float64(now.UnixMilli()), Member: deviceId})
+	pipe.HSet(ctx, presenceStatusesKey(userId), deviceId, string(status))
+	pipe.Expire(ctx, presenceDevicesKey(userId), PresenceTimeout)
+	pipe.Expire(ctx, presenceStatusesKey(userId), PresenceTimeout)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to record heartbeat: %v", err)
+	}
+
+	return pm.GetPresence(userId)
+}
+
+// Forget about a device straight away, e.g. when the client is closed,
+// rather than waiting for it to time out
+func (pm *PresenceManager) Disconnect(userId string, deviceId string) error {
+	ctx := context.Background()
+	pipe := pm.client.TxPipeline()
+	pipe.ZRem(ctx, presenceDevicesKey(userId), deviceId)
+	pipe.HDel(ctx, presenceStatusesKey(userId), deviceId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to disconnect device: %v", err)
+	}
+	return nil
+}
+
+// Forget about every device a user has, e.g. when all of their sessions are
+// revoked
+func (pm *PresenceManager) DisconnectAll(userId string) error {
+	ctx := context.Background()
+	return pm.client.Del(ctx, presenceDevicesKey(userId), presenceStatusesKey(userId)).Err()
+}
+
+// Set the custom status for a user, a nil expiry means it sticks around
+// until it's cleared
+func (pm *PresenceManager) SetCustomStatus(userId string, text string, expiresAt *time.Time) (*CustomStatus, error) {
+	custom := &CustomStatus{Text: text, ExpiresAt: expiresAt}
+	data, err := json.Marshal(custom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal custom status: %v", err)
+	}
+
+	var ttl time.Duration
+	if expiresAt != nil {
+		ttl = time.Until(*expiresAt)
+		if ttl <= 0 {
+			return nil, fmt.Errorf("custom status expiry is in the past")
+		}
+	}
+
+	ctx := context.Background()
+	if err := pm.client.Set(ctx, customStatusKey(userId), data, ttl).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store custom status: %v", err)
+	}
+	return custom, nil
+}
+
+// Clear the custom status for a user
+func (pm *PresenceManager) ClearCustomStatus(userId string) error {
+	ctx := context.Background()
+	return pm.client.Del(ctx, customStatusKey(userId)).Err()
+}
+
+// Get the presence of a single user, as they see it themselves
+func (pm *PresenceManager) GetPresence(userId string) (*Presence, error) {
+	presences, err := pm.GetPresences([]string{userId})
+	if err != nil {
+		return nil, err
+	}
+	return presences[userId], nil
+}
+
+// Get the presence of several users at once, keyed by user id. These are the
+// real presences, use Public() before sending them to anyone else
+func (pm *PresenceManager) GetPresences(userIds []string) (map[string]*Presence, error) {
+	ctx := context.Background()
+	cutoff := strconv.FormatInt(time.Now().Add(-PresenceTimeout).UnixMilli(), 10)
+
+	type pending struct {
+		devices  *redis.StringSliceCmd
+		expired  *redis.StringSliceCmd
+		statuses *redis.MapStringStringCmd
+		custom   *redis.StringCmd
+	}
+
+	pipe := pm.client.Pipeline()
+	results := make(map[string]pending, len(userIds))
+	for _, userId := range userIds {
+		results[userId] = pending{
+			devices:  pipe.ZRangeByScore(ctx, presenceDevicesKey(userId), &redis.ZRangeBy{Min: "(" + cutoff, Max: "+inf"}),
+			expired:  pipe.ZRangeByScore(ctx, presenceDevicesKey(userId), &redis.ZRangeBy{Min: "-inf", Max: cutoff}),
+			statuses: pipe.HGetAll(ctx, presenceStatusesKey(userId)),
+			custom:   pipe.Get(ctx, customStatusKey(userId)),
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get presence: %v", err)
+	}
+
+	presences := make(map[string]*Presence, len(userIds))
+	for userId, result := range results {
+		presence := &Presence{Status: StatusOffline}
+
+		// only devices which have sent a heartbeat recently count, any
+		// others have gone away without telling us
+		statuses := result.statuses.Val()
+		for _, deviceId := range result.devices.Val() {
+			status := PresenceStatus(statuses[deviceId])
+			if !status.Valid() {
+				continue
+			}
+			presence.Devices++
+			if statusPriority[status] > statusPriority[presence.Status] {
+				presence.Status = status
+			}
+		}
+
+		if data, err := result.custom.Result(); err == nil {
+			var custom CustomStatus
+			if err := json.Unmarshal([]byte(data), &custom); err == nil {
+				presence.CustomStatus = &custom
+			}
+		}
+
+		presences[userId] = presence
+	}
+
+	// tidy up any devices that have timed out, along with the statuses they
+	// reported, it doesn't matter if this fails. A device that comes back
+	// in the meantime just reappears with its next heartbeat
+	cleanup := pm.client.Pipeline()
+	for userId, result := range results {
+		expired := result.expired.Val()
+		if len(expired) == 0 {
+			continue
+		}
+		members := make([]interface{}, len(expired))
+		for i, deviceId := range expired {
+			members[i] = deviceId
+		}
+		cleanup.ZRem(ctx, presenceDevicesKey(userId), members...)
+		cleanup.HDel(ctx, presenceStatusesKey(userId), expired...)
+	}
+	cleanup.Exec(ctx)
+
+	return presences, nil
+}
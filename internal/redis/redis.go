@@ -1,12 +1,12 @@
-package redis 
+package redis
 
-import( 
-	"github.com/redis/go-redis/v9"
-	"sync"
+import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sync"
 	"time"
-	"encoding/json"
 )
 
 // struct for the config object
@@ -24,14 +24,16 @@ type SessionManager struct {
 
 // Struct to represent a session stored in Redis
 type Session struct {
+	Id        string    `json:"id"`
 	UserId    string    `json:"userId"`
 	CreatedAt time.Time `json:"createdAt"`
 	ExpiresAt time.Time `json:"expiresAt"`
 }
 
 var (
+	client         *redis.Client
 	sessionManager *SessionManager
-	once          sync.Once
+	once           sync.Once
 )
 
 // Initialize a new Redis client with the given configuration
@@ -39,7 +41,7 @@ var (
 func Initialize(config Config) error {
 	var initErr error
 	once.Do(func() {
-		client := redis.NewClient(&redis.Options{
+		c := redis.NewClient(&redis.Options{
 			Addr:     fmt.Sprintf("%s:%d", config.Host, config.Port),
 			Password: config.Password,
 			DB:       config.DB,
@@ -50,14 +52,15 @@ func Initialize(config Config) error {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		_, err := client.Ping(ctx).Result()
+		_, err := c.Ping(ctx).Result()
 		if err != nil {
 			initErr = fmt.Errorf("failed to connect to Redis: %v", err)
 			return
 		}
 
+		client = c
 		sessionManager = &SessionManager{
-			client: client,
+			client: c,
 		}
 	})
 
@@ -75,6 +78,7 @@ func GetConnection() (*SessionManager, error) {
 // Create a new session in redis!
 func (sm *SessionManager) CreateSession(sessionId string, userId string, duration time.Duration) (*Session, error) {
 	session := &Session{
+		Id:        sessionId,
 		UserId:    userId,
 		CreatedAt: time.Now(),
 		ExpiresAt: time.Now().Add(duration),
@@ -85,23 +89,28 @@ func (sm *SessionManager) CreateSession(sessionId string, userId string, duratio
 		return nil, fmt.Errorf("failed to marshal session: %v", err)
 	}
 
+	// keep track of every session a user has so that we can list and revoke
+	// them later on, the set lives as long as the newest session does
 	ctx := context.Background()
-	err = sm.client.Set(ctx, fmt.Sprintf("session:%s", sessionId), data, duration).Err()
-	if err != nil {
+	pipe := sm.client.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("session:%s", sessionId), data, duration)
+	pipe.SAdd(ctx, userSessionsKey(userId), sessionId)
+	pipe.Expire(ctx, userSessionsKey(userId), duration)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return nil, fmt.Errorf("failed to store session: %v", err)
 	}
 
 	return session, nil
 }
 
-// Retrieve a session from Redis 
+// Retrieve a session from Redis
 func (sm *SessionManager) GetSession(sessionId string) (*Session, error) {
 	ctx := context.Background()
 	data, err := sm.client.Get(ctx, fmt.Sprintf("session:%s", sessionId)).Result()
 	if err != nil {
 		if err == redis.Nil {
 			// we didn't find a session in redis for this user
-			return nil, nil 
+			return nil, nil
 		}
 		return nil, fmt.Errorf("failed to get session: %v", err)
 	}
@@ -132,12 +141,78 @@ func (sm *SessionManager) ExtendSession(sessionId string, duration time.Duration
 	}
 
 	ctx := context.Background()
-	return sm.client.Set(ctx, fmt.Sprintf("session:%s", sessionId), data, duration).Err()
+	pipe := sm.client.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("session:%s", sessionId), data, duration)
+	pipe.Expire(ctx, userSessionsKey(session.UserId), duration)
+	_, err = pipe.Exec(ctx)
+	return err
 }
 
 // Remove a session from Redis
 // useful if we need to somehow log everyone out!
 func (sm *SessionManager) DeleteSession(sessionId string) error {
+	session, err := sm.GetSession(sessionId)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	pipe := sm.client.TxPipeline()
+	pipe.Del(ctx, fmt.Sprintf("session:%s", sessionId))
+	if session != nil {
+		pipe.SRem(ctx, userSessionsKey(session.UserId), sessionId)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// List all of the sessions that a user currently has, tidying up any
+// sessions which have since expired along the way
+func (sm *SessionManager) ListUserSessions(userId string) ([]*Session, error) {
+	ctx := context.Background()
+	sessionIds, err := sm.client.SMembers(ctx, userSessionsKey(userId)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+
+	sessions := []*Session{}
+	for _, sessionId := range sessionIds {
+		session, err := sm.GetSession(sessionId)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			sm.client.SRem(ctx, userSessionsKey(userId), sessionId)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// Remove every session for a user, logging them out everywhere; returns
+// the number of sessions that were revoked
+func (sm *SessionManager) RevokeUserSessions(userId string) (int, error) {
+	sessions, err := sm.ListUserSessions(userId)
+	if err != nil {
+		return 0, err
+	}
+
 	ctx := context.Background()
-	return sm.client.Del(ctx, fmt.Sprintf("session:%s", sessionId)).Err()
-}
\ No newline at end of file
+	pipe := sm.client.TxPipeline()
+	for _, session := range sessions {
+		pipe.Del(ctx, fmt.Sprintf("session:%s", session.Id))
+	}
+	pipe.Del(ctx, userSessionsKey(userId))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+
+	return len(sessions), nil
+}
+
+// The key of the set holding the ids of every session for a user
+func userSessionsKey(userId string) string {
+	return fmt.Sprintf("user_sessions:%s", userId)
+}
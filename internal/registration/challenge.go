@@ -0,0 +1,100 @@
+package registration
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/redis"
+)
+
+// Solutions are whatever the client likes (usually a counter), within reason
+const maxSolutionLength = 64
+
+// The challenge doesn't exist, has expired, has already been used or the
+// solution is wrong; we deliberately don't say which
+var ErrChallengeFailed = errors.New("proof of work challenge failed")
+
+// How hard the proof of work for registering is. Every registration has to
+// come with the solution to a challenge we handed out: a string which, when
+// appended to the challenge prefix, gives a SHA-256 hash starting with at
+// least Difficulty zero bits. That costs a real client a second or two once,
+// but makes scripting thousands of signups expensive. When more than
+// LoadThreshold challenges are being handed out a minute, each doubling on
+// top of that adds another bit (i.e. doubles the work), up to MaxDifficulty
+type ChallengePolicy struct {
+	Difficulty    int // 0 turns the challenge off altogether
+	MaxDifficulty int
+	LoadThreshold int64 // challenges a minute before the difficulty starts going up
+	TTL           time.Duration
+}
+
+// Is a challenge needed to register at all?
+func (p ChallengePolicy) Enabled() bool {
+	return p.Difficulty > 0
+}
+
+// Work out the difficulty given how many challenges were handed out over the
+// last minute
+func (p ChallengePolicy) difficultyFor(issued int64) int {
+	difficulty := p.Difficulty
+	if p.LoadThreshold <= 0 {
+		return difficulty
+	}
+	for load := issued; load >= p.LoadThreshold && difficulty < p.MaxDifficulty; load /= 2 {
+		difficulty++
+	}
+	return difficulty
+}
+
+// Hand out a new challenge, harder than usual if we're under load
+func IssueChallenge(policy ChallengePolicy) (*redis.Challenge, error) {
+	challengeManager, err := redis.GetChallengeManager()
+	if err != nil {
+		return nil, err
+	}
+
+	issued, err := challengeManager.RecentlyIssued()
+	if err != nil {
+		return nil, err
+	}
+	return challengeManager.Issue(policy.difficultyFor(issued), policy.TTL)
+}
+
+// Check the solution to a challenge, using the challenge up whether or not
+// it's right so that every attempt needs a new one
+func VerifyChallenge(id string, solution string) error {
+	if id == "" || solution == "" || len(solution) > maxSolutionLength {
+		return ErrChallengeFailed
+	}
+
+	challengeManager, err := redis.GetChallengeManager()
+	if err != nil {
+		return err
+	}
+
+	challenge, err := challengeManager.Take(id)
+	if err != nil {
+		return err
+	}
+	if challenge == nil || !solves(challenge.Prefix, solution, challenge.Difficulty) {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+// Does the SHA-256 hash of prefix+solution start with enough zero bits?
+func solves(prefix string, solution string, difficulty int) bool {
+	hash := sha256.Sum256([]byte(prefix + solution))
+
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= difficulty
+}
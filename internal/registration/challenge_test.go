@@ -0,0 +1,104 @@
+package registration
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Count the leading zero bits of a hash one bit at a time, so that solves
+// is checked against something other than itself
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	for i := 0; i < len(hash)*8; i++ {
+		if hash[i/8]&(0x80>>(i%8)) != 0 {
+			return i
+		}
+	}
+	return len(hash) * 8
+}
+
+// Find a solution whose hash starts with exactly zeros zero bits
+func findSolution(t *testing.T, prefix string, zeros int) string {
+	t.Helper()
+	for i := 0; i < 1<<22; i++ {
+		solution := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(prefix+solution))) == zeros {
+			return solution
+		}
+	}
+	t.Fatalf("no solution with exactly %d zero bits", zeros)
+	return ""
+}
+
+func TestSolves(t *testing.T) {
+	const prefix = "voxly-test-prefix"
+	// 7, 8 and 9 are either side of the first byte boundary, and 15, 16 and
+	// 17 the second
+	for _, zeros := range []int{0, 1, 7, 8, 9, 15, 16, 17} {
+		solution := findSolution(t, prefix, zeros)
+		tests := []struct {
+			difficulty int
+			want       bool
+		}{
+			{0, true},
+			{zeros - 1, true},
+			{zeros, true},
+			{zeros + 1, false},
+			{zeros + 8, false},
+		}
+		for _, test := range tests {
+			if test.difficulty < 0 {
+				continue
+			}
+			if got := solves(prefix, solution, test.difficulty); got != test.want {
+				t.Errorf("%d zero bits, difficulty %d: got %v, want %v", zeros, test.difficulty, got, test.want)
+			}
+		}
+	}
+}
+
+func TestDifficultyFor(t *testing.T) {
+	policy := ChallengePolicy{Difficulty: 16, MaxDifficulty: 20, LoadThreshold: 100}
+	tests := []struct {
+		name   string
+		policy ChallengePolicy
+		issued int64
+		want   int
+	}{
+		{"idle", policy, 0, 16},
+		{"just under the threshold", policy, 99, 16},
+		{"at the threshold", policy, 100, 17},
+		{"under double the threshold", policy, 199, 17},
+		{"double the threshold", policy, 200, 18},
+		{"four times the threshold", policy, 400, 19},
+		{"eight times the threshold", policy, 800, 20},
+		{"capped", policy, 1 << 40, 20},
+		{"max below the base", ChallengePolicy{Difficulty: 16, MaxDifficulty: 10, LoadThreshold: 100}, 1000, 16},
+		{"no threshold", ChallengePolicy{Difficulty: 16, MaxDifficulty: 20}, 1 << 40, 16},
+		{"negative threshold", ChallengePolicy{Difficulty: 16, MaxDifficulty: 20, LoadThreshold: -1}, 1 << 40, 16},
+	}
+	for _, test := range tests {
+		if got := test.policy.difficultyFor(test.issued); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// Anything that's obviously wrong is turned away before Redis is involved
+func TestVerifyChallengeRejectsBadSolutions(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		solution string
+	}{
+		{"no id", "", "1234"},
+		{"no solution", "challenge", ""},
+		{"solution too long", "challenge", strings.Repeat("1", maxSolutionLength+1)},
+	}
+	for _, test := range tests {
+		if err := VerifyChallenge(test.id, test.solution); err != ErrChallengeFailed {
+			t.Errorf("%s: got %v, want ErrChallengeFailed", test.name, err)
+		}
+	}
+}
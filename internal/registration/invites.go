@@ -0,0 +1,211 @@
+package registration
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that invite codes are stored in
+const invitesCollection = "registration_invites"
+
+// Codes are made up of characters that can't be mixed up with each other
+// when somebody reads one out or types it in, so no 0/O or 1/I
+const (
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength   = 10
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	// the code doesn't exist, has expired, has been revoked or has been used
+	// up; we deliberately don't say which
+	ErrInviteInvalid = errors.New("invite code is not valid")
+)
+
+// A code which lets somebody register while registration is invite only
+type Invite struct {
+	Code      string     `bson:"code" json:"code"`
+	CreatedBy string     `bson:"createdBy,omitempty" json:"createdBy,omitempty"` // the admin who made it, empty if it came from the CLI
+	CreatedAt time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty" json:"expiresAt"` // nil if it never expires
+	MaxUses   int        `bson:"maxUses" json:"maxUses"`               // 0 means it can be used any number of times
+	Uses      int        `bson:"uses" json:"uses"`
+	RevokedAt *time.Time `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+}
+
+// Can the invite still be used to register?
+func (i *Invite) Usable(now time.Time) bool {
+	if i.RevokedAt != nil {
+		return false
+	}
+	if i.ExpiresAt != nil && !i.ExpiresAt.After(now) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+// Normalize a code the way somebody typed it in; codes are stored in upper
+// case and people have a habit of pasting spaces along with them
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Generate a new random invite code
+func generateCode() (string, error) {
+	var code strings.Builder
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := 0; i < codeLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate invite code: %w", err)
+		}
+		code.WriteByte(codeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// Create a new invite code. maxUses of 1 gives a single use code and 0 one
+// that can be used any number of times; expiresAt can be nil for a code that
+// never expires
+func CreateInvite(ctx context.Context, createdBy string, maxUses int, expiresAt *time.Time) (*Invite, error) {
+	if maxUses < 0 {
+		return nil, fmt.Errorf("max uses can't be negative")
+	}
+
+	code, err := generateCode()
+	if err != nil {
+		return nil, err
+	}
+
+	invite := &Invite{
+		Code:      code,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+		MaxUses:   maxUses,
+	}
+	if _, err := database.GetCollection(invitesCollection).InsertOne(ctx, invite); err != nil {
+		return nil, fmt.Errorf("failed to save invite: %w", err)
+	}
+	return invite, nil
+}
+
+// List every invite, newest first
+func ListInvites(ctx context.Context) ([]Invite, error) {
+	cursor, err := database.GetCollection(invitesCollection).Find(ctx,
+		map[string]interface{}{},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invites: %w", err)
+	}
+
+	invites := []Invite{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		return nil, fmt.Errorf("failed to decode invites: %w", err)
+	}
+	return invites, nil
+}
+
+// Get a single invite by its code
+func GetInvite(ctx context.Context, code string) (*Invite, error) {
+	var invite Invite
+	err := database.GetCollection(invitesCollection).FindOne(ctx,
+		map[string]interface{}{"code": NormalizeCode(code)},
+	).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find invite: %w", err)
+	}
+	return &invite, nil
+}
+
+// Revoke an invite so that it can't be used any more. The invite itself is
+// kept so that we can still tell which accounts registered with it
+func RevokeInvite(ctx context.Context, code string) (*Invite, error) {
+	var invite Invite
+	err := database.GetCollection(invitesCollection).FindOneAndUpdate(ctx,
+		map[string]interface{}{"code": NormalizeCode(code)},
+		map[string]interface{}{"$set": map[string]interface{}{"revokedAt": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke invite: %w", err)
+	}
+	return &invite, nil
+}
+
+// Use up one use of an invite, returning ErrInviteInvalid if it can't be
+// used. This is a single update so that two people can't both squeeze
+// through on the last use of a code
+func Redeem(ctx context.Context, code string) (*Invite, error) {
+	var invite Invite
+	err := database.GetCollection(invitesCollection).FindOneAndUpdate(ctx,
+		map[string]interface{}{
+			"code":      NormalizeCode(code),
+			"revokedAt": map[string]interface{}{"$exists": false},
+			"$and": []map[string]interface{}{
+				{"$or": []map[string]interface{}{
+					{"expiresAt": map[string]interface{}{"$exists": false}},
+					{"expiresAt": map[string]interface{}{"$gt": time.Now().UTC()}},
+				}},
+				{"$or": []map[string]interface{}{
+					{"maxUses": 0},
+					{"$expr": map[string]interface{}{"$lt": []string{"$uses", "$maxUses"}}},
+				}},
+			},
+		},
+		map[string]interface{}{"$inc": map[string]interface{}{"uses": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInviteInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem invite: %w", err)
+	}
+	return &invite, nil
+}
+
+// Give back a use of an invite which was redeemed for a registration that
+// then failed, so that the code isn't burnt for nothing
+func Release(ctx context.Context, code string) error {
+	_, err := database.GetCollection(invitesCollection).UpdateOne(ctx,
+		map[string]interface{}{
+			"code": NormalizeCode(code),
+			"uses": map[string]interface{}{"$gt": 0},
+		},
+		map[string]interface{}{"$inc": map[string]interface{}{"uses": -1}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release invite: %w", err)
+	}
+	return nil
+}
+
+// Codes are unique, obviously
+func ensureInviteIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(invitesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create invite indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package registration
+
+import (
+	"context"
+	"fmt"
+)
+
+// Who is allowed to sign up through the API. Admins can always create
+// accounts with `voxly user create`, whatever the mode
+type Mode string
+
+const (
+	ModeOpen   Mode = "open"   // anyone can register
+	ModeInvite Mode = "invite" // registering needs a valid invite code
+	ModeClosed Mode = "closed" // nobody can register through the API
+)
+
+// Parse the registration mode from the configuration, open if it isn't set
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case "", ModeOpen:
+		return ModeOpen, nil
+	case ModeInvite, ModeClosed:
+		return Mode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown registration mode %q", mode)
+	}
+}
+
+// Make sure every index the registration package relies on exists
+func EnsureIndexes(ctx context.Context) error {
+	return ensureInviteIndexes(ctx)
+}
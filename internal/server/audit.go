@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that audit log entries are stored in
+const auditCollection = "server_audit_log"
+
+// How long audit log entries are kept for before Mongo throws them away
+const AuditLogRetention = 90 * 24 * time.Hour
+
+type AuditAction string
+
+const (
+	AuditServerUpdate     AuditAction = "server_update"
+	AuditChannelCreate    AuditAction = "channel_create"
+	AuditChannelUpdate    AuditAction = "channel_update"
+	AuditChannelDelete    AuditAction = "channel_delete"
+	AuditOverwriteCreate  AuditAction = "overwrite_create"
+	AuditOverwriteUpdate  AuditAction = "overwrite_update"
+	AuditOverwriteDelete  AuditAction = "overwrite_delete"
+	AuditRoleCreate       AuditAction = "role_create"
+	AuditRoleUpdate       AuditAction = "role_update"
+	AuditRoleDelete       AuditAction = "role_delete"
+	AuditMemberUpdate     AuditAction = "member_update"
+	AuditMemberRoleAdd    AuditAction = "member_role_add"
+	AuditMemberRoleRemove AuditAction = "member_role_remove"
+	AuditMemberKick       AuditAction = "member_kick"
+	AuditMemberBan        AuditAction = "member_ban"
+	AuditMemberUnban      AuditAction = "member_unban"
+	AuditInviteCreate     AuditAction = "invite_create"
+	AuditInviteDelete     AuditAction = "invite_delete"
+	AuditTemplateCreate   AuditAction = "template_create"
+	AuditTemplateUpdate   AuditAction = "template_update"
+	AuditTemplateDelete   AuditAction = "template_delete"
+)
+
+var auditActions = map[AuditAction]bool{
+	AuditServerUpdate: true, AuditChannelCreate: true, AuditChannelUpdate: true, AuditChannelDelete: true,
+	AuditOverwriteCreate: true, AuditOverwriteUpdate: true, AuditOverwriteDelete: true,
+	AuditRoleCreate: true, AuditRoleUpdate: true, AuditRoleDelete: true,
+	AuditMemberUpdate: true, AuditMemberRoleAdd: true, AuditMemberRoleRemove: true,
+	AuditMemberKick: true, AuditMemberBan: true, AuditMemberUnban: true,
+	AuditInviteCreate: true, AuditInviteDelete: true,
+	AuditTemplateCreate: true, AuditTemplateUpdate: true, AuditTemplateDelete: true,
+}
+
+func (a AuditAction) Valid() bool {
+	return auditActions[a]
+}
+
+// What sort of thing the target of an audit log entry is
+type AuditTargetType string
+
+const (
+	AuditTargetServer   AuditTargetType = "server"
+	AuditTargetChannel  AuditTargetType = "channel"
+	AuditTargetRole     AuditTargetType = "role"
+	AuditTargetUser     AuditTargetType = "user"
+	AuditTargetInvite   AuditTargetType = "invite"
+	AuditTargetTemplate AuditTargetType = "template"
+)
+
+// One thing that somebody did to a server
+type AuditEntry struct {
+	Id         string          `bson:"id" json:"id"`
+	ServerId   string          `bson:"serverId" json:"-"`
+	Action     AuditAction     `bson:"action" json:"action"`
+	ActorId    string          `bson:"actorId" json:"actorId"`
+	TargetType AuditTargetType `bson:"targetType" json:"targetType"`
+	TargetId   string          `bson:"targetId" json:"targetId"`
+	Changes    []AuditChange   `bson:"changes" json:"changes"`
+	Reason     string          `bson:"reason" json:"reason"`
+	CreatedAt  time.Time       `bson:"createdAt" json:"createdAt"`
+}
+
+// A single field that an action changed. Old is null for things which were
+// created and New is null for things which were deleted
+type AuditChange struct {
+	Key string      `bson:"key" json:"key"`
+	Old interface{} `bson:"old" json:"old"`
+	New interface{} `bson:"new" json:"new"`
+}
+
+// Work out which fields differ between two snapshots of something, in key
+// order; either can be nil for something being created or deleted
+func Diff(before map[string]interface{}, after map[string]interface{}) []AuditChange {
+	keys := []string{}
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []AuditChange{}
+	for _, key := range keys {
+		old, new := before[key], after[key]
+		if !reflect.DeepEqual(old, new) {
+			changes = append(changes, AuditChange{Key: key, Old: old, New: new})
+		}
+	}
+	return changes
+}
+
+// The fields of each kind of target that are worth keeping track of, for
+// passing to Diff
+
+func (s *Server) AuditFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"name":        s.Name,
+		"description": s.Description,
+		"icon":        s.Icon,
+		"ownerId":     s.OwnerId,
+		"vanityCode":  s.VanityCode,
+		"listed":      s.Listing != nil,
+		"category":    nil,
+		"tags":        nil,
+	}
+	if s.Listing != nil {
+		fields["category"] = string(s.Listing.Category)
+		fields["tags"] = s.Listing.Tags
+	}
+	return fields
+}
+
+func (c *Channel) AuditFields() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     string(c.Type),
+		"name":     c.Name,
+		"topic":    c.Topic,
+		"nsfw":     c.NSFW,
+		"parentId": c.ParentId,
+		"position": c.Position,
+	}
+}
+
+func (o *Overwrite) AuditFields() map[string]interface{} {
+	return map[string]interface{}{
+		"id":    o.Id,
+		"type":  string(o.Type),
+		"allow": int64(o.Allow),
+		"deny":  int64(o.Deny),
+	}
+}
+
+func (r *Role) AuditFields() map[string]interface{} {
+	return map[string]interface{}{
+		"name":        r.Name,
+		"color":       r.Color,
+		"permissions": int64(r.Permissions),
+		"position":    r.Position,
+	}
+}
+
+func (m *Member) AuditFields() map[string]interface{} {
+	return map[string]interface{}{
+		"nickname": m.Nickname,
+	}
+}
+
+func (i *Invite) AuditFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"code":      i.Code,
+		"channelId": i.ChannelId,
+		"maxUses":   i.MaxUses,
+		"temporary": i.Temporary,
+		"expiresAt": nil,
+	}
+	if i.ExpiresAt != nil {
+		fields["expiresAt"] = *i.ExpiresAt
+	}
+	return fields
+}
+
+func (t *Template) AuditFields() map[string]interface{} {
+	return map[string]interface{}{
+		"code":        t.Code,
+		"name":        t.Name,
+		"description": t.Description,
+		"syncedAt":    t.SyncedAt,
+	}
+}
+
+// Add an entry to the audit log of a server
+func RecordAudit(ctx context.Context, entry AuditEntry) error {
+	entry.Id = uuid.New().String()
+	entry.CreatedAt = time.Now().UTC()
+	if entry.Changes == nil {
+		entry.Changes = []AuditChange{}
+	}
+	if _, err := database.GetCollection(auditCollection).InsertOne(ctx, entry); err != nil {
+		return fmt.Errorf("failed to insert audit log entry: %w", err)
+	}
+	return nil
+}
+
+// Which audit log entries to list; anything left empty matches everything
+type AuditFilter struct {
+	Actions []AuditAction
+	ActorId string
+	// only entries from after and before these times
+	After  *time.Time
+	Before *time.Time
+}
+
+// A page of the audit log of a server, newest first
+type AuditPage struct {
+	Entries []AuditEntry
+	Total   int
+}
+
+// List the audit log of a server a page at a time, newest first
+func ListAuditLog(ctx context.Context, serverId string, filter AuditFilter, limit int, offset int) (*AuditPage, error) {
+	query := map[string]interface{}{"serverId": serverId}
+	if len(filter.Actions) > 0 {
+		query["action"] = map[string]interface{}{"$in": filter.Actions}
+	}
+	if filter.ActorId != "" {
+		query["actorId"] = filter.ActorId
+	}
+	createdAt := map[string]interface{}{}
+	if filter.After != nil {
+		createdAt["$gt"] = *filter.After
+	}
+	if filter.Before != nil {
+		createdAt["$lt"] = *filter.Before
+	}
+	if len(createdAt) > 0 {
+		query["createdAt"] = createdAt
+	}
+
+	total, err := database.GetCollection(auditCollection).CountDocuments(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count audit log entries: %w", err)
+	}
+
+	cursor, err := database.GetCollection(auditCollection).Find(ctx, query,
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "id", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit log entries: %w", err)
+	}
+
+	page := &AuditPage{Entries: []AuditEntry{}, Total: int(total)}
+	if err := cursor.All(ctx, &page.Entries); err != nil {
+		return nil, fmt.Errorf("failed to decode audit log entries: %w", err)
+	}
+	return page, nil
+}
+
+// Throw away the audit log of a server, once it's deleted
+func deleteAuditLog(ctx context.Context, serverId string) error {
+	_, err := database.GetCollection(auditCollection).DeleteMany(ctx, map[string]interface{}{"serverId": serverId})
+	if err != nil {
+		return fmt.Errorf("failed to delete audit log: %w", err)
+	}
+	return nil
+}
+
+// The audit log is always read newest first, optionally for a single actor
+// or action; old entries expire on their own
+func ensureAuditIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(auditCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "serverId", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "serverId", Value: 1}, {Key: "actorId", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "serverId", Value: 1}, {Key: "action", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+		{
+			Keys:    bson.D{{Key: "createdAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(AuditLogRetention / time.Second)),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit log indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that bans are stored in
+const bansCollection = "server_bans"
+
+const (
+	MaxReasonLength = 512
+	// how far back a ban can delete the banned user's messages
+	MaxBanMessageDeletion = 7 * 24 * time.Hour
+)
+
+var (
+	ErrBanned       = errors.New("user is banned from the server")
+	ErrBanNotFound  = errors.New("ban not found")
+	ErrReasonLength = errors.New("reason must be at most 512 characters")
+)
+
+// Somebody who isn't allowed in a server. Bans work on the user, so they
+// can't just come back with another invite
+type Ban struct {
+	ServerId  string    `bson:"serverId" json:"-"`
+	UserId    string    `bson:"userId" json:"userId"`
+	Reason    string    `bson:"reason" json:"reason"`
+	BannedBy  string    `bson:"bannedBy" json:"bannedBy"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// Tidy up the reason for a moderation action, which can be empty
+func NormalizeReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > MaxReasonLength {
+		return "", ErrReasonLength
+	}
+	return reason, nil
+}
+
+// Ban a user from a server, removing them from it if they're in it. Banning
+// somebody who is already banned just updates the reason. Whether they're
+// allowed to be banned is up to the caller.
+//
+// deleteMessages is how far back to delete their messages from; there
+// aren't any messages yet, so for now there's nothing to delete, but it's
+// part of the API so that clients don't have to change once there are
+func BanUser(ctx context.Context, s *Server, userId string, bannedBy string, reason string, deleteMessages time.Duration) (*Ban, error) {
+	if s.OwnerId == userId {
+		return nil, ErrOwnerCannotLeave
+	}
+
+	ban := &Ban{
+		ServerId:  s.Id,
+		UserId:    userId,
+		Reason:    reason,
+		BannedBy:  bannedBy,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err := database.GetCollection(bansCollection).ReplaceOne(ctx,
+		map[string]interface{}{"serverId": s.Id, "userId": userId},
+		ban,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ban user: %w", err)
+	}
+
+	if err := removeMember(ctx, s.Id, userId); err != nil && err != ErrNotMember {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// Let a banned user back in; they still need an invite to rejoin
+func Unban(ctx context.Context, serverId string, userId string) error {
+	result, err := database.GetCollection(bansCollection).DeleteOne(ctx,
+		map[string]interface{}{"serverId": serverId, "userId": userId},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unban user: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrBanNotFound
+	}
+	return nil
+}
+
+// Get the ban of a user from a server
+func GetBan(ctx context.Context, serverId string, userId string) (*Ban, error) {
+	var ban Ban
+	err := database.GetCollection(bansCollection).FindOne(ctx,
+		map[string]interface{}{"serverId": serverId, "userId": userId},
+	).Decode(&ban)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrBanNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find ban: %w", err)
+	}
+	return &ban, nil
+}
+
+// Is the user banned from the server?
+func IsBanned(ctx context.Context, serverId string, userId string) (bool, error) {
+	_, err := GetBan(ctx, serverId, userId)
+	if err == ErrBanNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// A page of the bans of a server, newest first
+type BanPage struct {
+	Bans  []Ban
+	Total int
+}
+
+// List the bans of a server a page at a time, newest first
+func ListBans(ctx context.Context, serverId string, limit int, offset int) (*BanPage, error) {
+	filter := map[string]interface{}{"serverId": serverId}
+	total, err := database.GetCollection(bansCollection).CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count bans: %w", err)
+	}
+
+	cursor, err := database.GetCollection(bansCollection).Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "userId", Value: 1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bans: %w", err)
+	}
+
+	page := &BanPage{Bans: []Ban{}, Total: int(total)}
+	if err := cursor.All(ctx, &page.Bans); err != nil {
+		return nil, fmt.Errorf("failed to decode bans: %w", err)
+	}
+	return page, nil
+}
+
+// Throw away every ban from a server, once it's deleted
+func deleteBans(ctx context.Context, serverId string) error {
+	_, err := database.GetCollection(bansCollection).DeleteMany(ctx, map[string]interface{}{"serverId": serverId})
+	if err != nil {
+		return fmt.Errorf("failed to delete bans: %w", err)
+	}
+	return nil
+}
+
+// Each user can only be banned from a server once
+func ensureBanIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(bansCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "serverId", Value: 1}, {Key: "userId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "serverId", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create ban indexes: %w", err)
+	}
+	return nil
+}
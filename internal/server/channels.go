@@ -0,0 +1,594 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that channels are stored in
+const channelsCollection = "server_channels"
+
+const (
+	MaxChannels           = 500 // per server, categories included
+	MaxChannelNameLength  = 100
+	MaxChannelTopicLength = 1024
+	MaxOverwrites         = 100 // per channel
+)
+
+var (
+	ErrChannelNotFound    = errors.New("channel not found")
+	ErrTooManyChannels    = errors.New("server has too many channels")
+	ErrInvalidParent      = errors.New("parent must be a category in the same server")
+	ErrNestedCategory     = errors.New("categories can't be put inside other categories")
+	ErrChannelNameLength  = errors.New("channel name must be between 1 and 100 characters")
+	ErrChannelNameChars   = errors.New("channel name may not contain control characters")
+	ErrChannelTopicLength = errors.New("topic must be at most 1024 characters")
+	ErrCategoryTopic      = errors.New("categories can't have a topic or be marked NSFW")
+	ErrInvalidChannelType = errors.New("channel type must be one of text, voice or category")
+	ErrTooManyOverwrites  = errors.New("channel has too many overwrites")
+	ErrOverwriteNotFound  = errors.New("overwrite not found")
+)
+
+type ChannelType string
+
+const (
+	ChannelText     ChannelType = "text"
+	ChannelVoice    ChannelType = "voice"
+	ChannelCategory ChannelType = "category" // groups other channels, never contains another category
+)
+
+func (t ChannelType) Valid() bool {
+	return t == ChannelText || t == ChannelVoice || t == ChannelCategory
+}
+
+// A channel in a server. Positions order the channels which share a parent
+// (the categories and the channels outside of any category share the top
+// level) and always run from 0 with no gaps
+type Channel struct {
+	Id        string      `bson:"id" json:"id"`
+	ServerId  string      `bson:"serverId" json:"serverId"`
+	Type      ChannelType `bson:"type" json:"type"`
+	Name      string      `bson:"name" json:"name"`
+	Topic     string      `bson:"topic" json:"topic"`
+	Position  int         `bson:"position" json:"position"`
+	ParentId  string      `bson:"parentId,omitempty" json:"parentId,omitempty"` // the category the channel is in, if it's in one
+	NSFW      bool        `bson:"nsfw" json:"nsfw"`
+	CreatedAt time.Time   `bson:"createdAt" json:"createdAt"`
+	// changes to what particular roles and members can do in the channel,
+	// at most one per role or member
+	Overwrites []Overwrite `bson:"overwrites" json:"overwrites"`
+}
+
+// Tidy up a channel name and check that it's one we'll accept. Text channel
+// names are lowercased with dashes for spaces so that they're easy to link
+// to; voice channels and categories can be called whatever people like
+func NormalizeChannelName(channelType ChannelType, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if channelType == ChannelText {
+		name = strings.Join(strings.Fields(strings.ToLower(name)), "-")
+	}
+	if n := utf8.RuneCountInString(name); n < 1 || n > MaxChannelNameLength {
+		return "", ErrChannelNameLength
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", ErrChannelNameChars
+		}
+	}
+	return name, nil
+}
+
+// Tidy up a topic, which can be empty
+func NormalizeChannelTopic(topic string) (string, error) {
+	topic = strings.TrimSpace(topic)
+	if utf8.RuneCountInString(topic) > MaxChannelTopicLength {
+		return "", ErrChannelTopicLength
+	}
+	return topic, nil
+}
+
+// Everything needed to create a channel; the name and topic should already
+// have been normalized
+type NewChannel struct {
+	Type     ChannelType
+	Name     string
+	Topic    string
+	ParentId string
+	NSFW     bool
+}
+
+// List every channel in a server, in position order with the top level first
+func ListChannels(ctx context.Context, serverId string) ([]Channel, error) {
+	cursor, err := database.GetCollection(channelsCollection).Find(ctx,
+		map[string]interface{}{"serverId": serverId},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list channels: %w", err)
+	}
+
+	channels := []Channel{}
+	if err := cursor.All(ctx, &channels); err != nil {
+		return nil, fmt.Errorf("failed to decode channels: %w", err)
+	}
+	for i := range channels {
+		if channels[i].Overwrites == nil {
+			channels[i].Overwrites = []Overwrite{}
+		}
+	}
+	sortChannels(channels)
+	return channels, nil
+}
+
+// Get a single channel in a server
+func GetChannel(ctx context.Context, serverId string, channelId string) (*Channel, error) {
+	var channel Channel
+	err := database.GetCollection(channelsCollection).FindOne(ctx,
+		map[string]interface{}{"serverId": serverId, "id": channelId},
+	).Decode(&channel)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrChannelNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find channel: %w", err)
+	}
+	if channel.Overwrites == nil {
+		channel.Overwrites = []Overwrite{}
+	}
+	return &channel, nil
+}
+
+// Sort channels top level first, then by parent, then by position; the id
+// breaks any ties so that the order is always the same
+func sortChannels(channels []Channel) {
+	sort.SliceStable(channels, func(i, j int) bool {
+		a, b := channels[i], channels[j]
+		if a.ParentId != b.ParentId {
+			if a.ParentId == "" || b.ParentId == "" {
+				return a.ParentId == ""
+			}
+			return a.ParentId < b.ParentId
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.Id < b.Id
+	})
+}
+
+// Check that a channel can go in the given parent: the parent has to be a
+// category in the same server, and categories can't go in anything
+func checkParent(channels []Channel, channelType ChannelType, parentId string) error {
+	if parentId == "" {
+		return nil
+	}
+	if channelType == ChannelCategory {
+		return ErrNestedCategory
+	}
+	for _, channel := range channels {
+		if channel.Id == parentId {
+			if channel.Type != ChannelCategory {
+				return ErrInvalidParent
+			}
+			return nil
+		}
+	}
+	return ErrInvalidParent
+}
+
+// Count the channels which share a parent, i.e. the position a new one at
+// the end would get
+func siblingCount(channels []Channel, parentId string, exceptId string) int {
+	count := 0
+	for _, channel := range channels {
+		if channel.ParentId == parentId && channel.Id != exceptId {
+			count++
+		}
+	}
+	return count
+}
+
+// Create a channel at the end of its parent (or of the top level). Channels
+// created in a category start off with the same overwrites as it
+func CreateChannel(ctx context.Context, serverId string, new NewChannel) (*Channel, error) {
+	if !new.Type.Valid() {
+		return nil, ErrInvalidChannelType
+	}
+	if new.Type == ChannelCategory && (new.Topic != "" || new.NSFW) {
+		return nil, ErrCategoryTopic
+	}
+
+	channels, err := ListChannels(ctx, serverId)
+	if err != nil {
+		return nil, err
+	}
+	if len(channels) >= MaxChannels {
+		return nil, ErrTooManyChannels
+	}
+	if err := checkParent(channels, new.Type, new.ParentId); err != nil {
+		return nil, err
+	}
+	overwrites := []Overwrite{}
+	for _, channel := range channels {
+		if channel.Id == new.ParentId {
+			overwrites = append(overwrites, channel.Overwrites...)
+		}
+	}
+
+	channel := &Channel{
+		Id:         uuid.New().String(),
+		ServerId:   serverId,
+		Type:       new.Type,
+		Name:       new.Name,
+		Topic:      new.Topic,
+		Position:   siblingCount(channels, new.ParentId, ""),
+		ParentId:   new.ParentId,
+		NSFW:       new.NSFW,
+		CreatedAt:  time.Now().UTC(),
+		Overwrites: overwrites,
+	}
+	if _, err := database.GetCollection(channelsCollection).InsertOne(ctx, channel); err != nil {
+		return nil, fmt.Errorf("failed to insert channel: %w", err)
+	}
+	return channel, nil
+}
+
+// The parts of a channel that can be changed, nil means leave the field as
+// it is. The type of a channel can never change
+type ChannelUpdate struct {
+	Name     *string
+	Topic    *string
+	NSFW     *bool
+	ParentId *string // an empty string moves the channel out of its category
+}
+
+// Save changes to a channel; the name and topic should already have been
+// normalized. Moving a channel to a different parent puts it at the end
+func UpdateChannel(ctx context.Context, channel *Channel, changes ChannelUpdate) error {
+	if channel.Type == ChannelCategory && ((changes.Topic != nil && *changes.Topic != "") || (changes.NSFW != nil && *changes.NSFW)) {
+		return ErrCategoryTopic
+	}
+
+	set := map[string]interface{}{}
+	unset := map[string]interface{}{}
+	if changes.Name != nil {
+		set["name"] = *changes.Name
+	}
+	if changes.Topic != nil {
+		set["topic"] = *changes.Topic
+	}
+	if changes.NSFW != nil {
+		set["nsfw"] = *changes.NSFW
+	}
+
+	var channels []Channel
+	moving := changes.ParentId != nil && *changes.ParentId != channel.ParentId
+	if moving {
+		var err error
+		if channels, err = ListChannels(ctx, channel.ServerId); err != nil {
+			return err
+		}
+		if err := checkParent(channels, channel.Type, *changes.ParentId); err != nil {
+			return err
+		}
+
+		set["position"] = siblingCount(channels, *changes.ParentId, channel.Id)
+		if *changes.ParentId == "" {
+			unset["parentId"] = ""
+		} else {
+			set["parentId"] = *changes.ParentId
+		}
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return nil
+	}
+
+	update := map[string]interface{}{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	result, err := database.GetCollection(channelsCollection).UpdateOne(ctx,
+		map[string]interface{}{"serverId": channel.ServerId, "id": channel.Id},
+		update,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update channel: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrChannelNotFound
+	}
+
+	oldParentId := channel.ParentId
+	if changes.Name != nil {
+		channel.Name = *changes.Name
+	}
+	if changes.Topic != nil {
+		channel.Topic = *changes.Topic
+	}
+	if changes.NSFW != nil {
+		channel.NSFW = *changes.NSFW
+	}
+	if moving {
+		channel.ParentId = *changes.ParentId
+		channel.Position = set["position"].(int)
+		// close the gap the channel left behind
+		if err := compactPositions(ctx, channel.ServerId, oldParentId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Where one channel should end up in a bulk reorder
+type ChannelPosition struct {
+	Id       string
+	Position int
+	ParentId *string // nil leaves the channel where it is, "" moves it to the top level
+}
+
+// Move several channels at once, e.g. after somebody drags them around. Each
+// channel given ends up at its position among the channels that end up
+// sharing its parent, and the rest keep their order around it; afterwards
+// every group of siblings is numbered from 0 again. Returns every channel in
+// the server
+func ReorderChannels(ctx context.Context, serverId string, positions []ChannelPosition) ([]Channel, error) {
+	channels, err := ListChannels(ctx, serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[string]int, len(channels))
+	for i, channel := range channels {
+		byId[channel.Id] = i
+	}
+
+	// work out where everything ends up before checking any parents, so that
+	// a category and its channels can be moved in the same request
+	original := make([]Channel, len(channels))
+	copy(original, channels)
+	targets := map[string]int{}
+	for _, position := range positions {
+		i, ok := byId[position.Id]
+		if !ok {
+			return nil, ErrChannelNotFound
+		}
+		targets[position.Id] = position.Position
+		if position.ParentId != nil {
+			channels[i].ParentId = *position.ParentId
+		}
+	}
+	for _, channel := range channels {
+		if err := checkParent(channels, channel.Type, channel.ParentId); err != nil {
+			return nil, err
+		}
+	}
+
+	// the channels are still in their old order, which is the order that
+	// everything that wasn't moved keeps
+	var parents []string
+	groups := map[string][]Channel{}
+	for _, channel := range channels {
+		if _, ok := groups[channel.ParentId]; !ok {
+			parents = append(parents, channel.ParentId)
+		}
+		groups[channel.ParentId] = append(groups[channel.ParentId], channel)
+	}
+	channels = channels[:0]
+	for _, parentId := range parents {
+		placed := applyMoves(groups[parentId], func(channel Channel) (int, bool) {
+			index, ok := targets[channel.Id]
+			return index, ok
+		})
+		for i := range placed {
+			placed[i].Position = i
+		}
+		channels = append(channels, placed...)
+	}
+
+	if err := saveChannelPositions(ctx, original, channels); err != nil {
+		return nil, err
+	}
+	sortChannels(channels)
+	return channels, nil
+}
+
+// Write out the position and parent of every channel which has changed
+func saveChannelPositions(ctx context.Context, before []Channel, after []Channel) error {
+	previous := make(map[string]Channel, len(before))
+	for _, channel := range before {
+		previous[channel.Id] = channel
+	}
+
+	var models []mongo.WriteModel
+	for _, channel := range after {
+		old := previous[channel.Id]
+		if old.Position == channel.Position && old.ParentId == channel.ParentId {
+			continue
+		}
+
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "position", Value: channel.Position}}}}
+		if channel.ParentId == "" {
+			update = append(update, bson.E{Key: "$unset", Value: bson.D{{Key: "parentId", Value: ""}}})
+		} else {
+			update[0].Value = append(update[0].Value.(bson.D), bson.E{Key: "parentId", Value: channel.ParentId})
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "serverId", Value: channel.ServerId}, {Key: "id", Value: channel.Id}}).
+			SetUpdate(update))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	if _, err := database.GetCollection(channelsCollection).BulkWrite(ctx, models); err != nil {
+		return fmt.Errorf("failed to reorder channels: %w", err)
+	}
+	return nil
+}
+
+// Number the channels under a parent from 0 again, e.g. after one has been
+// taken away from them
+func compactPositions(ctx context.Context, serverId string, parentId string) error {
+	channels, err := ListChannels(ctx, serverId)
+	if err != nil {
+		return err
+	}
+
+	before := make([]Channel, len(channels))
+	copy(before, channels)
+	position := 0
+	for i := range channels {
+		if channels[i].ParentId == parentId {
+			channels[i].Position = position
+			position++
+		}
+	}
+	return saveChannelPositions(ctx, before, channels)
+}
+
+// Delete a channel. Deleting a category doesn't delete what's in it, those
+// channels move to the end of the top level instead
+func DeleteChannel(ctx context.Context, channel *Channel) error {
+	result, err := database.GetCollection(channelsCollection).DeleteOne(ctx,
+		map[string]interface{}{"serverId": channel.ServerId, "id": channel.Id},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete channel: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrChannelNotFound
+	}
+
+	// the channel is already gone, so finish tidying up regardless
+	ctx = context.WithoutCancel(ctx)
+	if channel.Type == ChannelCategory {
+		channels, err := ListChannels(ctx, channel.ServerId)
+		if err != nil {
+			return err
+		}
+		before := make([]Channel, len(channels))
+		copy(before, channels)
+
+		top := siblingCount(channels, "", "")
+		for i := range channels {
+			if channels[i].ParentId == channel.Id {
+				channels[i].ParentId = ""
+				channels[i].Position = top
+				top++
+			}
+		}
+		if err := saveChannelPositions(ctx, before, channels); err != nil {
+			return err
+		}
+	}
+	return compactPositions(ctx, channel.ServerId, channel.ParentId)
+}
+
+// Add an overwrite to a channel, replacing any there already is for the same
+// role or member. The overwrite should already have been validated
+func SetOverwrite(ctx context.Context, channel *Channel, overwrite Overwrite) error {
+	overwrites := []Overwrite{}
+	for _, existing := range channel.Overwrites {
+		if existing.Id != overwrite.Id || existing.Type != overwrite.Type {
+			overwrites = append(overwrites, existing)
+		}
+	}
+	if len(overwrites) >= MaxOverwrites {
+		return ErrTooManyOverwrites
+	}
+	overwrites = append(overwrites, overwrite)
+
+	if err := setOverwrites(ctx, channel, overwrites); err != nil {
+		return err
+	}
+	channel.Overwrites = overwrites
+	return nil
+}
+
+// Remove the overwrite for a role or member from a channel
+func DeleteOverwrite(ctx context.Context, channel *Channel, overwriteType OverwriteType, id string) error {
+	overwrites := []Overwrite{}
+	for _, existing := range channel.Overwrites {
+		if existing.Id != id || existing.Type != overwriteType {
+			overwrites = append(overwrites, existing)
+		}
+	}
+	if len(overwrites) == len(channel.Overwrites) {
+		return ErrOverwriteNotFound
+	}
+
+	if err := setOverwrites(ctx, channel, overwrites); err != nil {
+		return err
+	}
+	channel.Overwrites = overwrites
+	return nil
+}
+
+func setOverwrites(ctx context.Context, channel *Channel, overwrites []Overwrite) error {
+	result, err := database.GetCollection(channelsCollection).UpdateOne(ctx,
+		map[string]interface{}{"serverId": channel.ServerId, "id": channel.Id},
+		map[string]interface{}{"$set": map[string]interface{}{"overwrites": overwrites}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update overwrites: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrChannelNotFound
+	}
+	return nil
+}
+
+// Remove every overwrite for a role or member from every channel in a
+// server, e.g. when the role is deleted
+func deleteOverwritesFor(ctx context.Context, serverId string, overwriteType OverwriteType, id string) error {
+	_, err := database.GetCollection(channelsCollection).UpdateMany(ctx,
+		map[string]interface{}{"serverId": serverId},
+		map[string]interface{}{"$pull": map[string]interface{}{
+			"overwrites": map[string]interface{}{"type": overwriteType, "id": id},
+		}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete overwrites: %w", err)
+	}
+	return nil
+}
+
+// Throw away every channel in a server, once it's deleted
+func deleteChannels(ctx context.Context, serverId string) error {
+	_, err := database.GetCollection(channelsCollection).DeleteMany(ctx, map[string]interface{}{"serverId": serverId})
+	if err != nil {
+		return fmt.Errorf("failed to delete channels: %w", err)
+	}
+	return nil
+}
+
+// Channels are always looked up within their server
+func ensureChannelIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(channelsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "serverId", Value: 1}, {Key: "parentId", Value: 1}, {Key: "position", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create channel indexes: %w", err)
+	}
+	return nil
+}
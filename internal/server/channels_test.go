@@ -0,0 +1,32 @@
+package server
+
+import "testing"
+
+func TestCheckParent(t *testing.T) {
+	channels := []Channel{
+		{Id: "category", Type: ChannelCategory},
+		{Id: "text", Type: ChannelText},
+		{Id: "voice", Type: ChannelVoice, ParentId: "category"},
+	}
+	tests := []struct {
+		name        string
+		channelType ChannelType
+		parentId    string
+		want        error
+	}{
+		{"text at the top level", ChannelText, "", nil},
+		{"category at the top level", ChannelCategory, "", nil},
+		{"text in a category", ChannelText, "category", nil},
+		{"voice in a category", ChannelVoice, "category", nil},
+		{"category in a category", ChannelCategory, "category", ErrNestedCategory},
+		{"category in a text channel", ChannelCategory, "text", ErrNestedCategory},
+		{"text in a text channel", ChannelText, "text", ErrInvalidParent},
+		{"text in a voice channel", ChannelText, "voice", ErrInvalidParent},
+		{"unknown parent", ChannelText, "missing", ErrInvalidParent},
+	}
+	for _, test := range tests {
+		if got := checkParent(channels, test.channelType, test.parentId); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MaxTags = 5
+	// activity is how many people joined a listed server over this long
+	ActivityWindow = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidCategory  = errors.New("category must be one of gaming, music, education, science, technology, entertainment, art, community or other")
+	ErrTooManyTags      = errors.New("servers can have at most 5 tags")
+	ErrInvalidTag       = errors.New("tags must be 2 to 24 lowercase letters, numbers and dashes")
+	ErrNotListed        = errors.New("server isn't in the directory")
+	ErrDirectoryBlocked = errors.New("server has been blocked from the directory")
+)
+
+type DirectoryCategory string
+
+const (
+	CategoryGaming        DirectoryCategory = "gaming"
+	CategoryMusic         DirectoryCategory = "music"
+	CategoryEducation     DirectoryCategory = "education"
+	CategoryScience       DirectoryCategory = "science"
+	CategoryTechnology    DirectoryCategory = "technology"
+	CategoryEntertainment DirectoryCategory = "entertainment"
+	CategoryArt           DirectoryCategory = "art"
+	CategoryCommunity     DirectoryCategory = "community"
+	CategoryOther         DirectoryCategory = "other"
+)
+
+func (c DirectoryCategory) Valid() bool {
+	switch c {
+	case CategoryGaming, CategoryMusic, CategoryEducation, CategoryScience, CategoryTechnology,
+		CategoryEntertainment, CategoryArt, CategoryCommunity, CategoryOther:
+		return true
+	}
+	return false
+}
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{0,22}[a-z0-9])$`)
+
+// How a server shows up in the directory, which it's only in if its owners
+// have opted in
+type Listing struct {
+	Category DirectoryCategory `bson:"category" json:"category"`
+	Tags     []string          `bson:"tags" json:"tags"`
+	ListedAt time.Time         `bson:"listedAt" json:"listedAt"`
+	// how many people joined in the last ActivityWindow, kept up to date by
+	// the worker
+	Activity int `bson:"activity" json:"activity"`
+}
+
+// An admin keeping a server out of the directory; this outlasts the listing,
+// so the server can't just be put straight back in
+type DirectoryBlock struct {
+	Reason    string    `bson:"reason" json:"reason"`
+	BlockedBy string    `bson:"blockedBy" json:"blockedBy"`
+	BlockedAt time.Time `bson:"blockedAt" json:"blockedAt"`
+}
+
+// The directory is browsed by activity, size or age, and admins look through
+// blocked servers newest first; only listed or blocked servers have these
+// fields, hence sparse. Text search has its own index over just the listed
+// servers, weighted so that a word in the name beats one in a tag, which
+// beats one in the description
+func ensureDirectoryIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(collectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "name", Value: "text"},
+				{Key: "listing.tags", Value: "text"},
+				{Key: "description", Value: "text"},
+			},
+			Options: options.Index().
+				SetName("directory_text").
+				SetPartialFilterExpression(bson.D{{Key: "listing", Value: bson.D{{Key: "$exists", Value: true}}}}).
+				SetWeights(bson.D{{Key: "name", Value: 10}, {Key: "listing.tags", Value: 5}, {Key: "description", Value: 1}}),
+		},
+		{
+			Keys:    bson.D{{Key: "listing.activity", Value: -1}, {Key: "memberCount", Value: -1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "listing.listedAt", Value: -1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "listing.category", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "directoryBlock.blockedAt", Value: -1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create directory indexes: %w", err)
+	}
+	return nil
+}
+
+// Tidy up the tags of a listing, dropping any duplicates
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, ErrInvalidTag
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > MaxTags {
+		return nil, ErrTooManyTags
+	}
+	return normalized, nil
+}
+
+// The filter for servers that show up in the directory
+func listedServers(filter map[string]interface{}) map[string]interface{} {
+	filter["listing"] = map[string]interface{}{"$exists": true}
+	filter["directoryBlock"] = map[string]interface{}{"$exists": false}
+	return filter
+}
+
+// Put the server in the directory, or change how it's listed if it already
+// is; the tags should already have been normalized
+func (s *Server) List(ctx context.Context, category DirectoryCategory, tags []string) error {
+	if s.DirectoryBlock != nil {
+		return ErrDirectoryBlocked
+	}
+	if !category.Valid() {
+		return ErrInvalidCategory
+	}
+
+	listing := &Listing{Category: category, Tags: tags, ListedAt: time.Now().UTC()}
+	if s.Listing != nil {
+		listing.ListedAt = s.Listing.ListedAt
+		listing.Activity = s.Listing.Activity
+	} else {
+		activity, err := database.GetCollection(membersCollection).CountDocuments(ctx, map[string]interface{}{
+			"serverId": s.Id,
+			"joinedAt": map[string]interface{}{"$gt": time.Now().UTC().Add(-ActivityWindow)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to count recent members: %w", err)
+		}
+		listing.Activity = int(activity)
+	}
+
+	// check the block again in case an admin got there first
+	result, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": s.Id, "directoryBlock": map[string]interface{}{"$exists": false}},
+		map[string]interface{}{"$set": map[string]interface{}{"listing": listing}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list server: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrDirectoryBlocked
+	}
+	s.Listing = listing
+	return nil
+}
+
+// Take the server out of the directory
+func (s *Server) Unlist(ctx context.Context) error {
+	_, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": s.Id},
+		map[string]interface{}{"$unset": map[string]interface{}{"listing": ""}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unlist server: %w", err)
+	}
+	s.Listing = nil
+	return nil
+}
+
+type DirectorySort string
+
+const (
+	SortRelevance DirectorySort = "relevance" // the best matches for the text first, then by activity
+	SortActivity  DirectorySort = "activity"  // the most people joining lately first
+	SortMembers   DirectorySort = "members"   // the biggest first
+	SortNewest    DirectorySort = "newest"    // the most recently listed first
+)
+
+func (s DirectorySort) Valid() bool {
+	return s == SortRelevance || s == SortActivity || s == SortMembers || s == SortNewest
+}
+
+// What to look for in the directory; anything left empty matches everything
+type DirectoryQuery struct {
+	// searched for with the directory's text index, so it matches whole
+	// (stemmed) words of the name, tags and description rather than any
+	// part of them. Matches in the name count for the most and the
+	// description the least
+	Text     string
+	Category DirectoryCategory
+	Tag      string
+	// defaults to relevance when there's text and activity when there isn't
+	Sort DirectorySort
+}
+
+// A page of servers from the directory
+type DirectoryPage struct {
+	Servers []Server
+	Total   int
+}
+
+// Search the directory a page at a time
+func SearchDirectory(ctx context.Context, query DirectoryQuery, limit int, offset int) (*DirectoryPage, error) {
+	filter := listedServers(map[string]interface{}{})
+	if query.Category != "" {
+		filter["listing.category"] = query.Category
+	}
+	if query.Tag != "" {
+		filter["listing.tags"] = strings.ToLower(query.Tag)
+	}
+	text := strings.TrimSpace(query.Text)
+	if text != "" {
+		filter["$text"] = map[string]interface{}{"$search": text}
+	}
+
+	var sort bson.D
+	switch query.Sort {
+	case SortRelevance, "":
+		if text != "" {
+			sort = bson.D{{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}}, {Key: "listing.activity", Value: -1}}
+			break
+		}
+		// with nothing to be relevant to, the busiest servers come first
+		sort = bson.D{{Key: "listing.activity", Value: -1}, {Key: "memberCount", Value: -1}}
+	case SortMembers:
+		sort = bson.D{{Key: "memberCount", Value: -1}}
+	case SortNewest:
+		sort = bson.D{{Key: "listing.listedAt", Value: -1}}
+	default:
+		sort = bson.D{{Key: "listing.activity", Value: -1}, {Key: "memberCount", Value: -1}}
+	}
+	sort = append(sort, bson.E{Key: "id", Value: 1})
+
+	opts := options.Find().SetSort(sort).SetSkip(int64(offset)).SetLimit(int64(limit))
+	if text != "" {
+		opts.SetProjection(bson.D{{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}}})
+	}
+	return findServerPage(ctx, filter, opts)
+}
+
+func findServerPage(ctx context.Context, filter map[string]interface{}, opts *options.FindOptions) (*DirectoryPage, error) {
+	total, err := database.GetCollection(collectionName).CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count servers: %w", err)
+	}
+
+	cursor, err := database.GetCollection(collectionName).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search servers: %w", err)
+	}
+
+	page := &DirectoryPage{Servers: []Server{}, Total: int(total)}
+	if err := cursor.All(ctx, &page.Servers); err != nil {
+		return nil, fmt.Errorf("failed to decode servers: %w", err)
+	}
+	return page, nil
+}
+
+// Join a server from the directory, without an invite. Like Join, somebody
+// who is already a member stays as they are and joined is false
+func JoinListed(ctx context.Context, s *Server, userId string) (joined bool, err error) {
+	if s.Listing == nil || s.DirectoryBlock != nil {
+		return false, ErrNotListed
+	}
+
+	member, err := IsMember(ctx, s.Id, userId)
+	if err != nil || member {
+		return false, err
+	}
+	banned, err := IsBanned(ctx, s.Id, userId)
+	if err != nil {
+		return false, err
+	}
+	if banned {
+		return false, ErrBanned
+	}
+
+	err = addMember(ctx, Member{ServerId: s.Id, UserId: userId, JoinedAt: time.Now().UTC()})
+	if err == ErrAlreadyMember {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.MemberCount++
+	return true, nil
+}
+
+// Keep a server out of the directory, taking it out if it's in there
+func BlockFromDirectory(ctx context.Context, s *Server, adminId string, reason string) error {
+	block := &DirectoryBlock{Reason: reason, BlockedBy: adminId, BlockedAt: time.Now().UTC()}
+	result, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": s.Id},
+		map[string]interface{}{
+			"$set":   map[string]interface{}{"directoryBlock": block},
+			"$unset": map[string]interface{}{"listing": ""},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to block server: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	s.DirectoryBlock = block
+	s.Listing = nil
+	return nil
+}
+
+// Let a server be listed again; it has to be put back in by its owners
+func UnblockFromDirectory(ctx context.Context, s *Server) error {
+	result, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": s.Id},
+		map[string]interface{}{"$unset": map[string]interface{}{"directoryBlock": ""}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unblock server: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	s.DirectoryBlock = nil
+	return nil
+}
+
+// List the servers that have been blocked from the directory, the most
+// recently blocked first
+func ListBlocked(ctx context.Context, limit int, offset int) (*DirectoryPage, error) {
+	return findServerPage(ctx,
+		map[string]interface{}{"directoryBlock": map[string]interface{}{"$exists": true}},
+		options.Find().
+			SetSort(bson.D{{Key: "directoryBlock.blockedAt", Value: -1}, {Key: "id", Value: 1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)),
+	)
+}
+
+// Work out the activity of every listed server again, returning how many
+// were updated
+func RefreshDirectoryActivity(ctx context.Context) (int, error) {
+	cursor, err := database.GetCollection(collectionName).Find(ctx, listedServers(map[string]interface{}{}),
+		options.Find().SetProjection(map[string]interface{}{"id": 1, "listing.activity": 1}),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find listed servers: %w", err)
+	}
+	var listed []Server
+	if err := cursor.All(ctx, &listed); err != nil {
+		return 0, fmt.Errorf("failed to decode listed servers: %w", err)
+	}
+	if len(listed) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, len(listed))
+	for i, s := range listed {
+		ids[i] = s.Id
+	}
+	cursor, err = database.GetCollection(membersCollection).Aggregate(ctx, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "serverId", Value: bson.D{{Key: "$in", Value: ids}}},
+			{Key: "joinedAt", Value: bson.D{{Key: "$gt", Value: time.Now().UTC().Add(-ActivityWindow)}}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$serverId"},
+			{Key: "joins", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count recent members: %w", err)
+	}
+	var counts []struct {
+		ServerId string `bson:"_id"`
+		Joins    int    `bson:"joins"`
+	}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return 0, fmt.Errorf("failed to decode recent members: %w", err)
+	}
+	activity := map[string]int{}
+	for _, count := range counts {
+		activity[count.ServerId] = count.Joins
+	}
+
+	// only touch the ones that changed
+	var models []mongo.WriteModel
+	for _, s := range listed {
+		if s.Listing != nil && s.Listing.Activity == activity[s.Id] {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(listedServers(map[string]interface{}{"id": s.Id})).
+			SetUpdate(map[string]interface{}{"$set": map[string]interface{}{"listing.activity": activity[s.Id]}}))
+	}
+	if len(models) == 0 {
+		return 0, nil
+	}
+	if _, err := database.GetCollection(collectionName).BulkWrite(ctx, models); err != nil {
+		return 0, fmt.Errorf("failed to update activity: %w", err)
+	}
+	return len(models), nil
+}
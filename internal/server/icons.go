@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oauthority/voxly-backend/internal/storage"
+	"github.com/oauthority/voxly-backend/internal/user"
+)
+
+// Icons are stored under their own prefix in the blob store, the same way
+// (and at the same sizes) as avatars
+const IconPrefixRoot = "icons/"
+
+var IconSizes = user.AvatarSizes
+
+// The prefix that every size of every icon for a server is stored under, so
+// that they can all be deleted in one go
+func IconPrefix(serverId string) string {
+	return fmt.Sprintf("%s%s/", IconPrefixRoot, serverId)
+}
+
+// The key that a single size of an icon is stored under
+func IconKey(serverId string, image string, size user.ImageSize) string {
+	return fmt.Sprintf("%s%s/%s", IconPrefix(serverId), size.Name, image)
+}
+
+// Get the URLs for every size of an icon, or nil if there is no icon
+func IconURLs(serverId string, image string) map[string]string {
+	if image == "" {
+		return nil
+	}
+
+	urls := map[string]string{}
+	for _, size := range IconSizes {
+		urls[size.Name] = storage.URL(IconKey(serverId, image, size))
+	}
+	return urls
+}
+
+// Set (or clear, with an empty name) the icon of a server
+func (s *Server) SetIcon(ctx context.Context, image string) error {
+	if err := update(ctx, s.Id, map[string]interface{}{"icon": image}); err != nil {
+		return err
+	}
+	s.Icon = image
+	return nil
+}
+
+// Throw away every icon a server has ever had, once it's deleted
+func deleteIcons(ctx context.Context, serverId string) error {
+	store, err := storage.Get()
+	if err != nil {
+		return err
+	}
+	return store.DeletePrefix(ctx, IconPrefix(serverId))
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that server invites are stored in
+const invitesCollection = "server_invites"
+
+// Invite (and template) codes are case sensitive, which keeps them short; the
+// alphabet still leaves out the characters that get mixed up with each other
+const (
+	inviteAlphabet   = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	inviteCodeLength = 8
+	MaxInvites       = 1000 // per server, expired ones don't count
+	MaxInviteAge     = 7 * 24 * time.Hour
+	MaxInviteUses    = 100
+)
+
+var (
+	// the code doesn't exist, has expired or has been used up; we don't say
+	// which
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrTooManyInvites = errors.New("server has too many invites")
+	ErrVanityTaken    = errors.New("vanity code is already in use")
+	ErrInvalidVanity  = errors.New("vanity codes must be 3 to 32 lowercase letters, numbers and dashes")
+)
+
+// Vanity codes are picked by people, so they're kept simple
+var vanityPattern = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{1,30}[a-z0-9])$`)
+
+// An invite to join a server, optionally pointing at a particular channel.
+// Temporary invites give a membership which goes away once the member
+// disconnects, unless they've been given a role by then
+type Invite struct {
+	Code      string     `bson:"code" json:"code"`
+	ServerId  string     `bson:"serverId" json:"serverId"`
+	ChannelId string     `bson:"channelId,omitempty" json:"channelId,omitempty"`
+	CreatedBy string     `bson:"createdBy,omitempty" json:"createdBy,omitempty"` // empty for the vanity code
+	CreatedAt time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty" json:"expiresAt"` // nil if it never expires
+	MaxUses   int        `bson:"maxUses" json:"maxUses"`               // 0 means it can be used any number of times
+	Uses      int        `bson:"uses" json:"uses"`
+	Temporary bool       `bson:"temporary" json:"temporary"`
+	Vanity    bool       `bson:"-" json:"vanity"`
+}
+
+// Tidy up a vanity code and check that it's one we'll accept
+func NormalizeVanityCode(code string) (string, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if !vanityPattern.MatchString(code) {
+		return "", ErrInvalidVanity
+	}
+	return code, nil
+}
+
+// Generate a new random code, for an invite or a template
+func generateCode() (string, error) {
+	var code strings.Builder
+	max := big.NewInt(int64(len(inviteAlphabet)))
+	for i := 0; i < inviteCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate code: %w", err)
+		}
+		code.WriteByte(inviteAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// The filter for invites which can still be used
+func usableInvites(filter map[string]interface{}) map[string]interface{} {
+	filter["$and"] = []map[string]interface{}{
+		{"$or": []map[string]interface{}{
+			{"expiresAt": map[string]interface{}{"$exists": false}},
+			{"expiresAt": map[string]interface{}{"$gt": time.Now().UTC()}},
+		}},
+		{"$or": []map[string]interface{}{
+			{"maxUses": 0},
+			{"$expr": map[string]interface{}{"$lt": []string{"$uses", "$maxUses"}}},
+		}},
+	}
+	return filter
+}
+
+// Create an invite to a server, or to a channel in it if channel isn't nil.
+// A maxAge of 0 gives an invite that never expires, and maxUses of 0 one that
+// can be used any number of times
+func CreateInvite(ctx context.Context, s *Server, channel *Channel, createdBy string, maxAge time.Duration, maxUses int, temporary bool) (*Invite, error) {
+	count, err := database.GetCollection(invitesCollection).CountDocuments(ctx,
+		usableInvites(map[string]interface{}{"serverId": s.Id}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count invites: %w", err)
+	}
+	if count >= MaxInvites {
+		return nil, ErrTooManyInvites
+	}
+
+	invite := &Invite{
+		ServerId:  s.Id,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+		MaxUses:   maxUses,
+		Temporary: temporary,
+	}
+	if channel != nil {
+		invite.ChannelId = channel.Id
+	}
+	if maxAge > 0 {
+		expiresAt := invite.CreatedAt.Add(maxAge)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	// a clash is vanishingly unlikely, but try again if it happens
+	for attempt := 0; attempt < 3; attempt++ {
+		if invite.Code, err = generateCode(); err != nil {
+			return nil, err
+		}
+		_, err = database.GetCollection(invitesCollection).InsertOne(ctx, invite)
+		if err == nil {
+			return invite, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("failed to insert invite: %w", err)
+}
+
+// Look up an invite by its code, which can also be the vanity code of a
+// server. Invites which can't be used anymore are reported as not found
+func GetInvite(ctx context.Context, code string) (*Invite, error) {
+	code = strings.TrimSpace(code)
+
+	var invite Invite
+	err := database.GetCollection(invitesCollection).FindOne(ctx,
+		usableInvites(map[string]interface{}{"code": code}),
+	).Decode(&invite)
+	if err == nil {
+		return &invite, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("failed to find invite: %w", err)
+	}
+
+	// vanity codes never expire or run out
+	var s Server
+	err = database.GetCollection(collectionName).FindOne(ctx,
+		map[string]interface{}{"vanityCode": strings.ToLower(code)},
+	).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find vanity code: %w", err)
+	}
+	return &Invite{
+		Code:      s.VanityCode,
+		ServerId:  s.Id,
+		CreatedAt: s.CreatedAt,
+		Uses:      s.VanityUses,
+		Vanity:    true,
+	}, nil
+}
+
+// List the invites to a server which can still be used, newest first. The
+// vanity code isn't included, it's part of the server
+func ListInvites(ctx context.Context, serverId string) ([]Invite, error) {
+	cursor, err := database.GetCollection(invitesCollection).Find(ctx,
+		usableInvites(map[string]interface{}{"serverId": serverId}),
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invites: %w", err)
+	}
+
+	invites := []Invite{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		return nil, fmt.Errorf("failed to decode invites: %w", err)
+	}
+	return invites, nil
+}
+
+// Delete an invite so that it can't be used anymore
+func DeleteInvite(ctx context.Context, invite *Invite) error {
+	if invite.Vanity {
+		return ErrInviteNotFound
+	}
+	result, err := database.GetCollection(invitesCollection).DeleteOne(ctx, map[string]interface{}{"code": invite.Code})
+	if err != nil {
+		return fmt.Errorf("failed to delete invite: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// Use up an invite, returning ErrInviteNotFound if it's expired or run out
+// since it was looked up
+func redeemInvite(ctx context.Context, invite *Invite) error {
+	var result *mongo.UpdateResult
+	var err error
+	if invite.Vanity {
+		result, err = database.GetCollection(collectionName).UpdateOne(ctx,
+			map[string]interface{}{"id": invite.ServerId, "vanityCode": invite.Code},
+			map[string]interface{}{"$inc": map[string]interface{}{"vanityUses": 1}},
+		)
+	} else {
+		result, err = database.GetCollection(invitesCollection).UpdateOne(ctx,
+			usableInvites(map[string]interface{}{"code": invite.Code}),
+			map[string]interface{}{"$inc": map[string]interface{}{"uses": 1}},
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to redeem invite: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// Give back a use of an invite when joining failed after all
+func releaseInvite(ctx context.Context, invite *Invite) error {
+	collection, field, filter := invitesCollection, "uses", map[string]interface{}{"code": invite.Code}
+	if invite.Vanity {
+		collection, field, filter = collectionName, "vanityUses", map[string]interface{}{"id": invite.ServerId}
+	}
+	filter[field] = map[string]interface{}{"$gt": 0}
+
+	_, err := database.GetCollection(collection).UpdateOne(ctx, filter,
+		map[string]interface{}{"$inc": map[string]interface{}{field: -1}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release invite: %w", err)
+	}
+	return nil
+}
+
+// Join a server with an invite. Somebody who is already a member stays as
+// they are without using the invite up, in which case joined is false, and
+// anyone who has been banned gets ErrBanned
+func Join(ctx context.Context, invite *Invite, userId string) (s *Server, joined bool, err error) {
+	s, err = GetById(ctx, invite.ServerId)
+	if err != nil {
+		if err == ErrNotFound {
+			err = ErrInviteNotFound
+		}
+		return nil, false, err
+	}
+
+	member, err := IsMember(ctx, s.Id, userId)
+	if err != nil || member {
+		return s, false, err
+	}
+	banned, err := IsBanned(ctx, s.Id, userId)
+	if err != nil {
+		return nil, false, err
+	}
+	if banned {
+		return nil, false, ErrBanned
+	}
+
+	if err := redeemInvite(ctx, invite); err != nil {
+		return nil, false, err
+	}
+	err = addMember(ctx, Member{
+		ServerId:  s.Id,
+		UserId:    userId,
+		JoinedAt:  time.Now().UTC(),
+		Temporary: invite.Temporary,
+	})
+	if err == ErrAlreadyMember {
+		// they joined some other way in the meantime
+		releaseInvite(context.WithoutCancel(ctx), invite)
+		return s, false, nil
+	}
+	if err != nil {
+		releaseInvite(context.WithoutCancel(ctx), invite)
+		return nil, false, err
+	}
+
+	s.MemberCount++
+	return s, true, nil
+}
+
+// Check that nobody else is using a vanity code, either as their own vanity
+// code or as a normal invite
+func checkVanityCode(ctx context.Context, serverId string, code string) error {
+	count, err := database.GetCollection(collectionName).CountDocuments(ctx, map[string]interface{}{
+		"vanityCode": code,
+		"id":         map[string]interface{}{"$ne": serverId},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check vanity code: %w", err)
+	}
+	if count > 0 {
+		return ErrVanityTaken
+	}
+
+	count, err = database.GetCollection(invitesCollection).CountDocuments(ctx, map[string]interface{}{"code": code})
+	if err != nil {
+		return fmt.Errorf("failed to check vanity code: %w", err)
+	}
+	if count > 0 {
+		return ErrVanityTaken
+	}
+	return nil
+}
+
+// Throw away every invite to a server, once it's deleted
+func deleteInvites(ctx context.Context, serverId string) error {
+	_, err := database.GetCollection(invitesCollection).DeleteMany(ctx, map[string]interface{}{"serverId": serverId})
+	if err != nil {
+		return fmt.Errorf("failed to delete invites: %w", err)
+	}
+	return nil
+}
+
+// Invite codes are unique, and Mongo clears out expired invites by itself
+func ensureInviteIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(invitesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "code", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "serverId", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create invite indexes: %w", err)
+	}
+	return nil
+}
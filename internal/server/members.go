@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that memberships are stored in
+const membersCollection = "server_members"
+
+const MaxNicknameLength = 32
+
+var (
+	ErrAlreadyMember    = errors.New("user is already a member of the server")
+	ErrOwnerCannotLeave = errors.New("the owner can't leave their server without handing it over first")
+	ErrNicknameLength   = errors.New("nickname must be at most 32 characters")
+	ErrNicknameChars    = errors.New("nickname may not contain control characters")
+)
+
+// A user being in a server; there's one of these per user per server
+type Member struct {
+	ServerId string    `bson:"serverId" json:"-"`
+	UserId   string    `bson:"userId" json:"userId"`
+	JoinedAt time.Time `bson:"joinedAt" json:"joinedAt"`
+	Roles    []string  `bson:"roles" json:"roles"`                 // the ids of the member's roles, @everyone isn't included
+	Nickname string    `bson:"nickname,omitempty" json:"nickname"` // what the member is called in this server, if not their username
+	// temporary members are removed once they disconnect, unless they've
+	// been given a role by then
+	Temporary bool `bson:"temporary,omitempty" json:"temporary"`
+}
+
+// Save a new membership, without touching the member count
+func insertMember(ctx context.Context, member Member) error {
+	if member.Roles == nil {
+		member.Roles = []string{}
+	}
+	_, err := database.GetCollection(membersCollection).InsertOne(ctx, member)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyMember
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert member: %w", err)
+	}
+	return nil
+}
+
+// Add somebody to a server and keep the member count in step
+func addMember(ctx context.Context, member Member) error {
+	if err := insertMember(ctx, member); err != nil {
+		return err
+	}
+
+	_, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": member.ServerId},
+		map[string]interface{}{"$inc": map[string]interface{}{"memberCount": 1}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update member count: %w", err)
+	}
+	return nil
+}
+
+// Get the membership of a user in a server, returning ErrNotMember if they
+// aren't in it
+func GetMember(ctx context.Context, serverId string, userId string) (*Member, error) {
+	var member Member
+	err := database.GetCollection(membersCollection).FindOne(ctx,
+		map[string]interface{}{"serverId": serverId, "userId": userId},
+	).Decode(&member)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find member: %w", err)
+	}
+	if member.Roles == nil {
+		member.Roles = []string{}
+	}
+	return &member, nil
+}
+
+// A page of the members of a server, in the order they joined
+type MemberPage struct {
+	Members []Member
+	Total   int
+}
+
+// List the members of a server a page at a time, in the order they joined
+// with user ids breaking ties so that paging is stable
+func ListMembers(ctx context.Context, serverId string, limit int, offset int) (*MemberPage, error) {
+	filter := map[string]interface{}{"serverId": serverId}
+	total, err := database.GetCollection(membersCollection).CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count members: %w", err)
+	}
+
+	cursor, err := database.GetCollection(membersCollection).Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: "joinedAt", Value: 1}, {Key: "userId", Value: 1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+
+	page := &MemberPage{Members: []Member{}, Total: int(total)}
+	if err := cursor.All(ctx, &page.Members); err != nil {
+		return nil, fmt.Errorf("failed to decode members: %w", err)
+	}
+	for i := range page.Members {
+		if page.Members[i].Roles == nil {
+			page.Members[i].Roles = []string{}
+		}
+	}
+	return page, nil
+}
+
+// Tidy up a nickname and check that it's one we'll accept; an empty nickname
+// means going back to the username
+func NormalizeNickname(nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+	if utf8.RuneCountInString(nickname) > MaxNicknameLength {
+		return "", ErrNicknameLength
+	}
+	for _, r := range nickname {
+		if unicode.IsControl(r) {
+			return "", ErrNicknameChars
+		}
+	}
+	return nickname, nil
+}
+
+// Set (or clear, with an empty string) the nickname of a member
+func (m *Member) SetNickname(ctx context.Context, nickname string) error {
+	update := map[string]interface{}{"$set": map[string]interface{}{"nickname": nickname}}
+	if nickname == "" {
+		update = map[string]interface{}{"$unset": map[string]interface{}{"nickname": ""}}
+	}
+
+	result, err := database.GetCollection(membersCollection).UpdateOne(ctx,
+		map[string]interface{}{"serverId": m.ServerId, "userId": m.UserId},
+		update,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set nickname: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotMember
+	}
+	m.Nickname = nickname
+	return nil
+}
+
+// Leave a server. The owner has to hand it over (or delete it) first
+func Leave(ctx context.Context, s *Server, userId string) error {
+	if s.OwnerId == userId {
+		return ErrOwnerCannotLeave
+	}
+	return removeMember(ctx, s.Id, userId)
+}
+
+// Remove somebody else from a server; they can come back with another
+// invite. Whether they're allowed to be kicked is up to the caller
+func Kick(ctx context.Context, s *Server, userId string) error {
+	if s.OwnerId == userId {
+		return ErrOwnerCannotLeave
+	}
+	return removeMember(ctx, s.Id, userId)
+}
+
+// Is the user a member of the server?
+func IsMember(ctx context.Context, serverId string, userId string) (bool, error) {
+	_, err := GetMember(ctx, serverId, userId)
+	if err == ErrNotMember {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// List every server the user is a member of, in the order they joined them
+func ListForUser(ctx context.Context, userId string) ([]Server, error) {
+	cursor, err := database.GetCollection(membersCollection).Find(ctx,
+		map[string]interface{}{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "joinedAt", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find memberships: %w", err)
+	}
+
+	var memberships []Member
+	if err := cursor.All(ctx, &memberships); err != nil {
+		return nil, fmt.Errorf("failed to decode memberships: %w", err)
+	}
+
+	ids := make([]string, len(memberships))
+	for i, membership := range memberships {
+		ids[i] = membership.ServerId
+	}
+	found, err := GetByIds(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := []Server{}
+	for _, id := range ids {
+		if s, ok := found[id]; ok {
+			servers = append(servers, *s)
+		}
+	}
+	return servers, nil
+}
+
+// Find the servers that two users are both members of, ordered by id. Like
+// mutual friends, this is worked out by Mongo rather than by loading every
+// membership of both users
+func GetMutualServers(ctx context.Context, userId string, otherId string) ([]Server, error) {
+	cursor, err := database.GetCollection(membersCollection).Aggregate(ctx, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "userId", Value: bson.D{{Key: "$in", Value: bson.A{userId, otherId}}}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$serverId"},
+			{Key: "members", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "members", Value: 2}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: collectionName},
+			{Key: "localField", Value: "_id"},
+			{Key: "foreignField", Value: "id"},
+			{Key: "as", Value: "server"},
+		}}},
+		bson.D{{Key: "$unwind", Value: "$server"}},
+		bson.D{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$server"}}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find mutual servers: %w", err)
+	}
+
+	servers := []Server{}
+	if err := cursor.All(ctx, &servers); err != nil {
+		return nil, fmt.Errorf("failed to decode mutual servers: %w", err)
+	}
+	return servers, nil
+}
+
+// Remove a user from every server they're in, e.g. when their account is
+// deleted. Servers they own are left alone, they have to be handed over or
+// deleted first
+func RemoveFromAll(ctx context.Context, userId string) error {
+	cursor, err := database.GetCollection(membersCollection).Find(ctx, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return fmt.Errorf("failed to find memberships: %w", err)
+	}
+	var memberships []Member
+	if err := cursor.All(ctx, &memberships); err != nil {
+		return fmt.Errorf("failed to decode memberships: %w", err)
+	}
+
+	for _, membership := range memberships {
+		s, err := GetById(ctx, membership.ServerId)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if s.OwnerId == userId {
+			continue
+		}
+		if err := removeMember(ctx, s.Id, userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a membership and keep the member count in step
+func removeMember(ctx context.Context, serverId string, userId string) error {
+	result, err := database.GetCollection(membersCollection).DeleteOne(ctx,
+		map[string]interface{}{"serverId": serverId, "userId": userId},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove member: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotMember
+	}
+
+	_, err = database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": serverId},
+		map[string]interface{}{"$inc": map[string]interface{}{"memberCount": -1}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update member count: %w", err)
+	}
+	return deleteOverwritesFor(ctx, serverId, OverwriteMember, userId)
+}
+
+// Each user can only be in a server once; the other indexes are for listing
+// the servers of a user and the members of a server in the order they joined
+func ensureMemberIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(membersCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "serverId", Value: 1}, {Key: "userId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "joinedAt", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "serverId", Value: 1}, {Key: "joinedAt", Value: 1}, {Key: "userId", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create member indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import "sort"
+
+// Put a list back in order after some of it has been moved. Everything that
+// was moved ends up at the index it asked for (or as near to it as it can
+// get, if several asked for the same one or it's past the end) and
+// everything else keeps its order around them. target says where an item
+// was moved to, if it was moved at all
+func applyMoves[T any](items []T, target func(T) (int, bool)) []T {
+	type move struct {
+		item  T
+		index int
+	}
+
+	var stayed []T
+	var moved []move
+	for _, item := range items {
+		if index, ok := target(item); ok {
+			moved = append(moved, move{item, index})
+		} else {
+			stayed = append(stayed, item)
+		}
+	}
+	sort.SliceStable(moved, func(i, j int) bool {
+		return moved[i].index < moved[j].index
+	})
+
+	placed := make([]T, 0, len(items))
+	for len(placed) < len(items) {
+		if len(moved) > 0 && (moved[0].index <= len(placed) || len(stayed) == 0) {
+			placed = append(placed, moved[0].item)
+			moved = moved[1:]
+		} else {
+			placed = append(placed, stayed[0])
+			stayed = stayed[1:]
+		}
+	}
+	return placed
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyMoves(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		name  string
+		moves map[string]int
+		want  []string
+	}{
+		{"nothing moved", map[string]int{}, []string{"a", "b", "c", "d", "e"}},
+		{"last to first", map[string]int{"e": 0}, []string{"e", "a", "b", "c", "d"}},
+		{"first to the middle", map[string]int{"a": 2}, []string{"b", "c", "a", "d", "e"}},
+		{"moved to where it already is", map[string]int{"c": 2}, []string{"a", "b", "c", "d", "e"}},
+		{"everything reversed", map[string]int{"a": 4, "b": 3, "c": 2, "d": 1, "e": 0}, []string{"e", "d", "c", "b", "a"}},
+		// items asking for the same index keep their original order
+		{"colliding", map[string]int{"a": 1, "d": 1}, []string{"b", "a", "d", "c", "e"}},
+		{"colliding at the start", map[string]int{"e": 0, "c": 0}, []string{"c", "e", "a", "b", "d"}},
+		// anything past the end goes at the end, in the order asked for
+		{"out of range", map[string]int{"b": 10}, []string{"a", "c", "d", "e", "b"}},
+		{"several out of range", map[string]int{"a": 10, "b": 7}, []string{"c", "d", "e", "b", "a"}},
+	}
+	for _, test := range tests {
+		got := applyMoves(items, func(item string) (int, bool) {
+			index, ok := test.moves[item]
+			return index, ok
+		})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// A set of permissions, one bit each. The bits are part of the API so new
+// permissions only ever get added on the end
+type Permissions uint64
+
+const (
+	PermAdministrator      Permissions = 1 << iota // every permission, in every channel, regardless of overwrites
+	PermViewChannel                                // see a channel at all
+	PermManageChannels                             // create, edit, reorder and delete channels
+	PermManageRoles                                // edit roles below your highest one, and channel overwrites
+	PermManageServer                               // change the name, description and icon of the server
+	PermCreateInvite                               // invite people to the server
+	PermChangeNickname                             // change your own nickname
+	PermManageNicknames                            // change the nicknames of other members
+	PermKickMembers                                // remove members from the server
+	PermBanMembers                                 // ban members from the server
+	PermViewAuditLog                               // see who changed what
+	PermSendMessages                               // send messages in text channels
+	PermReadMessageHistory                         // read messages sent before you opened a channel
+	PermManageMessages                             // delete and pin other people's messages
+	PermAttachFiles                                // upload files with messages
+	PermAddReactions                               // react to messages
+	PermMentionEveryone                            // mention everyone in a channel at once
+	PermConnect                                    // join voice channels
+	PermSpeak                                      // talk in voice channels
+	PermMuteMembers                                // mute other people in voice channels
+	PermDeafenMembers                              // deafen other people in voice channels
+	PermMoveMembers                                // move people between voice channels
+
+	// Every permission there is
+	AllPermissions = PermMoveMembers<<1 - 1
+
+	// What everyone in a new server can do
+	DefaultPermissions = PermViewChannel | PermCreateInvite | PermChangeNickname | PermSendMessages |
+		PermReadMessageHistory | PermAttachFiles | PermAddReactions | PermConnect | PermSpeak
+
+	// The permissions which only make sense for the server as a whole, and so
+	// can't be part of a channel overwrite
+	ServerOnlyPermissions = PermAdministrator | PermManageServer | PermChangeNickname | PermManageNicknames |
+		PermKickMembers | PermBanMembers | PermViewAuditLog
+
+	// The permissions which a channel overwrite can allow or deny
+	ChannelPermissions = AllPermissions &^ ServerOnlyPermissions
+)
+
+// The names of the permissions in bit order, for error messages and the like
+var permissionNames = []string{
+	"administrator", "viewChannel", "manageChannels", "manageRoles", "manageServer", "createInvite",
+	"changeNickname", "manageNicknames", "kickMembers", "banMembers", "viewAuditLog", "sendMessages",
+	"readMessageHistory", "manageMessages", "attachFiles", "addReactions", "mentionEveryone", "connect",
+	"speak", "muteMembers", "deafenMembers", "moveMembers",
+}
+
+var ErrUnknownPermissions = errors.New("unknown permission bits")
+
+// Does the set include every one of the given permissions?
+func (p Permissions) Has(perms Permissions) bool {
+	return p&perms == perms
+}
+
+// The names of every permission in the set, in bit order
+func (p Permissions) Names() []string {
+	names := []string{}
+	for i, name := range permissionNames {
+		if p&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Check that a set of permissions from a client only uses bits we know about
+func (p Permissions) Validate() error {
+	if p&^AllPermissions != 0 {
+		return ErrUnknownPermissions
+	}
+	return nil
+}
+
+type OverwriteType string
+
+const (
+	OverwriteRole   OverwriteType = "role"
+	OverwriteMember OverwriteType = "member"
+)
+
+// Changes to the permissions of a role or a single member in one channel.
+// Deny is applied before allow, so something in both ends up allowed
+type Overwrite struct {
+	Id    string        `bson:"id" json:"id"` // the id of the role or the user
+	Type  OverwriteType `bson:"type" json:"type"`
+	Allow Permissions   `bson:"allow" json:"allow"`
+	Deny  Permissions   `bson:"deny" json:"deny"`
+}
+
+// What a member can do in a server, worked out once per request from their
+// roles and then checked against the server or any channel in it
+type Access struct {
+	ServerId string
+	UserId   string
+	Owner    bool
+	RoleIds  map[string]bool // the member's roles, not counting @everyone
+	Base     Permissions     // what they can do server wide, before any channel overwrites
+	Highest  int             // the position of their highest role; the owner is above every role
+}
+
+// Work out what a member can do. The roles are every role in the server,
+// including @everyone; any role ids the member has which aren't in there
+// (i.e. roles which have since been deleted) are ignored. The owner can do
+// everything, as can anyone with a role that has administrator
+func NewAccess(s *Server, userId string, memberRoleIds []string, roles []Role) *Access {
+	access := &Access{
+		ServerId: s.Id,
+		UserId:   userId,
+		Owner:    s.OwnerId == userId,
+		RoleIds:  map[string]bool{},
+	}
+
+	has := map[string]bool{}
+	for _, id := range memberRoleIds {
+		has[id] = true
+	}
+	for _, role := range roles {
+		if role.Id == s.Id {
+			access.Base |= role.Permissions
+			continue
+		}
+		if !has[role.Id] {
+			continue
+		}
+		access.RoleIds[role.Id] = true
+		access.Base |= role.Permissions
+		if role.Position > access.Highest {
+			access.Highest = role.Position
+		}
+	}
+
+	if access.Owner {
+		access.Highest = math.MaxInt
+	}
+	if access.Owner || access.Base.Has(PermAdministrator) {
+		access.Base = AllPermissions
+	}
+	return access
+}
+
+// Is the member allowed to do all of these things server wide?
+func (a *Access) Has(perms Permissions) bool {
+	return a.Base.Has(perms)
+}
+
+// Work out what the member can do in a channel: the @everyone overwrite is
+// applied first, then the overwrites for all of their roles together, and
+// finally the overwrite for them in particular. Nobody can do anything in a
+// channel they can't see. Administrators ignore overwrites entirely
+func (a *Access) In(channel *Channel) Permissions {
+	if a.Base.Has(PermAdministrator) {
+		return AllPermissions
+	}
+
+	perms := a.Base
+	var roleAllow, roleDeny Permissions
+	var member *Overwrite
+	for i := range channel.Overwrites {
+		overwrite := &channel.Overwrites[i]
+		switch {
+		case overwrite.Type == OverwriteRole && overwrite.Id == a.ServerId:
+			perms = perms&^overwrite.Deny | overwrite.Allow
+		case overwrite.Type == OverwriteRole && a.RoleIds[overwrite.Id]:
+			roleAllow |= overwrite.Allow
+			roleDeny |= overwrite.Deny
+		case overwrite.Type == OverwriteMember && overwrite.Id == a.UserId:
+			member = overwrite
+		}
+	}
+	perms = perms&^roleDeny | roleAllow
+	if member != nil {
+		perms = perms&^member.Deny | member.Allow
+	}
+
+	// overwrites can't hand out server wide powers
+	perms = perms&^ServerOnlyPermissions | a.Base&ServerOnlyPermissions
+	if !perms.Has(PermViewChannel) {
+		return 0
+	}
+	return perms
+}
+
+// Is the member allowed to do all of these things in a channel?
+func (a *Access) HasIn(channel *Channel, perms Permissions) bool {
+	return a.In(channel).Has(perms)
+}
+
+// Can the member hand out these permissions, whether on a role or in an
+// overwrite? Nobody can give away what they don't have themselves
+func (a *Access) CanGrant(perms Permissions) bool {
+	return a.Base.Has(perms)
+}
+
+// Can the member edit, delete or hand out a role? They need to be able to
+// manage roles and the role has to be below their highest one. Nobody can
+// touch @everyone's position or hand it out, but anyone who can manage
+// roles can edit what it allows
+func (a *Access) CanManageRole(role *Role) bool {
+	if !a.Has(PermManageRoles) {
+		return false
+	}
+	if role.Everyone() {
+		return true
+	}
+	return role.Position < a.Highest
+}
+
+// Can the member act on another member, e.g. kicking them or changing their
+// roles? The owner can't be acted on, and otherwise the target's highest
+// role has to be below the member's
+func (a *Access) Outranks(target *Access) bool {
+	if target.Owner {
+		return false
+	}
+	return a.Owner || target.Highest < a.Highest
+}
+
+// Sort roles highest first, the way they're shown to people, with ids
+// breaking ties so that the order never changes
+func sortRoles(roles []Role) {
+	sort.SliceStable(roles, func(i, j int) bool {
+		if roles[i].Position != roles[j].Position {
+			return roles[i].Position > roles[j].Position
+		}
+		return roles[i].Id < roles[j].Id
+	})
+}
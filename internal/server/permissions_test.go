@@ -0,0 +1,636 @@
+package server
+
+import (
+	"math"
+	"math/bits"
+	"reflect"
+	"testing"
+)
+
+const (
+	testServerId = "server"
+	testOwnerId  = "owner"
+	testUserId   = "user"
+)
+
+var testServer = &Server{Id: testServerId, OwnerId: testOwnerId}
+
+func everyone(perms Permissions) Role {
+	return Role{Id: testServerId, ServerId: testServerId, Name: everyoneRoleName, Permissions: perms}
+}
+
+func role(id string, position int, perms Permissions) Role {
+	return Role{Id: id, ServerId: testServerId, Name: id, Position: position, Permissions: perms}
+}
+
+func roleOverwrite(id string, allow Permissions, deny Permissions) Overwrite {
+	return Overwrite{Id: id, Type: OverwriteRole, Allow: allow, Deny: deny}
+}
+
+func memberOverwrite(id string, allow Permissions, deny Permissions) Overwrite {
+	return Overwrite{Id: id, Type: OverwriteMember, Allow: allow, Deny: deny}
+}
+
+func TestPermissionConstants(t *testing.T) {
+	if got := bits.OnesCount64(uint64(AllPermissions)); got != len(permissionNames) {
+		t.Fatalf("AllPermissions has %d bits but there are %d names", got, len(permissionNames))
+	}
+	if !AllPermissions.Has(DefaultPermissions) {
+		t.Error("DefaultPermissions has bits outside of AllPermissions")
+	}
+	if DefaultPermissions.Has(PermAdministrator) {
+		t.Error("everyone shouldn't be an administrator by default")
+	}
+	if ChannelPermissions&ServerOnlyPermissions != 0 {
+		t.Error("ChannelPermissions and ServerOnlyPermissions overlap")
+	}
+	if ChannelPermissions|ServerOnlyPermissions != AllPermissions {
+		t.Error("ChannelPermissions and ServerOnlyPermissions don't cover every permission")
+	}
+	if !ChannelPermissions.Has(PermViewChannel | PermManageChannels | PermManageRoles) {
+		t.Error("channel overwrites need to be able to hide channels and hand out management")
+	}
+}
+
+func TestPermissionsHas(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   Permissions
+		check Permissions
+		want  bool
+	}{
+		{"empty set, nothing asked for", 0, 0, true},
+		{"empty set", 0, PermViewChannel, false},
+		{"exact", PermViewChannel, PermViewChannel, true},
+		{"subset", PermViewChannel | PermSendMessages, PermSendMessages, true},
+		{"needs all of them", PermViewChannel, PermViewChannel | PermSendMessages, false},
+		{"all of them", PermViewChannel | PermSendMessages, PermViewChannel | PermSendMessages, true},
+		{"everything", AllPermissions, AllPermissions, true},
+		{"administrator is just a bit", PermAdministrator, PermViewChannel, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.set.Has(test.check); got != test.want {
+				t.Errorf("Has() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsNames(t *testing.T) {
+	if got := Permissions(0).Names(); len(got) != 0 {
+		t.Errorf("no permissions should have no names, got %v", got)
+	}
+	if got, want := (PermSendMessages | PermAdministrator).Names(), []string{"administrator", "sendMessages"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	if got := AllPermissions.Names(); !reflect.DeepEqual(got, permissionNames) {
+		t.Errorf("every permission should be named in order, got %v", got)
+	}
+	// unknown bits have no name
+	if got := Permissions(1 << 63).Names(); len(got) != 0 {
+		t.Errorf("unknown bits shouldn't be named, got %v", got)
+	}
+}
+
+func TestPermissionsValidate(t *testing.T) {
+	for _, perms := range []Permissions{0, PermViewChannel, DefaultPermissions, AllPermissions} {
+		if err := perms.Validate(); err != nil {
+			t.Errorf("Validate(%d) = %v, want nil", perms, err)
+		}
+	}
+	for _, perms := range []Permissions{AllPermissions + 1, 1 << 63, math.MaxUint64} {
+		if err := perms.Validate(); err != ErrUnknownPermissions {
+			t.Errorf("Validate(%d) = %v, want ErrUnknownPermissions", perms, err)
+		}
+	}
+}
+
+func TestNewAccess(t *testing.T) {
+	roles := []Role{
+		role("admin", 3, PermAdministrator),
+		role("mod", 2, PermKickMembers|PermBanMembers),
+		role("helper", 1, PermManageMessages),
+		everyone(PermViewChannel | PermSendMessages),
+	}
+
+	tests := []struct {
+		name        string
+		userId      string
+		roleIds     []string
+		roles       []Role
+		wantBase    Permissions
+		wantHighest int
+		wantRoles   []string
+	}{
+		{
+			name:        "no roles gets @everyone",
+			userId:      testUserId,
+			roles:       roles,
+			wantBase:    PermViewChannel | PermSendMessages,
+			wantHighest: 0,
+		},
+		{
+			name:        "roles add to @everyone",
+			userId:      testUserId,
+			roleIds:     []string{"helper"},
+			roles:       roles,
+			wantBase:    PermViewChannel | PermSendMessages | PermManageMessages,
+			wantHighest: 1,
+			wantRoles:   []string{"helper"},
+		},
+		{
+			name:        "several roles are combined and the highest counts",
+			userId:      testUserId,
+			roleIds:     []string{"helper", "mod"},
+			roles:       roles,
+			wantBase:    PermViewChannel | PermSendMessages | PermManageMessages | PermKickMembers | PermBanMembers,
+			wantHighest: 2,
+			wantRoles:   []string{"helper", "mod"},
+		},
+		{
+			name:        "the order the member has them in doesn't matter",
+			userId:      testUserId,
+			roleIds:     []string{"mod", "helper"},
+			roles:       roles,
+			wantBase:    PermViewChannel | PermSendMessages | PermManageMessages | PermKickMembers | PermBanMembers,
+			wantHighest: 2,
+			wantRoles:   []string{"helper", "mod"},
+		},
+		{
+			name:        "administrator gets everything",
+			userId:      testUserId,
+			roleIds:     []string{"admin"},
+			roles:       roles,
+			wantBase:    AllPermissions,
+			wantHighest: 3,
+			wantRoles:   []string{"admin"},
+		},
+		{
+			name:        "administrator on @everyone gets everyone everything",
+			userId:      testUserId,
+			roles:       []Role{everyone(PermAdministrator)},
+			wantBase:    AllPermissions,
+			wantHighest: 0,
+		},
+		{
+			name:        "deleted roles are ignored",
+			userId:      testUserId,
+			roleIds:     []string{"deleted", "helper"},
+			roles:       roles,
+			wantBase:    PermViewChannel | PermSendMessages | PermManageMessages,
+			wantHighest: 1,
+			wantRoles:   []string{"helper"},
+		},
+		{
+			name:        "the @everyone id in the member's roles changes nothing",
+			userId:      testUserId,
+			roleIds:     []string{testServerId},
+			roles:       roles,
+			wantBase:    PermViewChannel | PermSendMessages,
+			wantHighest: 0,
+		},
+		{
+			name:        "@everyone with nothing",
+			userId:      testUserId,
+			roles:       []Role{everyone(0)},
+			wantBase:    0,
+			wantHighest: 0,
+		},
+		{
+			name:        "no roles at all",
+			userId:      testUserId,
+			wantBase:    0,
+			wantHighest: 0,
+		},
+		{
+			name:        "the owner gets everything",
+			userId:      testOwnerId,
+			roles:       []Role{everyone(0)},
+			wantBase:    AllPermissions,
+			wantHighest: math.MaxInt,
+		},
+		{
+			name:        "the owner is above every role they have",
+			userId:      testOwnerId,
+			roleIds:     []string{"mod"},
+			roles:       roles,
+			wantBase:    AllPermissions,
+			wantHighest: math.MaxInt,
+			wantRoles:   []string{"mod"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access := NewAccess(testServer, test.userId, test.roleIds, test.roles)
+			if access.Base != test.wantBase {
+				t.Errorf("Base = %v, want %v", access.Base.Names(), test.wantBase.Names())
+			}
+			if access.Highest != test.wantHighest {
+				t.Errorf("Highest = %d, want %d", access.Highest, test.wantHighest)
+			}
+			if access.Owner != (test.userId == testOwnerId) {
+				t.Errorf("Owner = %v", access.Owner)
+			}
+			if access.ServerId != testServerId || access.UserId != test.userId {
+				t.Errorf("wrong ids %q %q", access.ServerId, access.UserId)
+			}
+			if len(access.RoleIds) != len(test.wantRoles) {
+				t.Errorf("RoleIds = %v, want %v", access.RoleIds, test.wantRoles)
+			}
+			for _, id := range test.wantRoles {
+				if !access.RoleIds[id] {
+					t.Errorf("RoleIds is missing %q", id)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessIn(t *testing.T) {
+	base := PermViewChannel | PermSendMessages | PermAddReactions
+	roles := []Role{
+		role("admin", 3, PermAdministrator),
+		role("red", 2, 0),
+		role("blue", 1, 0),
+		everyone(base),
+	}
+
+	tests := []struct {
+		name       string
+		userId     string
+		roleIds    []string
+		overwrites []Overwrite
+		want       Permissions
+	}{
+		{
+			name: "no overwrites is the base",
+			want: base,
+		},
+		{
+			name:       "@everyone deny",
+			overwrites: []Overwrite{roleOverwrite(testServerId, 0, PermSendMessages)},
+			want:       PermViewChannel | PermAddReactions,
+		},
+		{
+			name:       "@everyone allow",
+			overwrites: []Overwrite{roleOverwrite(testServerId, PermAttachFiles, 0)},
+			want:       base | PermAttachFiles,
+		},
+		{
+			name:       "allow beats deny in the same overwrite",
+			overwrites: []Overwrite{roleOverwrite(testServerId, PermSendMessages, PermSendMessages)},
+			want:       base,
+		},
+		{
+			name:       "hiding the channel takes everything away",
+			overwrites: []Overwrite{roleOverwrite(testServerId, PermAttachFiles, PermViewChannel)},
+			want:       0,
+		},
+		{
+			name:       "role allow beats @everyone deny",
+			roleIds:    []string{"red"},
+			overwrites: []Overwrite{roleOverwrite(testServerId, 0, PermViewChannel), roleOverwrite("red", PermViewChannel, 0)},
+			want:       base,
+		},
+		{
+			name:       "role deny beats @everyone allow",
+			roleIds:    []string{"red"},
+			overwrites: []Overwrite{roleOverwrite(testServerId, PermAttachFiles, 0), roleOverwrite("red", 0, PermAttachFiles)},
+			want:       base,
+		},
+		{
+			name:       "a role's allow beats another role's deny regardless of position",
+			roleIds:    []string{"red", "blue"},
+			overwrites: []Overwrite{roleOverwrite("red", 0, PermSendMessages), roleOverwrite("blue", PermSendMessages, 0)},
+			want:       base,
+		},
+		{
+			name:       "and the other way around",
+			roleIds:    []string{"red", "blue"},
+			overwrites: []Overwrite{roleOverwrite("red", PermSendMessages, 0), roleOverwrite("blue", 0, PermSendMessages)},
+			want:       base,
+		},
+		{
+			name:       "role denies are combined",
+			roleIds:    []string{"red", "blue"},
+			overwrites: []Overwrite{roleOverwrite("red", 0, PermSendMessages), roleOverwrite("blue", 0, PermAddReactions)},
+			want:       PermViewChannel,
+		},
+		{
+			name:       "role allows are combined",
+			roleIds:    []string{"red", "blue"},
+			overwrites: []Overwrite{roleOverwrite("red", PermAttachFiles, 0), roleOverwrite("blue", PermManageMessages, 0)},
+			want:       base | PermAttachFiles | PermManageMessages,
+		},
+		{
+			name:       "overwrites for roles the member doesn't have are ignored",
+			roleIds:    []string{"blue"},
+			overwrites: []Overwrite{roleOverwrite("red", PermManageMessages, PermViewChannel)},
+			want:       base,
+		},
+		{
+			name:       "overwrites for deleted roles are ignored",
+			roleIds:    []string{"deleted"},
+			overwrites: []Overwrite{roleOverwrite("deleted", 0, PermViewChannel)},
+			want:       base,
+		},
+		{
+			name:       "member allow beats role deny",
+			roleIds:    []string{"red"},
+			overwrites: []Overwrite{roleOverwrite("red", 0, PermSendMessages), memberOverwrite(testUserId, PermSendMessages, 0)},
+			want:       base,
+		},
+		{
+			name:       "member deny beats role allow",
+			roleIds:    []string{"red"},
+			overwrites: []Overwrite{roleOverwrite("red", PermAttachFiles, 0), memberOverwrite(testUserId, 0, PermAttachFiles)},
+			want:       base,
+		},
+		{
+			name:       "member allow beats @everyone deny",
+			overwrites: []Overwrite{roleOverwrite(testServerId, 0, PermViewChannel), memberOverwrite(testUserId, PermViewChannel, 0)},
+			want:       base,
+		},
+		{
+			name:       "the order the overwrites are stored in doesn't matter",
+			roleIds:    []string{"red"},
+			overwrites: []Overwrite{memberOverwrite(testUserId, PermViewChannel, 0), roleOverwrite("red", 0, PermViewChannel), roleOverwrite(testServerId, 0, PermViewChannel)},
+			want:       base,
+		},
+		{
+			name:       "overwrites for other members are ignored",
+			overwrites: []Overwrite{memberOverwrite("someone else", 0, PermViewChannel)},
+			want:       base,
+		},
+		{
+			name:       "a role and a member with the same id aren't confused",
+			overwrites: []Overwrite{roleOverwrite(testUserId, 0, PermViewChannel)},
+			want:       base,
+		},
+		{
+			name:       "a member overwrite with the server's id isn't @everyone",
+			overwrites: []Overwrite{memberOverwrite(testServerId, 0, PermViewChannel)},
+			want:       base,
+		},
+		{
+			name:       "overwrites can't hand out server wide permissions",
+			overwrites: []Overwrite{memberOverwrite(testUserId, PermAdministrator|PermBanMembers, 0)},
+			want:       base,
+		},
+		{
+			name:       "or take them away",
+			roleIds:    []string{"red"},
+			overwrites: []Overwrite{memberOverwrite(testUserId, 0, PermKickMembers)},
+			want:       base,
+		},
+		{
+			name:       "administrators ignore overwrites",
+			roleIds:    []string{"admin"},
+			overwrites: []Overwrite{roleOverwrite(testServerId, 0, AllPermissions), roleOverwrite("admin", 0, AllPermissions), memberOverwrite(testUserId, 0, AllPermissions)},
+			want:       AllPermissions,
+		},
+		{
+			name:       "the owner ignores overwrites",
+			userId:     testOwnerId,
+			overwrites: []Overwrite{roleOverwrite(testServerId, 0, AllPermissions), memberOverwrite(testOwnerId, 0, AllPermissions)},
+			want:       AllPermissions,
+		},
+		{
+			name:       "allowing the channel on its own gives just that",
+			overwrites: []Overwrite{roleOverwrite(testServerId, PermViewChannel, AllPermissions)},
+			want:       PermViewChannel,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userId := test.userId
+			if userId == "" {
+				userId = testUserId
+			}
+			access := NewAccess(testServer, userId, test.roleIds, roles)
+			channel := &Channel{Id: "channel", ServerId: testServerId, Overwrites: test.overwrites}
+			if got := access.In(channel); got != test.want {
+				t.Errorf("In() = %v, want %v", got.Names(), test.want.Names())
+			}
+			if got := access.HasIn(channel, test.want); !got {
+				t.Errorf("HasIn() = false for the permissions In() returned")
+			}
+		})
+	}
+}
+
+func TestAccessInKeepsServerOnlyPermissions(t *testing.T) {
+	roles := []Role{role("mod", 1, PermKickMembers|PermViewAuditLog), everyone(PermViewChannel)}
+	access := NewAccess(testServer, testUserId, []string{"mod"}, roles)
+
+	channel := &Channel{Overwrites: []Overwrite{roleOverwrite(testServerId, PermSendMessages, 0)}}
+	want := PermViewChannel | PermSendMessages | PermKickMembers | PermViewAuditLog
+	if got := access.In(channel); got != want {
+		t.Errorf("In() = %v, want %v", got.Names(), want.Names())
+	}
+
+	// but not in a channel they can't see
+	channel.Overwrites = []Overwrite{roleOverwrite("mod", 0, PermViewChannel)}
+	if got := access.In(channel); got != 0 {
+		t.Errorf("In() = %v, want nothing", got.Names())
+	}
+}
+
+func TestAccessHas(t *testing.T) {
+	roles := []Role{role("mod", 1, PermKickMembers), everyone(PermViewChannel)}
+	access := NewAccess(testServer, testUserId, []string{"mod"}, roles)
+
+	if !access.Has(PermKickMembers) || !access.Has(PermViewChannel|PermKickMembers) {
+		t.Error("Has() should include the member's roles and @everyone")
+	}
+	if access.Has(PermBanMembers) || access.Has(PermKickMembers|PermBanMembers) {
+		t.Error("Has() shouldn't include anything else")
+	}
+	if !access.Has(0) {
+		t.Error("everyone has no permissions")
+	}
+}
+
+func TestAccessCanGrant(t *testing.T) {
+	roles := []Role{
+		role("admin", 2, PermAdministrator),
+		role("mod", 1, PermManageRoles|PermKickMembers),
+		everyone(PermViewChannel),
+	}
+
+	tests := []struct {
+		name    string
+		userId  string
+		roleIds []string
+		grant   Permissions
+		want    bool
+	}{
+		{"nothing", testUserId, nil, 0, true},
+		{"something they have", testUserId, []string{"mod"}, PermKickMembers, true},
+		{"something from @everyone", testUserId, []string{"mod"}, PermViewChannel, true},
+		{"everything they have", testUserId, []string{"mod"}, PermViewChannel | PermManageRoles | PermKickMembers, true},
+		{"something they don't have", testUserId, []string{"mod"}, PermBanMembers, false},
+		{"some of which they don't have", testUserId, []string{"mod"}, PermKickMembers | PermBanMembers, false},
+		{"administrator without having it", testUserId, []string{"mod"}, PermAdministrator, false},
+		{"administrators can grant anything", testUserId, []string{"admin"}, AllPermissions, true},
+		{"owners can grant anything", testOwnerId, nil, AllPermissions, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access := NewAccess(testServer, test.userId, test.roleIds, roles)
+			if got := access.CanGrant(test.grant); got != test.want {
+				t.Errorf("CanGrant() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAccessCanManageRole(t *testing.T) {
+	roles := []Role{
+		role("admin", 4, PermAdministrator),
+		role("manager", 3, PermManageRoles),
+		role("peer", 3, 0),
+		role("helper", 2, PermManageRoles),
+		role("member", 1, 0),
+		everyone(PermViewChannel),
+	}
+	find := func(id string) *Role {
+		for i := range roles {
+			if roles[i].Id == id {
+				return &roles[i]
+			}
+		}
+		t.Fatalf("no role %q", id)
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		userId  string
+		roleIds []string
+		target  string
+		want    bool
+	}{
+		{"below their highest role", testUserId, []string{"manager"}, "helper", true},
+		{"well below their highest role", testUserId, []string{"manager"}, "member", true},
+		{"their own highest role", testUserId, []string{"manager"}, "manager", false},
+		{"a role at the same position", testUserId, []string{"manager"}, "peer", false},
+		{"a role above them", testUserId, []string{"manager"}, "admin", false},
+		{"@everyone", testUserId, []string{"manager"}, testServerId, true},
+		{"their highest role counts even without the permission", testUserId, []string{"helper", "peer"}, "helper", true},
+		{"without manage roles", testUserId, []string{"peer"}, "member", false},
+		{"@everyone without manage roles", testUserId, []string{"peer"}, testServerId, false},
+		{"no roles at all", testUserId, nil, testServerId, false},
+		{"administrators below their highest role", testUserId, []string{"admin"}, "manager", true},
+		{"administrators not on their own role", testUserId, []string{"admin"}, "admin", false},
+		{"the owner can manage the top role", testOwnerId, nil, "admin", true},
+		{"the owner can manage @everyone", testOwnerId, nil, testServerId, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access := NewAccess(testServer, test.userId, test.roleIds, roles)
+			if got := access.CanManageRole(find(test.target)); got != test.want {
+				t.Errorf("CanManageRole() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAccessOutranks(t *testing.T) {
+	roles := []Role{role("high", 2, 0), role("low", 1, 0), everyone(0)}
+	owner := NewAccess(testServer, testOwnerId, nil, roles)
+	high := NewAccess(testServer, "high", []string{"high"}, roles)
+	highToo := NewAccess(testServer, "high too", []string{"high", "low"}, roles)
+	low := NewAccess(testServer, "low", []string{"low"}, roles)
+	none := NewAccess(testServer, "none", nil, roles)
+
+	tests := []struct {
+		name   string
+		actor  *Access
+		target *Access
+		want   bool
+	}{
+		{"higher role", high, low, true},
+		{"higher role than no roles", low, none, true},
+		{"same highest role", high, highToo, false},
+		{"lower role", low, high, false},
+		{"both without roles", none, none, false},
+		{"the owner outranks everyone", owner, high, true},
+		{"the owner outranks people without roles", owner, none, true},
+		{"nobody outranks the owner", high, owner, false},
+		{"not even the owner", owner, owner, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.actor.Outranks(test.target); got != test.want {
+				t.Errorf("Outranks() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSortRoles(t *testing.T) {
+	roles := []Role{everyone(0), role("b", 1, 0), role("c", 2, 0), role("a", 1, 0)}
+	sortRoles(roles)
+
+	var got []string
+	for _, r := range roles {
+		got = append(got, r.Id)
+	}
+	if want := []string{"c", "a", "b", testServerId}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortRoles() = %v, want %v", got, want)
+	}
+}
+
+func TestReorderRoles(t *testing.T) {
+	roles := func() []Role {
+		return []Role{role("c", 3, 0), role("b", 2, 0), role("a", 1, 0), everyone(0)}
+	}
+	order := func(roles []Role) []string {
+		var ids []string
+		for _, r := range roles {
+			ids = append(ids, r.Id)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name      string
+		positions []RolePosition
+		want      []string
+		err       error
+	}{
+		{"nothing moves", []RolePosition{{Id: "a", Position: 1}}, []string{"c", "b", "a", testServerId}, nil},
+		{"to the top", []RolePosition{{Id: "a", Position: 3}}, []string{"a", "c", "b", testServerId}, nil},
+		{"past the top", []RolePosition{{Id: "a", Position: 100}}, []string{"a", "c", "b", testServerId}, nil},
+		{"to the bottom", []RolePosition{{Id: "c", Position: 1}}, []string{"b", "a", "c", testServerId}, nil},
+		{"into the middle", []RolePosition{{Id: "c", Position: 2}}, []string{"b", "c", "a", testServerId}, nil},
+		{"swapping", []RolePosition{{Id: "a", Position: 3}, {Id: "c", Position: 1}}, []string{"a", "b", "c", testServerId}, nil},
+		{"everything at once", []RolePosition{{Id: "a", Position: 2}, {Id: "b", Position: 1}, {Id: "c", Position: 3}}, []string{"c", "a", "b", testServerId}, nil},
+		{"@everyone can't move", []RolePosition{{Id: testServerId, Position: 3}}, nil, ErrEveryoneRole},
+		{"unknown roles", []RolePosition{{Id: "nope", Position: 1}}, nil, ErrRoleNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := reorderRoles(roles(), test.positions)
+			if err != test.err {
+				t.Fatalf("reorderRoles() error = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if ids := order(got); !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("reorderRoles() = %v, want %v", ids, test.want)
+			}
+			// positions always run from 1 to the top with @everyone at 0
+			for i, r := range got {
+				if want := len(got) - 1 - i; r.Position != want {
+					t.Errorf("%s is at %d, want %d", r.Id, r.Position, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that roles are stored in
+const rolesCollection = "server_roles"
+
+const (
+	MaxRoles          = 250 // per server, not counting @everyone
+	MaxRoleNameLength = 100
+	MaxRoleColor      = 0xFFFFFF
+	everyoneRoleName  = "@everyone"
+)
+
+var (
+	ErrRoleNotFound    = errors.New("role not found")
+	ErrTooManyRoles    = errors.New("server has too many roles")
+	ErrEveryoneRole    = errors.New("the @everyone role can't be renamed, moved, deleted or handed out")
+	ErrRoleHierarchy   = errors.New("roles can only be moved below your highest role")
+	ErrRoleNameLength  = errors.New("role name must be between 1 and 100 characters")
+	ErrRoleNameChars   = errors.New("role name may not contain control characters")
+	ErrInvalidRoleName = errors.New("only the @everyone role can be called @everyone")
+	ErrInvalidColor    = errors.New("color must be between 0 and 0xFFFFFF")
+)
+
+// A role in a server. Every server has an @everyone role, which has the same
+// id as the server, always sits at position 0 and applies to every member;
+// the rest are handed out to members and sit above it, the highest first
+type Role struct {
+	Id          string      `bson:"id" json:"id"`
+	ServerId    string      `bson:"serverId" json:"serverId"`
+	Name        string      `bson:"name" json:"name"`
+	Color       int         `bson:"color" json:"color"` // as 0xRRGGBB, 0 means no color
+	Position    int         `bson:"position" json:"position"`
+	Permissions Permissions `bson:"permissions" json:"permissions"`
+	CreatedAt   time.Time   `bson:"createdAt" json:"createdAt"`
+}
+
+// Is this the @everyone role?
+func (r *Role) Everyone() bool {
+	return r.Id == r.ServerId
+}
+
+// The @everyone role as it is before anyone changes it. It's only saved once
+// it's been edited, so servers always have one even if it's not in Mongo
+func defaultEveryoneRole(s *Server) Role {
+	return Role{
+		Id:          s.Id,
+		ServerId:    s.Id,
+		Name:        everyoneRoleName,
+		Permissions: DefaultPermissions,
+		CreatedAt:   s.CreatedAt,
+	}
+}
+
+// Tidy up a role name and check that it's one we'll accept
+func NormalizeRoleName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if n := utf8.RuneCountInString(name); n < 1 || n > MaxRoleNameLength {
+		return "", ErrRoleNameLength
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", ErrRoleNameChars
+		}
+	}
+	if name == everyoneRoleName {
+		return "", ErrInvalidRoleName
+	}
+	return name, nil
+}
+
+// Check that a color is one we can store
+func ValidateColor(color int) error {
+	if color < 0 || color > MaxRoleColor {
+		return ErrInvalidColor
+	}
+	return nil
+}
+
+// List every role in a server, highest first, so @everyone is always last
+func ListRoles(ctx context.Context, s *Server) ([]Role, error) {
+	cursor, err := database.GetCollection(rolesCollection).Find(ctx,
+		map[string]interface{}{"serverId": s.Id},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+
+	roles := []Role{}
+	if err := cursor.All(ctx, &roles); err != nil {
+		return nil, fmt.Errorf("failed to decode roles: %w", err)
+	}
+
+	hasEveryone := false
+	for _, role := range roles {
+		if role.Everyone() {
+			hasEveryone = true
+		}
+	}
+	if !hasEveryone {
+		roles = append(roles, defaultEveryoneRole(s))
+	}
+	sortRoles(roles)
+	return roles, nil
+}
+
+// Get a single role in a server
+func GetRole(ctx context.Context, s *Server, roleId string) (*Role, error) {
+	var role Role
+	err := database.GetCollection(rolesCollection).FindOne(ctx,
+		map[string]interface{}{"serverId": s.Id, "id": roleId},
+	).Decode(&role)
+	if err == mongo.ErrNoDocuments {
+		if roleId == s.Id {
+			role = defaultEveryoneRole(s)
+			return &role, nil
+		}
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find role: %w", err)
+	}
+	return &role, nil
+}
+
+// Work out what a user can do in a server, returning ErrNotMember if they
+// aren't in it
+func GetAccess(ctx context.Context, s *Server, userId string) (*Access, error) {
+	member, err := GetMember(ctx, s.Id, userId)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := ListRoles(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return NewAccess(s, userId, member.Roles, roles), nil
+}
+
+// Create a role just above @everyone, where it can't do any harm until
+// somebody moves it; the name should already have been normalized
+func CreateRole(ctx context.Context, s *Server, name string, color int, perms Permissions) (*Role, error) {
+	roles, err := ListRoles(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles)-1 >= MaxRoles {
+		return nil, ErrTooManyRoles
+	}
+
+	// make room at the bottom
+	_, err = database.GetCollection(rolesCollection).UpdateMany(ctx,
+		map[string]interface{}{"serverId": s.Id, "position": map[string]interface{}{"$gte": 1}},
+		map[string]interface{}{"$inc": map[string]interface{}{"position": 1}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move roles up: %w", err)
+	}
+
+	role := &Role{
+		Id:          uuid.New().String(),
+		ServerId:    s.Id,
+		Name:        name,
+		Color:       color,
+		Position:    1,
+		Permissions: perms,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if _, err := database.GetCollection(rolesCollection).InsertOne(ctx, role); err != nil {
+		return nil, fmt.Errorf("failed to insert role: %w", err)
+	}
+	return role, nil
+}
+
+// The parts of a role that can be changed, nil means leave the field as it
+// is. Positions are changed with ReorderRoles
+type RoleUpdate struct {
+	Name        *string
+	Color       *int
+	Permissions *Permissions
+}
+
+// Save changes to a role; the name should already have been normalized. The
+// @everyone role can only have its permissions changed
+func UpdateRole(ctx context.Context, role *Role, changes RoleUpdate) error {
+	if role.Everyone() && (changes.Name != nil || changes.Color != nil) {
+		return ErrEveryoneRole
+	}
+
+	fields := map[string]interface{}{}
+	if changes.Name != nil {
+		fields["name"] = *changes.Name
+	}
+	if changes.Color != nil {
+		fields["color"] = *changes.Color
+	}
+	if changes.Permissions != nil {
+		fields["permissions"] = *changes.Permissions
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	filter := map[string]interface{}{"serverId": role.ServerId, "id": role.Id}
+	if role.Everyone() {
+		// @everyone might not have been saved yet
+		fields["name"] = role.Name
+		fields["position"] = 0
+		fields["createdAt"] = role.CreatedAt
+		_, err := database.GetCollection(rolesCollection).UpdateOne(ctx, filter,
+			map[string]interface{}{"$set": fields},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update role: %w", err)
+		}
+	} else {
+		result, err := database.GetCollection(rolesCollection).UpdateOne(ctx, filter,
+			map[string]interface{}{"$set": fields},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update role: %w", err)
+		}
+		if result.MatchedCount == 0 {
+			return ErrRoleNotFound
+		}
+	}
+
+	if changes.Name != nil {
+		role.Name = *changes.Name
+	}
+	if changes.Color != nil {
+		role.Color = *changes.Color
+	}
+	if changes.Permissions != nil {
+		role.Permissions = *changes.Permissions
+	}
+	return nil
+}
+
+// Where one role should end up in a bulk reorder
+type RolePosition struct {
+	Id       string
+	Position int
+}
+
+// Work out the new order of the roles without saving anything. Like
+// channels, each role given ends up at the position it asked for with the
+// rest keeping their order around it, and the roles are numbered from 1
+// again afterwards with @everyone left at 0. The roles come back highest first
+func reorderRoles(roles []Role, positions []RolePosition) ([]Role, error) {
+	var everyone *Role
+	var others []Role
+	for i := range roles {
+		if roles[i].Everyone() {
+			everyone = &roles[i]
+		} else {
+			others = append(others, roles[i])
+		}
+	}
+
+	exists := map[string]bool{}
+	for _, role := range others {
+		exists[role.Id] = true
+	}
+	targets := map[string]int{}
+	for _, position := range positions {
+		if everyone != nil && position.Id == everyone.Id {
+			return nil, ErrEveryoneRole
+		}
+		if !exists[position.Id] {
+			return nil, ErrRoleNotFound
+		}
+		targets[position.Id] = position.Position - 1
+	}
+
+	// lowest first, so that indexes line up with positions
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].Position < others[j].Position
+	})
+	reordered := applyMoves(others, func(role Role) (int, bool) {
+		index, ok := targets[role.Id]
+		return index, ok
+	})
+	for i := range reordered {
+		reordered[i].Position = i + 1
+	}
+
+	if everyone != nil {
+		reordered = append(reordered, *everyone)
+	}
+	sortRoles(reordered)
+	return reordered, nil
+}
+
+// Move several roles at once. Whoever is doing it can only move roles which
+// are below their highest role, and only to somewhere that's still below it;
+// otherwise this returns ErrRoleHierarchy without changing anything. Returns
+// every role in the server, highest first
+func ReorderRoles(ctx context.Context, s *Server, access *Access, positions []RolePosition) ([]Role, error) {
+	roles, err := ListRoles(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	reordered, err := reorderRoles(roles, positions)
+	if err != nil {
+		return nil, err
+	}
+
+	before := make(map[string]int, len(roles))
+	for _, role := range roles {
+		before[role.Id] = role.Position
+	}
+	after := NewAccess(s, access.UserId, keys(access.RoleIds), reordered)
+
+	var models []mongo.WriteModel
+	for _, role := range reordered {
+		if before[role.Id] == role.Position {
+			continue
+		}
+		if !access.Owner && (before[role.Id] >= access.Highest || role.Position >= after.Highest) {
+			return nil, ErrRoleHierarchy
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "serverId", Value: s.Id}, {Key: "id", Value: role.Id}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "position", Value: role.Position}}}}))
+	}
+	if len(models) > 0 {
+		if _, err := database.GetCollection(rolesCollection).BulkWrite(ctx, models); err != nil {
+			return nil, fmt.Errorf("failed to reorder roles: %w", err)
+		}
+	}
+	return reordered, nil
+}
+
+// Delete a role, taking it away from everyone who had it and out of every
+// channel overwrite
+func DeleteRole(ctx context.Context, role *Role) error {
+	if role.Everyone() {
+		return ErrEveryoneRole
+	}
+
+	result, err := database.GetCollection(rolesCollection).DeleteOne(ctx,
+		map[string]interface{}{"serverId": role.ServerId, "id": role.Id},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrRoleNotFound
+	}
+
+	// nothing can use the role anymore, since NewAccess ignores roles that
+	// don't exist, so the rest is just tidying up
+	ctx = context.WithoutCancel(ctx)
+	var errs []error
+	_, err = database.GetCollection(rolesCollection).UpdateMany(ctx,
+		map[string]interface{}{"serverId": role.ServerId, "position": map[string]interface{}{"$gt": role.Position}},
+		map[string]interface{}{"$inc": map[string]interface{}{"position": -1}},
+	)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to move roles down: %w", err))
+	}
+	_, err = database.GetCollection(membersCollection).UpdateMany(ctx,
+		map[string]interface{}{"serverId": role.ServerId, "roles": role.Id},
+		map[string]interface{}{"$pull": map[string]interface{}{"roles": role.Id}},
+	)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to take role away from members: %w", err))
+	}
+	if err := deleteOverwritesFor(ctx, role.ServerId, OverwriteRole, role.Id); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Give a member a role, which does nothing if they already have it
+func AddMemberRole(ctx context.Context, role *Role, userId string) error {
+	return updateMemberRoles(ctx, role, userId, "$addToSet")
+}
+
+// Take a role away from a member, which does nothing if they don't have it
+func RemoveMemberRole(ctx context.Context, role *Role, userId string) error {
+	return updateMemberRoles(ctx, role, userId, "$pull")
+}
+
+func updateMemberRoles(ctx context.Context, role *Role, userId string, operator string) error {
+	if role.Everyone() {
+		return ErrEveryoneRole
+	}
+
+	result, err := database.GetCollection(membersCollection).UpdateOne(ctx,
+		map[string]interface{}{"serverId": role.ServerId, "userId": userId},
+		map[string]interface{}{operator: map[string]interface{}{"roles": role.Id}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update member roles: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// Throw away every role in a server, once it's deleted
+func deleteRoles(ctx context.Context, serverId string) error {
+	_, err := database.GetCollection(rolesCollection).DeleteMany(ctx, map[string]interface{}{"serverId": serverId})
+	if err != nil {
+		return fmt.Errorf("failed to delete roles: %w", err)
+	}
+	return nil
+}
+
+func keys(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for key := range set {
+		list = append(list, key)
+	}
+	return list
+}
+
+// Roles are always looked up within their server
+func ensureRoleIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(rolesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "serverId", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create role indexes: %w", err)
+	}
+	return nil
+}
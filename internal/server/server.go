@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that servers are stored in
+const collectionName = "servers"
+
+var (
+	ErrNotFound  = errors.New("server not found")
+	ErrNotMember = errors.New("user is not a member of the server")
+)
+
+// A server (guild, community, whatever you want to call it) that users can
+// join. The owner can always do anything to the server, and can't leave it
+// without handing it over to somebody else first; what everyone else can do
+// is down to their roles, see Access
+type Server struct {
+	Id          string    `bson:"id"`
+	Name        string    `bson:"name"`
+	Description string    `bson:"description"`
+	Icon        string    `bson:"icon"` // the name of the icon in the blob store, if there is one
+	OwnerId     string    `bson:"ownerId"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	MemberCount int       `bson:"memberCount"`          // kept up to date as people join and leave
+	VanityCode  string    `bson:"vanityCode,omitempty"` // an invite code of the server's own choosing, which never runs out
+	VanityUses  int       `bson:"vanityUses"`
+	// set while the server is in the directory, see List
+	Listing        *Listing        `bson:"listing,omitempty"`
+	DirectoryBlock *DirectoryBlock `bson:"directoryBlock,omitempty"`
+}
+
+// The server as it is sent to clients
+type PublicServer struct {
+	Id          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Icon        map[string]string `json:"icon"` // the URL of each size of the icon, keyed by size, or null
+	OwnerId     string            `json:"ownerId"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	MemberCount int               `json:"memberCount"`
+	VanityCode  string            `json:"vanityCode,omitempty"`
+	Listing     *Listing          `json:"listing,omitempty"`
+}
+
+func (s *Server) Public() PublicServer {
+	return PublicServer{
+		Id:          s.Id,
+		Name:        s.Name,
+		Description: s.Description,
+		Icon:        IconURLs(s.Id, s.Icon),
+		OwnerId:     s.OwnerId,
+		CreatedAt:   s.CreatedAt,
+		MemberCount: s.MemberCount,
+		VanityCode:  s.VanityCode,
+		Listing:     s.Listing,
+	}
+}
+
+// Create a new server, with its creator as the owner and first member. The
+// name and description should already have been validated
+func Create(ctx context.Context, ownerId string, name string, description string) (*Server, error) {
+	now := time.Now().UTC()
+	s := &Server{
+		Id:          uuid.New().String(),
+		Name:        name,
+		Description: description,
+		OwnerId:     ownerId,
+		CreatedAt:   now,
+		MemberCount: 1,
+	}
+
+	if _, err := database.GetCollection(collectionName).InsertOne(ctx, s); err != nil {
+		return nil, fmt.Errorf("failed to insert server: %w", err)
+	}
+	if err := insertMember(ctx, Member{ServerId: s.Id, UserId: ownerId, JoinedAt: now}); err != nil {
+		// a server with nobody in it is no use to anyone
+		database.GetCollection(collectionName).DeleteOne(context.WithoutCancel(ctx), map[string]interface{}{"id": s.Id})
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get a server by its id
+func GetById(ctx context.Context, id string) (*Server, error) {
+	var s Server
+	err := database.GetCollection(collectionName).FindOne(ctx, map[string]interface{}{"id": id}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find server: %w", err)
+	}
+	return &s, nil
+}
+
+// Get several servers at once, keyed by id; any ids which don't exist are
+// just left out
+func GetByIds(ctx context.Context, ids []string) (map[string]*Server, error) {
+	servers := map[string]*Server{}
+	if len(ids) == 0 {
+		return servers, nil
+	}
+
+	cursor, err := database.GetCollection(collectionName).Find(ctx, map[string]interface{}{
+		"id": map[string]interface{}{"$in": ids},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find servers: %w", err)
+	}
+
+	var found []Server
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("failed to decode servers: %w", err)
+	}
+	for i := range found {
+		servers[found[i].Id] = &found[i]
+	}
+	return servers, nil
+}
+
+// Update the fields of a single server, returning ErrNotFound if there is no
+// server with the given id
+func update(ctx context.Context, id string, fields map[string]interface{}) error {
+	result, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": id},
+		map[string]interface{}{"$set": fields},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update server: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// The parts of a server that can be changed, nil means leave the field as
+// it is
+type Update struct {
+	Name        *string
+	Description *string
+	OwnerId     *string // the new owner has to already be a member
+	VanityCode  *string // normalized already, an empty string takes it away
+}
+
+// Save changes to a server; the update should already have been validated
+func (s *Server) Update(ctx context.Context, changes Update) error {
+	fields := map[string]interface{}{}
+	if changes.Name != nil {
+		fields["name"] = *changes.Name
+	}
+	if changes.Description != nil {
+		fields["description"] = *changes.Description
+	}
+	if changes.OwnerId != nil && *changes.OwnerId != s.OwnerId {
+		member, err := IsMember(ctx, s.Id, *changes.OwnerId)
+		if err != nil {
+			return err
+		}
+		if !member {
+			return ErrNotMember
+		}
+		fields["ownerId"] = *changes.OwnerId
+	}
+	if changes.VanityCode != nil && *changes.VanityCode != s.VanityCode {
+		if *changes.VanityCode == "" {
+			if err := clearVanityCode(ctx, s.Id); err != nil {
+				return err
+			}
+		} else {
+			if err := checkVanityCode(ctx, s.Id, *changes.VanityCode); err != nil {
+				return err
+			}
+			fields["vanityCode"] = *changes.VanityCode
+			fields["vanityUses"] = 0
+		}
+	}
+	if len(fields) > 0 {
+		if err := update(ctx, s.Id, fields); mongo.IsDuplicateKeyError(err) {
+			// somebody else took the vanity code in the meantime
+			return ErrVanityTaken
+		} else if err != nil {
+			return err
+		}
+	}
+	if changes.Name != nil {
+		s.Name = *changes.Name
+	}
+	if changes.Description != nil {
+		s.Description = *changes.Description
+	}
+	if changes.OwnerId != nil {
+		s.OwnerId = *changes.OwnerId
+	}
+	if changes.VanityCode != nil && *changes.VanityCode != s.VanityCode {
+		s.VanityCode = *changes.VanityCode
+		s.VanityUses = 0
+	}
+	return nil
+}
+
+// Take away the vanity code of a server
+func clearVanityCode(ctx context.Context, id string) error {
+	_, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": id},
+		map[string]interface{}{"$unset": map[string]interface{}{"vanityCode": ""}, "$set": map[string]interface{}{"vanityUses": 0}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to clear vanity code: %w", err)
+	}
+	return nil
+}
+
+// Delete a server along with everything in it
+func (s *Server) Delete(ctx context.Context) error {
+	if _, err := database.GetCollection(collectionName).DeleteOne(ctx, map[string]interface{}{"id": s.Id}); err != nil {
+		return fmt.Errorf("failed to delete server: %w", err)
+	}
+
+	// the server is gone as far as anyone can tell, so carry on clearing up
+	// after it even if the request goes away, and report any failures at
+	// the end
+	ctx = context.WithoutCancel(ctx)
+	var errs []error
+
+	if _, err := database.GetCollection(membersCollection).DeleteMany(ctx, map[string]interface{}{"serverId": s.Id}); err != nil {
+		errs = append(errs, fmt.Errorf("failed to delete server members: %w", err))
+	}
+	if err := deleteChannels(ctx, s.Id); err != nil {
+		errs = append(errs, err)
+	}
+	if err := deleteRoles(ctx, s.Id); err != nil {
+		errs = append(errs, err)
+	}
+	if err := deleteInvites(ctx, s.Id); err != nil {
+		errs = append(errs, err)
+	}
+	if err := deleteBans(ctx, s.Id); err != nil {
+		errs = append(errs, err)
+	}
+	if err := deleteTemplate(ctx, s.Id); err != nil {
+		errs = append(errs, err)
+	}
+	if err := deleteAuditLog(ctx, s.Id); err != nil {
+		errs = append(errs, err)
+	}
+	if err := deleteIcons(ctx, s.Id); err != nil {
+		errs = append(errs, fmt.Errorf("failed to delete icons: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// List the servers owned by a user
+func ListOwnedBy(ctx context.Context, userId string) ([]Server, error) {
+	cursor, err := database.GetCollection(collectionName).Find(ctx,
+		map[string]interface{}{"ownerId": userId},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find servers: %w", err)
+	}
+
+	servers := []Server{}
+	if err := cursor.All(ctx, &servers); err != nil {
+		return nil, fmt.Errorf("failed to decode servers: %w", err)
+	}
+	return servers, nil
+}
+
+// Make sure every index the server package relies on exists; this is safe to
+// call every time we start as Mongo does nothing for indexes that already exist
+func EnsureIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(collectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "ownerId", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "vanityCode", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create server indexes: %w", err)
+	}
+
+	if err := ensureMemberIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureChannelIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureRoleIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureInviteIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureBanIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureTemplateIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureAuditIndexes(ctx); err != nil {
+		return err
+	}
+	return ensureDirectoryIndexes(ctx)
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that templates are stored in
+const templatesCollection = "server_templates"
+
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+	ErrTemplateExists   = errors.New("server already has a template")
+)
+
+// A snapshot of how a server is laid out (its roles, channels and the
+// overwrites on them, but no members or messages) that anyone with the code
+// can make a new server from. Each server has at most one, which is synced
+// by hand so that work in progress isn't shared by accident
+type Template struct {
+	Code        string           `bson:"code" json:"code"`
+	ServerId    string           `bson:"serverId" json:"serverId"` // the server the template was made from
+	Name        string           `bson:"name" json:"name"`
+	Description string           `bson:"description" json:"description"`
+	CreatedBy   string           `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time        `bson:"createdAt" json:"createdAt"`
+	SyncedAt    time.Time        `bson:"syncedAt" json:"syncedAt"` // when the snapshot was last taken
+	Uses        int              `bson:"uses" json:"uses"`
+	Snapshot    TemplateSnapshot `bson:"snapshot" json:"snapshot"`
+}
+
+// The layout of a server. Roles and channels get small ids of their own,
+// which only mean anything within the snapshot, so that nothing in it
+// points back at the original server
+type TemplateSnapshot struct {
+	// lowest first, so @everyone is always first with an id of 0 and each
+	// role's id is also its position
+	Roles []TemplateRole `bson:"roles" json:"roles"`
+	// in the order ListChannels gives them, so categories always come before
+	// the channels in them
+	Channels []TemplateChannel `bson:"channels" json:"channels"`
+}
+
+type TemplateRole struct {
+	Id          int         `bson:"id" json:"id"`
+	Name        string      `bson:"name" json:"name"`
+	Color       int         `bson:"color" json:"color"`
+	Permissions Permissions `bson:"permissions" json:"permissions"`
+}
+
+type TemplateChannel struct {
+	Id       int         `bson:"id" json:"id"`
+	Type     ChannelType `bson:"type" json:"type"`
+	Name     string      `bson:"name" json:"name"`
+	Topic    string      `bson:"topic" json:"topic"`
+	ParentId *int        `bson:"parentId,omitempty" json:"parentId"`
+	NSFW     bool        `bson:"nsfw" json:"nsfw"`
+	// member overwrites are left out, the members don't come along
+	Overwrites []TemplateOverwrite `bson:"overwrites" json:"overwrites"`
+}
+
+type TemplateOverwrite struct {
+	RoleId int         `bson:"roleId" json:"roleId"`
+	Allow  Permissions `bson:"allow" json:"allow"`
+	Deny   Permissions `bson:"deny" json:"deny"`
+}
+
+// Take a snapshot of the roles and channels of a server as they are now
+func takeSnapshot(ctx context.Context, s *Server) (TemplateSnapshot, error) {
+	snapshot := TemplateSnapshot{Roles: []TemplateRole{}, Channels: []TemplateChannel{}}
+
+	roles, err := ListRoles(ctx, s)
+	if err != nil {
+		return snapshot, err
+	}
+	roleIds := map[string]int{}
+	for i := len(roles) - 1; i >= 0; i-- {
+		id := len(snapshot.Roles)
+		roleIds[roles[i].Id] = id
+		snapshot.Roles = append(snapshot.Roles, TemplateRole{
+			Id:          id,
+			Name:        roles[i].Name,
+			Color:       roles[i].Color,
+			Permissions: roles[i].Permissions,
+		})
+	}
+
+	channels, err := ListChannels(ctx, s.Id)
+	if err != nil {
+		return snapshot, err
+	}
+	channelIds := map[string]int{}
+	for i, channel := range channels {
+		channelIds[channel.Id] = i
+	}
+	for i, channel := range channels {
+		entry := TemplateChannel{
+			Id:         i,
+			Type:       channel.Type,
+			Name:       channel.Name,
+			Topic:      channel.Topic,
+			NSFW:       channel.NSFW,
+			Overwrites: []TemplateOverwrite{},
+		}
+		if parentId, ok := channelIds[channel.ParentId]; ok {
+			entry.ParentId = &parentId
+		}
+		for _, overwrite := range channel.Overwrites {
+			if roleId, ok := roleIds[overwrite.Id]; ok && overwrite.Type == OverwriteRole {
+				entry.Overwrites = append(entry.Overwrites, TemplateOverwrite{RoleId: roleId, Allow: overwrite.Allow, Deny: overwrite.Deny})
+			}
+		}
+		snapshot.Channels = append(snapshot.Channels, entry)
+	}
+	return snapshot, nil
+}
+
+// Make a template from a server; the name and description should already
+// have been normalized
+func CreateTemplate(ctx context.Context, s *Server, createdBy string, name string, description string) (*Template, error) {
+	if _, err := GetTemplate(ctx, s.Id); err == nil {
+		return nil, ErrTemplateExists
+	} else if err != ErrTemplateNotFound {
+		return nil, err
+	}
+
+	snapshot, err := takeSnapshot(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	template := &Template{
+		ServerId:    s.Id,
+		Name:        name,
+		Description: description,
+		CreatedBy:   createdBy,
+		CreatedAt:   now,
+		SyncedAt:    now,
+		Snapshot:    snapshot,
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		if template.Code, err = generateCode(); err != nil {
+			return nil, err
+		}
+		_, err = database.GetCollection(templatesCollection).InsertOne(ctx, template)
+		if err == nil {
+			return template, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+		// somebody else made one for the same server at the same time
+		if _, err := GetTemplate(ctx, s.Id); err == nil {
+			return nil, ErrTemplateExists
+		}
+	}
+	return nil, fmt.Errorf("failed to insert template: %w", err)
+}
+
+func findTemplate(ctx context.Context, filter map[string]interface{}) (*Template, error) {
+	var template Template
+	err := database.GetCollection(templatesCollection).FindOne(ctx, filter).Decode(&template)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find template: %w", err)
+	}
+	return &template, nil
+}
+
+// Get the template of a server
+func GetTemplate(ctx context.Context, serverId string) (*Template, error) {
+	return findTemplate(ctx, map[string]interface{}{"serverId": serverId})
+}
+
+// Look up a template by its code
+func GetTemplateByCode(ctx context.Context, code string) (*Template, error) {
+	return findTemplate(ctx, map[string]interface{}{"code": strings.TrimSpace(code)})
+}
+
+// The parts of a template that can be changed, nil means leave the field as
+// it is
+type TemplateUpdate struct {
+	Name        *string
+	Description *string
+}
+
+// Save changes to the name or description of a template
+func (t *Template) Update(ctx context.Context, changes TemplateUpdate) error {
+	fields := map[string]interface{}{}
+	if changes.Name != nil {
+		fields["name"] = *changes.Name
+	}
+	if changes.Description != nil {
+		fields["description"] = *changes.Description
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	if err := t.set(ctx, fields); err != nil {
+		return err
+	}
+
+	if changes.Name != nil {
+		t.Name = *changes.Name
+	}
+	if changes.Description != nil {
+		t.Description = *changes.Description
+	}
+	return nil
+}
+
+// Take a new snapshot of the server the template was made from
+func (t *Template) Sync(ctx context.Context, s *Server) error {
+	snapshot, err := takeSnapshot(ctx, s)
+	if err != nil {
+		return err
+	}
+	syncedAt := time.Now().UTC()
+	if err := t.set(ctx, map[string]interface{}{"snapshot": snapshot, "syncedAt": syncedAt}); err != nil {
+		return err
+	}
+	t.Snapshot = snapshot
+	t.SyncedAt = syncedAt
+	return nil
+}
+
+func (t *Template) set(ctx context.Context, fields map[string]interface{}) error {
+	result, err := database.GetCollection(templatesCollection).UpdateOne(ctx,
+		map[string]interface{}{"code": t.Code},
+		map[string]interface{}{"$set": fields},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update template: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// Delete a template, so that its code stops working
+func (t *Template) Delete(ctx context.Context) error {
+	result, err := database.GetCollection(templatesCollection).DeleteOne(ctx, map[string]interface{}{"code": t.Code})
+	if err != nil {
+		return fmt.Errorf("failed to delete template: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// Create a new server laid out like the template, owned by ownerId. The name
+// and description should already have been normalized
+func CreateFromTemplate(ctx context.Context, t *Template, ownerId string, name string, description string) (*Server, error) {
+	s, err := Create(ctx, ownerId, name, description)
+	if err != nil {
+		return nil, err
+	}
+	if err := applySnapshot(ctx, s, t.Snapshot); err != nil {
+		// a server with half of the template is worse than none at all
+		s.Delete(context.WithoutCancel(ctx))
+		return nil, err
+	}
+
+	_, err = database.GetCollection(templatesCollection).UpdateOne(ctx,
+		map[string]interface{}{"code": t.Code},
+		map[string]interface{}{"$inc": map[string]interface{}{"uses": 1}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update template uses: %w", err)
+	}
+	return s, nil
+}
+
+// Make the roles and channels of a snapshot in a brand new server
+func applySnapshot(ctx context.Context, s *Server, snapshot TemplateSnapshot) error {
+	now := time.Now().UTC()
+	roleIds := map[int]string{}
+	roles := []interface{}{}
+	for i, entry := range snapshot.Roles {
+		role := Role{
+			Id:          uuid.New().String(),
+			ServerId:    s.Id,
+			Name:        entry.Name,
+			Color:       entry.Color,
+			Position:    i,
+			Permissions: entry.Permissions,
+			CreatedAt:   now,
+		}
+		if i == 0 {
+			role.Id = s.Id
+			role.Name = everyoneRoleName
+		}
+		roleIds[entry.Id] = role.Id
+		roles = append(roles, role)
+	}
+	if len(roles) > 0 {
+		if _, err := database.GetCollection(rolesCollection).InsertMany(ctx, roles); err != nil {
+			return fmt.Errorf("failed to insert roles: %w", err)
+		}
+	}
+
+	channelIds := map[int]string{}
+	positions := map[string]int{}
+	channels := []interface{}{}
+	for _, entry := range snapshot.Channels {
+		channel := Channel{
+			Id:         uuid.New().String(),
+			ServerId:   s.Id,
+			Type:       entry.Type,
+			Name:       entry.Name,
+			Topic:      entry.Topic,
+			NSFW:       entry.NSFW,
+			CreatedAt:  now,
+			Overwrites: []Overwrite{},
+		}
+		if entry.ParentId != nil {
+			channel.ParentId = channelIds[*entry.ParentId]
+		}
+		channel.Position = positions[channel.ParentId]
+		positions[channel.ParentId]++
+		for _, overwrite := range entry.Overwrites {
+			if roleId, ok := roleIds[overwrite.RoleId]; ok {
+				channel.Overwrites = append(channel.Overwrites, Overwrite{Id: roleId, Type: OverwriteRole, Allow: overwrite.Allow, Deny: overwrite.Deny})
+			}
+		}
+		channelIds[entry.Id] = channel.Id
+		channels = append(channels, channel)
+	}
+	if len(channels) > 0 {
+		if _, err := database.GetCollection(channelsCollection).InsertMany(ctx, channels); err != nil {
+			return fmt.Errorf("failed to insert channels: %w", err)
+		}
+	}
+	return nil
+}
+
+// Throw away the template of a server, once it's deleted
+func deleteTemplate(ctx context.Context, serverId string) error {
+	_, err := database.GetCollection(templatesCollection).DeleteMany(ctx, map[string]interface{}{"serverId": serverId})
+	if err != nil {
+		return fmt.Errorf("failed to delete template: %w", err)
+	}
+	return nil
+}
+
+// Templates are looked up by code, and each server has at most one
+func ensureTemplateIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(templatesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "code", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "serverId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create template indexes: %w", err)
+	}
+	return nil
+}
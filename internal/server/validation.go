@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MinNameLength        = 2
+	MaxNameLength        = 100
+	MaxDescriptionLength = 1024
+)
+
+var (
+	ErrNameLength        = errors.New("name must be between 2 and 100 characters")
+	ErrNameCharacters    = errors.New("name may not contain control characters")
+	ErrDescriptionLength = errors.New("description must be at most 1024 characters")
+)
+
+// Tidy up a server name and check that it is one that we're willing to accept
+func NormalizeName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if n := utf8.RuneCountInString(name); n < MinNameLength || n > MaxNameLength {
+		return "", ErrNameLength
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", ErrNameCharacters
+		}
+	}
+	return name, nil
+}
+
+// Tidy up a description, which can be empty; newlines are fine here
+func NormalizeDescription(description string) (string, error) {
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > MaxDescriptionLength {
+		return "", ErrDescriptionLength
+	}
+	return description, nil
+}
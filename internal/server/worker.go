@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"github.com/oauthority/voxly-backend/internal/redis"
+)
+
+// How often the activity of servers in the directory is worked out again,
+// which is a lot more work than looking for temporary members
+const directoryRefreshInterval = 15 * time.Minute
+
+// Runs everything to do with servers that happens in the background, which
+// is removing temporary members once they've disconnected and keeping the
+// activity of servers in the directory up to date
+type Worker struct {
+	interval time.Duration
+}
+
+func NewWorker(interval time.Duration) *Worker {
+	return &Worker{interval: interval}
+}
+
+// Run until the context is cancelled, every interval
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var refreshed time.Time
+	for {
+		if removed, err := RemoveDisconnectedTemporary(ctx); err != nil {
+			log.Printf("Error removing temporary members: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d temporary member(s)", removed)
+		}
+		if time.Since(refreshed) >= directoryRefreshInterval {
+			if _, err := RefreshDirectoryActivity(ctx); err != nil {
+				log.Printf("Error refreshing directory activity: %v", err)
+			} else {
+				refreshed = time.Now()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Remove every temporary member who hasn't been given a role and isn't
+// connected from anywhere. People get as long as a device takes to time out
+// after joining to connect in the first place
+func RemoveDisconnectedTemporary(ctx context.Context) (int, error) {
+	cursor, err := database.GetCollection(membersCollection).Find(ctx, map[string]interface{}{
+		"temporary": true,
+		"joinedAt":  map[string]interface{}{"$lt": time.Now().UTC().Add(-redis.PresenceTimeout)},
+		"$or": []map[string]interface{}{
+			{"roles": map[string]interface{}{"$exists": false}},
+			{"roles": map[string]interface{}{"$size": 0}},
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find temporary members: %w", err)
+	}
+	var members []Member
+	if err := cursor.All(ctx, &members); err != nil {
+		return 0, fmt.Errorf("failed to decode temporary members: %w", err)
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
+
+	pm, err := redis.GetPresenceManager()
+	if err != nil {
+		return 0, err
+	}
+	userIds := make([]string, len(members))
+	for i, member := range members {
+		userIds[i] = member.UserId
+	}
+	presences, err := pm.GetPresences(userIds)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, member := range members {
+		// invisible people are still connected, so look at their devices
+		// rather than their status
+		if presence := presences[member.UserId]; presence != nil && presence.Devices > 0 {
+			continue
+		}
+		if err := removeMember(ctx, member.ServerId, member.UserId); err != nil && err != ErrNotMember {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"avatars/user/abc.png", true},
+		{"file", true},
+		{"a/b/c/d", true},
+		{"dots.in.names", true},
+		{"", false},
+		{"/avatars/user/abc.png", false},
+		{"avatars/../secrets", false},
+		{"../outside", false},
+		{"avatars/..", false},
+		{"avatars/./abc.png", false},
+		{"avatars//abc.png", false},
+		{"avatars/", false},
+		{"avatars\\..\\secrets", false},
+	}
+	for _, test := range tests {
+		if err := validateKey(test.key); (err == nil) != test.ok {
+			t.Errorf("%q: got error %v, want ok %v", test.key, err, test.ok)
+		}
+	}
+}
+
+func TestLocalStorePath(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewLocalStore(root, "https://media.example.com/media/")
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"avatars/user/abc.png", filepath.Join(root, "avatars", "user", "abc.png")},
+		{"file", filepath.Join(root, "file")},
+		{"../outside", ""},
+		{"/etc/passwd", ""},
+	}
+	for _, test := range tests {
+		got, err := s.path(test.key)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: got %s, want an error", test.key, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%q: got %s (%v), want %s", test.key, got, err, test.want)
+		}
+	}
+
+	if got, want := s.URL("avatars/user/abc.png"), "https://media.example.com/media/avatars/user/abc.png"; got != want {
+		t.Errorf("URL: got %s, want %s", got, want)
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := NewLocalStore(filepath.Join(root, "media"), "/media")
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	read := func(key string) (string, error) {
+		f, err := s.Open(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		return string(data), err
+	}
+
+	if err := s.Put(ctx, "avatars/user/abc.png", strings.NewReader("first"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, err := read("avatars/user/abc.png"); err != nil || got != "first" {
+		t.Errorf("after Put: got %q (%v), want first", got, err)
+	}
+
+	// putting again replaces the file, and leaves no temporary files behind
+	if err := s.Put(ctx, "avatars/user/abc.png", strings.NewReader("second"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, err := read("avatars/user/abc.png"); err != nil || got != "second" {
+		t.Errorf("after replacing: got %q (%v), want second", got, err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "media", "avatars", "user"))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("got %d files in the directory (%v), want just the one", len(entries), err)
+	}
+
+	// directories and missing files aren't blobs, and keys can't escape
+	for _, key := range []string{"avatars/user", "avatars/user/missing.png"} {
+		if _, err := s.Open(ctx, key); err != ErrNotFound {
+			t.Errorf("Open %q: got %v, want ErrNotFound", key, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0o600); err != nil {
+		t.Fatalf("writing secret: %v", err)
+	}
+	if _, err := s.Open(ctx, "../secret"); err == nil || err == ErrNotFound {
+		t.Errorf("Open ../secret: got %v, want an invalid key", err)
+	}
+	if err := s.Put(ctx, "../escaped", strings.NewReader("nope"), "text/plain"); err == nil {
+		t.Errorf("Put ../escaped succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("Put wrote outside of the store")
+	}
+
+	// deleting something that isn't there is fine
+	if err := s.Delete(ctx, "avatars/user/abc.png"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "avatars/user/abc.png"); err != nil {
+		t.Errorf("Delete again: %v", err)
+	}
+	if _, err := s.Open(ctx, "avatars/user/abc.png"); err != ErrNotFound {
+		t.Errorf("after Delete: got %v, want ErrNotFound", err)
+	}
+
+	// DeletePrefix takes everything under it, with or without the slash,
+	// and nothing else
+	for _, key := range []string{"avatars/user/a.png", "avatars/user/b.png", "avatars/other/c.png"} {
+		if err := s.Put(ctx, key, strings.NewReader(key), "image/png"); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	if err := s.DeletePrefix(ctx, "avatars/user/"); err != nil {
+		t.Fatalf("DeletePrefix: %v", err)
+	}
+	for _, key := range []string{"avatars/user/a.png", "avatars/user/b.png"} {
+		if _, err := s.Open(ctx, key); err != ErrNotFound {
+			t.Errorf("after DeletePrefix %s: got %v, want ErrNotFound", key, err)
+		}
+	}
+	if got, err := read("avatars/other/c.png"); err != nil || got != "avatars/other/c.png" {
+		t.Errorf("DeletePrefix took %s too", "avatars/other/c.png")
+	}
+	if err := s.DeletePrefix(ctx, "../"); err == nil {
+		t.Errorf("DeletePrefix ../ succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(root, "secret")); err != nil {
+		t.Errorf("DeletePrefix reached outside of the store: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Returned by Open when there is nothing stored under a key
+var ErrNotFound = errors.New("blob not found")
+
+// Somewhere that we can put files (avatars, banners et al.) so that they can
+// be served back out again. Keys are slash separated paths such as
+// "avatars/<userId>/128/<hash>.png"; implementations are free to store them
+// however they like
+type BlobStore interface {
+	// Store data under key, replacing anything already there
+	Put(ctx context.Context, key string, data io.Reader, contentType string) error
+	// Read back whatever is stored under key
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Remove whatever is stored under key, if anything
+	Delete(ctx context.Context, key string) error
+	// Remove everything stored under a prefix, e.g. every size of an avatar
+	DeletePrefix(ctx context.Context, prefix string) error
+	// The URL that clients should fetch key from
+	URL(key string) string
+}
+
+// struct for the config object
+type Config struct {
+	LocalDir string // where the local store keeps files
+	BaseURL  string // the URL that files are served from, e.g. /media or a CDN
+}
+
+var (
+	store BlobStore
+	once  sync.Once
+)
+
+// Initialize the blob store with the given configuration; only the local
+// filesystem is supported for now, but anything implementing BlobStore can
+// be dropped in here
+func Initialize(config Config) error {
+	var initErr error
+	once.Do(func() {
+		local, err := NewLocalStore(config.LocalDir, config.BaseURL)
+		if err != nil {
+			initErr = err
+			return
+		}
+		store = local
+	})
+	return initErr
+}
+
+// Get the blob store
+func Get() (BlobStore, error) {
+	if store == nil {
+		return nil, fmt.Errorf("blob store not initialized")
+	}
+	return store, nil
+}
+
+// Get the URL for a key, or an empty string if the store isn't set up
+func URL(key string) string {
+	if store == nil {
+		return ""
+	}
+	return store.URL(key)
+}
+
+// Make sure a key can't be used to escape wherever the store keeps things
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+)
+
+// Returned when cancelling a deletion that was never scheduled
+var ErrNoDeletionScheduled = errors.New("account deletion is not scheduled")
+
+// Schedule the account of a user to be deleted at the given time
+func ScheduleDeletion(ctx context.Context, id string, at time.Time) error {
+	return update(ctx, id, map[string]interface{}{"deletionScheduledAt": at})
+}
+
+// Cancel a scheduled deletion; too late once it has actually happened
+func CancelDeletion(ctx context.Context, id string) error {
+	result, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{
+			"id":                  id,
+			"deleted":             map[string]interface{}{"$ne": true},
+			"deletionScheduledAt": map[string]interface{}{"$exists": true},
+		},
+		map[string]interface{}{"$unset": map[string]interface{}{"deletionScheduledAt": ""}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to cancel deletion: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNoDeletionScheduled
+	}
+	return nil
+}
+
+// Get every user whose grace period has run out
+func DueForDeletion(ctx context.Context, now time.Time) ([]*User, error) {
+	cursor, err := database.GetCollection(collectionName).Find(ctx, map[string]interface{}{
+		"deleted":             map[string]interface{}{"$ne": true},
+		"deletionScheduledAt": map[string]interface{}{"$lte": now},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users due for deletion: %w", err)
+	}
+
+	var found []User
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+
+	users := make([]*User, len(found))
+	for i := range found {
+		users[i] = &found[i]
+	}
+	return users, nil
+}
+
+// The username a deleted account is left with; it has to stay unique, so it's
+// made from the id
+func deletedUsername(id string) string {
+	return "deleted_user_" + strings.ReplaceAll(id, "-", "")[:12]
+}
+
+// Strip everything that identifies a person from their account, leaving just
+// enough behind that anything pointing at the id still works. Their old
+// username is held for holdPeriod, same as if they had changed it, so that
+// nobody can pick it up straight away and pretend to be them. Anything in the
+// blob store and Redis is the callers problem
+func Anonymize(ctx context.Context, u *User, holdPeriod time.Duration) error {
+	username := deletedUsername(u.Id)
+	email := fmt.Sprintf("deleted+%s@deleted.invalid", u.Id)
+	fields := map[string]interface{}{
+		"username": username,
+		"password": "",
+		"name":     "",
+		"email":    email,
+		"avatar":   "",
+		"banner":   "",
+		"disabled": true,
+		"deleted":  true,
+		// nobody should be able to find a deleted account
+		"usernameLower": "",
+		"usernameGrams": []string{},
+		"nameLower":     "",
+		"nameGrams":     []string{},
+	}
+	result, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": u.Id},
+		map[string]interface{}{
+			"$set":   fields,
+			"$unset": map[string]interface{}{"usernameChangedAt": "", "deletionScheduledAt": ""},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to anonymize user: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	_, err = database.GetCollection(relationshipsCollection).DeleteMany(ctx, map[string]interface{}{
+		"$or": []map[string]string{
+			{"userId": u.Id},
+			{"targetId": u.Id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete relationships: %w", err)
+	}
+
+	_, err = database.GetCollection(usernameHistoryCollection).DeleteMany(ctx, map[string]interface{}{"userId": u.Id})
+	if err != nil {
+		return fmt.Errorf("failed to delete username history: %w", err)
+	}
+
+	if err := DeleteSettings(ctx, u.Id); err != nil {
+		return err
+	}
+
+	if u.Username != username {
+		if err := holdUsername(ctx, u.Username, u.Id, time.Now().UTC().Add(holdPeriod)); err != nil {
+			return err
+		}
+	}
+
+	u.Username = username
+	u.Name = ""
+	u.Email = email
+	u.Password = ""
+	u.Avatar = ""
+	u.Banner = ""
+	u.Disabled = true
+	u.Deleted = true
+	u.UsernameChangedAt = nil
+	u.DeletionScheduledAt = nil
+	return nil
+}
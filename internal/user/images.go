@@ -0,0 +1,81 @@
+package user
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oauthority/voxly-backend/internal/storage"
+)
+
+// The kinds of image a user can upload, the value is also the prefix that
+// the images are stored under in the blob store
+type ImageKind string
+
+const (
+	AvatarImage ImageKind = "avatars"
+	BannerImage ImageKind = "banners"
+)
+
+// A size that we store every uploaded image at, Name is what the clients see
+type ImageSize struct {
+	Name   string
+	Width  int
+	Height int
+}
+
+// Avatars are square, banners are 5:2
+var (
+	AvatarSizes = []ImageSize{
+		{"64", 64, 64},
+		{"128", 128, 128},
+		{"256", 256, 256},
+		{"512", 512, 512},
+	}
+	BannerSizes = []ImageSize{
+		{"600", 600, 240},
+		{"1200", 1200, 480},
+		{"1920", 1920, 768},
+	}
+)
+
+// Get the sizes that an image kind is stored at
+func (k ImageKind) Sizes() []ImageSize {
+	if k == BannerImage {
+		return BannerSizes
+	}
+	return AvatarSizes
+}
+
+// The prefix that every size of every image of a kind for a user is stored
+// under, so that they can all be deleted in one go
+func ImagePrefix(kind ImageKind, userId string) string {
+	return fmt.Sprintf("%s/%s/", kind, userId)
+}
+
+// The key that a single size of an image is stored under; the image name
+// changes with every upload so that nothing serves a stale cached copy
+func ImageKey(kind ImageKind, userId string, image string, size ImageSize) string {
+	return fmt.Sprintf("%s%s/%s", ImagePrefix(kind, userId), size.Name, image)
+}
+
+// Get the URLs for every size of an image, or nil if there is no image
+func ImageURLs(kind ImageKind, userId string, image string) map[string]string {
+	if image == "" {
+		return nil
+	}
+
+	urls := map[string]string{}
+	for _, size := range kind.Sizes() {
+		urls[size.Name] = storage.URL(ImageKey(kind, userId, image, size))
+	}
+	return urls
+}
+
+// Set (or clear, with an empty name) the image of a kind for a user
+func SetImage(ctx context.Context, id string, kind ImageKind, image string) error {
+	field := "avatar"
+	if kind == BannerImage {
+		field = "banner"
+	}
+	return update(ctx, id, map[string]interface{}{field: image})
+}
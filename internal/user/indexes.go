@@ -0,0 +1,62 @@
+package user
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Make sure every index the user package relies on exists; this is safe to
+// call every time we start as Mongo does nothing for indexes that already exist
+func EnsureIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(collectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// usernames are unique whatever their case; deleted accounts
+			// all have an empty usernameLower, so they're left out
+			Keys: bson.D{{Key: "usernameLower", Value: 1}},
+			Options: options.Index().
+				SetName("usernameLower_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "usernameLower", Value: bson.D{{Key: "$gt", Value: ""}}}}),
+		},
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// for finding accounts that are due to be deleted
+			Keys: bson.D{{Key: "deletionScheduledAt", Value: 1}},
+		},
+		{
+			// for seeing who registered with an invite code
+			Keys:    bson.D{{Key: "inviteCode", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create user indexes: %w", err)
+	}
+
+	if err := ensureSearchIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureRelationshipIndexes(ctx); err != nil {
+		return err
+	}
+	if err := ensureUsernameIndexes(ctx); err != nil {
+		return err
+	}
+	return ensureSettingsIndexes(ctx)
+}
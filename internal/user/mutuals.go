@@ -0,0 +1,98 @@
+package user
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A page of the friends two users have in common, ordered by id so that
+// paging through them is stable
+type MutualFriends struct {
+	Users []*User
+	Total int
+	// set when there's nothing the two have in common that can be shown,
+	// because they're the same person or one has blocked the other; the
+	// same goes for anything else they share, like servers
+	Hidden bool
+}
+
+// Find the friends that the viewer and another user have in common. Nobody
+// gets to see what they have in common with someone when either of them has
+// blocked the other, they just get nothing back.
+//
+// Both friend lists could be huge, so rather than loading them and
+// intersecting them here Mongo groups the friend documents of both users by
+// who they point at and keeps anyone who turns up twice; only the page that
+// was asked for ever leaves the database
+func GetMutualFriends(ctx context.Context, viewerId string, targetId string, limit int, offset int) (*MutualFriends, error) {
+	mutuals := &MutualFriends{Users: []*User{}, Hidden: true}
+	if viewerId == targetId {
+		return mutuals, nil
+	}
+
+	relationship, err := GetRelationship(ctx, viewerId, targetId)
+	if err != nil {
+		return nil, err
+	}
+	if relationship == Blocked || relationship == BlockedByUser {
+		return mutuals, nil
+	}
+	mutuals.Hidden = false
+
+	cursor, err := database.GetCollection(relationshipsCollection).Aggregate(ctx, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "userId", Value: bson.D{{Key: "$in", Value: bson.A{viewerId, targetId}}}},
+			{Key: "type", Value: Friend},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$targetId"},
+			{Key: "sides", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "sides", Value: 2}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "total", Value: bson.A{bson.D{{Key: "$count", Value: "count"}}}},
+			{Key: "page", Value: bson.A{
+				bson.D{{Key: "$skip", Value: offset}},
+				bson.D{{Key: "$limit", Value: limit}},
+			}},
+		}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find mutual friends: %w", err)
+	}
+
+	var results []struct {
+		Total []struct {
+			Count int `bson:"count"`
+		} `bson:"total"`
+		Page []struct {
+			Id string `bson:"_id"`
+		} `bson:"page"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode mutual friends: %w", err)
+	}
+	if len(results) == 0 || len(results[0].Total) == 0 {
+		return mutuals, nil
+	}
+	mutuals.Total = results[0].Total[0].Count
+
+	ids := make([]string, len(results[0].Page))
+	for i, result := range results[0].Page {
+		ids[i] = result.Id
+	}
+	users, err := GetByIds(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if u, ok := users[id]; ok {
+			mutuals.Users = append(mutuals.Users, u)
+		}
+	}
+	return mutuals, nil
+}
@@ -0,0 +1,72 @@
+package user
+
+import (
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/redis"
+)
+
+// The public view of a user that is safe to send to anyone, this never
+// includes the password and only includes the email when it is the user
+// looking at themselves
+type PublicUser struct {
+	Id               string    `json:"id"`
+	Username         string    `json:"username"`
+	Name             string    `json:"name"`
+	Email            string    `json:"email,omitempty"`
+	RegistrationDate time.Time `json:"registrationDate"`
+	Bot              bool      `json:"bot"`
+	Deleted          bool      `json:"deleted,omitempty"`
+	Online           bool      `json:"online"`
+
+	// whether the user can manage the instance, only ever shown to the user themselves
+	Admin bool `json:"admin,omitempty"`
+
+	// when the account is going to be deleted, only ever shown to the user themselves
+	DeletionScheduledAt *time.Time `json:"deletionScheduledAt,omitempty"`
+
+	// where the user is, as far as the user making the request is allowed to see
+	Presence redis.Presence `json:"presence"`
+
+	// the relationship between the user making the request and this user
+	Relationship RelationshipType `json:"relationship"`
+
+	// the URL of each size of the image, keyed by size, or null
+	Avatar map[string]string `json:"avatar"`
+	Banner map[string]string `json:"banner"`
+}
+
+// Get the public projection of the user; self should only be true when the
+// user is the one making the request. The relationship is left as None, set
+// it if it matters for wherever the user is being sent
+func (u *User) Public(self bool) PublicUser {
+	public := PublicUser{
+		Id:               u.Id,
+		Username:         u.Username,
+		Name:             u.Name,
+		RegistrationDate: u.RegisteredAt,
+		Bot:              u.Bot,
+		Deleted:          u.Deleted,
+		Presence:         redis.Presence{Status: redis.StatusOffline},
+		Avatar:           ImageURLs(AvatarImage, u.Id, u.Avatar),
+		Banner:           ImageURLs(BannerImage, u.Id, u.Banner),
+	}
+
+	if self {
+		public.Email = u.Email
+		public.Admin = u.Admin
+		public.DeletionScheduledAt = u.DeletionScheduledAt
+	}
+
+	return public
+}
+
+// Fill in the presence of the user; self decides whether we show the real
+// presence or what everyone else is allowed to see
+func (p *PublicUser) SetPresence(presence redis.Presence, self bool) {
+	if !self {
+		presence = presence.Public()
+	}
+	p.Presence = presence
+	p.Online = presence.Online()
+}
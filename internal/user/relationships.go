@@ -0,0 +1,315 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the collection that relationships are stored in
+const relationshipsCollection = "relationships"
+
+// A relationship as seen by one of the two users. Every relationship is
+// stored as a document per user that has one, e.g. a friend request is an
+// Outgoing document for the sender and an Incoming document for the receiver,
+// whereas a block is only stored for the user doing the blocking; the other
+// user sees it as BlockedByUser, which is worked out when it is read
+type RelationshipRecord struct {
+	UserId   string           `bson:"userId" json:"-"`
+	TargetId string           `bson:"targetId" json:"id"`
+	Type     RelationshipType `bson:"type" json:"type"`
+	Since    time.Time        `bson:"since" json:"since"`
+}
+
+var (
+	ErrSelfRelationship = errors.New("cannot have a relationship with yourself")
+	ErrBlocked          = errors.New("one of the users has blocked the other")
+	ErrAlreadyFriends   = errors.New("already friends")
+	ErrRequestExists    = errors.New("a friend request has already been sent")
+	ErrNoFriendRequest  = errors.New("no pending friend request")
+	ErrNotFriends       = errors.New("not friends")
+	ErrNotBlocked       = errors.New("user is not blocked")
+)
+
+// Get the documents for both sides of the relationship between two users,
+// either of which may be nil
+func getRelationshipPair(ctx context.Context, userId string, targetId string) (*RelationshipRecord, *RelationshipRecord, error) {
+	cursor, err := database.GetCollection(relationshipsCollection).Find(ctx, map[string]interface{}{
+		"$or": []map[string]string{
+			{"userId": userId, "targetId": targetId},
+			{"userId": targetId, "targetId": userId},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find relationship: %w", err)
+	}
+
+	var records []RelationshipRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode relationship: %w", err)
+	}
+
+	var ours, theirs *RelationshipRecord
+	for i := range records {
+		if records[i].UserId == userId {
+			ours = &records[i]
+		} else {
+			theirs = &records[i]
+		}
+	}
+	return ours, theirs, nil
+}
+
+// Work out the relationship from one side, given both documents
+func resolveRelationship(ours *RelationshipRecord, theirs *RelationshipRecord) RelationshipType {
+	if ours != nil && ours.Type == Blocked {
+		return Blocked
+	}
+	if theirs != nil && theirs.Type == Blocked {
+		return BlockedByUser
+	}
+	if ours != nil {
+		return ours.Type
+	}
+	return None
+}
+
+// Get the relationship between the viewer and another user, as the viewer
+// sees it
+func GetRelationship(ctx context.Context, viewerId string, targetId string) (RelationshipType, error) {
+	if viewerId == targetId {
+		return None, nil
+	}
+
+	ours, theirs, err := getRelationshipPair(ctx, viewerId, targetId)
+	if err != nil {
+		return None, err
+	}
+	return resolveRelationship(ours, theirs), nil
+}
+
+// Get the relationship between the viewer and each of several users at once,
+// keyed by the id of the other user; anyone without one is left out
+func GetRelationships(ctx context.Context, viewerId string, targetIds []string) (map[string]RelationshipType, error) {
+	relationships := map[string]RelationshipType{}
+	if len(targetIds) == 0 {
+		return relationships, nil
+	}
+
+	cursor, err := database.GetCollection(relationshipsCollection).Find(ctx, map[string]interface{}{
+		"$or": []map[string]interface{}{
+			{"userId": viewerId, "targetId": map[string]interface{}{"$in": targetIds}},
+			{"userId": map[string]interface{}{"$in": targetIds}, "targetId": viewerId},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find relationships: %w", err)
+	}
+
+	var records []RelationshipRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode relationships: %w", err)
+	}
+
+	ours := map[string]*RelationshipRecord{}
+	theirs := map[string]*RelationshipRecord{}
+	for i := range records {
+		if records[i].UserId == viewerId {
+			ours[records[i].TargetId] = &records[i]
+		} else {
+			theirs[records[i].UserId] = &records[i]
+		}
+	}
+	for _, targetId := range targetIds {
+		if relationship := resolveRelationship(ours[targetId], theirs[targetId]); relationship != None {
+			relationships[targetId] = relationship
+		}
+	}
+	return relationships, nil
+}
+
+// List every relationship a user has; this doesn't include users who have
+// blocked them, they shouldn't be able to find out who has
+func ListRelationships(ctx context.Context, userId string) ([]RelationshipRecord, error) {
+	cursor, err := database.GetCollection(relationshipsCollection).Find(ctx,
+		map[string]interface{}{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "since", Value: -1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list relationships: %w", err)
+	}
+
+	records := []RelationshipRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode relationships: %w", err)
+	}
+	return records, nil
+}
+
+// Create or replace one side of a relationship
+func setRelationship(ctx context.Context, userId string, targetId string, relationshipType RelationshipType, since time.Time) error {
+	_, err := database.GetCollection(relationshipsCollection).UpdateOne(ctx,
+		map[string]interface{}{"userId": userId, "targetId": targetId},
+		map[string]interface{}{"$set": RelationshipRecord{
+			UserId:   userId,
+			TargetId: targetId,
+			Type:     relationshipType,
+			Since:    since,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save relationship: %w", err)
+	}
+	return nil
+}
+
+// Remove both sides of a relationship between two users, but only where they
+// are one of the given types
+func deleteRelationships(ctx context.Context, userId string, targetId string, types ...RelationshipType) error {
+	_, err := database.GetCollection(relationshipsCollection).DeleteMany(ctx, map[string]interface{}{
+		"$or": []map[string]string{
+			{"userId": userId, "targetId": targetId},
+			{"userId": targetId, "targetId": userId},
+		},
+		"type": map[string]interface{}{"$in": types},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete relationship: %w", err)
+	}
+	return nil
+}
+
+// Send a friend request from one user to another. If the other user has
+// already sent one our way then we just accept it, which is almost certainly
+// what the user wanted. Returns the relationship we end up with
+func SendFriendRequest(ctx context.Context, userId string, targetId string) (RelationshipType, error) {
+	if userId == targetId {
+		return None, ErrSelfRelationship
+	}
+
+	ours, theirs, err := getRelationshipPair(ctx, userId, targetId)
+	if err != nil {
+		return None, err
+	}
+
+	switch resolveRelationship(ours, theirs) {
+	case Blocked, BlockedByUser:
+		return None, ErrBlocked
+	case Friend:
+		return None, ErrAlreadyFriends
+	case Outgoing:
+		return None, ErrRequestExists
+	case Incoming:
+		return Friend, AcceptFriendRequest(ctx, userId, targetId)
+	}
+
+	now := time.Now().UTC()
+	if err := setRelationship(ctx, userId, targetId, Outgoing, now); err != nil {
+		return None, err
+	}
+	if err := setRelationship(ctx, targetId, userId, Incoming, now); err != nil {
+		return None, err
+	}
+	return Outgoing, nil
+}
+
+// Accept a friend request that the user has received from fromId
+func AcceptFriendRequest(ctx context.Context, userId string, fromId string) error {
+	ours, theirs, err := getRelationshipPair(ctx, userId, fromId)
+	if err != nil {
+		return err
+	}
+	if resolveRelationship(ours, theirs) != Incoming {
+		return ErrNoFriendRequest
+	}
+
+	now := time.Now().UTC()
+	if err := setRelationship(ctx, userId, fromId, Friend, now); err != nil {
+		return err
+	}
+	return setRelationship(ctx, fromId, userId, Friend, now)
+}
+
+// Decline a friend request the user has received, or cancel one that they
+// have sent; either way the request is gone for both users
+func RemoveFriendRequest(ctx context.Context, userId string, otherId string) error {
+	ours, theirs, err := getRelationshipPair(ctx, userId, otherId)
+	if err != nil {
+		return err
+	}
+
+	relationship := resolveRelationship(ours, theirs)
+	if relationship != Incoming && relationship != Outgoing {
+		return ErrNoFriendRequest
+	}
+	return deleteRelationships(ctx, userId, otherId, Incoming, Outgoing)
+}
+
+// Stop being friends with someone, for both of them
+func RemoveFriend(ctx context.Context, userId string, friendId string) error {
+	ours, theirs, err := getRelationshipPair(ctx, userId, friendId)
+	if err != nil {
+		return err
+	}
+	if resolveRelationship(ours, theirs) != Friend {
+		return ErrNotFriends
+	}
+	return deleteRelationships(ctx, userId, friendId, Friend)
+}
+
+// Block a user; this ends any friendship or pending friend requests between
+// the two. If they had blocked us first their block stays as it is
+func Block(ctx context.Context, userId string, targetId string) error {
+	if userId == targetId {
+		return ErrSelfRelationship
+	}
+
+	if err := deleteRelationships(ctx, userId, targetId, Friend, Incoming, Outgoing); err != nil {
+		return err
+	}
+	return setRelationship(ctx, userId, targetId, Blocked, time.Now().UTC())
+}
+
+// Unblock a user that the user has blocked
+func Unblock(ctx context.Context, userId string, targetId string) error {
+	result, err := database.GetCollection(relationshipsCollection).DeleteOne(ctx, map[string]interface{}{
+		"userId":   userId,
+		"targetId": targetId,
+		"type":     Blocked,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unblock user: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotBlocked
+	}
+	return nil
+}
+
+// Make sure the indexes that relationships rely on exist; each pair of users
+// can only have one document per side
+func ensureRelationshipIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(relationshipsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "targetId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "type", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "targetId", Value: 1}, {Key: "type", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create relationship indexes: %w", err)
+	}
+	return nil
+}
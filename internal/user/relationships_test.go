@@ -0,0 +1,42 @@
+package user
+
+import "testing"
+
+// Every combination of what we have stored for ourselves and what they have
+// stored for themselves, whether or not it can actually happen. A block on
+// either side beats everything else, ours first
+func TestResolveRelationship(t *testing.T) {
+	sides := []RelationshipType{None, Friend, Outgoing, Incoming, Blocked, BlockedByUser}
+	names := map[RelationshipType]string{
+		None: "none", Friend: "friend", Outgoing: "outgoing", Incoming: "incoming", Blocked: "blocked", BlockedByUser: "blocked by",
+	}
+
+	tests := []struct {
+		ours RelationshipType
+		want []RelationshipType // for each of theirs, in the same order as sides
+	}{
+		{None, []RelationshipType{None, None, None, None, BlockedByUser, None}},
+		{Friend, []RelationshipType{Friend, Friend, Friend, Friend, BlockedByUser, Friend}},
+		{Outgoing, []RelationshipType{Outgoing, Outgoing, Outgoing, Outgoing, BlockedByUser, Outgoing}},
+		{Incoming, []RelationshipType{Incoming, Incoming, Incoming, Incoming, BlockedByUser, Incoming}},
+		{Blocked, []RelationshipType{Blocked, Blocked, Blocked, Blocked, Blocked, Blocked}},
+		// never stored, so it's passed through like any other type
+		{BlockedByUser, []RelationshipType{BlockedByUser, BlockedByUser, BlockedByUser, BlockedByUser, BlockedByUser, BlockedByUser}},
+	}
+
+	record := func(userId string, targetId string, relationship RelationshipType) *RelationshipRecord {
+		if relationship == None {
+			return nil
+		}
+		return &RelationshipRecord{UserId: userId, TargetId: targetId, Type: relationship}
+	}
+
+	for _, test := range tests {
+		for i, theirs := range sides {
+			got := resolveRelationship(record("us", "them", test.ours), record("them", "us", theirs))
+			if got != test.want[i] {
+				t.Errorf("ours %s, theirs %s: got %s, want %s", names[test.ours], names[theirs], names[got], names[test.want[i]])
+			}
+		}
+	}
+}
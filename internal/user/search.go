@@ -0,0 +1,404 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// The most users we'll consider for a single search before ranking them;
+	// anyone past this is too far down the list for anybody to scroll to
+	maxSearchCandidates = 500
+	// How alike a fuzzy match has to be to count, as the share of trigrams
+	// the two strings have in common
+	minSearchSimilarity = 0.3
+	// Queries shorter than this are only matched as a prefix, there aren't
+	// enough trigrams in them to do anything fuzzy
+	minFuzzyQueryLength = 3
+)
+
+// How much each kind of match counts towards the ranking; a closer match on
+// the username always beats a closer match on the display name, and knowing
+// someone through a friend is worth about as much as a decent fuzzy match
+const (
+	scoreExactUsername  = 100
+	scoreUsernamePrefix = 50
+	scoreNamePrefix     = 30
+	scoreSimilarity     = 25 // multiplied by the similarity
+	scoreFriend         = 20
+	scoreFriendOfFriend = 10
+	scorePerMutual      = 2 // per mutual friend, up to maxMutualBonus of them
+	maxMutualBonus      = 5
+)
+
+// How many results to return and where to start from
+type SearchOptions struct {
+	Limit  int
+	Offset int
+}
+
+// A page of search results, best matches first
+type SearchResults struct {
+	Users []*User
+	// how many users matched in total, capped at the number of candidates we look at
+	Total int
+}
+
+// Lowercase something so that it can be searched without caring about case
+func searchKey(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// Split a string into the set of three character chunks it is made of, which
+// is what fuzzy matching is based on; "alice" is "ali", "lic" and "ice".
+// Anything shorter than three characters is a single gram
+func trigrams(s string) []string {
+	runes := []rune(searchKey(s))
+	if len(runes) == 0 {
+		return []string{}
+	}
+	if len(runes) < 3 {
+		return []string{string(runes)}
+	}
+
+	seen := map[string]bool{}
+	grams := []string{}
+	for i := 0; i+3 <= len(runes); i++ {
+		gram := string(runes[i : i+3])
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// How alike two sets of trigrams are, from 0 (nothing in common) to 1
+func similarity(a []string, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	set := make(map[string]bool, len(a))
+	for _, gram := range a {
+		set[gram] = true
+	}
+	shared := 0
+	for _, gram := range b {
+		if set[gram] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// Fill in the fields that search runs against; these have to be kept up to
+// date whenever the username or name changes
+func (u *User) setSearchFields() {
+	u.UsernameLower = searchKey(u.Username)
+	u.UsernameGrams = trigrams(u.Username)
+	u.NameLower = searchKey(u.Name)
+	u.NameGrams = trigrams(u.Name)
+}
+
+// The search fields for a username, for when only the username is being updated
+func usernameSearchFields(username string) map[string]interface{} {
+	return map[string]interface{}{
+		"usernameLower": searchKey(username),
+		"usernameGrams": trigrams(username),
+	}
+}
+
+// The search fields for a name, for when only the name is being updated
+func nameSearchFields(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"nameLower": searchKey(name),
+		"nameGrams": trigrams(name),
+	}
+}
+
+// Find the ids of everyone the user has a relationship of the given type
+// with, from their side
+func relatedIds(ctx context.Context, userId string, relationshipType RelationshipType) ([]string, error) {
+	records, err := database.GetCollection(relationshipsCollection).Distinct(ctx, "targetId",
+		map[string]interface{}{"userId": userId, "type": relationshipType},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find related users: %w", err)
+	}
+
+	ids := make([]string, 0, len(records))
+	for _, record := range records {
+		if id, ok := record.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Find the ids of everyone who has blocked the user
+func blockedByIds(ctx context.Context, userId string) ([]string, error) {
+	records, err := database.GetCollection(relationshipsCollection).Distinct(ctx, "userId",
+		map[string]interface{}{"targetId": userId, "type": Blocked},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find blocks: %w", err)
+	}
+
+	ids := make([]string, 0, len(records))
+	for _, record := range records {
+		if id, ok := record.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Count how many of the users friends each of the candidates is friends with
+func countMutualFriends(ctx context.Context, friendIds []string, candidateIds []string) (map[string]int, error) {
+	counts := map[string]int{}
+	if len(friendIds) == 0 || len(candidateIds) == 0 {
+		return counts, nil
+	}
+
+	cursor, err := database.GetCollection(relationshipsCollection).Find(ctx, map[string]interface{}{
+		"userId":   map[string]interface{}{"$in": friendIds},
+		"targetId": map[string]interface{}{"$in": candidateIds},
+		"type":     Friend,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find mutual friends: %w", err)
+	}
+
+	var records []RelationshipRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode mutual friends: %w", err)
+	}
+	for _, record := range records {
+		counts[record.TargetId]++
+	}
+	return counts, nil
+}
+
+// Search for users by username and display name on behalf of searcherId.
+// Anything starting with the query matches, as does anything close enough to
+// it, so typos still find people. Users who have blocked the searcher (and
+// disabled users) never show up; friends, and friends of friends, are ranked
+// above strangers
+func Search(ctx context.Context, searcherId string, query string, opts SearchOptions) (*SearchResults, error) {
+	query = searchKey(query)
+	if query == "" {
+		return &SearchResults{Users: []*User{}}, nil
+	}
+
+	blockedBy, err := blockedByIds(ctx, searcherId)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := map[string]interface{}{"$nin": append(blockedBy, searcherId)}
+
+	// prefix matches go first so that they can never be crowded out of the
+	// candidates by a pile of vaguely similar names
+	prefix := map[string]interface{}{"$regex": "^" + regexp.QuoteMeta(query)}
+	candidates, err := findSearchCandidates(ctx, map[string]interface{}{
+		"$or": []map[string]interface{}{
+			{"usernameLower": prefix},
+			{"nameLower": prefix},
+		},
+		"id":       excluded,
+		"disabled": map[string]interface{}{"$ne": true},
+	}, maxSearchCandidates)
+	if err != nil {
+		return nil, err
+	}
+
+	queryGrams := trigrams(query)
+	if len([]rune(query)) >= minFuzzyQueryLength && len(candidates) < maxSearchCandidates {
+		seen := make([]string, 0, len(candidates))
+		for i := range candidates {
+			seen = append(seen, candidates[i].Id)
+		}
+
+		fuzzy, err := findSearchCandidates(ctx, map[string]interface{}{
+			"$or": []map[string]interface{}{
+				{"usernameGrams": map[string]interface{}{"$in": queryGrams}},
+				{"nameGrams": map[string]interface{}{"$in": queryGrams}},
+			},
+			"$and": []map[string]interface{}{
+				{"id": excluded},
+				{"id": map[string]interface{}{"$nin": seen}},
+			},
+			"disabled": map[string]interface{}{"$ne": true},
+		}, maxSearchCandidates-len(candidates))
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, fuzzy...)
+	}
+
+	friendIds, err := relatedIds(ctx, searcherId, Friend)
+	if err != nil {
+		return nil, err
+	}
+	friends := make(map[string]bool, len(friendIds))
+	for _, id := range friendIds {
+		friends[id] = true
+	}
+
+	candidateIds := make([]string, len(candidates))
+	for i := range candidates {
+		candidateIds[i] = candidates[i].Id
+	}
+	mutuals, err := countMutualFriends(ctx, friendIds, candidateIds)
+	if err != nil {
+		return nil, err
+	}
+
+	type ranked struct {
+		user  *User
+		score float64
+	}
+	var results []ranked
+	for i := range candidates {
+		u := &candidates[i]
+
+		var score float64
+		switch {
+		case u.UsernameLower == query:
+			score += scoreExactUsername
+		case strings.HasPrefix(u.UsernameLower, query):
+			score += scoreUsernamePrefix
+		case strings.HasPrefix(u.NameLower, query):
+			score += scoreNamePrefix
+		default:
+			// only here because of a trigram or two in common, make sure that
+			// it's actually a decent match before we let it in
+			best := similarity(queryGrams, u.UsernameGrams)
+			if name := similarity(queryGrams, u.NameGrams); name > best {
+				best = name
+			}
+			if best < minSearchSimilarity {
+				continue
+			}
+			score += best * scoreSimilarity
+		}
+
+		if friends[u.Id] {
+			score += scoreFriend
+		} else if mutual := mutuals[u.Id]; mutual > 0 {
+			if mutual > maxMutualBonus {
+				mutual = maxMutualBonus
+			}
+			score += scoreFriendOfFriend + float64(mutual*scorePerMutual)
+		}
+
+		results = append(results, ranked{user: u, score: score})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].user.UsernameLower < results[j].user.UsernameLower
+	})
+
+	page := &SearchResults{Users: []*User{}, Total: len(results)}
+	for i := opts.Offset; i < len(results) && i < opts.Offset+opts.Limit; i++ {
+		page.Users = append(page.Users, results[i].user)
+	}
+	return page, nil
+}
+
+// Get up to limit users matching a search filter
+func findSearchCandidates(ctx context.Context, filter map[string]interface{}, limit int) ([]User, error) {
+	cursor, err := database.GetCollection(collectionName).Find(ctx, filter,
+		options.Find().SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+
+	var candidates []User
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return candidates, nil
+}
+
+// Fill in the search fields for every user; users created before search
+// existed don't have them, so they can't be found until this has been run.
+// Deleted accounts are skipped, their fields are left empty so that nobody
+// can find them. Returns how many users were updated
+func ReindexSearch(ctx context.Context) (int, error) {
+	collection := database.GetCollection(collectionName)
+	cursor, err := collection.Find(ctx, map[string]interface{}{"deleted": map[string]interface{}{"$ne": true}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var models []mongo.WriteModel
+	updated := 0
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		if _, err := collection.BulkWrite(ctx, models); err != nil {
+			return fmt.Errorf("failed to update search fields: %w", err)
+		}
+		updated += len(models)
+		models = models[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var u User
+		if err := cursor.Decode(&u); err != nil {
+			return updated, fmt.Errorf("failed to decode user: %w", err)
+		}
+		fields := usernameSearchFields(u.Username)
+		for key, value := range nameSearchFields(u.Name) {
+			fields[key] = value
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(map[string]interface{}{"id": u.Id}).
+			SetUpdate(map[string]interface{}{"$set": fields}))
+
+		if len(models) >= 500 {
+			if err := flush(); err != nil {
+				return updated, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return updated, fmt.Errorf("failed to list users: %w", err)
+	}
+	if err := flush(); err != nil {
+		return updated, err
+	}
+	return updated, nil
+}
+
+// Indexes for searching; the lowercased fields serve the prefix matches (an
+// anchored regex can use an index) and the gram arrays the fuzzy ones
+func ensureSearchIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(collectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "usernameLower", Value: 1}}},
+		{Keys: bson.D{{Key: "nameLower", Value: 1}}},
+		{Keys: bson.D{{Key: "usernameGrams", Value: 1}}},
+		{Keys: bson.D{{Key: "nameGrams", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create search indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package user
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTrigrams(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"a", []string{"a"}},
+		{"ab", []string{"ab"}},
+		{" AB ", []string{"ab"}},
+		{"abc", []string{"abc"}},
+		{"alice", []string{"ali", "lic", "ice"}},
+		{"ALICE", []string{"ali", "lic", "ice"}},
+		{"aaaa", []string{"aaa"}},
+		{"abcabc", []string{"abc", "bca", "cab"}},
+		{"a b", []string{"a b"}},
+		// grams are made of characters rather than bytes
+		{"zoë", []string{"zoë"}},
+		{"Zoë", []string{"zoë"}},
+		{"éé", []string{"éé"}},
+		{"Ünïcödé", []string{"ünï", "nïc", "ïcö", "cöd", "ödé"}},
+		{"日本語テキスト", []string{"日本語", "本語テ", "語テキ", "テキス", "キスト"}},
+		{"😀😀😀x", []string{"😀😀😀", "😀😀x"}},
+	}
+	for _, test := range tests {
+		if got := trigrams(test.s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"alice", "alice", 1},
+		{"alice", "ALICE", 1},
+		{"alice", "", 0},
+		{"", "", 0},
+		{"alice", "bob", 0},
+		{"alice", "alicee", 0.75},
+		{"jonathan", "jonathon", 0.5},
+		{"bob", "bobby", 1.0 / 3},
+		{"alex", "alexander", 2.0 / 7},
+		{"ab", "ab", 1},
+		{"ab", "abc", 0},
+		{"zoë", "zoe", 0},
+		{"zoë", "zoëy", 0.5},
+	}
+	for _, test := range tests {
+		got := similarity(trigrams(test.a), trigrams(test.b))
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%q, %q: got %v, want %v", test.a, test.b, got, test.want)
+		}
+		if reverse := similarity(trigrams(test.b), trigrams(test.a)); math.Abs(reverse-got) > 1e-9 {
+			t.Errorf("%q, %q: got %v one way and %v the other", test.a, test.b, got, reverse)
+		}
+	}
+}
+
+// What makes it past minSearchSimilarity: small typos do, and a short query
+// inside a much longer name doesn't
+func TestSimilarityThreshold(t *testing.T) {
+	tests := []struct {
+		query, name string
+		want        bool
+	}{
+		{"alicee", "alice", true},
+		{"jonathon", "jonathan", true},
+		{"bobby", "bob", true},
+		{"christopher", "kristopher", true},
+		{"alex", "alexander", false},
+		{"alice", "alcie", false},
+		{"alice", "malice", true},
+		{"zoë", "zoe", false},
+	}
+	for _, test := range tests {
+		got := similarity(trigrams(test.query), trigrams(test.name)) >= minSearchSimilarity
+		if got != test.want {
+			t.Errorf("%q, %q: got %v, want %v", test.query, test.name, got, test.want)
+		}
+	}
+}
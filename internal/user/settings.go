@@ -0,0 +1,240 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/language"
+)
+
+// The name of the collection that settings are stored in
+const settingsCollection = "user_settings"
+
+// Returned when settings are updated from a version which is no longer the
+// latest, i.e. another device got there first
+var ErrSettingsConflict = errors.New("settings have been changed since they were read")
+
+var (
+	ErrInvalidTheme             = errors.New("theme must be one of system, light or dark")
+	ErrInvalidLocale            = errors.New("locale must be a valid language tag, e.g. en-GB")
+	ErrInvalidNotificationLevel = errors.New("notification level must be one of all, mentions or none")
+)
+
+type Theme string
+
+const (
+	ThemeSystem Theme = "system" // follow whatever the device is set to
+	ThemeLight  Theme = "light"
+	ThemeDark   Theme = "dark"
+)
+
+func (t Theme) Valid() bool {
+	return t == ThemeSystem || t == ThemeLight || t == ThemeDark
+}
+
+// What a user gets notified about by default
+type NotificationLevel string
+
+const (
+	NotifyAll      NotificationLevel = "all"
+	NotifyMentions NotificationLevel = "mentions"
+	NotifyNone     NotificationLevel = "none"
+)
+
+func (l NotificationLevel) Valid() bool {
+	return l == NotifyAll || l == NotifyMentions || l == NotifyNone
+}
+
+type NotificationSettings struct {
+	Level   NotificationLevel `bson:"level" json:"level"`
+	Desktop bool              `bson:"desktop" json:"desktop"` // show desktop notifications
+	Sounds  bool              `bson:"sounds" json:"sounds"`   // play sounds for them
+}
+
+// The preferences a user has which follow them from device to device. Every
+// change bumps the version, and an update has to say which version it was
+// made against so that two devices can't silently overwrite each other
+type Settings struct {
+	UserId        string               `bson:"userId" json:"-"`
+	Version       int64                `bson:"version" json:"version"`
+	Theme         Theme                `bson:"theme" json:"theme"`
+	Locale        string               `bson:"locale" json:"locale"`
+	CompactMode   bool                 `bson:"compactMode" json:"compactMode"`
+	Notifications NotificationSettings `bson:"notifications" json:"notifications"`
+	UpdatedAt     *time.Time           `bson:"updatedAt,omitempty" json:"updatedAt"`
+}
+
+// What a user gets before they've changed anything; version 0 means that
+// nothing has been saved yet
+func DefaultSettings(userId string) *Settings {
+	return &Settings{
+		UserId: userId,
+		Theme:  ThemeSystem,
+		Locale: "en-GB",
+		Notifications: NotificationSettings{
+			Level:   NotifyAll,
+			Desktop: true,
+			Sounds:  true,
+		},
+	}
+}
+
+// The same defaults as paths for $setOnInsert, so that the first update a
+// user makes fills in everything they didn't mention
+func defaultSettingsFields() map[string]interface{} {
+	defaults := DefaultSettings("")
+	return map[string]interface{}{
+		"theme":                 defaults.Theme,
+		"locale":                defaults.Locale,
+		"compactMode":           defaults.CompactMode,
+		"notifications.level":   defaults.Notifications.Level,
+		"notifications.desktop": defaults.Notifications.Desktop,
+		"notifications.sounds":  defaults.Notifications.Sounds,
+	}
+}
+
+// A partial update to settings, nil means leave the setting as it is
+type SettingsUpdate struct {
+	Theme         *Theme
+	Locale        *string
+	CompactMode   *bool
+	Notifications *NotificationSettingsUpdate
+}
+
+type NotificationSettingsUpdate struct {
+	Level   *NotificationLevel
+	Desktop *bool
+	Sounds  *bool
+}
+
+// Check that a locale is a real language tag, returning it in its canonical
+// form ("EN-gb" becomes "en-GB")
+func NormalizeLocale(locale string) (string, error) {
+	tag, err := language.Parse(locale)
+	if err != nil || tag == language.Und {
+		return "", ErrInvalidLocale
+	}
+	return tag.String(), nil
+}
+
+// The fields that an update changes, keyed by their path in the document
+func (u SettingsUpdate) fields() map[string]interface{} {
+	fields := map[string]interface{}{}
+	if u.Theme != nil {
+		fields["theme"] = *u.Theme
+	}
+	if u.Locale != nil {
+		fields["locale"] = *u.Locale
+	}
+	if u.CompactMode != nil {
+		fields["compactMode"] = *u.CompactMode
+	}
+	if n := u.Notifications; n != nil {
+		if n.Level != nil {
+			fields["notifications.level"] = *n.Level
+		}
+		if n.Desktop != nil {
+			fields["notifications.desktop"] = *n.Desktop
+		}
+		if n.Sounds != nil {
+			fields["notifications.sounds"] = *n.Sounds
+		}
+	}
+	return fields
+}
+
+// Get the settings for a user, or the defaults if they've never changed any
+func GetSettings(ctx context.Context, userId string) (*Settings, error) {
+	var settings Settings
+	err := database.GetCollection(settingsCollection).FindOne(ctx,
+		map[string]interface{}{"userId": userId},
+	).Decode(&settings)
+	if err == mongo.ErrNoDocuments {
+		return DefaultSettings(userId), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// Apply a partial update to the settings of a user, but only if they are
+// still at the given version; returns ErrSettingsConflict if they aren't.
+// The update should already have been validated
+func UpdateSettings(ctx context.Context, userId string, version int64, update SettingsUpdate) (*Settings, error) {
+	fields := update.fields()
+	if len(fields) == 0 {
+		settings, err := GetSettings(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
+		if settings.Version != version {
+			return nil, ErrSettingsConflict
+		}
+		return settings, nil
+	}
+
+	fields["updatedAt"] = time.Now().UTC()
+	changes := map[string]interface{}{
+		"$set": fields,
+		"$inc": map[string]interface{}{"version": 1},
+	}
+
+	// nobody has saved any settings yet, so this creates the document; if
+	// somebody beat us to it the unique index on userId turns the insert
+	// into a duplicate key error, which is a conflict like any other
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if version == 0 {
+		onInsert := map[string]interface{}{}
+		for path, value := range defaultSettingsFields() {
+			if _, ok := fields[path]; !ok {
+				onInsert[path] = value
+			}
+		}
+		if len(onInsert) > 0 {
+			changes["$setOnInsert"] = onInsert
+		}
+		opts.SetUpsert(true)
+	}
+
+	var settings Settings
+	err := database.GetCollection(settingsCollection).FindOneAndUpdate(ctx,
+		map[string]interface{}{"userId": userId, "version": version},
+		changes,
+		opts,
+	).Decode(&settings)
+	if err == mongo.ErrNoDocuments || mongo.IsDuplicateKeyError(err) {
+		return nil, ErrSettingsConflict
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// Throw away the settings of a user, e.g. when their account is deleted
+func DeleteSettings(ctx context.Context, userId string) error {
+	_, err := database.GetCollection(settingsCollection).DeleteOne(ctx, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return fmt.Errorf("failed to delete settings: %w", err)
+	}
+	return nil
+}
+
+// Every user has at most one settings document
+func ensureSettingsIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(settingsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create settings indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The name of the collection that users are stored in
+const collectionName = "users"
+
+// Returned when no user matches a lookup
+var ErrNotFound = errors.New("user not found")
+
+// Create a new user with the given details, hashing the password; the user
+// is not saved until it is passed to Insert
+func New(username string, email string, password string) (*User, error) {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{
+		Id:           uuid.New().String(),
+		Username:     username,
+		Password:     hashedPassword,
+		Email:        email,
+		Bot:          false,
+		RegisteredAt: time.Now().UTC(),
+	}
+	u.setSearchFields()
+	return u, nil
+}
+
+// Hash a password with bcrypt's default cost so that it can be saved
+func HashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hashedPassword), nil
+}
+
+// Check whether a password matches the one stored for the user
+func (u *User) CheckPassword(password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Find a single user matching the filter, returning ErrNotFound if there
+// isn't one
+func findOne(ctx context.Context, filter map[string]interface{}) (*User, error) {
+	u := User{}
+	err := database.GetCollection(collectionName).FindOne(ctx, filter).Decode(&u)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to find user: %w", err)
+	}
+	return &u, nil
+}
+
+// Get a user by their id
+func GetById(ctx context.Context, id string) (*User, error) {
+	return findOne(ctx, map[string]interface{}{"id": id})
+}
+
+// Get a user by their email
+func GetByEmail(ctx context.Context, email string) (*User, error) {
+	return findOne(ctx, map[string]interface{}{"email": email})
+}
+
+// Get a user by their id, username or email; handy for the admin commands
+// where we don't want to have to care which one we were given
+func Lookup(ctx context.Context, identifier string) (*User, error) {
+	return findOne(ctx, map[string]interface{}{
+		"$or": []map[string]string{
+			{"id": identifier},
+			{"username": identifier},
+			{"email": identifier},
+		},
+	})
+}
+
+// Check if there is already a user with the given username or email;
+// usernames are compared case insensitively, so "Alice" counts as taken if
+// "alice" exists
+func Exists(ctx context.Context, username string, email string) (bool, error) {
+	_, err := findOne(ctx, map[string]interface{}{
+		"$or": []map[string]string{
+			{"usernameLower": searchKey(username)},
+			{"email": email},
+		},
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Save a new user to the database
+func Insert(ctx context.Context, u *User) error {
+	if _, err := database.GetCollection(collectionName).InsertOne(ctx, u); err != nil {
+		return fmt.Errorf("failed to insert user: %w", err)
+	}
+	return nil
+}
+
+// Update the fields of a single user, returning ErrNotFound if there is no
+// user with the given id
+func update(ctx context.Context, id string, fields map[string]interface{}) error {
+	result, err := database.GetCollection(collectionName).UpdateOne(ctx,
+		map[string]interface{}{"id": id},
+		map[string]interface{}{"$set": fields},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Enable or disable a user; a disabled user can't log in
+func SetDisabled(ctx context.Context, id string, disabled bool) error {
+	return update(ctx, id, map[string]interface{}{"disabled": disabled})
+}
+
+// Make a user an admin, or take it away from them
+func SetAdmin(ctx context.Context, id string, admin bool) error {
+	return update(ctx, id, map[string]interface{}{"admin": admin})
+}
+
+// Change the password for a user
+func SetPassword(ctx context.Context, id string, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return update(ctx, id, map[string]interface{}{"password": hashedPassword})
+}
+
+// Check if somebody other than the given user already has a username, in
+// any case
+func UsernameTaken(ctx context.Context, username string, exceptId string) (bool, error) {
+	_, err := findOne(ctx, map[string]interface{}{
+		"usernameLower": searchKey(username),
+		"id":            map[string]interface{}{"$ne": exceptId},
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// The parts of a profile that a user can change themselves, nil means leave
+// the field as it is; usernames go through ChangeUsername instead
+type ProfileUpdate struct {
+	Name *string
+}
+
+// Save changes to a users profile; the update should already have been
+// validated
+func UpdateProfile(ctx context.Context, id string, changes ProfileUpdate) error {
+	fields := map[string]interface{}{}
+	if changes.Name != nil {
+		fields["name"] = *changes.Name
+		for key, value := range nameSearchFields(*changes.Name) {
+			fields[key] = value
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return update(ctx, id, fields)
+}
+
+// Get several users at once, keyed by id; any ids which don't exist are
+// just left out
+func GetByIds(ctx context.Context, ids []string) (map[string]*User, error) {
+	users := map[string]*User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	cursor, err := database.GetCollection(collectionName).Find(ctx, map[string]interface{}{
+		"id": map[string]interface{}{"$in": ids},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users: %w", err)
+	}
+
+	var found []User
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	for i := range found {
+		users[found[i].Id] = &found[i]
+	}
+	return users, nil
+}
+
+// Get every user who registered with an invite code, oldest first
+func ListByInviteCode(ctx context.Context, code string) ([]User, error) {
+	cursor, err := database.GetCollection(collectionName).Find(ctx,
+		map[string]interface{}{"inviteCode": code},
+		options.Find().SetSort(bson.D{{Key: "registeredAt", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users: %w", err)
+	}
+
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
@@ -1,34 +1,49 @@
 package user
 
-// This struct represents the information about a particular user
-// This can be amended at a later stage if more information is needed
+import (
+	"time"
+)
+
+// A user as it is stored in the users collection. This is never sent to
+// anyone as it is, it has the password hash in it for a start; use one of the
+// projections in projections.go instead. If you rename a bson tag here then
+// existing documents need a migration, see internal/migrations
 type User struct {
-	Id string // unique, global identifier for the user
-	Username string // global username for the user
-	Password string // the users password
-	Name string // the users name, if provided
-	Email string // the users email
-	RegistrationDate string // the users registration date
-	Bot bool // is this user a bot?
-	Online bool // is this user online?
-	Relationship Relationship // the users relationship with the current user
-}
+	Id                string     `bson:"id"`                          // unique, global identifier for the user
+	Username          string     `bson:"username"`                    // global username for the user
+	UsernameChangedAt *time.Time `bson:"usernameChangedAt,omitempty"` // when the username was last changed, if it ever has been
+	Password          string     `bson:"password"`                    // the bcrypt hash of the users password
+	Name              string     `bson:"name"`                        // the users name, if provided
+	Email             string     `bson:"email"`                       // the users email
+	RegisteredAt      time.Time  `bson:"registeredAt"`                // when the user registered
+	Bot               bool       `bson:"bot"`                         // is this user a bot?
+	Disabled          bool       `bson:"disabled"`                    // has this user been disabled by an admin?
+	Admin             bool       `bson:"admin"`                       // can this user manage the instance, e.g. invite codes?
+	InviteCode        string     `bson:"inviteCode,omitempty"`        // the invite code the user registered with, if they needed one
+	Avatar            string     `bson:"avatar"`                      // the name of the users avatar in the blob store, if they have one
+	Banner            string     `bson:"banner"`                      // the name of the users banner in the blob store, if they have one
 
-// struct for the user relationship
-type Relationship struct {
-    Type RelationshipType // The type of relationship (e.g., Friend, Blocked)
-}
+	DeletionScheduledAt *time.Time `bson:"deletionScheduledAt,omitempty"` // when the account is going to be deleted, if it is
+	Deleted             bool       `bson:"deleted"`                       // has the account been deleted? what's left of it is anonymous
 
+	// only used for searching, see search.go; kept up to date whenever the
+	// username or name changes
+	UsernameLower string   `bson:"usernameLower"`
+	UsernameGrams []string `bson:"usernameGrams"`
+	NameLower     string   `bson:"nameLower"`
+	NameGrams     []string `bson:"nameGrams"`
+}
 
 // RelationshipType represents the type of relationship between two users.
+// Relationships are stored in their own collection, see relationships.go
 type RelationshipType int
 
 // Enum values for RelationshipType
 const (
-    None RelationshipType = iota // Default value, neither friends or anything else
-    Friend // the two users are friends
-    Blocked // the user is blocked by the session user
-    Outgoing // the session user has sent a request to the user
-	Incoming // the session user has a request from the user
-    BlockedByUser // the user in the current session is blocked by this user
+	None          RelationshipType = iota // Default value, neither friends or anything else
+	Friend                                // the two users are friends
+	Blocked                               // the user is blocked by the session user
+	Outgoing                              // the session user has sent a request to the user
+	Incoming                              // the session user has a request from the user
+	BlockedByUser                         // the user in the current session is blocked by this user
 )
@@ -0,0 +1,330 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oauthority/voxly-backend/internal/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	usernameHistoryCollection   = "username_history"
+	usernameHoldsCollection     = "username_holds"
+	reservedUsernamesCollection = "reserved_usernames"
+)
+
+// Names nobody gets to register or rename to, on top of whatever has been
+// reserved with the admin commands; mostly so nobody can pretend to be us
+var defaultReservedUsernames = []string{
+	"admin", "administrator", "system", "voxly", "support", "help",
+	"staff", "moderator", "mod", "root", "official", "security",
+	"everyone", "here", "null", "undefined",
+}
+
+var (
+	ErrUsernameTaken    = errors.New("username is already taken")
+	ErrUsernameReserved = errors.New("username is reserved")
+	ErrUsernameHeld     = errors.New("username was recently released and is being held")
+	ErrUsernameCooldown = errors.New("username was changed too recently")
+)
+
+// How username changes are limited
+type UsernamePolicy struct {
+	Cooldown   time.Duration // how long a user has to wait between changes
+	HoldPeriod time.Duration // how long a released username is held for its old owner
+}
+
+// A single username change, kept so that moderators (and the user) can see
+// who somebody used to be
+type UsernameChange struct {
+	UserId      string    `bson:"userId" json:"-"`
+	OldUsername string    `bson:"oldUsername" json:"oldUsername"`
+	NewUsername string    `bson:"newUsername" json:"newUsername"`
+	ChangedAt   time.Time `bson:"changedAt" json:"changedAt"`
+}
+
+// A username which was released by a rename, nobody but its old owner can
+// take it until the hold expires
+type usernameHold struct {
+	Username  string    `bson:"username"` // lowercased
+	UserId    string    `bson:"userId"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// A username that nobody may use
+type ReservedUsername struct {
+	Username  string    `bson:"username" json:"username"` // lowercased
+	Reason    string    `bson:"reason" json:"reason"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// Holds and reservations ignore case, so that "Voxly" is as off limits as "voxly"
+func normalizeUsername(username string) string {
+	return strings.ToLower(username)
+}
+
+// Check whether a username is reserved, either by default or by an admin
+func IsReserved(ctx context.Context, username string) (bool, error) {
+	normalized := normalizeUsername(username)
+	for _, reserved := range defaultReservedUsernames {
+		if normalized == reserved {
+			return true, nil
+		}
+	}
+
+	err := database.GetCollection(reservedUsernamesCollection).FindOne(ctx,
+		map[string]interface{}{"username": normalized},
+	).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check reserved usernames: %w", err)
+	}
+	return true, nil
+}
+
+// Check that a username can be taken by a user; pass an empty userId for
+// somebody who is registering
+func CheckUsernameAvailable(ctx context.Context, username string, userId string) error {
+	reserved, err := IsReserved(ctx, username)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return ErrUsernameReserved
+	}
+
+	taken, err := UsernameTaken(ctx, username, userId)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUsernameTaken
+	}
+
+	// a username held for someone else is off limits, but the person it's
+	// held for is more than welcome to have it back
+	var hold usernameHold
+	err = database.GetCollection(usernameHoldsCollection).FindOne(ctx, map[string]interface{}{
+		"username":  normalizeUsername(username),
+		"expiresAt": map[string]interface{}{"$gt": time.Now().UTC()},
+	}).Decode(&hold)
+	if err == nil && hold.UserId != userId {
+		return ErrUsernameHeld
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fmt.Errorf("failed to check username holds: %w", err)
+	}
+
+	return nil
+}
+
+// When the user is next allowed to change their username; the zero time if
+// they can do it right now
+func (u *User) NextUsernameChange(policy UsernamePolicy) time.Time {
+	if u.UsernameChangedAt == nil {
+		return time.Time{}
+	}
+	next := u.UsernameChangedAt.Add(policy.Cooldown)
+	if next.Before(time.Now()) {
+		return time.Time{}
+	}
+	return next
+}
+
+// Change the username of a user, enforcing the cooldown, recording the change
+// in their history and holding on to the old name for them for a while
+func ChangeUsername(ctx context.Context, u *User, username string, policy UsernamePolicy) error {
+	if username == u.Username {
+		return nil
+	}
+
+	// changing the case of your own username doesn't free anything up, so
+	// there's no reason to make anyone wait for it
+	caseOnly := normalizeUsername(username) == normalizeUsername(u.Username)
+	if !caseOnly && !u.NextUsernameChange(policy).IsZero() {
+		return ErrUsernameCooldown
+	}
+
+	if err := CheckUsernameAvailable(ctx, username, u.Id); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	fields := usernameSearchFields(username)
+	fields["username"] = username
+	if !caseOnly {
+		fields["usernameChangedAt"] = now
+	}
+	if err := update(ctx, u.Id, fields); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrUsernameTaken
+		}
+		return err
+	}
+
+	_, err := database.GetCollection(usernameHistoryCollection).InsertOne(ctx, UsernameChange{
+		UserId:      u.Id,
+		OldUsername: u.Username,
+		NewUsername: username,
+		ChangedAt:   now,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record username change: %w", err)
+	}
+
+	if !caseOnly {
+		if err := holdUsername(ctx, u.Username, u.Id, now.Add(policy.HoldPeriod)); err != nil {
+			return err
+		}
+		// if they've taken back a name that was being held for them, it's
+		// theirs again and doesn't need holding any more
+		_, err = database.GetCollection(usernameHoldsCollection).DeleteOne(ctx, map[string]interface{}{
+			"username": normalizeUsername(username),
+			"userId":   u.Id,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to release username hold: %w", err)
+		}
+	}
+
+	u.Username = username
+	u.UsernameLower = searchKey(username)
+	u.UsernameGrams = trigrams(username)
+	if !caseOnly {
+		u.UsernameChangedAt = &now
+	}
+	return nil
+}
+
+// Hold on to a username for a user until expiresAt
+func holdUsername(ctx context.Context, username string, userId string, expiresAt time.Time) error {
+	normalized := normalizeUsername(username)
+	_, err := database.GetCollection(usernameHoldsCollection).UpdateOne(ctx,
+		map[string]interface{}{"username": normalized},
+		map[string]interface{}{"$set": usernameHold{
+			Username:  normalized,
+			UserId:    userId,
+			ExpiresAt: expiresAt,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to hold username: %w", err)
+	}
+	return nil
+}
+
+// Get every username change a user has made, newest first
+func UsernameHistory(ctx context.Context, userId string) ([]UsernameChange, error) {
+	cursor, err := database.GetCollection(usernameHistoryCollection).Find(ctx,
+		map[string]interface{}{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "changedAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get username history: %w", err)
+	}
+
+	changes := []UsernameChange{}
+	if err := cursor.All(ctx, &changes); err != nil {
+		return nil, fmt.Errorf("failed to decode username history: %w", err)
+	}
+	return changes, nil
+}
+
+// Reserve a username so that nobody can register or rename to it; this
+// doesn't affect anyone who already has it
+func ReserveUsername(ctx context.Context, username string, reason string) (*ReservedUsername, error) {
+	reserved := &ReservedUsername{
+		Username:  normalizeUsername(username),
+		Reason:    reason,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	_, err := database.GetCollection(reservedUsernamesCollection).UpdateOne(ctx,
+		map[string]interface{}{"username": reserved.Username},
+		map[string]interface{}{"$set": reserved},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve username: %w", err)
+	}
+	return reserved, nil
+}
+
+// Remove a reservation made with ReserveUsername, the built in ones can't be removed
+func UnreserveUsername(ctx context.Context, username string) error {
+	result, err := database.GetCollection(reservedUsernamesCollection).DeleteOne(ctx,
+		map[string]interface{}{"username": normalizeUsername(username)},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unreserve username: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List every reserved username, including the built in ones
+func ListReservedUsernames(ctx context.Context) ([]ReservedUsername, error) {
+	reserved := []ReservedUsername{}
+	for _, username := range defaultReservedUsernames {
+		reserved = append(reserved, ReservedUsername{Username: username, Reason: "built in"})
+	}
+
+	cursor, err := database.GetCollection(reservedUsernamesCollection).Find(ctx,
+		map[string]interface{}{},
+		options.Find().SetSort(bson.D{{Key: "username", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reserved usernames: %w", err)
+	}
+
+	var stored []ReservedUsername
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode reserved usernames: %w", err)
+	}
+	return append(reserved, stored...), nil
+}
+
+// Indexes for the username collections; holds clean themselves up once they
+// expire thanks to the TTL index
+func ensureUsernameIndexes(ctx context.Context) error {
+	_, err := database.GetCollection(usernameHistoryCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "changedAt", Value: -1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create username history indexes: %w", err)
+	}
+
+	_, err = database.GetCollection(usernameHoldsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create username hold indexes: %w", err)
+	}
+
+	_, err = database.GetCollection(reservedUsernamesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create reserved username indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package user
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MinUsernameLength = 2
+	MaxUsernameLength = 32
+	MaxNameLength     = 64
+)
+
+// usernames are kept simple so that they're easy to type and mention
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.]+$`)
+
+var (
+	ErrUsernameLength     = errors.New("username must be between 2 and 32 characters")
+	ErrUsernameCharacters = errors.New("username may only contain letters, numbers, underscores and periods")
+	ErrUsernamePeriods    = errors.New("username may not start or end with a period, or contain two in a row")
+	ErrNameLength         = errors.New("name must be at most 64 characters")
+	ErrNameCharacters     = errors.New("name may not contain control characters")
+)
+
+// Check that a username is one that we're willing to accept
+func ValidateUsername(username string) error {
+	if len(username) < MinUsernameLength || len(username) > MaxUsernameLength {
+		return ErrUsernameLength
+	}
+	if !usernamePattern.MatchString(username) {
+		return ErrUsernameCharacters
+	}
+	if strings.HasPrefix(username, ".") || strings.HasSuffix(username, ".") || strings.Contains(username, "..") {
+		return ErrUsernamePeriods
+	}
+	return nil
+}
+
+// Tidy up a display name and check that it is one that we're willing to
+// accept, an empty name is fine and just means the user hasn't set one
+func NormalizeName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		return "", ErrNameLength
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", ErrNameCharacters
+		}
+	}
+	return name, nil
+}